@@ -0,0 +1,497 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admin is an introspection and control HTTP handler (net/http compatible)
+// for one or more servers. All responses are JSON.
+//
+//	GET    /                        servers with state, config and worker pool stats
+//	GET    /connections             active connections (incl. TCP_INFO)
+//	GET    /connections/{id}        single connection
+//	POST   /connections/{id}/close  close connection (or DELETE /connections/{id})
+//	POST   /drain?enabled=true      enable/disable drain mode
+//	POST   /shutdown?timeout=30s    start graceful shutdown
+//	POST   /tls/reload              reload TLS certificates (see Server.SetTLSCertificateFiles)
+//
+// All endpoints but the connection specific ones accept a "server" query
+// parameter to select a single server by name; otherwise all servers are used.
+//
+// The handler has no authentication and should be bound to a separate
+// (loopback) address, e.g. http.ListenAndServe("127.0.0.1:9000", admin).
+type Admin struct {
+	mutex   sync.Mutex
+	servers []*Server
+}
+
+type adminServer struct {
+	Name           string            `json:"name"`
+	ListenAddr     string            `json:"listen_addr"`
+	State          string            `json:"state"`
+	TLS            bool              `json:"tls"`
+	TLSCertificate *adminCertificate `json:"tls_certificate,omitempty"`
+	Connections    adminConnCounts   `json:"connections"`
+	WorkerPool     adminWorkerPool   `json:"worker_pool"`
+	Config         adminServerConfig `json:"config"`
+}
+
+type adminConnCounts struct {
+	Active   int32 `json:"active"`
+	Queued   int32 `json:"queued"`
+	Accepted int32 `json:"accepted"`
+}
+
+type adminWorkerPool struct {
+	Workers         int                  `json:"workers"`
+	Queued          int32                `json:"queued"`
+	PriorityClasses []PriorityClassStats `json:"priority_classes,omitempty"`
+}
+
+type adminServerConfig struct {
+	Loops                  int                    `json:"loops"`
+	MaxAcceptConnections   int32                  `json:"max_accept_connections"`
+	AllowThreadLocking     bool                   `json:"allow_thread_locking"`
+	LoopAffinity           [][]int                `json:"loop_affinity,omitempty"`
+	NodeLocalWorkers       bool                   `json:"node_local_workers"`
+	Middlewares            int                    `json:"middlewares"`
+	HybridMode             bool                   `json:"hybrid_mode"`
+	Backend                string                 `json:"backend,omitempty"`
+	SocketReusePort        bool                   `json:"socket_reuse_port"`
+	SocketFastOpen         bool                   `json:"socket_fast_open"`
+	SocketFastOpenQueueLen int                    `json:"socket_fast_open_queue_len"`
+	SocketDeferAccept      bool                   `json:"socket_defer_accept"`
+	SocketSharding         bool                   `json:"socket_sharding"`
+	SocketCPUSteering      bool                   `json:"socket_cpu_steering"`
+	WorkerPool             *adminWorkerPoolConfig `json:"worker_pool,omitempty"`
+}
+
+type adminWorkerPoolConfig struct {
+	Shards             int    `json:"shards"`
+	IdleWorkerLifetime string `json:"idle_worker_lifetime"`
+	MaxWorkers         int    `json:"max_workers"`
+	MaxQueued          int    `json:"max_queued"`
+	OverloadPolicy     string `json:"overload_policy"`
+	Prewarm            int    `json:"prewarm"`
+}
+
+type adminCertificate struct {
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+type adminConn struct {
+	ID              uint64         `json:"id"`
+	Server          string         `json:"server"`
+	ClientAddr      string         `json:"client_addr"`
+	ServerAddr      string         `json:"server_addr"`
+	StartTime       time.Time      `json:"start_time"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	State           string         `json:"state"`
+	Stats           adminConnStats `json:"stats"`
+	TCPInfo         *TCPInfo       `json:"tcp_info,omitempty"`
+}
+
+type adminConnStats struct {
+	BytesRead    uint64     `json:"bytes_read"`
+	BytesWritten uint64     `json:"bytes_written"`
+	Reads        uint64     `json:"reads"`
+	Writes       uint64     `json:"writes"`
+	FirstByte    *time.Time `json:"first_byte,omitempty"`
+	LastByte     *time.Time `json:"last_byte,omitempty"`
+}
+
+type adminResult struct {
+	Server string `json:"server"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Creates a new admin handler for given servers
+func NewAdmin(servers ...*Server) *Admin {
+	return &Admin{
+		servers: servers,
+	}
+}
+
+// Adds a server to the admin handler
+func (a *Admin) AddServer(s *Server) {
+	a.mutex.Lock()
+	a.servers = append(a.servers, s)
+	a.mutex.Unlock()
+}
+
+// Serves admin requests (implements http.Handler)
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "":
+		if a.allowMethod(w, r, http.MethodGet) {
+			a.serveServers(w, r)
+		}
+	case path == "connections":
+		if a.allowMethod(w, r, http.MethodGet) {
+			a.serveConnections(w, r)
+		}
+	case parts[0] == "connections" && len(parts) <= 3:
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid connection ID '%s'", parts[1]))
+			return
+		}
+		switch {
+		case len(parts) == 2 && r.Method == http.MethodDelete:
+			a.closeConnection(w, id)
+		case len(parts) == 2:
+			if a.allowMethod(w, r, http.MethodGet, http.MethodDelete) {
+				a.serveConnection(w, id)
+			}
+		case parts[2] == "close":
+			if a.allowMethod(w, r, http.MethodPost) {
+				a.closeConnection(w, id)
+			}
+		default:
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		}
+	case path == "drain":
+		if a.allowMethod(w, r, http.MethodPost) {
+			a.drain(w, r)
+		}
+	case path == "shutdown":
+		if a.allowMethod(w, r, http.MethodPost) {
+			a.shutdown(w, r)
+		}
+	case path == "tls/reload":
+		if a.allowMethod(w, r, http.MethodPost) {
+			a.reloadTLS(w, r)
+		}
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+// Returns servers selected by the "server" query parameter
+func (a *Admin) selectServers(w http.ResponseWriter, r *http.Request) ([]*Server, bool) {
+	a.mutex.Lock()
+	servers := make([]*Server, len(a.servers))
+	copy(servers, a.servers)
+	a.mutex.Unlock()
+
+	name := r.URL.Query().Get("server")
+	if name == "" {
+		return servers, true
+	}
+	for _, s := range servers {
+		if s.GetName() == name {
+			return []*Server{s}, true
+		}
+	}
+	writeAdminError(w, http.StatusNotFound, fmt.Errorf("unknown server '%s'", name))
+	return nil, false
+}
+
+func (a *Admin) serveServers(w http.ResponseWriter, r *http.Request) {
+	servers, ok := a.selectServers(w, r)
+	if !ok {
+		return
+	}
+
+	result := make([]adminServer, 0, len(servers))
+	for _, s := range servers {
+		result = append(result, newAdminServer(s))
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"servers": result})
+}
+
+func (a *Admin) serveConnections(w http.ResponseWriter, r *http.Request) {
+	servers, ok := a.selectServers(w, r)
+	if !ok {
+		return
+	}
+
+	result := make([]adminConn, 0)
+	var rawConns []net.Conn
+	for _, s := range servers {
+		s.registry.each(func(conn *TCPConn) bool {
+			ac, rawConn := newAdminConn(s, conn)
+			result = append(result, ac)
+			rawConns = append(rawConns, rawConn)
+			return true
+		})
+	}
+	for i := range result {
+		result[i].addTCPInfo(rawConns[i])
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"connections": result})
+}
+
+func (a *Admin) serveConnection(w http.ResponseWriter, id uint64) {
+	a.mutex.Lock()
+	servers := a.servers
+	a.mutex.Unlock()
+
+	for _, s := range servers {
+		sh := s.registry.shard(id)
+		sh.mutex.Lock()
+		conn, ok := sh.conns[id]
+		if ok {
+			info, rawConn := newAdminConn(s, conn)
+			sh.mutex.Unlock()
+			info.addTCPInfo(rawConn)
+			writeAdminJSON(w, http.StatusOK, info)
+			return
+		}
+		sh.mutex.Unlock()
+	}
+	writeAdminError(w, http.StatusNotFound, fmt.Errorf("unknown connection %d", id))
+}
+
+func (a *Admin) closeConnection(w http.ResponseWriter, id uint64) {
+	a.mutex.Lock()
+	servers := a.servers
+	a.mutex.Unlock()
+
+	for _, s := range servers {
+		if s.CloseConnection(id) {
+			writeAdminJSON(w, http.StatusOK, map[string]interface{}{"id": id, "closed": true})
+			return
+		}
+	}
+	writeAdminError(w, http.StatusNotFound, fmt.Errorf("unknown connection %d", id))
+}
+
+func (a *Admin) drain(w http.ResponseWriter, r *http.Request) {
+	enabled := true
+	if v := r.URL.Query().Get("enabled"); v != "" {
+		var err error
+		if enabled, err = strconv.ParseBool(v); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid value '%s' for enabled", v))
+			return
+		}
+	}
+
+	servers, ok := a.selectServers(w, r)
+	if !ok {
+		return
+	}
+
+	result := make([]adminResult, 0, len(servers))
+	for _, s := range servers {
+		s.SetDraining(enabled)
+		result = append(result, adminResult{Server: s.GetName()})
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"draining": enabled, "servers": result})
+}
+
+func (a *Admin) shutdown(w http.ResponseWriter, r *http.Request) {
+	var timeout time.Duration
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout '%s'", v))
+			return
+		}
+	}
+
+	servers, ok := a.selectServers(w, r)
+	if !ok {
+		return
+	}
+
+	result := make([]adminResult, 0, len(servers))
+	for _, s := range servers {
+		res := adminResult{Server: s.GetName()}
+		if err := s.Shutdown(timeout); err != nil {
+			res.Error = err.Error()
+		}
+		result = append(result, res)
+	}
+	writeAdminJSON(w, http.StatusAccepted, map[string]interface{}{"timeout": timeout.String(), "servers": result})
+}
+
+func (a *Admin) reloadTLS(w http.ResponseWriter, r *http.Request) {
+	servers, ok := a.selectServers(w, r)
+	if !ok {
+		return
+	}
+
+	status := http.StatusOK
+	result := make([]adminResult, 0, len(servers))
+	for _, s := range servers {
+		if s.certificate == nil && len(servers) > 1 {
+			// skip servers without reloadable certificates unless explicitly selected
+			continue
+		}
+		res := adminResult{Server: s.GetName()}
+		if err := s.ReloadTLSCertificate(); err != nil {
+			res.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+		result = append(result, res)
+	}
+	writeAdminJSON(w, status, map[string]interface{}{"servers": result})
+}
+
+// Returns false and writes an error if the request method is not allowed
+func (a *Admin) allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m || (m == http.MethodGet && r.Method == http.MethodHead) {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+// Returns server snapshot
+func newAdminServer(s *Server) adminServer {
+	state := "serving"
+	switch {
+	case atomic.LoadInt32(&s.shutdownStarted) == 1:
+		state = "shutting_down"
+	case s.listener == nil:
+		state = "not_listening"
+	case s.IsDraining():
+		state = "draining"
+	}
+
+	as := adminServer{
+		Name:  s.GetName(),
+		State: state,
+		TLS:   s.tlsEnabled,
+		Connections: adminConnCounts{
+			Active:   s.GetActiveConnections(),
+			Queued:   s.GetQueuedConnections(),
+			Accepted: atomic.LoadInt32(&s.acceptedConnections),
+		},
+		WorkerPool: adminWorkerPool{
+			Workers:         s.GetWorkers(),
+			Queued:          s.GetQueuedConnections(),
+			PriorityClasses: s.GetPriorityClassStats(),
+		},
+		Config: adminServerConfig{
+			Loops:                s.GetLoops(),
+			MaxAcceptConnections: atomic.LoadInt32(&s.maxAcceptConnections),
+			AllowThreadLocking:   s.allowThreadLocking,
+			NodeLocalWorkers:     s.nodeLocalWorkers,
+			Middlewares:          len(s.middlewares),
+			HybridMode:           s.IsHybridMode(),
+		},
+	}
+
+	if s.backend != nil {
+		as.Config.Backend = s.backend.Name()
+	}
+
+	for i := 0; i < as.Config.Loops; i++ {
+		if cpus := s.GetLoopAffinity(i); cpus != nil {
+			if as.Config.LoopAffinity == nil {
+				as.Config.LoopAffinity = make([][]int, as.Config.Loops)
+			}
+			as.Config.LoopAffinity[i] = cpus
+		}
+	}
+
+	if la := s.GetListenAddr(); la != nil {
+		as.ListenAddr = la.String()
+	} else {
+		as.ListenAddr = s.listenAddr.String()
+	}
+
+	if lc := s.GetListenConfig(); lc != nil {
+		as.Config.SocketReusePort = lc.SocketReusePort
+		as.Config.SocketFastOpen = lc.SocketFastOpen
+		as.Config.SocketFastOpenQueueLen = lc.SocketFastOpenQueueLen
+		as.Config.SocketDeferAccept = lc.SocketDeferAccept
+		as.Config.SocketSharding = lc.SocketSharding
+		as.Config.SocketCPUSteering = lc.SocketCPUSteering
+	}
+
+	if wpc := s.GetWorkerPoolConfig(); wpc != nil {
+		as.Config.WorkerPool = &adminWorkerPoolConfig{
+			Shards:             wpc.Shards,
+			IdleWorkerLifetime: wpc.IdleWorkerLifetime.String(),
+			MaxWorkers:         wpc.MaxWorkers,
+			MaxQueued:          wpc.MaxQueued,
+			OverloadPolicy:     wpc.OverloadPolicy.String(),
+			Prewarm:            wpc.Prewarm,
+		}
+	}
+
+	if cert := s.GetTLSCertificate(); cert != nil && cert.Leaf != nil {
+		as.TLSCertificate = &adminCertificate{
+			Subject:   cert.Leaf.Subject.String(),
+			DNSNames:  cert.Leaf.DNSNames,
+			NotBefore: cert.Leaf.NotBefore,
+			NotAfter:  cert.Leaf.NotAfter,
+		}
+	}
+	return as
+}
+
+// Returns the connection snapshot (without TCP_INFO) and its socket; called
+// while holding the connection's registry shard lock
+func newAdminConn(s *Server, conn *TCPConn) (adminConn, net.Conn) {
+	info := conn.info()
+	ac := adminConn{
+		ID:              info.ID,
+		Server:          s.GetName(),
+		ClientAddr:      info.ClientAddr.String(),
+		ServerAddr:      info.ServerAddr.String(),
+		StartTime:       info.StartTime,
+		DurationSeconds: time.Since(info.StartTime).Seconds(),
+		State:           info.State.String(),
+		Stats: adminConnStats{
+			BytesRead:    info.Stats.BytesRead,
+			BytesWritten: info.Stats.BytesWritten,
+			Reads:        info.Stats.Reads,
+			Writes:       info.Stats.Writes,
+		},
+	}
+	if !info.Stats.FirstByte.IsZero() {
+		ac.Stats.FirstByte = &info.Stats.FirstByte
+		ac.Stats.LastByte = &info.Stats.LastByte
+	}
+	return ac, conn.rawConn
+}
+
+// Adds the kernel's TCP_INFO (a syscall, so it's queried after releasing the
+// registry locks); omitted if the connection has been closed meanwhile
+func (ac *adminConn) addTCPInfo(rawConn net.Conn) {
+	if tcpConn, ok := rawConn.(*net.TCPConn); ok {
+		if tcpInfo, err := getTCPInfo(tcpConn); err == nil {
+			ac.TCPInfo = tcpInfo
+		}
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
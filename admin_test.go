@@ -0,0 +1,55 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestAdminConnections(t *testing.T) {
+	s := startServer(t, func(conn Connection) {
+		_, _ = io.Copy(io.Discard, conn)
+	}, nil)
+	admin := NewAdmin(s)
+
+	dial(t, s)
+	waitFor(t, "connection", func() bool {
+		return len(s.GetConnections()) == 1
+	})
+
+	get := func(path string, v interface{}) int {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s: %s (%s)", path, err, rec.Body.String())
+		}
+		return rec.Code
+	}
+
+	var list struct {
+		Connections []adminConn `json:"connections"`
+	}
+	if code := get("/connections", &list); code != http.StatusOK || len(list.Connections) != 1 {
+		t.Fatalf("GET /connections = %d with %d connections", code, len(list.Connections))
+	}
+	ac := list.Connections[0]
+	if runtime.GOOS == "linux" && (ac.TCPInfo == nil || ac.TCPInfo.State != "established") {
+		t.Errorf("TCP_INFO missing or wrong: %+v", ac.TCPInfo)
+	}
+
+	var single adminConn
+	if code := get(fmt.Sprintf("/connections/%d", ac.ID), &single); code != http.StatusOK || single.ID != ac.ID {
+		t.Errorf("GET /connections/%d = %d, %+v", ac.ID, code, single)
+	}
+	var errResp map[string]string
+	if code := get(fmt.Sprintf("/connections/%d", ac.ID+1000), &errResp); code != http.StatusNotFound {
+		t.Errorf("GET unknown connection = %d, want 404", code)
+	}
+}
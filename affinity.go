@@ -0,0 +1,194 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+)
+
+// Maximum number of CPUs supported for pinning
+const maxAffinityCPUs = 1024
+
+// NUMA node and the CPUs belonging to it
+type NUMANode struct {
+	ID   int   `json:"id"`
+	CPUs []int `json:"cpus"`
+}
+
+// Returns the NUMA nodes of the machine (Linux only); only CPUs the process
+// may run on are included and nodes without such CPUs are left out
+func GetNUMANodes() ([]NUMANode, error) {
+	return getNUMANodes()
+}
+
+// Returns CPU sets for SetLoopAffinity that distribute given number of accept
+// loops round robin over the NUMA nodes (or only the given ones); each loop
+// may run on all CPUs of its node
+func NUMALoopAffinity(loops int, nodes ...int) ([][]int, error) {
+	if loops < 1 {
+		return nil, fmt.Errorf("number of loops must be at least 1")
+	}
+	all, err := GetNUMANodes()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := all
+	if len(nodes) > 0 {
+		selected = nil
+		for _, id := range nodes {
+			i := sort.Search(len(all), func(i int) bool { return all[i].ID >= id })
+			if i == len(all) || all[i].ID != id {
+				return nil, fmt.Errorf("NUMA node %d doesn't exist or has no usable CPUs", id)
+			}
+			selected = append(selected, all[i])
+		}
+	}
+
+	affinity := make([][]int, loops)
+	for i := range affinity {
+		affinity[i] = selected[i%len(selected)].CPUs
+	}
+	return affinity, nil
+}
+
+// Sets the CPUs each accept loop is pinned to (loop i uses cpus[i % len(cpus)];
+// Linux only). Takes precedence over SetAllowThreadLocking; must be called
+// before Serve().
+func (s *Server) SetLoopAffinity(cpus [][]int) {
+	s.loopAffinity = cpus
+}
+
+// Returns the CPUs the accept loop with given id is pinned to (nil if not pinned)
+func (s *Server) GetLoopAffinity(loop int) []int {
+	if s.loopCPUs != nil {
+		if loop < 0 || loop >= len(s.loopCPUs) {
+			return nil
+		}
+		return s.loopCPUs[loop]
+	}
+	if len(s.loopAffinity) == 0 || loop < 0 {
+		return nil
+	}
+	return s.loopAffinity[loop%len(s.loopAffinity)]
+}
+
+// Enables/disables serving connections on the CPUs of the NUMA node(s) of the
+// accept loop that accepted them (requires pinned accept loops; Linux only).
+// Workers are locked to their OS thread, which is pinned once and terminated
+// when the worker exits, so every worker occupies an OS thread; consider
+// limiting WorkerPoolConfig.MaxWorkers. Meant for the worker pool dispatcher;
+// with NewGoroutineDispatcher every connection terminates its thread.
+func (s *Server) SetNodeLocalWorkers(enable bool) {
+	s.nodeLocalWorkers = enable
+}
+
+// Resolves the CPUs accept loops and node local workers are pinned to
+// (called by Serve)
+func (s *Server) resolveAffinity(loops int) error {
+	if len(s.loopAffinity) > 0 && runtime.GOOS != "linux" {
+		return fmt.Errorf("CPU affinity is only supported on Linux")
+	}
+	for _, cpus := range s.loopAffinity {
+		if len(cpus) == 0 {
+			return fmt.Errorf("empty CPU set in loop affinity")
+		}
+		for _, cpu := range cpus {
+			if cpu < 0 || cpu >= maxAffinityCPUs {
+				return fmt.Errorf("invalid CPU %d in loop affinity", cpu)
+			}
+		}
+	}
+
+	steering := s.allowThreadLocking && len(s.listeners) > 1 && s.listenConfig.SocketCPUSteering
+	s.loopCPUs = make([][]int, loops)
+	pinned := false
+	for i := range s.loopCPUs {
+		if len(s.loopAffinity) > 0 {
+			s.loopCPUs[i] = s.loopAffinity[i%len(s.loopAffinity)]
+		} else if steering {
+			s.loopCPUs[i] = steeringCPUs(i, loops)
+		}
+		pinned = pinned || len(s.loopCPUs[i]) > 0
+	}
+
+	if !s.nodeLocalWorkers {
+		return nil
+	}
+	if !pinned {
+		return fmt.Errorf("node local workers require pinned accept loops")
+	}
+	nodes, err := GetNUMANodes()
+	if err != nil {
+		return err
+	}
+
+	s.processCPUs = processCPUs()
+	s.workerCPUs = make([][]int, loops)
+	for i, cpus := range s.loopCPUs {
+		for _, node := range nodes {
+			for _, cpu := range cpus {
+				if containsCPU(node.CPUs, cpu) {
+					s.workerCPUs[i] = append(s.workerCPUs[i], node.CPUs...)
+					break
+				}
+			}
+		}
+		sort.Ints(s.workerCPUs[i])
+	}
+	return nil
+}
+
+// Pins the serving go routine to the NUMA node(s) of the accept loop. The go
+// routine stays locked to its pinned OS thread afterwards, so a worker serving
+// connections of the same node(s) is pinned only once (the thread is
+// terminated when the worker exits).
+func (s *Server) pinWorker(conn *TCPConn) {
+	if int(conn.loop) >= len(s.workerCPUs) || len(s.workerCPUs[conn.loop]) == 0 {
+		return
+	}
+	cpus := s.workerCPUs[conn.loop]
+
+	runtime.LockOSThread()
+	current := threadCPUs()
+	if equalCPUs(current, cpus) {
+		// pinned by a previous connection (the go routine is still locked)
+		// or the process may only run on these CPUs anyway
+		runtime.UnlockOSThread()
+		return
+	}
+	if err := pinThread(cpus); err != nil {
+		runtime.UnlockOSThread()
+		return
+	}
+	if !equalCPUs(current, s.processCPUs) {
+		// pinned to other nodes by a previous connection; keep a single lock
+		runtime.UnlockOSThread()
+	}
+}
+
+// Returns whether a and b contain the same CPUs (both sorted)
+func equalCPUs(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether cpus contains cpu
+func containsCPU(cpus []int, cpu int) bool {
+	for _, c := range cpus {
+		if c == cpu {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux
+// +build linux
+
+package tcpserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Directory containing the NUMA nodes
+const numaNodesDir = "/sys/devices/system/node"
+
+// CPUs the process may run on; read on startup before any thread is pinned
+// (the affinity of the calling thread is inherited from the parent process)
+var initialCPUs = threadCPUs()
+
+// Returns the CPUs the process may run on
+func processCPUs() []int {
+	return append([]int(nil), initialCPUs...)
+}
+
+// Returns the CPUs the current OS thread may run on
+func threadCPUs() []int {
+	var mask [maxAffinityCPUs / 64]uint64
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return nil
+	}
+
+	var cpus []int
+	for cpu := 0; cpu < maxAffinityCPUs; cpu++ {
+		if mask[cpu/64]&(1<<(cpu%64)) != 0 {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
+
+// Reads the NUMA nodes from sysfs; a single node containing all CPUs is
+// returned if the kernel has no NUMA support
+func getNUMANodes() ([]NUMANode, error) {
+	allowed := processCPUs()
+	if allowed == nil {
+		return nil, fmt.Errorf("unable to get CPU affinity of process")
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(numaNodesDir, "node[0-9]*"))
+	if err != nil || len(dirs) == 0 {
+		return []NUMANode{{ID: 0, CPUs: allowed}}, nil
+	}
+
+	var nodes []NUMANode
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CPUs of NUMA node %d: %s", id, err)
+		}
+		cpus, err := parseCPUList(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse CPUs of NUMA node %d: %s", id, err)
+		}
+		cpus = intersectCPUs(cpus, allowed)
+		if len(cpus) == 0 {
+			// memory only node or no CPU the process may run on
+			continue
+		}
+		nodes = append(nodes, NUMANode{ID: id, CPUs: cpus})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes, nil
+}
+
+// Parses a CPU list like "0-3,8,10-11"
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	if list == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(to); err != nil {
+				return nil, err
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// Returns the CPUs contained in both a and b
+func intersectCPUs(a []int, b []int) []int {
+	var cpus []int
+	for _, cpu := range a {
+		if containsCPU(b, cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
@@ -0,0 +1,21 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build !linux
+// +build !linux
+
+package tcpserver
+
+import "fmt"
+
+func processCPUs() []int {
+	return nil
+}
+
+func threadCPUs() []int {
+	return nil
+}
+
+func getNUMANodes() ([]NUMANode, error) {
+	return nil, fmt.Errorf("NUMA nodes are only available on Linux")
+}
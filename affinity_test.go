@@ -0,0 +1,40 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux
+// +build linux
+
+package tcpserver
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestPinWorker(t *testing.T) {
+	cpus := processCPUs()
+	if len(cpus) < 2 {
+		t.Skip("requires at least 2 CPUs")
+	}
+	s := &Server{
+		processCPUs: cpus,
+		workerCPUs:  [][]int{cpus[:1], cpus[1:2]},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// the thread is terminated when the go routine exits locked
+		defer close(done)
+		for i, loop := range []uint16{0, 0, 1, 1, 0} {
+			s.pinWorker(&TCPConn{loop: loop})
+			runtime.Gosched()
+			if got := threadCPUs(); !equalCPUs(got, s.workerCPUs[loop]) {
+				t.Errorf("connection %d: expected thread to be pinned to %v, got %v", i, s.workerCPUs[loop], got)
+			}
+		}
+		if got := processCPUs(); !equalCPUs(got, cpus) {
+			t.Errorf("expected process CPUs %v, got %v", cpus, got)
+		}
+	}()
+	<-done
+}
@@ -0,0 +1,80 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"net"
+)
+
+// Backend accepts connections on the server's listener and provides their
+// I/O. The default backend uses the net package (see NewNetBackend);
+// NewUringBackend returns an experimental io_uring based backend.
+type Backend interface {
+	// Returns backend name
+	Name() string
+	// Starts the backend (called by Serve); accepted has to be called from
+	// the accept loops (with their id) for every accepted connection
+	Start(s *Server, accepted func(loop int, conn net.Conn)) error
+	// Runs accept loop with given id (called by Serve in a separate go
+	// routine per loop); returns nil once the listener has been closed
+	AcceptLoop(id int) error
+	// Stops accepting new connections (called on shutdown)
+	StopAccepting()
+	// Stops the backend (called after all connections have been closed)
+	Stop()
+}
+
+// Sets backend (defaults to NewNetBackend()); must be called before Serve()
+func (s *Server) SetBackend(b Backend) {
+	s.backend = b
+}
+
+// Returns backend (nil until Serve() has been called if none set)
+func (s *Server) GetBackend() Backend {
+	return s.backend
+}
+
+// Backend using net.TCPListener and net.TCPConn
+type netBackend struct {
+	server *Server
+}
+
+// Creates a new backend using the net package (default)
+func NewNetBackend() Backend {
+	return &netBackend{}
+}
+
+// Returns "net"
+func (b *netBackend) Name() string {
+	return "net"
+}
+
+// Starts the backend
+func (b *netBackend) Start(s *Server, accepted func(loop int, conn net.Conn)) error {
+	b.server = s
+	return nil
+}
+
+// Runs accept loop
+func (b *netBackend) AcceptLoop(id int) error {
+	return b.server.acceptLoop(id)
+}
+
+// Closing the listener stops the accept loops
+func (b *netBackend) StopAccepting() {
+}
+
+// Stops the backend
+func (b *netBackend) Stop() {
+}
+
+// Config of the io_uring backend (see NewUringBackend)
+type UringConfig struct {
+	// Number of submission queue entries per accept loop (defaults to 4096)
+	Entries int
+	// Number of provided receive buffers per accept loop (defaults to 512)
+	Buffers int
+	// Size of provided receive buffers (defaults to 4096)
+	BufferSize int
+}
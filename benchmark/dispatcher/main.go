@@ -0,0 +1,188 @@
+// Compares tcpserver dispatchers (worker pool, bounded worker pool and
+// goroutine per connection) using an in-process echo server and clients.
+//
+//	go run ./benchmark/dispatcher -conns 256 -duration 5s
+//
+// Note that with keep-alive connections the bounded worker pool only serves
+// -maxworkers clients at a time; the others wait until a worker becomes free.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+var (
+	conns     int
+	duration  time.Duration
+	msgSize   int
+	short     bool
+	only      string
+	maxWorker int
+)
+
+type result struct {
+	ops         uint64
+	latencies   []time.Duration
+	peakWorkers int
+	mallocs     uint64
+}
+
+func main() {
+	flag.IntVar(&conns, "conns", 256, "number of concurrent client connections")
+	flag.DurationVar(&duration, "duration", 5*time.Second, "duration per dispatcher")
+	flag.IntVar(&msgSize, "size", 128, "message size in bytes")
+	flag.BoolVar(&short, "short", false, "use a new connection per request (default: keep-alive)")
+	flag.StringVar(&only, "dispatcher", "", "only run given dispatcher (workerpool, bounded, goroutine)")
+	flag.IntVar(&maxWorker, "maxworkers", runtime.GOMAXPROCS(0)*16, "max workers for the bounded worker pool")
+	flag.Parse()
+
+	dispatchers := []struct {
+		name string
+		new  func() tcpserver.Dispatcher
+	}{
+		{"workerpool", func() tcpserver.Dispatcher { return tcpserver.NewWorkerPoolDispatcher(nil) }},
+		{"bounded", func() tcpserver.Dispatcher {
+			return tcpserver.NewWorkerPoolDispatcher(&tcpserver.WorkerPoolConfig{MaxWorkers: maxWorker, Prewarm: maxWorker})
+		}},
+		{"goroutine", tcpserver.NewGoroutineDispatcher},
+	}
+
+	mode := "keep-alive"
+	if short {
+		mode = "short-lived"
+	}
+	fmt.Printf("%d %s connections, %d byte messages, %s per dispatcher, GOMAXPROCS=%d\n\n", conns, mode, msgSize, duration, runtime.GOMAXPROCS(0))
+	fmt.Printf("%-12s %12s %10s %10s %10s %10s %12s\n", "dispatcher", "req/s", "p50", "p99", "p99.9", "workers", "allocs/req")
+
+	for _, d := range dispatchers {
+		if only != "" && only != d.name {
+			continue
+		}
+		res, err := run(d.new())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", d.name, err)
+			os.Exit(1)
+		}
+
+		sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+		fmt.Printf("%-12s %12.0f %10s %10s %10s %10d %12.1f\n", d.name,
+			float64(res.ops)/duration.Seconds(),
+			percentile(res.latencies, 0.5), percentile(res.latencies, 0.99), percentile(res.latencies, 0.999),
+			res.peakWorkers, float64(res.mallocs)/float64(res.ops))
+	}
+}
+
+// Runs the benchmark for a single dispatcher
+func run(d tcpserver.Dispatcher) (*result, error) {
+	server, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server.SetDispatcher(d)
+	server.SetRequestHandler(echo)
+	if err = server.Listen(); err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	defer server.Halt()
+
+	addr := server.GetListenAddr().String()
+	res := &result{}
+	stop := int32(0)
+	latencies := make([][]time.Duration, conns)
+
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	mallocs := ms.Mallocs
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			latencies[i] = client(addr, &stop, &res.ops)
+		}(i)
+	}
+
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		if w := d.GetWorkers(); w > res.peakWorkers {
+			res.peakWorkers = w
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	runtime.ReadMemStats(&ms)
+	res.mallocs = ms.Mallocs - mallocs
+	for _, l := range latencies {
+		res.latencies = append(res.latencies, l...)
+	}
+	return res, nil
+}
+
+// Sends messages and waits for the echo until stop is set
+func client(addr string, stop *int32, ops *uint64) (latencies []time.Duration) {
+	msg := make([]byte, msgSize)
+	buf := make([]byte, msgSize)
+	var conn net.Conn
+	var err error
+
+	for atomic.LoadInt32(stop) == 0 {
+		start := time.Now()
+		if conn == nil {
+			if conn, err = net.Dial("tcp", addr); err != nil {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+		}
+		if _, err = conn.Write(msg); err == nil {
+			_, err = io.ReadFull(conn, buf)
+		}
+		if err != nil || short {
+			conn.Close()
+			conn = nil
+		}
+		if err == nil {
+			latencies = append(latencies, time.Since(start))
+			atomic.AddUint64(ops, 1)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	return latencies
+}
+
+// Echoes messages of msgSize bytes until the client closes the connection
+func echo(conn tcpserver.Connection) {
+	buf := make([]byte, msgSize)
+	for {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if _, err := conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func percentile(l []time.Duration, p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	return l[int(float64(len(l)-1)*p)].Round(time.Microsecond)
+}
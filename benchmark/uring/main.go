@@ -0,0 +1,186 @@
+// Compares the net backend (default) with the experimental io_uring backend
+// using an in-process echo server and clients.
+//
+//	go run ./benchmark/uring -conns 256 -duration 5s
+//
+// Note that clients and server share the machine; use -loops and GOMAXPROCS
+// to find the sweet spot for many-core machines.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+var (
+	conns    int
+	duration time.Duration
+	msgSize  int
+	short    bool
+	only     string
+	loops    int
+)
+
+type result struct {
+	ops       uint64
+	latencies []time.Duration
+	mallocs   uint64
+}
+
+func main() {
+	flag.IntVar(&conns, "conns", 256, "number of concurrent client connections")
+	flag.DurationVar(&duration, "duration", 5*time.Second, "duration per backend")
+	flag.IntVar(&msgSize, "size", 128, "message size in bytes")
+	flag.BoolVar(&short, "short", false, "use a new connection per request (default: keep-alive)")
+	flag.StringVar(&only, "backend", "", "only run given backend (net, io_uring)")
+	flag.IntVar(&loops, "loops", 0, "number of accept loops (default: tcpserver default)")
+	flag.Parse()
+
+	backends := []struct {
+		name string
+		new  func() (tcpserver.Backend, error)
+	}{
+		{"net", func() (tcpserver.Backend, error) { return tcpserver.NewNetBackend(), nil }},
+		{"io_uring", func() (tcpserver.Backend, error) { return tcpserver.NewUringBackend(nil) }},
+	}
+
+	mode := "keep-alive"
+	if short {
+		mode = "short-lived"
+	}
+	fmt.Printf("%d %s connections, %d byte messages, %s per backend, GOMAXPROCS=%d\n\n", conns, mode, msgSize, duration, runtime.GOMAXPROCS(0))
+	fmt.Printf("%-12s %12s %10s %10s %10s %12s\n", "backend", "req/s", "p50", "p99", "p99.9", "allocs/req")
+
+	for _, b := range backends {
+		if only != "" && only != b.name {
+			continue
+		}
+		backend, err := b.new()
+		if err != nil {
+			fmt.Printf("%-12s not available: %s\n", b.name, err)
+			continue
+		}
+		res, err := run(backend)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", b.name, err)
+			os.Exit(1)
+		}
+
+		sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+		fmt.Printf("%-12s %12.0f %10s %10s %10s %12.1f\n", b.name,
+			float64(res.ops)/duration.Seconds(),
+			percentile(res.latencies, 0.5), percentile(res.latencies, 0.99), percentile(res.latencies, 0.999),
+			float64(res.mallocs)/float64(res.ops))
+	}
+}
+
+// Runs the benchmark for a single backend
+func run(b tcpserver.Backend) (*result, error) {
+	server, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server.SetBackend(b)
+	if loops > 0 {
+		server.SetLoops(loops)
+	}
+	server.SetRequestHandler(echo)
+	if err = server.Listen(); err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	defer server.Halt()
+
+	addr := server.GetListenAddr().String()
+	res := &result{}
+	stop := int32(0)
+	latencies := make([][]time.Duration, conns)
+
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	mallocs := ms.Mallocs
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			latencies[i] = client(addr, &stop, &res.ops)
+		}(i)
+	}
+
+	time.Sleep(duration)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	runtime.ReadMemStats(&ms)
+	res.mallocs = ms.Mallocs - mallocs
+	for _, l := range latencies {
+		res.latencies = append(res.latencies, l...)
+	}
+	return res, nil
+}
+
+// Sends messages and waits for the echo until stop is set
+func client(addr string, stop *int32, ops *uint64) (latencies []time.Duration) {
+	msg := make([]byte, msgSize)
+	buf := make([]byte, msgSize)
+	var conn net.Conn
+	var err error
+
+	for atomic.LoadInt32(stop) == 0 {
+		start := time.Now()
+		if conn == nil {
+			if conn, err = net.Dial("tcp", addr); err != nil {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+		}
+		if _, err = conn.Write(msg); err == nil {
+			_, err = io.ReadFull(conn, buf)
+		}
+		if err != nil || short {
+			conn.Close()
+			conn = nil
+		}
+		if err == nil {
+			latencies = append(latencies, time.Since(start))
+			atomic.AddUint64(ops, 1)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	return latencies
+}
+
+// Echoes messages of msgSize bytes until the client closes the connection
+func echo(conn tcpserver.Connection) {
+	buf := make([]byte, msgSize)
+	for {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if _, err := conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func percentile(l []time.Duration, p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	return l[int(float64(len(l)-1)*p)].Round(time.Microsecond)
+}
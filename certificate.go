@@ -0,0 +1,92 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// TLS certificate loaded from PEM files that can be reloaded at runtime
+type certificateFiles struct {
+	certFile string
+	keyFile  string
+	current  atomic.Value // *tls.Certificate
+}
+
+// Loads certificate and key from the PEM files
+func (cf *certificateFiles) load() error {
+	cert, err := tls.LoadX509KeyPair(cf.certFile, cf.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate '%s': %s", cf.certFile, err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("error parsing TLS certificate '%s': %s", cf.certFile, err)
+		}
+	}
+	cf.current.Store(&cert)
+	return nil
+}
+
+// Returns current certificate (used as tls.Config.GetCertificate)
+func (cf *certificateFiles) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cf.current.Load().(*tls.Certificate), nil
+}
+
+// Loads TLS certificate and key from PEM files and uses them for all TLS
+// connections. Creates a TLS config if none has been set yet; the files are
+// read again on ReloadTLSCertificate(). Must be called before Serve().
+func (s *Server) SetTLSCertificateFiles(certFile, keyFile string) error {
+	cf := &certificateFiles{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cf.load(); err != nil {
+		return err
+	}
+
+	s.certificate = cf
+	if s.tlsConfig == nil {
+		s.tlsConfig = &tls.Config{}
+	}
+	s.tlsConfig = s.certificate.apply(s.tlsConfig)
+	return nil
+}
+
+// Returns a copy of config serving the certificate loaded from the files
+func (cf *certificateFiles) apply(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.Certificates = nil
+	config.GetCertificate = cf.get
+	return config
+}
+
+// Reloads the TLS certificate from the files given to SetTLSCertificateFiles().
+// The previous certificate is kept on error; existing connections are not affected.
+func (s *Server) ReloadTLSCertificate() error {
+	if s.certificate == nil {
+		return fmt.Errorf("no TLS certificate files set")
+	}
+	if err := s.certificate.load(); err != nil {
+		s.log(slog.LevelError, "TLS certificate reload failed", slog.Any("error", err))
+		return err
+	}
+
+	leaf := s.GetTLSCertificate().Leaf
+	s.log(slog.LevelInfo, "TLS certificate reloaded", slog.String("subject", leaf.Subject.String()), slog.Time("not_after", leaf.NotAfter))
+	return nil
+}
+
+// Returns the TLS certificate loaded by SetTLSCertificateFiles() (nil if none)
+func (s *Server) GetTLSCertificate() *tls.Certificate {
+	if s.certificate == nil {
+		return nil
+	}
+	return s.certificate.current.Load().(*tls.Certificate)
+}
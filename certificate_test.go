@@ -0,0 +1,53 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// Returns the common name of the certificate presented by s
+func serverCertificateName(t *testing.T, s *Server) string {
+	t.Helper()
+	c, err := tls.Dial("tcp", s.GetListenAddr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSCertificateReloadWithLaterConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := testCertificateFiles(t, dir, "one")
+
+	s := startServer(t, func(conn Connection) {
+		_, _ = conn.Read(make([]byte, 1))
+	}, func(s *Server) {
+		if err := s.SetTLSCertificateFiles(certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+		// a config set afterwards must keep the reloadable certificate
+		s.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+		if err := s.EnableTLS(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if name := serverCertificateName(t, s); name != "one" {
+		t.Fatalf("certificate = %q, want \"one\"", name)
+	}
+	if v := s.GetTLSConfig().MinVersion; v != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x, want %x", v, tls.VersionTLS12)
+	}
+
+	testCertificateFiles(t, dir, "two")
+	if err := s.ReloadTLSCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if name := serverCertificateName(t, s); name != "two" {
+		t.Errorf("certificate after reload = %q, want \"two\"", name)
+	}
+}
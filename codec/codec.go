@@ -0,0 +1,321 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package codec implements message framing on top of a tcpserver connection.
+//
+//	server.SetRequestHandler(func(conn tcpserver.Connection) {
+//		c := codec.NewConn(conn, codec.LengthPrefixed{Size: 4}, nil)
+//		defer c.Release()
+//		for {
+//			frame, err := c.ReadFrame()
+//			if err != nil {
+//				return
+//			}
+//			if err = c.WriteFrame(frame); err != nil {
+//				return
+//			}
+//		}
+//	})
+//
+// Frames can be queued with QueueFrame and sent together with Flush; small
+// frames are copied into a write buffer while larger ones are referenced and
+// sent with a vectored write (writev on plain TCP connections).
+package codec
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Returned when a frame exceeds MaxFrameSize (or the maximum length of the
+// framer's length prefix)
+var ErrFrameTooLarge = errors.New("codec: frame too large")
+
+// Returned when a frame can't be encoded with the framer (e.g. it contains
+// the delimiter) or a malformed frame header has been received
+var ErrInvalidFrame = errors.New("codec: invalid frame")
+
+// Frames up to this size are copied into the write buffer when queued
+const maxInlineSize = 1024
+
+// Maximum size of a frame header
+const maxHeaderSize = 16
+
+// Buffers larger than this aren't kept in the pool
+const maxPooledBufferSize = 64 * 1024
+
+// Codec config
+type Config struct {
+	// Maximum size of a frame (without header or trailer) (defaults to 1 MiB)
+	MaxFrameSize int
+	// Initial size of the read buffer (defaults to 4 KiB)
+	ReadBufferSize int
+}
+
+// Connection reading and writing frames; frames may be written concurrently,
+// but only one goroutine may read at a time
+type Conn struct {
+	conn   tcpserver.Connection
+	framer Framer
+	config Config
+
+	rbuf  *buffer
+	start int
+	end   int
+
+	writeMu sync.Mutex
+	wbuf    *buffer
+	inserts []insert
+	vec     net.Buffers
+}
+
+// Frame referenced instead of being copied into the write buffer
+type insert struct {
+	offset int
+	data   []byte
+}
+
+// Connections implementing vectored writes (such as *tcpserver.TCPConn)
+type buffersWriter interface {
+	WriteBuffers(bufs *net.Buffers) (int64, error)
+}
+
+// Returns a new codec connection; Release should be called once it isn't
+// used anymore
+func NewConn(conn tcpserver.Connection, framer Framer, config *Config) *Conn {
+	c := &Conn{conn: conn, framer: framer}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.MaxFrameSize <= 0 {
+		c.config.MaxFrameSize = 1024 * 1024
+	}
+	if c.config.ReadBufferSize <= 0 {
+		c.config.ReadBufferSize = 4096
+	}
+	return c
+}
+
+// Returns the underlying connection
+func (c *Conn) GetConn() tcpserver.Connection {
+	return c.conn
+}
+
+// Returns the next frame; it is only valid until the next call. Returns
+// io.EOF if the connection has been closed between frames and
+// io.ErrUnexpectedEOF if it has been closed within a frame.
+func (c *Conn) ReadFrame() ([]byte, error) {
+	for {
+		if c.end > c.start {
+			frame, n, err := c.framer.Decode(c.rbuf.b[c.start:c.end], c.config.MaxFrameSize)
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				c.start += n
+				return frame, nil
+			}
+		}
+		if err := c.fill(); err != nil {
+			if err == io.EOF && c.end > c.start {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// Reads more data into the read buffer
+func (c *Conn) fill() error {
+	if c.rbuf == nil {
+		c.rbuf = acquireBuffer(c.config.ReadBufferSize)
+	}
+	if c.start == c.end {
+		c.start, c.end = 0, 0
+		if len(c.rbuf.b) > maxPooledBufferSize {
+			// shrink after a large frame
+			releaseBuffer(c.rbuf)
+			c.rbuf = acquireBuffer(c.config.ReadBufferSize)
+		}
+	} else if c.start > 0 {
+		c.end = copy(c.rbuf.b, c.rbuf.b[c.start:c.end])
+		c.start = 0
+	}
+
+	if c.end == len(c.rbuf.b) {
+		limit := c.config.MaxFrameSize + maxHeaderSize + len(c.framer.Trailer())
+		if c.end >= limit {
+			return ErrFrameTooLarge
+		}
+		size := 2 * len(c.rbuf.b)
+		if size > limit {
+			size = limit
+		}
+		b := make([]byte, size)
+		copy(b, c.rbuf.b[:c.end])
+		c.rbuf.b = b
+	}
+
+	n, err := c.conn.Read(c.rbuf.b[c.end:])
+	c.end += n
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return err
+}
+
+// Sends a frame
+func (c *Conn) WriteFrame(frame []byte) error {
+	if err := c.QueueFrame(frame); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+// Sends multiple frames with a single (vectored) write
+func (c *Conn) WriteFrames(frames ...[]byte) error {
+	for _, frame := range frames {
+		if err := c.QueueFrame(frame); err != nil {
+			return err
+		}
+	}
+	return c.Flush()
+}
+
+// Queues a frame to be sent with the next Flush; frames larger than 1 KiB
+// aren't copied and must not be modified until then (note that frames
+// returned by ReadFrame are overwritten by the next ReadFrame)
+func (c *Conn) QueueFrame(frame []byte) error {
+	if len(frame) > c.config.MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.wbuf == nil {
+		c.wbuf = acquireBuffer(0)
+	}
+	b, err := c.framer.AppendHeader(c.wbuf.b, frame)
+	if err != nil {
+		return err
+	}
+	if len(frame) <= maxInlineSize {
+		b = append(b, frame...)
+	} else {
+		c.inserts = append(c.inserts, insert{offset: len(b), data: frame})
+	}
+	c.wbuf.b = append(b, c.framer.Trailer()...)
+	return nil
+}
+
+// Sends queued frames
+func (c *Conn) Flush() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.wbuf == nil {
+		return nil
+	}
+	var err error
+	if len(c.inserts) == 0 {
+		_, err = c.conn.Write(c.wbuf.b)
+	} else {
+		err = c.writeVectored()
+	}
+	releaseBuffer(c.wbuf)
+	c.wbuf = nil
+	return err
+}
+
+// Sends the write buffer with referenced frames inserted
+func (c *Conn) writeVectored() error {
+	vec := c.vec[:0]
+	b := c.wbuf.b
+	prev := 0
+	for _, ins := range c.inserts {
+		if ins.offset > prev {
+			vec = append(vec, b[prev:ins.offset])
+		}
+		vec = append(vec, ins.data)
+		prev = ins.offset
+	}
+	if prev < len(b) {
+		vec = append(vec, b[prev:])
+	}
+
+	bufs := vec
+	var err error
+	if bw, ok := c.conn.(buffersWriter); ok {
+		_, err = bw.WriteBuffers(&bufs)
+	} else {
+		_, err = bufs.WriteTo(c.conn)
+	}
+
+	for i := range vec {
+		vec[i] = nil
+	}
+	c.vec = vec[:0]
+	for i := range c.inserts {
+		c.inserts[i].data = nil
+	}
+	c.inserts = c.inserts[:0]
+	return err
+}
+
+// Returns buffers to the pool; the connection must not be used afterwards
+func (c *Conn) Release() {
+	if c.rbuf != nil {
+		releaseBuffer(c.rbuf)
+		c.rbuf = nil
+	}
+	c.start, c.end = 0, 0
+	c.writeMu.Lock()
+	if c.wbuf != nil {
+		releaseBuffer(c.wbuf)
+		c.wbuf = nil
+	}
+	c.inserts, c.vec = nil, nil
+	c.writeMu.Unlock()
+}
+
+// Pooled buffer
+type buffer struct {
+	b []byte
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &buffer{}
+	},
+}
+
+// Returns a buffer of length size (empty with some capacity if size is 0)
+func acquireBuffer(size int) *buffer {
+	buf := bufferPool.Get().(*buffer)
+	if size == 0 {
+		if cap(buf.b) == 0 {
+			buf.b = make([]byte, 0, 4096)
+		}
+		buf.b = buf.b[:0]
+		return buf
+	}
+	if cap(buf.b) < size {
+		buf.b = make([]byte, size)
+	}
+	buf.b = buf.b[:cap(buf.b)]
+	return buf
+}
+
+func releaseBuffer(buf *buffer) {
+	if cap(buf.b) > maxPooledBufferSize {
+		buf.b = nil
+	}
+	bufferPool.Put(buf)
+}
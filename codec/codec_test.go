@@ -0,0 +1,374 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package codec_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/codec"
+)
+
+var framers = []struct {
+	name   string
+	framer codec.Framer
+}{
+	{"length prefixed 1", codec.LengthPrefixed{Size: 1}},
+	{"length prefixed 2", codec.LengthPrefixed{Size: 2}},
+	{"length prefixed 4", codec.LengthPrefixed{Size: 4, ByteOrder: binary.LittleEndian}},
+	{"length prefixed 8", codec.LengthPrefixed{Size: 8}},
+	{"varint", codec.Varint{}},
+	{"line", codec.Line{}},
+	{"line CRLF", codec.Line{CRLF: true}},
+	{"delimited", codec.Delimited{Delimiter: []byte("--")}},
+	{"fixed size", codec.FixedSize{Size: 4}},
+}
+
+// Returns test frames supported by the framer
+func testFrames(framer codec.Framer) [][]byte {
+	if f, ok := framer.(codec.FixedSize); ok {
+		return [][]byte{[]byte("abcd"), bytes.Repeat([]byte{0}, f.Size), []byte("wxyz")}
+	}
+	frames := [][]byte{[]byte("hello"), {}, []byte("a-b"), bytes.Repeat([]byte("x"), 200)}
+	if f, ok := framer.(codec.LengthPrefixed); !ok || f.Size > 1 {
+		frames = append(frames, bytes.Repeat([]byte("y"), 5000))
+	}
+	return frames
+}
+
+// Encodes frames
+func encode(t *testing.T, framer codec.Framer, frames [][]byte) []byte {
+	t.Helper()
+	var b []byte
+	for _, frame := range frames {
+		var err error
+		if b, err = framer.AppendHeader(b, frame); err != nil {
+			t.Fatal(err)
+		}
+		b = append(append(b, frame...), framer.Trailer()...)
+	}
+	return b
+}
+
+func TestFramerRoundTrip(t *testing.T) {
+	for _, tt := range framers {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := testFrames(tt.framer)
+			b := encode(t, tt.framer, frames)
+			for i, expected := range frames {
+				frame, n, err := tt.framer.Decode(b, 1024*1024)
+				if err != nil || n == 0 {
+					t.Fatalf("frame %d: unexpected result %d (%v)", i, n, err)
+				}
+				if !bytes.Equal(frame, expected) {
+					t.Fatalf("frame %d: expected %q, got %q", i, expected, frame)
+				}
+				b = b[n:]
+			}
+			if len(b) != 0 {
+				t.Fatalf("%d bytes left", len(b))
+			}
+		})
+	}
+
+	// a preceding "\r" is removed from lines
+	frame, n, err := codec.Line{}.Decode([]byte("hello\r\nworld"), 100)
+	if string(frame) != "hello" || n != 7 || err != nil {
+		t.Fatalf("unexpected result %q %d (%v)", frame, n, err)
+	}
+}
+
+func TestFramerPartial(t *testing.T) {
+	for _, tt := range framers {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, frame := range testFrames(tt.framer) {
+				b := encode(t, tt.framer, [][]byte{frame})
+				if _, ok := tt.framer.(codec.Line); ok {
+					// "\r" might be part of the frame until "\n" is received
+					b = b[:len(b)-1]
+				}
+				for i := 0; i < len(b); i++ {
+					if _, n, err := tt.framer.Decode(b[:i], 1024*1024); n != 0 || err != nil {
+						t.Fatalf("%d of %d bytes: expected incomplete frame, got %d (%v)", i, len(b), n, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFramerMaxSize(t *testing.T) {
+	const maxSize = 100
+	for _, tt := range framers {
+		t.Run(tt.name, func(t *testing.T) {
+			size := maxSize
+			if f, ok := tt.framer.(codec.FixedSize); ok {
+				size = f.Size
+			}
+			b := encode(t, tt.framer, [][]byte{bytes.Repeat([]byte("z"), size)})
+			if frame, n, err := tt.framer.Decode(b, size); err != nil || n != len(b) || len(frame) != size {
+				t.Fatalf("expected frame of maximum size, got %d (%v)", n, err)
+			}
+
+			if _, ok := tt.framer.(codec.FixedSize); ok {
+				if _, _, err := tt.framer.Decode(b, size-1); err != codec.ErrFrameTooLarge {
+					t.Fatalf("expected %v, got %v", codec.ErrFrameTooLarge, err)
+				}
+				return
+			}
+
+			b = encode(t, tt.framer, [][]byte{bytes.Repeat([]byte("z"), size+1)})
+			if _, _, err := tt.framer.Decode(b, size); err != codec.ErrFrameTooLarge {
+				t.Fatalf("expected %v, got %v", codec.ErrFrameTooLarge, err)
+			}
+			// detected without waiting for the whole frame
+			partial := b[:len(b)-size-1]
+			switch tt.framer.(type) {
+			case codec.Line:
+				partial = bytes.Repeat([]byte("z"), size+2)
+			case codec.Delimited:
+				partial = bytes.Repeat([]byte("z"), size+len(tt.framer.Trailer()))
+			}
+			if _, _, err := tt.framer.Decode(partial, size); err != codec.ErrFrameTooLarge {
+				t.Fatalf("%d bytes: expected %v, got %v", len(partial), codec.ErrFrameTooLarge, err)
+			}
+		})
+	}
+}
+
+func TestFramerInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		framer codec.Framer
+		frame  []byte
+		err    error
+	}{
+		{"length prefix too small", codec.LengthPrefixed{Size: 1}, make([]byte, 256), codec.ErrFrameTooLarge},
+		{"line with LF", codec.Line{}, []byte("a\nb"), codec.ErrInvalidFrame},
+		{"line with CR", codec.Line{}, []byte("a\rb"), codec.ErrInvalidFrame},
+		{"frame with delimiter", codec.Delimited{Delimiter: []byte("--")}, []byte("a--b"), codec.ErrInvalidFrame},
+		{"wrong size", codec.FixedSize{Size: 4}, []byte("abc"), codec.ErrInvalidFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.framer.AppendHeader(nil, tt.frame); err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// invalid configurations
+	for _, framer := range []codec.Framer{codec.LengthPrefixed{Size: 3}, codec.Delimited{}, codec.FixedSize{}} {
+		if _, _, err := framer.Decode([]byte("abcd"), 100); err == nil {
+			t.Errorf("%#v: expected error", framer)
+		}
+	}
+
+	// varint overflow
+	if _, _, err := (codec.Varint{}).Decode(bytes.Repeat([]byte{0xff}, 11), 100); err != codec.ErrInvalidFrame {
+		t.Fatalf("expected %v, got %v", codec.ErrInvalidFrame, err)
+	}
+}
+
+// Starts a server echoing frames; the error ReadFrame finally returned is sent
+// to the returned channel
+func startServer(t *testing.T, framer codec.Framer, config *codec.Config) (string, chan error) {
+	t.Helper()
+	errs := make(chan error, 1)
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetRequestHandler(func(conn tcpserver.Connection) {
+		c := codec.NewConn(conn, framer, config)
+		defer c.Release()
+		for {
+			frame, err := c.ReadFrame()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err = c.WriteFrame(frame); err != nil {
+				errs <- err
+				return
+			}
+		}
+	})
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	})
+	return s.GetListenAddr().String(), errs
+}
+
+// Connects to the server
+func dial(t *testing.T, addr string) *net.TCPConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn.(*net.TCPConn)
+}
+
+// Waits for the error returned by the server
+func waitError(t *testing.T, errs chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the server")
+		return nil
+	}
+}
+
+func TestConn(t *testing.T) {
+	for _, tt := range framers {
+		t.Run(tt.name, func(t *testing.T) {
+			// the read buffer has to grow for larger frames
+			addr, errs := startServer(t, tt.framer, &codec.Config{ReadBufferSize: 16})
+			frames := testFrames(tt.framer)
+			b := encode(t, tt.framer, frames)
+
+			conn := dial(t, addr)
+			// frames are received in pieces
+			for i := 0; i < len(b); i += 7 {
+				end := i + 7
+				if end > len(b) {
+					end = len(b)
+				}
+				if _, err := conn.Write(b[i:end]); err != nil {
+					t.Fatal(err)
+				}
+				if i < 100 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			echo := make([]byte, len(b))
+			if _, err := io.ReadFull(conn, echo); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(echo, b) {
+				t.Fatal("unexpected echo")
+			}
+
+			// closed between frames
+			_ = conn.CloseWrite()
+			if err := waitError(t, errs); err != io.EOF {
+				t.Fatalf("expected %v, got %v", io.EOF, err)
+			}
+		})
+	}
+}
+
+func TestConnTruncated(t *testing.T) {
+	for _, tt := range framers {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, errs := startServer(t, tt.framer, nil)
+			b := encode(t, tt.framer, testFrames(tt.framer)[:1])
+
+			conn := dial(t, addr)
+			if _, err := conn.Write(b[:len(b)-1]); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.CloseWrite()
+			if err := waitError(t, errs); err != io.ErrUnexpectedEOF {
+				t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+			}
+		})
+	}
+}
+
+func TestConnFrameTooLarge(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		framer codec.Framer
+		data   string
+	}{
+		{"length prefixed", codec.LengthPrefixed{Size: 4}, "\x00\x00\x01\x00"},
+		{"varint", codec.Varint{}, "\x80\x02"},
+		{"line", codec.Line{}, strings.Repeat("x", 300)},
+		{"delimited", codec.Delimited{Delimiter: []byte("--")}, strings.Repeat("x", 300)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, errs := startServer(t, tt.framer, &codec.Config{MaxFrameSize: 100, ReadBufferSize: 16})
+			conn := dial(t, addr)
+			if _, err := io.WriteString(conn, tt.data); err != nil {
+				t.Fatal(err)
+			}
+			if err := waitError(t, errs); err != codec.ErrFrameTooLarge {
+				t.Fatalf("expected %v, got %v", codec.ErrFrameTooLarge, err)
+			}
+		})
+	}
+}
+
+func TestConnWrite(t *testing.T) {
+	framer := codec.LengthPrefixed{Size: 4}
+	frames := make(chan [][]byte, 1)
+	errs := make(chan error, 1)
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetRequestHandler(func(conn tcpserver.Connection) {
+		c := codec.NewConn(conn, framer, &codec.Config{MaxFrameSize: 4096})
+		defer c.Release()
+		if err := c.QueueFrame(make([]byte, 4097)); err != codec.ErrFrameTooLarge {
+			errs <- errors.New("expected ErrFrameTooLarge")
+			return
+		}
+		errs <- c.WriteFrames(<-frames...)
+	})
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	})
+
+	// small frames are copied, larger ones are referenced (vectored write)
+	sent := [][]byte{[]byte("small"), bytes.Repeat([]byte("L"), 3000), {}, []byte("tail"), bytes.Repeat([]byte("M"), 2000)}
+	conn := dial(t, s.GetListenAddr().String())
+	frames <- sent
+	if err = waitError(t, errs); err != nil {
+		t.Fatal(err)
+	}
+	expected := encode(t, framer, sent)
+	b := make([]byte, len(expected))
+	if _, err = io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatal("unexpected frames")
+	}
+}
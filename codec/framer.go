@@ -0,0 +1,252 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Frame format
+type Framer interface {
+	// Returns the first frame in b and the number of bytes it occupies (0 if
+	// b doesn't contain a complete frame yet); returns ErrFrameTooLarge as
+	// soon as it is known that the frame exceeds maxSize
+	Decode(b []byte, maxSize int) (frame []byte, n int, err error)
+	// Appends the header of frame to dst (if any)
+	AppendHeader(dst []byte, frame []byte) ([]byte, error)
+	// Returns the trailer following each frame (nil if none)
+	Trailer() []byte
+}
+
+var errEmptyDelimiter = errors.New("codec: empty delimiter")
+
+// Frames prefixed with their length as unsigned integer of 1, 2, 4 or 8 bytes
+type LengthPrefixed struct {
+	// Size of the length prefix in bytes
+	Size int
+	// Byte order of the length prefix (defaults to binary.BigEndian)
+	ByteOrder binary.ByteOrder
+}
+
+func (f LengthPrefixed) Decode(b []byte, maxSize int) ([]byte, int, error) {
+	if err := f.validate(); err != nil {
+		return nil, 0, err
+	}
+	if len(b) < f.Size {
+		return nil, 0, nil
+	}
+	length := f.get(b)
+	if length > uint64(maxSize) {
+		return nil, 0, ErrFrameTooLarge
+	}
+	n := f.Size + int(length)
+	if len(b) < n {
+		return nil, 0, nil
+	}
+	return b[f.Size:n], n, nil
+}
+
+func (f LengthPrefixed) AppendHeader(dst []byte, frame []byte) ([]byte, error) {
+	if err := f.validate(); err != nil {
+		return dst, err
+	}
+	length := uint64(len(frame))
+	if f.Size < 8 && length >= 1<<(8*f.Size) {
+		return dst, ErrFrameTooLarge
+	}
+	n := len(dst)
+	dst = append(dst, make([]byte, f.Size)...)
+	switch order := f.order(); f.Size {
+	case 1:
+		dst[n] = byte(length)
+	case 2:
+		order.PutUint16(dst[n:], uint16(length))
+	case 4:
+		order.PutUint32(dst[n:], uint32(length))
+	default:
+		order.PutUint64(dst[n:], length)
+	}
+	return dst, nil
+}
+
+func (f LengthPrefixed) Trailer() []byte {
+	return nil
+}
+
+func (f LengthPrefixed) validate() error {
+	switch f.Size {
+	case 1, 2, 4, 8:
+		return nil
+	}
+	return fmt.Errorf("codec: invalid length prefix size %d", f.Size)
+}
+
+func (f LengthPrefixed) order() binary.ByteOrder {
+	if f.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return f.ByteOrder
+}
+
+// Returns the length prefix at the beginning of b
+func (f LengthPrefixed) get(b []byte) uint64 {
+	order := f.order()
+	switch f.Size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	}
+	return order.Uint64(b)
+}
+
+// Frames prefixed with their length as unsigned varint (as used by Protocol
+// Buffers)
+type Varint struct{}
+
+func (f Varint) Decode(b []byte, maxSize int) ([]byte, int, error) {
+	length, size := binary.Uvarint(b)
+	if size == 0 {
+		// more bytes needed
+		return nil, 0, nil
+	}
+	if size < 0 {
+		return nil, 0, ErrInvalidFrame
+	}
+	if length > uint64(maxSize) {
+		return nil, 0, ErrFrameTooLarge
+	}
+	n := size + int(length)
+	if len(b) < n {
+		return nil, 0, nil
+	}
+	return b[size:n], n, nil
+}
+
+func (f Varint) AppendHeader(dst []byte, frame []byte) ([]byte, error) {
+	return binary.AppendUvarint(dst, uint64(len(frame))), nil
+}
+
+func (f Varint) Trailer() []byte {
+	return nil
+}
+
+// Frames terminated by "\n" (a preceding "\r" is removed)
+type Line struct {
+	// Terminate written frames with "\r\n" instead of "\n"
+	CRLF bool
+}
+
+func (f Line) Decode(b []byte, maxSize int) ([]byte, int, error) {
+	// the frame may be followed by "\r\n"
+	limit := maxSize + 2
+	if len(b) < limit {
+		limit = len(b)
+	}
+	i := bytes.IndexByte(b[:limit], '\n')
+	if i < 0 {
+		if len(b) >= maxSize+2 {
+			return nil, 0, ErrFrameTooLarge
+		}
+		return nil, 0, nil
+	}
+	frame := b[:i]
+	if len(frame) > 0 && frame[len(frame)-1] == '\r' {
+		frame = frame[:len(frame)-1]
+	}
+	if len(frame) > maxSize {
+		return nil, 0, ErrFrameTooLarge
+	}
+	return frame, i + 1, nil
+}
+
+func (f Line) AppendHeader(dst []byte, frame []byte) ([]byte, error) {
+	if bytes.IndexByte(frame, '\n') >= 0 || bytes.IndexByte(frame, '\r') >= 0 {
+		return dst, ErrInvalidFrame
+	}
+	return dst, nil
+}
+
+var (
+	lf   = []byte("\n")
+	crlf = []byte("\r\n")
+)
+
+func (f Line) Trailer() []byte {
+	if f.CRLF {
+		return crlf
+	}
+	return lf
+}
+
+// Frames terminated by a delimiter
+type Delimited struct {
+	Delimiter []byte
+}
+
+func (f Delimited) Decode(b []byte, maxSize int) ([]byte, int, error) {
+	if len(f.Delimiter) == 0 {
+		return nil, 0, errEmptyDelimiter
+	}
+	limit := maxSize + len(f.Delimiter)
+	if len(b) < limit {
+		limit = len(b)
+	}
+	i := bytes.Index(b[:limit], f.Delimiter)
+	if i < 0 {
+		if len(b) >= maxSize+len(f.Delimiter) {
+			return nil, 0, ErrFrameTooLarge
+		}
+		return nil, 0, nil
+	}
+	return b[:i], i + len(f.Delimiter), nil
+}
+
+func (f Delimited) AppendHeader(dst []byte, frame []byte) ([]byte, error) {
+	if len(f.Delimiter) == 0 {
+		return dst, errEmptyDelimiter
+	}
+	if bytes.Contains(frame, f.Delimiter) {
+		return dst, ErrInvalidFrame
+	}
+	return dst, nil
+}
+
+func (f Delimited) Trailer() []byte {
+	return f.Delimiter
+}
+
+// Frames of a fixed size
+type FixedSize struct {
+	Size int
+}
+
+func (f FixedSize) Decode(b []byte, maxSize int) ([]byte, int, error) {
+	if f.Size <= 0 {
+		return nil, 0, fmt.Errorf("codec: invalid frame size %d", f.Size)
+	}
+	if f.Size > maxSize {
+		return nil, 0, ErrFrameTooLarge
+	}
+	if len(b) < f.Size {
+		return nil, 0, nil
+	}
+	return b[:f.Size], f.Size, nil
+}
+
+func (f FixedSize) AppendHeader(dst []byte, frame []byte) ([]byte, error) {
+	if len(frame) != f.Size {
+		return dst, ErrInvalidFrame
+	}
+	return dst, nil
+}
+
+func (f FixedSize) Trailer() []byte {
+	return nil
+}
@@ -0,0 +1,478 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maurice2k/ultrapool"
+)
+
+// Dispatcher hands accepted connections over to goroutines serving them.
+// The default is a worker pool based on ultrapool (see WorkerPoolConfig).
+// Dispatchers that may block in Dispatch should also implement Abort(),
+// which is called on Shutdown() and has to make blocked and future blocking
+// calls return ErrShutdown.
+type Dispatcher interface {
+	// Starts the dispatcher; serve must be called exactly once for every
+	// dispatched connection
+	Start(serve func(conn Connection)) error
+	// Dispatches an accepted connection (called from the accept loops); if an
+	// error is returned the connection is closed without being served
+	Dispatch(conn Connection) error
+	// Stops the dispatcher (called after all connections have been served)
+	Stop()
+	// Returns number of spawned worker goroutines
+	GetWorkers() int
+}
+
+// Returned by dispatchers if a connection is rejected due to overload
+var ErrOverloaded = errors.New("tcpserver: overloaded")
+
+// Returned by dispatchers if a connection would have to wait for a worker
+// while the server is shutting down
+var ErrShutdown = errors.New("tcpserver: server is shutting down")
+
+// What to do with new connections if the worker pool is overloaded
+type OverloadPolicy uint8
+
+const (
+	// Block accept loops until a worker becomes available (new connections
+	// pile up in the listen backlog)
+	OverloadBlock OverloadPolicy = iota
+	// Close new connections right away
+	OverloadClose
+	// Write OverloadResponse and close new connections
+	OverloadRespond
+)
+
+var overloadPolicyNames = [...]string{
+	OverloadBlock:   "block",
+	OverloadClose:   "close",
+	OverloadRespond: "respond",
+}
+
+// Returns policy name
+func (p OverloadPolicy) String() string {
+	if int(p) < len(overloadPolicyNames) {
+		return overloadPolicyNames[p]
+	}
+	return "unknown"
+}
+
+// Time to wait for the overload response to be written
+const overloadResponseTimeout = 100 * time.Millisecond
+
+// Worker pool config
+type WorkerPoolConfig struct {
+	// Number of worker pool shards (defaults to GOMAXPROCS * 2)
+	Shards int
+	// Time after which idle workers are stopped (defaults to 5s)
+	IdleWorkerLifetime time.Duration
+	// Maximum number of workers serving connections at the same time
+	// (defaults to 0 which means unlimited)
+	MaxWorkers int
+	// Maximum number of connections waiting for a worker if MaxWorkers is
+	// reached (defaults to 0 which means no waiting connections)
+	MaxQueued int
+	// What to do with new connections if MaxWorkers and MaxQueued are reached
+	// (defaults to OverloadBlock)
+	OverloadPolicy OverloadPolicy
+	// Response written to new connections using OverloadRespond (not written
+	// for TLS connections). Use OverloadClose together with an OnReject hook
+	// for more complex responses.
+	OverloadResponse []byte
+	// Number of workers spawned on start (they are still subject to
+	// IdleWorkerLifetime)
+	Prewarm int
+	// Priority classes in descending order of priority (requires MaxWorkers);
+	// connections are assigned to classes by the server's classifier (see
+	// SetClassifier) and waiting connections of higher classes are served first
+	PriorityClasses []PriorityClass
+}
+
+// Priority class of the worker pool
+type PriorityClass struct {
+	// Class name
+	Name string
+	// Number of workers only available to this class; the remaining workers
+	// (MaxWorkers minus all reserved workers) are shared by all classes
+	ReservedWorkers int
+	// Maximum number of connections of this class waiting for a worker
+	// (defaults to 0 which means WorkerPoolConfig.MaxQueued)
+	MaxQueued int
+}
+
+// Stats of a priority class
+type PriorityClassStats struct {
+	Name            string `json:"name"`
+	ReservedWorkers int    `json:"reserved_workers"`
+	Busy            int    `json:"busy"`
+	Queued          int    `json:"queued"`
+}
+
+var defaultWorkerPoolConfig = &WorkerPoolConfig{}
+
+// Sets worker pool config used by the default dispatcher; must be called before Serve()
+func (s *Server) SetWorkerPoolConfig(config *WorkerPoolConfig) {
+	s.workerPoolConfig = config
+}
+
+// Returns worker pool config
+func (s *Server) GetWorkerPoolConfig() *WorkerPoolConfig {
+	return s.workerPoolConfig
+}
+
+// Sets dispatcher (defaults to a worker pool configured by SetWorkerPoolConfig);
+// must be called before Serve()
+func (s *Server) SetDispatcher(d Dispatcher) {
+	s.dispatcher = d
+}
+
+// Returns dispatcher (nil until Serve() has been called if none set)
+func (s *Server) GetDispatcher() Dispatcher {
+	return s.dispatcher
+}
+
+// Dispatcher using an ultrapool worker pool
+type workerPoolDispatcher struct {
+	config  WorkerPoolConfig
+	wp      *ultrapool.WorkerPool
+	serve   func(conn Connection)
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	busy    int
+	waiting int
+	aborted bool
+	lanes   []*lane
+}
+
+// Connections of a priority class
+type lane struct {
+	name      string
+	reserved  int
+	maxQueued int
+	busy      int
+	queue     []Connection
+}
+
+// Task used to spawn workers on start
+type prewarmTask struct {
+	started *sync.WaitGroup
+	release chan struct{}
+}
+
+// Creates a new worker pool dispatcher (uses defaults if config is nil)
+func NewWorkerPoolDispatcher(config *WorkerPoolConfig) Dispatcher {
+	if config == nil {
+		config = defaultWorkerPoolConfig
+	}
+	return &workerPoolDispatcher{
+		config: *config,
+	}
+}
+
+// Starts the worker pool
+func (d *workerPoolDispatcher) Start(serve func(conn Connection)) error {
+	shards := d.config.Shards
+	if shards < 1 {
+		shards = runtime.GOMAXPROCS(0) * 2
+	}
+	idleWorkerLifetime := d.config.IdleWorkerLifetime
+	if idleWorkerLifetime <= 0 {
+		idleWorkerLifetime = 5 * time.Second
+	}
+
+	d.serve = serve
+	if d.config.MaxWorkers > 0 {
+		if err := d.initLanes(); err != nil {
+			return err
+		}
+	} else if len(d.config.PriorityClasses) > 0 {
+		return fmt.Errorf("priority classes require MaxWorkers to be set")
+	}
+
+	d.wp = ultrapool.NewWorkerPool(d.handleTask)
+	d.wp.SetNumShards(shards)
+	d.wp.SetIdleWorkerLifetime(idleWorkerLifetime)
+	d.wp.Start()
+
+	if d.config.Prewarm > 0 {
+		d.prewarm(d.config.Prewarm, shards)
+	}
+	return nil
+}
+
+// Creates a lane per priority class (or a single default lane)
+func (d *workerPoolDispatcher) initLanes() error {
+	classes := d.config.PriorityClasses
+	if len(classes) == 0 {
+		classes = []PriorityClass{{Name: "default"}}
+	}
+	if len(classes) > 256 {
+		return fmt.Errorf("too many priority classes (max. 256)")
+	}
+
+	reserved := 0
+	d.lanes = make([]*lane, len(classes))
+	for i, c := range classes {
+		if c.ReservedWorkers < 0 || c.MaxQueued < 0 {
+			return fmt.Errorf("invalid priority class %q", c.Name)
+		}
+		reserved += c.ReservedWorkers
+		d.lanes[i] = &lane{
+			name:      c.Name,
+			reserved:  c.ReservedWorkers,
+			maxQueued: c.MaxQueued,
+		}
+		if c.MaxQueued == 0 {
+			d.lanes[i].maxQueued = d.config.MaxQueued
+		}
+	}
+	if reserved > d.config.MaxWorkers {
+		return fmt.Errorf("reserved workers of priority classes (%d) exceed MaxWorkers (%d)", reserved, d.config.MaxWorkers)
+	}
+
+	d.cond = sync.NewCond(&d.mutex)
+	return nil
+}
+
+// Returns the lane of the connection's priority class
+func (d *workerPoolDispatcher) laneOf(conn Connection) *lane {
+	class := 0
+	if pc, ok := conn.(interface{ GetPriorityClass() int }); ok {
+		class = pc.GetPriorityClass()
+	}
+	if class >= len(d.lanes) {
+		class = len(d.lanes) - 1
+	}
+	return d.lanes[class]
+}
+
+// Checks whether a connection of given lane may be served right now; a lane
+// may always use its reserved workers and shares the remaining workers with
+// the other lanes (must be called with mutex held)
+func (d *workerPoolDispatcher) canRun(l *lane) bool {
+	if l.busy < l.reserved {
+		return true
+	}
+	used := d.busy
+	for _, o := range d.lanes {
+		if o.busy < o.reserved {
+			used += o.reserved - o.busy
+		}
+	}
+	return used < d.config.MaxWorkers
+}
+
+// Marks a worker of given lane as busy (must be called with mutex held)
+func (d *workerPoolDispatcher) acquire(l *lane) {
+	l.busy++
+	d.busy++
+}
+
+// Releases a worker of given lane and returns the next waiting connection
+// the worker should serve (if any)
+func (d *workerPoolDispatcher) release(l *lane) (Connection, *lane) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	l.busy--
+	d.busy--
+	if d.waiting > 0 {
+		d.cond.Broadcast()
+	}
+
+	for _, next := range d.lanes {
+		if len(next.queue) > 0 && d.canRun(next) {
+			conn := next.queue[0]
+			next.queue[0] = nil
+			next.queue = next.queue[1:]
+			d.acquire(next)
+			return conn, next
+		}
+	}
+	return nil, nil
+}
+
+// Returns stats per priority class (nil if MaxWorkers isn't set)
+func (d *workerPoolDispatcher) GetPriorityClassStats() []PriorityClassStats {
+	if d.lanes == nil {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	stats := make([]PriorityClassStats, len(d.lanes))
+	for i, l := range d.lanes {
+		stats[i] = PriorityClassStats{
+			Name:            l.name,
+			ReservedWorkers: l.reserved,
+			Busy:            l.busy,
+			Queued:          len(l.queue),
+		}
+	}
+	return stats
+}
+
+// Spawns n workers by blocking them until all of them have been started
+func (d *workerPoolDispatcher) prewarm(n int, shards int) {
+	task := prewarmTask{
+		started: &sync.WaitGroup{},
+		release: make(chan struct{}),
+	}
+	task.started.Add(n)
+	for i := 0; i < n; i++ {
+		_ = d.wp.AddTaskForShard(task, i%shards)
+	}
+	task.started.Wait()
+	close(task.release)
+}
+
+// Handles a worker pool task
+func (d *workerPoolDispatcher) handleTask(task ultrapool.Task) {
+	if t, ok := task.(prewarmTask); ok {
+		t.started.Done()
+		<-t.release
+		return
+	}
+
+	conn := task.(Connection)
+	if d.lanes == nil {
+		d.serve(conn)
+		return
+	}
+
+	// keep the worker while there are waiting connections; the lane has to be
+	// looked up before serving as the connection is recycled afterwards
+	l := d.laneOf(conn)
+	for conn != nil {
+		d.serve(conn)
+		conn, l = d.release(l)
+	}
+}
+
+// Dispatches connection to a worker; if MaxWorkers is reached the connection
+// is queued or the overload policy is applied
+func (d *workerPoolDispatcher) Dispatch(conn Connection) error {
+	if d.lanes == nil {
+		return d.wp.AddTask(conn)
+	}
+
+	l := d.laneOf(conn)
+	d.mutex.Lock()
+	for {
+		if d.canRun(l) {
+			d.acquire(l)
+			d.mutex.Unlock()
+			err := d.wp.AddTask(conn)
+			if err != nil {
+				d.mutex.Lock()
+				l.busy--
+				d.busy--
+				d.mutex.Unlock()
+			}
+			return err
+		}
+		if len(l.queue) < l.maxQueued {
+			l.queue = append(l.queue, conn)
+			d.mutex.Unlock()
+			return nil
+		}
+		if d.config.OverloadPolicy != OverloadBlock {
+			break
+		}
+		if d.aborted {
+			d.mutex.Unlock()
+			return ErrShutdown
+		}
+		d.waiting++
+		d.cond.Wait()
+		d.waiting--
+	}
+	d.mutex.Unlock()
+
+	if d.config.OverloadPolicy == OverloadRespond {
+		d.writeOverloadResponse(conn)
+	}
+	return ErrOverloaded
+}
+
+// Writes the overload response (if any)
+func (d *workerPoolDispatcher) writeOverloadResponse(conn Connection) {
+	if len(d.config.OverloadResponse) == 0 {
+		return
+	}
+	if s := conn.GetServer(); s != nil && s.tlsEnabled {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(overloadResponseTimeout))
+	_, _ = conn.Write(d.config.OverloadResponse)
+}
+
+// Wakes up Dispatch calls waiting for a worker (OverloadBlock); they and
+// all later calls that would wait return ErrShutdown
+func (d *workerPoolDispatcher) Abort() {
+	if d.cond == nil {
+		return
+	}
+	d.mutex.Lock()
+	d.aborted = true
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+}
+
+// Stops the worker pool
+func (d *workerPoolDispatcher) Stop() {
+	d.wp.Stop()
+}
+
+// Returns number of spawned workers
+func (d *workerPoolDispatcher) GetWorkers() int {
+	if d.wp == nil {
+		return 0
+	}
+	return d.wp.GetSpawnedWorkers()
+}
+
+// Dispatcher spawning a new goroutine per connection
+type goroutineDispatcher struct {
+	serve   func(conn Connection)
+	workers int64
+}
+
+// Creates a new dispatcher spawning a new goroutine per connection
+func NewGoroutineDispatcher() Dispatcher {
+	return &goroutineDispatcher{}
+}
+
+// Starts the dispatcher
+func (d *goroutineDispatcher) Start(serve func(conn Connection)) error {
+	d.serve = serve
+	return nil
+}
+
+// Serves connection in a new goroutine
+func (d *goroutineDispatcher) Dispatch(conn Connection) error {
+	atomic.AddInt64(&d.workers, 1)
+	go func() {
+		d.serve(conn)
+		atomic.AddInt64(&d.workers, -1)
+	}()
+	return nil
+}
+
+// Stops the dispatcher
+func (d *goroutineDispatcher) Stop() {
+}
+
+// Returns number of running goroutines serving connections
+func (d *goroutineDispatcher) GetWorkers() int {
+	return int(atomic.LoadInt64(&d.workers))
+}
@@ -0,0 +1,175 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Message size used by the dispatcher benchmarks
+const benchMsgSize = 128
+
+// Number of client connections per GOMAXPROCS used by the dispatcher benchmarks
+const benchParallelism = 8
+
+// Dispatchers compared by the benchmarks
+var benchDispatchers = []struct {
+	name string
+	new  func() Dispatcher
+}{
+	{"workerpool", func() Dispatcher { return NewWorkerPoolDispatcher(nil) }},
+	{"bounded", func() Dispatcher {
+		// enough workers to serve all benchmark clients at the same time
+		maxWorkers := runtime.GOMAXPROCS(0) * benchParallelism * 2
+		return NewWorkerPoolDispatcher(&WorkerPoolConfig{MaxWorkers: maxWorkers, Prewarm: maxWorkers})
+	}},
+	{"goroutine", NewGoroutineDispatcher},
+}
+
+func TestShutdownBlockedDispatch(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetLoops(1)
+	s.SetWorkerPoolConfig(&WorkerPoolConfig{MaxWorkers: 1, OverloadPolicy: OverloadBlock})
+	s.SetRequestHandler(func(conn Connection) {
+		_, _ = conn.Read(make([]byte, 1))
+	})
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+
+	// the first connection occupies the only worker, the accept loop blocks
+	// while dispatching the second one
+	dial(t, s)
+	waitFor(t, "active connection", func() bool {
+		return s.GetActiveConnections() == 1
+	})
+	dial(t, s)
+	waitFor(t, "queued connection", func() bool {
+		return s.GetQueuedConnections() == 1
+	})
+
+	_ = s.Shutdown(200 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Serve() didn't return after the shutdown deadline (active %d, queued %d)", s.GetActiveConnections(), s.GetQueuedConnections())
+	}
+	if n := s.GetActiveConnections() + s.GetQueuedConnections(); n != 0 {
+		t.Errorf("expected all connections to be closed, got %d", n)
+	}
+}
+
+// Echoes messages of benchMsgSize bytes until the client closes the connection
+func benchEcho(conn Connection) {
+	buf := make([]byte, benchMsgSize)
+	for {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if _, err := conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+// Sends a message and waits for the echo
+func benchRoundTrip(b *testing.B, conn net.Conn, msg, buf []byte) {
+	if _, err := conn.Write(msg); err != nil {
+		b.Error(err)
+		return
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		b.Error(err)
+	}
+}
+
+// Round trips over keep-alive connections
+func BenchmarkDispatcherKeepAlive(b *testing.B) {
+	for _, d := range benchDispatchers {
+		b.Run(d.name, func(b *testing.B) {
+			benchKeepAlive(b, func(s *Server) {
+				s.SetDispatcher(d.new())
+			})
+		})
+	}
+}
+
+// Single round trip per connection
+func BenchmarkDispatcherShortLived(b *testing.B) {
+	for _, d := range benchDispatchers {
+		b.Run(d.name, func(b *testing.B) {
+			benchShortLived(b, func(s *Server) {
+				s.SetDispatcher(d.new())
+			})
+		})
+	}
+}
+
+// Measures round trips over keep-alive connections to an echo server
+// configured by setup
+func benchKeepAlive(b *testing.B, setup func(s *Server)) {
+	s := startServer(b, benchEcho, setup)
+	addr := s.GetListenAddr().String()
+
+	b.SetBytes(benchMsgSize)
+	b.ReportAllocs()
+	b.SetParallelism(benchParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		msg := make([]byte, benchMsgSize)
+		buf := make([]byte, benchMsgSize)
+		for pb.Next() {
+			benchRoundTrip(b, conn, msg, buf)
+		}
+	})
+}
+
+// Measures single round trips over new connections to an echo server
+// configured by setup
+func benchShortLived(b *testing.B, setup func(s *Server)) {
+	s := startServer(b, benchEcho, setup)
+	addr := s.GetListenAddr().String()
+
+	b.SetBytes(benchMsgSize)
+	b.ReportAllocs()
+	b.SetParallelism(benchParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		msg := make([]byte, benchMsgSize)
+		buf := make([]byte, benchMsgSize)
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			benchRoundTrip(b, conn, msg, buf)
+
+			// reset the connection so that the client doesn't run
+			// out of ephemeral ports due to TIME_WAIT
+			_ = conn.(*net.TCPConn).SetLinger(0)
+			_ = conn.Close()
+		}
+	})
+}
@@ -24,7 +24,7 @@ func main() {
 	flag.StringVar(&listenAddr, "listen", "127.0.0.1:5000", "server listen addr")
 	flag.BoolVar(&zeroCopy, "zerocopy", true, "use splice/sendfile zero copy")
 	flag.IntVar(&loops, "loops", -1, "number of accept loops (defaults to 4 which is more than enough for most use cases)")
-	flag.IntVar(&wpShards, "wpshards", -1, "number of workerpool shards")
+	flag.IntVar(&wpShards, "wpshards", -1, "number of workerpool shards (defaults to GOMAXPROCS * 2)")
 	flag.BoolVar(&useTls, "useTls", false, "use HTTPS")
 	flag.Parse()
 
@@ -49,7 +49,9 @@ func main() {
 	})
 	server.SetRequestHandler(requestHandler)
 	server.SetLoops(loops)
-	server.SetWorkerpoolShards(2)
+	server.SetWorkerPoolConfig(&tcpserver.WorkerPoolConfig{
+		Shards: wpShards,
+	})
 	server.SetAllowThreadLocking(true)
 
 	var err error
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+var listenAddr string
+var upstreamAddr string
+var idleTimeout time.Duration
+var loops int
+
+func main() {
+	flag.StringVar(&listenAddr, "listen", "127.0.0.1:5001", "server listen addr")
+	flag.StringVar(&upstreamAddr, "upstream", "127.0.0.1:5000", "upstream addr")
+	flag.DurationVar(&idleTimeout, "idle", time.Minute, "idle timeout")
+	flag.IntVar(&loops, "loops", -1, "number of accept loops (defaults to 8)")
+	flag.Parse()
+
+	fmt.Printf("Running proxy on %s to %s\n", listenAddr, upstreamAddr)
+
+	server, _ := tcpserver.NewServer(listenAddr)
+	server.SetRequestHandlerErr(requestHandler)
+	server.SetLoops(loops)
+
+	err := server.Listen()
+	if err != nil {
+		panic("Error listening on interface: " + err.Error())
+	}
+
+	err = server.Serve()
+	if err != nil {
+		panic("Error serving: " + err.Error())
+	}
+}
+
+func requestHandler(conn tcpserver.Connection) error {
+	upstream, err := net.DialTimeout("tcp", upstreamAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer upstream.Close()
+
+	stats, err := tcpserver.Proxy(conn, upstream, &tcpserver.ProxyOptions{
+		IdleTimeout: idleTimeout,
+	})
+	conn.Logger().Info("proxied", "client_to_upstream", stats.ClientToUpstream, "upstream_to_client", stats.UpstreamToClient, "zero_copy", stats.ZeroCopy)
+	return err
+}
@@ -1,6 +1,6 @@
 module github.com/maurice2k/tcpserver
 
-go 1.19
+go 1.21
 
 require (
 	github.com/maurice2k/ultrapool v1.2.0
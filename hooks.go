@@ -0,0 +1,132 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Connection lifecycle hooks (all hooks are optional).
+// Hooks are called synchronously and should therefore return quickly.
+type Hooks struct {
+	// Called after the server started listening
+	OnListen func(s *Server)
+	// Called from the accept loop for each accepted connection;
+	// returning an error rejects (closes) the connection
+	OnAccept func(conn Connection) error
+	// Called for accepted connections that are rejected by an OnAccept hook,
+	// drain mode or the dispatcher (e.g. if overloaded) right before they are
+	// closed; may be used to write a protocol specific response
+	OnReject func(conn Connection, reason RejectReason)
+	// Called after the server side TLS handshake (err is non-nil if the
+	// handshake failed, in which case the request handler is not called)
+	OnTLSHandshake func(conn Connection, state tls.ConnectionState, err error)
+	// Called right before the request handler is called
+	OnHandlerStart func(conn Connection)
+	// Called if the request handler panics (the panic is recovered afterwards)
+	OnHandlerPanic func(conn Connection, v interface{}, stack []byte)
+	// Called after the connection has been closed
+	OnClose func(conn Connection, info CloseInfo)
+	// Called once when the server starts shutting down
+	OnShutdown func(s *Server)
+}
+
+// Information about a closed connection passed to the OnClose hook
+type CloseInfo struct {
+	// Why the connection has been closed
+	Reason CloseReason
+	// Error returned by the request handler, recovered panic (*PanicError)
+	// or TLS handshake error
+	Err error
+	// Time between accepting and closing the connection
+	Duration time.Duration
+	// Final connection stats
+	Stats ConnStats
+}
+
+// Registered hooks by type
+type hookChain struct {
+	onListen       []func(s *Server)
+	onAccept       []func(conn Connection) error
+	onReject       []func(conn Connection, reason RejectReason)
+	onTLSHandshake []func(conn Connection, state tls.ConnectionState, err error)
+	onHandlerStart []func(conn Connection)
+	onHandlerPanic []func(conn Connection, v interface{}, stack []byte)
+	onClose        []func(conn Connection, info CloseInfo)
+	onShutdown     []func(s *Server)
+}
+
+// Adds connection lifecycle hooks. Can be called multiple times; hooks of the same
+// type are called in the order they have been added. Must not be called while serving.
+func (s *Server) AddHooks(h Hooks) {
+	if h.OnListen != nil {
+		s.hooks.onListen = append(s.hooks.onListen, h.OnListen)
+	}
+	if h.OnAccept != nil {
+		s.hooks.onAccept = append(s.hooks.onAccept, h.OnAccept)
+	}
+	if h.OnReject != nil {
+		s.hooks.onReject = append(s.hooks.onReject, h.OnReject)
+	}
+	if h.OnTLSHandshake != nil {
+		s.hooks.onTLSHandshake = append(s.hooks.onTLSHandshake, h.OnTLSHandshake)
+	}
+	if h.OnHandlerStart != nil {
+		s.hooks.onHandlerStart = append(s.hooks.onHandlerStart, h.OnHandlerStart)
+	}
+	if h.OnHandlerPanic != nil {
+		s.hooks.onHandlerPanic = append(s.hooks.onHandlerPanic, h.OnHandlerPanic)
+	}
+	if h.OnClose != nil {
+		s.hooks.onClose = append(s.hooks.onClose, h.OnClose)
+	}
+	if h.OnShutdown != nil {
+		s.hooks.onShutdown = append(s.hooks.onShutdown, h.OnShutdown)
+	}
+}
+
+// Calls OnAccept hooks; returns the first error (remaining hooks are skipped)
+func (s *Server) callAcceptHooks(conn Connection) error {
+	for _, f := range s.hooks.onAccept {
+		if err := f(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls OnReject hooks
+func (s *Server) callRejectHooks(conn Connection, reason RejectReason) {
+	for _, f := range s.hooks.onReject {
+		f(conn, reason)
+	}
+}
+
+// Calls OnTLSHandshake hooks
+func (s *Server) callTLSHandshakeHooks(conn Connection, tlsConn *tls.Conn, err error) {
+	if len(s.hooks.onTLSHandshake) == 0 {
+		return
+	}
+	state := tlsConn.ConnectionState()
+	for _, f := range s.hooks.onTLSHandshake {
+		f(conn, state, err)
+	}
+}
+
+// Calls OnClose hooks
+func (s *Server) callCloseHooks(conn *TCPConn, reason CloseReason, err error) {
+	if len(s.hooks.onClose) == 0 {
+		return
+	}
+	info := CloseInfo{
+		Reason:   reason,
+		Err:      err,
+		Duration: time.Duration(time.Now().UnixNano() - conn.ts),
+		Stats:    conn.GetStats(),
+	}
+	for _, f := range s.hooks.onClose {
+		f(conn, info)
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package http1 implements a minimal HTTP/1.1 server as tcpserver request
+// handler for simple high-throughput endpoints.
+//
+//	server.SetRequestHandler(http1.NewHandler(func(resp *http1.Response, req *http1.Request) {
+//		resp.SetContentType("text/plain")
+//		resp.WriteString("Hello World!\r\n")
+//	}, nil))
+//
+// Requests are parsed without allocations into buffers that are reused per
+// connection; pipelined requests are answered in order with their responses
+// sent in batches. Request bodies (with Content-Length or chunked) are read
+// completely before the handler is called, response bodies are sent with
+// Content-Length or streamed chunked (see Response.Flush).
+package http1
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Request errors; the corresponding status is sent before the connection is
+// closed and the error is set on the connection
+var (
+	// 400 Bad Request
+	ErrMalformedRequest = errors.New("http1: malformed request")
+	// 431 Request Header Fields Too Large
+	ErrHeaderTooLarge = errors.New("http1: request header too large")
+	// 413 Payload Too Large
+	ErrBodyTooLarge = errors.New("http1: request body too large")
+	// 501 Not Implemented (unsupported transfer coding)
+	ErrNotImplemented = errors.New("http1: transfer coding not implemented")
+	// 505 HTTP Version Not Supported
+	ErrVersionNotSupported = errors.New("http1: HTTP version not supported")
+)
+
+// Handler function type; req and resp are only valid until it returns
+type HandlerFunc func(resp *Response, req *Request)
+
+// Handler config
+type Config struct {
+	// Maximum size of request line and header fields (defaults to 8 KiB)
+	MaxHeaderSize int
+	// Maximum size of a request body (defaults to 4 MiB)
+	MaxBodySize int
+	// Maximum number of requests per connection (defaults to 0 which means
+	// unlimited)
+	MaxRequestsPerConn int
+	// Timeout for reading a request once its first bytes have been received
+	// (defaults to 30s)
+	ReadTimeout time.Duration
+	// Time a keep-alive connection may wait for the next request (defaults to
+	// 60s)
+	IdleTimeout time.Duration
+	// Close connections after each response
+	DisableKeepAlive bool
+	// Value of the Server header field (defaults to "" which means none)
+	ServerName string
+}
+
+// Output buffer size at which pipelined responses are sent without waiting
+// for further requests
+const flushSize = 64 * 1024
+
+// Buffers larger than this aren't kept in the pool
+const maxPooledBufferSize = 64 * 1024
+
+// Additional input buffer space for chunked encoding overhead
+const chunkedOverhead = 64 * 1024
+
+type handler struct {
+	config Config
+	fn     HandlerFunc
+}
+
+// Connection state
+type conn struct {
+	handler *handler
+	nc      tcpserver.Connection
+	buf     []byte
+	start   int
+	end     int
+	out     []byte
+	body    []byte
+	req     Request
+	resp    Response
+}
+
+var connPool = sync.Pool{
+	New: func() interface{} {
+		return &conn{
+			buf: make([]byte, 4096),
+			out: make([]byte, 0, 4096),
+		}
+	},
+}
+
+// Returns a request handler serving HTTP/1.x requests with fn
+func NewHandler(fn HandlerFunc, config *Config) tcpserver.RequestHandlerFunc {
+	h := &handler{fn: fn}
+	if config != nil {
+		h.config = *config
+	}
+	if h.config.MaxHeaderSize <= 0 {
+		h.config.MaxHeaderSize = 8 * 1024
+	}
+	if h.config.MaxBodySize <= 0 {
+		h.config.MaxBodySize = 4 * 1024 * 1024
+	}
+	if h.config.ReadTimeout <= 0 {
+		h.config.ReadTimeout = 30 * time.Second
+	}
+	if h.config.IdleTimeout <= 0 {
+		h.config.IdleTimeout = 60 * time.Second
+	}
+
+	return func(nc tcpserver.Connection) {
+		c := connPool.Get().(*conn)
+		c.handler, c.nc = h, nc
+		c.start, c.end = 0, 0
+
+		if err := c.serve(); err != nil {
+			nc.SetError(err)
+		}
+
+		c.handler, c.nc, c.req.conn, c.resp.c = nil, nil, nil, nil
+		if len(c.buf) > maxPooledBufferSize {
+			c.buf = make([]byte, 4096)
+		}
+		if cap(c.out) > maxPooledBufferSize {
+			c.out = make([]byte, 0, 4096)
+		}
+		if cap(c.body) > maxPooledBufferSize || cap(c.resp.body) > maxPooledBufferSize {
+			c.body, c.resp.body = nil, nil
+		}
+		connPool.Put(c)
+	}
+}
+
+// Serves requests until the connection is to be closed
+func (c *conn) serve() error {
+	config := &c.handler.config
+	requests := 0
+	chunkedPos := 0
+	continued := false
+
+	for {
+		// the head is parsed again after reading more data as the buffer might
+		// have been moved
+		headLen, err := parseHead(c.buf[c.start:c.end], &c.req)
+		if err == nil && (headLen > config.MaxHeaderSize || (headLen == 0 && c.end-c.start > config.MaxHeaderSize)) {
+			err = ErrHeaderTooLarge
+		}
+		if err != nil {
+			return c.fail(err)
+		}
+		if headLen == 0 {
+			if err = c.fill(); err != nil {
+				return c.fail(err)
+			}
+			continue
+		}
+
+		size := headLen
+		complete := true
+		if c.req.chunked {
+			var n int
+			c.body, n, complete, err = decodeChunked(c.buf[c.start+headLen+chunkedPos:c.end], c.body, config.MaxBodySize)
+			if err != nil {
+				return c.fail(err)
+			}
+			chunkedPos += n
+			c.req.body = c.body
+			size += chunkedPos
+		} else if cl := c.req.contentLength; cl > 0 {
+			if cl > int64(config.MaxBodySize) {
+				return c.fail(ErrBodyTooLarge)
+			}
+			if complete = int64(c.end-c.start-headLen) >= cl; complete {
+				c.req.body = c.buf[c.start+headLen : c.start+headLen+int(cl)]
+				size += int(cl)
+			}
+		}
+		if !complete {
+			if c.req.expect && !continued {
+				continued = true
+				c.out = append(c.out, "HTTP/1.1 100 Continue\r\n\r\n"...)
+			}
+			if err = c.fill(); err != nil {
+				return c.fail(err)
+			}
+			continue
+		}
+
+		requests++
+		if config.DisableKeepAlive || (config.MaxRequestsPerConn > 0 && requests >= config.MaxRequestsPerConn) {
+			c.req.keepAlive = false
+		}
+		c.req.conn = c.nc
+		c.resp.reset(c, &c.req)
+		c.handler.fn(&c.resp, &c.req)
+		if err = c.resp.finish(); err != nil {
+			return err
+		}
+
+		c.start += size
+		if c.start == c.end {
+			c.start, c.end = 0, 0
+		}
+		c.body = c.body[:0]
+		chunkedPos, continued = 0, false
+
+		if c.resp.close {
+			return c.flush()
+		}
+		// pipelined requests are answered in batches
+		if c.start == c.end || len(c.out) >= flushSize {
+			if err = c.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Sends pending responses and reads more data
+func (c *conn) fill() error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	config := &c.handler.config
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	if c.end == len(c.buf) {
+		limit := config.MaxHeaderSize + config.MaxBodySize + chunkedOverhead
+		if len(c.buf) >= limit {
+			return ErrBodyTooLarge
+		}
+		size := 2 * len(c.buf)
+		if size > limit {
+			size = limit
+		}
+		buf := make([]byte, size)
+		copy(buf, c.buf[:c.end])
+		c.buf = buf
+	}
+
+	timeout := config.ReadTimeout
+	if c.end == 0 {
+		timeout = config.IdleTimeout
+	}
+	_ = c.nc.SetReadDeadline(time.Now().Add(timeout))
+	n, err := c.nc.Read(c.buf[c.end:])
+	c.end += n
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return err
+}
+
+// Sends pending responses
+func (c *conn) flush() error {
+	if len(c.out) == 0 {
+		return nil
+	}
+	_, err := c.nc.Write(c.out)
+	c.out = c.out[:0]
+	return err
+}
+
+// Sends pending responses followed by b (without copying b)
+func (c *conn) writeDirect(b []byte) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	_, err := c.nc.Write(b)
+	return err
+}
+
+// Handles an error that ends the connection; sends an error response for
+// request errors and returns the error to be set on the connection (nil if
+// the client closed the connection or was idle for too long)
+func (c *conn) fail(err error) error {
+	status := 0
+	switch err {
+	case ErrMalformedRequest:
+		status = 400
+	case ErrHeaderTooLarge:
+		status = 431
+	case ErrBodyTooLarge:
+		status = 413
+	case ErrNotImplemented:
+		status = 501
+	case ErrVersionNotSupported:
+		status = 505
+	case io.EOF:
+		return nil
+	default:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return err
+		}
+		if c.end == c.start {
+			return nil
+		}
+		status, err = 408, nil
+	}
+
+	c.out = appendStatusLine(c.out, status)
+	c.out = append(c.out, "Content-Length: 0\r\nConnection: close\r\n\r\n"...)
+	if ferr := c.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
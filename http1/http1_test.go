@@ -0,0 +1,223 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package http1_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/http1"
+)
+
+// Answers with "<method> <path> <body>"
+func echoRequest(resp *http1.Response, req *http1.Request) {
+	resp.SetContentType("text/plain")
+	_, _ = resp.Write(req.GetMethod())
+	_, _ = resp.WriteString(" ")
+	_, _ = resp.Write(req.GetPath())
+	_, _ = resp.WriteString(" ")
+	_, _ = resp.Write(req.GetBody())
+}
+
+// Starts a server answering with echoRequest; returns its address
+func startServer(t *testing.T, config *http1.Config) string {
+	t.Helper()
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetRequestHandler(http1.NewHandler(echoRequest, config))
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	})
+	return s.GetListenAddr().String()
+}
+
+// Reads responses until the connection is closed; returns them as
+// "<status> <body>"
+func readResponses(t *testing.T, conn net.Conn) []string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+	var responses []string
+	for {
+		resp, err := http.ReadResponse(rd, nil)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatal(err)
+			}
+			return responses
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, strconv.Itoa(resp.StatusCode)+" "+string(body))
+	}
+}
+
+func TestRequests(t *testing.T) {
+	get := "GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+	post := "POST /p HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	tests := []struct {
+		name   string
+		config *http1.Config
+		input  string
+		// keep the connection open after sending input (the server closes it)
+		keepOpen bool
+		expected []string
+	}{
+		{"get", nil, get, false, []string{"200 GET / "}},
+		{"http/1.0", nil, "GET /x HTTP/1.0\r\n\r\n", false, []string{"200 GET /x "}},
+		{"empty lines before request", nil, "\r\n\r\n" + get, false, []string{"200 GET / "}},
+		{"content-length", nil, "POST /p HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello", false, []string{"200 POST /p hello"}},
+		{"pipelined", nil, get + "POST /p HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\nhi" + post + "2\r\nho\r\n0\r\n\r\n" + "GET /c HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n" + get,
+			false, []string{"200 GET / ", "200 POST /p hi", "200 POST /p ho", "200 GET /c "}},
+		{"pipelined with error", nil, get + "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n" + get, false, []string{"200 GET / ", "400 "}},
+
+		// request smuggling vectors
+		{"content-length and transfer-encoding", nil, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"transfer-encoding and content-length", nil, "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"different content-lengths", nil, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", false, []string{"400 "}},
+		{"invalid content-length", nil, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello", false, []string{"400 "}},
+		{"duplicate host", nil, "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", false, []string{"400 "}},
+		{"missing host", nil, "GET / HTTP/1.1\r\n\r\n", false, []string{"400 "}},
+		{"space before colon", nil, "GET / HTTP/1.1\r\nHost : a\r\n\r\n", false, []string{"400 "}},
+		{"obsolete line folding", nil, "GET / HTTP/1.1\r\nHost: a\r\nX: b\r\n c\r\n\r\n", false, []string{"400 "}},
+		{"bare CR", nil, "GET / HTTP/1.1\r\nHost: a\rX: b\r\n\r\n", false, []string{"400 "}},
+		{"bare LF", nil, "GET / HTTP/1.1\nHost: a\n\n", false, []string{"400 "}},
+		{"bare LF in header", nil, "POST / HTTP/1.1\r\nHost: a\r\nX: b\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"bare LF before request", nil, "\n" + get, false, []string{"400 "}},
+
+		// chunked bodies
+		{"chunked", nil, post + "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", false, []string{"200 POST /p hello world"}},
+		{"chunked upper case size", nil, post + "A\r\n0123456789\r\n0\r\n\r\n", false, []string{"200 POST /p 0123456789"}},
+		{"chunked extensions", nil, post + "5;a=b\r\nhello\r\n5 ; c\r\nworld\r\n0;d\r\n\r\n", false, []string{"200 POST /p helloworld"}},
+		{"chunked trailers", nil, post + "5\r\nhello\r\n0\r\nX-Checksum: 1\r\nX-Other: 2\r\n\r\n" + get, false, []string{"200 POST /p hello", "200 GET / "}},
+		{"chunked trailer without colon", nil, post + "5\r\nhello\r\n0\r\nX-Checksum\r\n\r\n", false, []string{"400 "}},
+		{"chunked folded trailer", nil, post + "5\r\nhello\r\n0\r\nX: 1\r\n 2\r\n\r\n", false, []string{"400 "}},
+		{"chunked bare LF after size", nil, post + "5\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked bare LF after data", nil, post + "5\r\nhello\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked bare LF after last chunk", nil, post + "5\r\nhello\r\n0\n\r\n", false, []string{"400 "}},
+		{"chunked bare LF in trailer", nil, post + "5\r\nhello\r\n0\r\nX: 1\n\r\n", false, []string{"400 "}},
+		{"chunked bare LF at end", nil, post + "5\r\nhello\r\n0\r\n\n", false, []string{"400 "}},
+		{"chunked missing CRLF after data", nil, post + "5\r\nhelloX\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked space before size", nil, post + " 5\r\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked space after size", nil, post + "5 \r\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked tab after size", nil, post + "5\t\r\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked space before extension", nil, post + " 5;a\r\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked hex prefix", nil, post + "0x5\r\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked negative size", nil, post + "-5\r\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked empty size", nil, post + "\r\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+		{"chunked size overflow", nil, post + "10000000000000005\r\nhello\r\n0\r\n\r\n", false, []string{"400 "}},
+
+		// error statuses
+		{"408 request timeout", &http1.Config{ReadTimeout: 50 * time.Millisecond}, "GET / HTTP/1.1\r\nHost", true, []string{"408 "}},
+		{"idle timeout", &http1.Config{IdleTimeout: 50 * time.Millisecond}, get, true, []string{"200 GET / "}},
+		{"413 content-length", &http1.Config{MaxBodySize: 4}, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello", false, []string{"413 "}},
+		{"413 chunked", &http1.Config{MaxBodySize: 8}, post + "5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n", false, []string{"413 "}},
+		{"431 header size", &http1.Config{MaxHeaderSize: 64}, "GET / HTTP/1.1\r\nHost: a\r\nX: " + strings.Repeat("x", 64) + "\r\n\r\n", false, []string{"431 "}},
+		{"431 incomplete header", &http1.Config{MaxHeaderSize: 64}, "GET / HTTP/1.1\r\nHost: a\r\nX: " + strings.Repeat("x", 64), true, []string{"431 "}},
+		{"431 header count", nil, "GET / HTTP/1.1\r\nHost: a\r\n" + strings.Repeat("X: x\r\n", 128) + "\r\n", false, []string{"431 "}},
+		{"501 transfer coding", nil, "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", false, []string{"501 "}},
+		{"501 duplicate transfer-encoding", nil, "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false, []string{"501 "}},
+		{"505 version", nil, "GET / HTTP/2.0\r\nHost: a\r\n\r\n", false, []string{"505 "}},
+		{"400 invalid version", nil, "GET / HTTP/1.1.1\r\nHost: a\r\n\r\n", false, []string{"400 "}},
+		{"400 invalid method", nil, "G(T / HTTP/1.1\r\nHost: a\r\n\r\n", false, []string{"400 "}},
+		{"400 missing target", nil, "GET HTTP/1.1\r\nHost: a\r\n\r\n", false, []string{"400 "}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", startServer(t, tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err = conn.Write([]byte(tt.input)); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.keepOpen {
+				_ = conn.(*net.TCPConn).CloseWrite()
+			}
+
+			responses := readResponses(t, conn)
+			if strings.Join(responses, "|") != strings.Join(tt.expected, "|") {
+				t.Errorf("expected responses %q, got %q", tt.expected, responses)
+			}
+		})
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	conn, err := net.Dial("tcp", startServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rd := bufio.NewReader(conn)
+
+	// the interim response is only sent once the head has been read and the
+	// body is still missing
+	if _, err = conn.Write([]byte("POST /p HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(rd, nil)
+	if err != nil || resp.StatusCode != 100 {
+		t.Fatalf("expected 100 Continue, got %v (%v)", resp, err)
+	}
+
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != 200 || string(body) != "POST /p hello" {
+		t.Fatalf("expected 200 with echo, got %d %q (%v)", resp.StatusCode, body, err)
+	}
+
+	// no interim response if the body has been sent along with the head or
+	// for HTTP/1.0 clients
+	requests := "POST /p HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhi" +
+		"POST /p HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\n"
+	if _, err = conn.Write([]byte(requests)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err = conn.Write([]byte("ho")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"200 POST /p hi", "200 POST /p ho"} {
+		resp, err = http.ReadResponse(rd, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		if got := strconv.Itoa(resp.StatusCode) + " " + string(body); got != expected {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+}
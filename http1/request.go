@@ -0,0 +1,405 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package http1
+
+import (
+	"bytes"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Maximum number of header fields per request
+const maxHeaders = 128
+
+// HTTP request; all returned byte slices point into the connection's buffer
+// and are only valid until the handler returns
+type Request struct {
+	method        []byte
+	uri           []byte
+	path          []byte
+	query         []byte
+	proto         []byte
+	headers       []header
+	body          []byte
+	contentLength int64
+	chunked       bool
+	keepAlive     bool
+	http11        bool
+	head          bool
+	expect        bool
+	conn          tcpserver.Connection
+}
+
+type header struct {
+	name  []byte
+	value []byte
+}
+
+// Returns request method (e.g. "GET")
+func (r *Request) GetMethod() []byte {
+	return r.method
+}
+
+// Returns request target as sent by the client (path and query)
+func (r *Request) GetURI() []byte {
+	return r.uri
+}
+
+// Returns path of the request target (without query)
+func (r *Request) GetPath() []byte {
+	return r.path
+}
+
+// Returns query of the request target (without "?")
+func (r *Request) GetQuery() []byte {
+	return r.query
+}
+
+// Returns protocol version ("HTTP/1.1" or "HTTP/1.0")
+func (r *Request) GetProto() []byte {
+	return r.proto
+}
+
+// Returns value of the first header field with the given name (case
+// insensitive) or nil if there is none
+func (r *Request) GetHeader(name string) []byte {
+	for i := range r.headers {
+		if equalFold(r.headers[i].name, name) {
+			return r.headers[i].value
+		}
+	}
+	return nil
+}
+
+// Calls f for each header field in the order received
+func (r *Request) VisitHeaders(f func(name, value []byte)) {
+	for i := range r.headers {
+		f(r.headers[i].name, r.headers[i].value)
+	}
+}
+
+// Returns request body (decoded if sent chunked)
+func (r *Request) GetBody() []byte {
+	return r.body
+}
+
+// Returns Content-Length of the request (-1 if the body has been sent
+// chunked)
+func (r *Request) GetContentLength() int64 {
+	if r.chunked {
+		return -1
+	}
+	return r.contentLength
+}
+
+// Returns whether the connection is kept alive after this request
+func (r *Request) IsKeepAlive() bool {
+	return r.keepAlive
+}
+
+// Returns the underlying connection
+func (r *Request) GetConn() tcpserver.Connection {
+	return r.conn
+}
+
+// Resets request for parsing
+func (r *Request) reset() {
+	r.method, r.uri, r.path, r.query, r.proto, r.body = nil, nil, nil, nil, nil, nil
+	r.headers = r.headers[:0]
+	r.contentLength = 0
+	r.chunked, r.keepAlive, r.http11, r.head, r.expect = false, false, false, false, false
+}
+
+// Parses the request line and header fields from b; returns the length of
+// the head (0 if b doesn't contain a complete head yet)
+func parseHead(b []byte, r *Request) (int, error) {
+	r.reset()
+
+	// ignore empty lines before the request line (RFC 7230, 3.5)
+	i := 0
+	for i+1 < len(b) && b[i] == '\r' && b[i+1] == '\n' {
+		i += 2
+	}
+
+	line, next, ok, err := nextLine(b, i)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if hasInvalidChars(line) {
+		return 0, ErrMalformedRequest
+	}
+
+	sp := bytes.IndexByte(line, ' ')
+	if sp <= 0 || !isToken(line[:sp]) {
+		return 0, ErrMalformedRequest
+	}
+	r.method = line[:sp]
+	line = line[sp+1:]
+	if sp = bytes.IndexByte(line, ' '); sp <= 0 {
+		return 0, ErrMalformedRequest
+	}
+	r.uri = line[:sp]
+	r.proto = line[sp+1:]
+	for _, c := range r.uri {
+		if c <= ' ' || c == 0x7f {
+			return 0, ErrMalformedRequest
+		}
+	}
+
+	switch string(r.proto) {
+	case "HTTP/1.1":
+		r.http11, r.keepAlive = true, true
+	case "HTTP/1.0":
+	default:
+		if len(r.proto) == 8 && string(r.proto[:5]) == "HTTP/" && isDigit(r.proto[5]) && r.proto[6] == '.' && isDigit(r.proto[7]) {
+			return 0, ErrVersionNotSupported
+		}
+		return 0, ErrMalformedRequest
+	}
+
+	r.path = r.uri
+	if q := bytes.IndexByte(r.uri, '?'); q >= 0 {
+		r.path, r.query = r.uri[:q], r.uri[q+1:]
+	}
+	r.head = string(r.method) == "HEAD"
+
+	hosts := 0
+	hasContentLength := false
+	for {
+		if line, next, ok, err = nextLine(b, next); err != nil || !ok {
+			return 0, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' || hasInvalidChars(line) {
+			// obsolete line folding (RFC 7230, 3.2.4) or invalid characters
+			return 0, ErrMalformedRequest
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || !isToken(line[:colon]) {
+			return 0, ErrMalformedRequest
+		}
+		if len(r.headers) == maxHeaders {
+			return 0, ErrHeaderTooLarge
+		}
+		name, value := line[:colon], trimSpace(line[colon+1:])
+		r.headers = append(r.headers, header{name: name, value: value})
+
+		switch {
+		case equalFold(name, "Host"):
+			hosts++
+		case equalFold(name, "Content-Length"):
+			n, ok := parseUint(value)
+			if !ok || (hasContentLength && n != r.contentLength) {
+				return 0, ErrMalformedRequest
+			}
+			r.contentLength, hasContentLength = n, true
+		case equalFold(name, "Transfer-Encoding"):
+			// only "chunked" is supported (RFC 7230, 3.3.1)
+			if !equalFold(value, "chunked") || r.chunked {
+				return 0, ErrNotImplemented
+			}
+			r.chunked = true
+		case equalFold(name, "Connection"):
+			for v := value; len(v) > 0; {
+				token := v
+				if comma := bytes.IndexByte(v, ','); comma >= 0 {
+					token, v = v[:comma], v[comma+1:]
+				} else {
+					v = nil
+				}
+				token = trimSpace(token)
+				if equalFold(token, "close") {
+					r.keepAlive = false
+				} else if equalFold(token, "keep-alive") && !r.http11 {
+					r.keepAlive = true
+				}
+			}
+		case equalFold(name, "Expect"):
+			r.expect = r.http11 && equalFold(value, "100-continue")
+		}
+	}
+
+	if (r.http11 && hosts == 0) || hosts > 1 || (r.chunked && hasContentLength) {
+		return 0, ErrMalformedRequest
+	}
+	return next, nil
+}
+
+// Decodes a chunked body from b appending the data to dst; returns dst, the
+// number of bytes of complete chunks consumed and whether the last chunk
+// (and trailer section) has been read
+func decodeChunked(b, dst []byte, maxSize int) ([]byte, int, bool, error) {
+	i := 0
+	for {
+		line, next, ok, err := nextLine(b, i)
+		if err != nil || !ok {
+			return dst, i, false, err
+		}
+		if semi := bytes.IndexByte(line, ';'); semi >= 0 {
+			// chunk extensions are ignored; whitespace is only allowed
+			// before them (RFC 7230, 4.1.1 and errata)
+			line = line[:semi]
+			for len(line) > 0 && (line[len(line)-1] == ' ' || line[len(line)-1] == '\t') {
+				line = line[:len(line)-1]
+			}
+		}
+		size, ok := parseHex(line)
+		if !ok {
+			return dst, i, false, ErrMalformedRequest
+		}
+
+		if size == 0 {
+			// trailer section; the fields are validated but ignored
+			for {
+				if line, next, ok, err = nextLine(b, next); err != nil || !ok {
+					return dst, i, false, err
+				}
+				if len(line) == 0 {
+					return dst, next, true, nil
+				}
+				colon := bytes.IndexByte(line, ':')
+				if colon <= 0 || !isToken(line[:colon]) || hasInvalidChars(line) {
+					return dst, i, false, ErrMalformedRequest
+				}
+			}
+		}
+
+		if size > int64(maxSize-len(dst)) {
+			return dst, i, false, ErrBodyTooLarge
+		}
+		end := next + int(size)
+		if (end < len(b) && b[end] != '\r') || (end+1 < len(b) && b[end+1] != '\n') {
+			return dst, i, false, ErrMalformedRequest
+		}
+		if end+1 >= len(b) {
+			return dst, i, false, nil
+		}
+		dst = append(dst, b[next:end]...)
+		i = end + 2
+	}
+}
+
+// Returns the line starting at b[i] (without CRLF) and the index of the next
+// line; ok is false if the line isn't complete. Lines terminated by a bare LF
+// are rejected as intermediaries might split them differently (request
+// smuggling).
+func nextLine(b []byte, i int) (line []byte, next int, ok bool, err error) {
+	j := bytes.IndexByte(b[i:], '\n')
+	if j < 0 {
+		return nil, 0, false, nil
+	}
+	if j == 0 || b[i+j-1] != '\r' {
+		return nil, 0, false, ErrMalformedRequest
+	}
+	return b[i : i+j-1], i + j + 1, true, nil
+}
+
+// Returns whether line contains a CR or NUL (not allowed in the request line
+// and header fields)
+func hasInvalidChars(line []byte) bool {
+	for _, c := range line {
+		if c == '\r' || c == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether b is a non-empty token (RFC 7230, 3.2.6)
+func isToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if !tokenChars[c] {
+			return false
+		}
+	}
+	return true
+}
+
+var tokenChars = func() (t [256]bool) {
+	for c := '0'; c <= '9'; c++ {
+		t[c] = true
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		t[c] = true
+		t[c-'a'+'A'] = true
+	}
+	for _, c := range "!#$%&'*+-.^_`|~" {
+		t[c] = true
+	}
+	return
+}()
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Parses a decimal number consisting of digits only
+func parseUint(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		if !isDigit(c) {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	return n, true
+}
+
+// Parses a hexadecimal number
+func parseHex(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 15 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c -= 'a' - 10
+		case c >= 'A' && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | int64(c)
+	}
+	return n, true
+}
+
+// Trims spaces and tabs
+func trimSpace(b []byte) []byte {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+		b = b[1:]
+	}
+	for len(b) > 0 && (b[len(b)-1] == ' ' || b[len(b)-1] == '\t') {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// Compares b and s case insensitively (ASCII only)
+func equalFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		c, d := b[i], s[i]
+		if c == d {
+			continue
+		}
+		if c|0x20 != d|0x20 || c|0x20 < 'a' || c|0x20 > 'z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,238 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package http1
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Bodies of at least this size are written directly instead of being copied
+// to the output buffer
+const directWriteSize = 16 * 1024
+
+// HTTP response; the body is buffered and sent with Content-Length once the
+// handler returns unless Flush is called (which streams the body chunked)
+type Response struct {
+	c         *conn
+	req       *Request
+	status    int
+	header    []byte
+	body      []byte
+	close     bool
+	streaming bool
+	chunked   bool
+}
+
+// Sets status code (defaults to 200)
+func (r *Response) SetStatus(code int) {
+	r.status = code
+}
+
+// Returns status code
+func (r *Response) GetStatus() int {
+	return r.status
+}
+
+// Adds a header field; Content-Length, Transfer-Encoding, Connection, Date
+// and Server are set automatically. Fields containing CR or LF are dropped.
+func (r *Response) AddHeader(name, value string) {
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\r' || name[i] == '\n' {
+			return
+		}
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\r' || value[i] == '\n' {
+			return
+		}
+	}
+	r.header = append(r.header, name...)
+	r.header = append(r.header, ": "...)
+	r.header = append(r.header, value...)
+	r.header = append(r.header, "\r\n"...)
+}
+
+// Sets Content-Type header field
+func (r *Response) SetContentType(value string) {
+	r.AddHeader("Content-Type", value)
+}
+
+// Closes the connection after the response has been sent
+func (r *Response) SetConnectionClose() {
+	r.close = true
+}
+
+// Appends p to the response body
+func (r *Response) Write(p []byte) (int, error) {
+	r.body = append(r.body, p...)
+	return len(p), nil
+}
+
+// Appends s to the response body
+func (r *Response) WriteString(s string) (int, error) {
+	r.body = append(r.body, s...)
+	return len(s), nil
+}
+
+// Sends the response head (on first call) and the body written so far; the
+// body is sent chunked (or until the connection is closed for HTTP/1.0
+// clients). Header fields and status can't be changed afterwards.
+func (r *Response) Flush() error {
+	c := r.c
+	if !r.streaming {
+		r.streaming = true
+		r.chunked = r.req.http11
+		if !r.chunked {
+			r.close = true
+		}
+		c.out = r.appendHead(c.out, -1)
+	}
+	if len(r.body) > 0 && !r.req.head && bodyAllowed(r.status) {
+		if r.chunked {
+			c.out = strconv.AppendInt(c.out, int64(len(r.body)), 16)
+			c.out = append(c.out, "\r\n"...)
+			c.out = append(c.out, r.body...)
+			c.out = append(c.out, "\r\n"...)
+		} else {
+			c.out = append(c.out, r.body...)
+		}
+	}
+	r.body = r.body[:0]
+	return c.flush()
+}
+
+// Resets response for the next request
+func (r *Response) reset(c *conn, req *Request) {
+	r.c, r.req = c, req
+	r.status = http.StatusOK
+	r.header = r.header[:0]
+	r.body = r.body[:0]
+	r.close = !req.keepAlive
+	r.streaming, r.chunked = false, false
+}
+
+// Appends the response to the connection's output buffer (or writes it)
+func (r *Response) finish() error {
+	c := r.c
+	if r.streaming {
+		if len(r.body) > 0 {
+			if err := r.Flush(); err != nil {
+				return err
+			}
+		}
+		if r.chunked {
+			c.out = append(c.out, "0\r\n\r\n"...)
+		}
+		return nil
+	}
+
+	c.out = r.appendHead(c.out, len(r.body))
+	if r.req.head || !bodyAllowed(r.status) || len(r.body) == 0 {
+		return nil
+	}
+	if len(r.body) >= directWriteSize {
+		return c.writeDirect(r.body)
+	}
+	c.out = append(c.out, r.body...)
+	return nil
+}
+
+// Appends status line and header fields; contentLength < 0 means streaming
+func (r *Response) appendHead(b []byte, contentLength int) []byte {
+	b = appendStatusLine(b, r.status)
+	if name := r.c.handler.config.ServerName; name != "" {
+		b = append(b, "Server: "...)
+		b = append(b, name...)
+		b = append(b, "\r\n"...)
+	}
+	b = append(b, "Date: "...)
+	b = appendDate(b)
+	b = append(b, "\r\n"...)
+	b = append(b, r.header...)
+
+	if bodyAllowed(r.status) {
+		if contentLength >= 0 {
+			b = append(b, "Content-Length: "...)
+			b = strconv.AppendInt(b, int64(contentLength), 10)
+			b = append(b, "\r\n"...)
+		} else if r.chunked {
+			b = append(b, "Transfer-Encoding: chunked\r\n"...)
+		}
+	}
+	if r.close {
+		b = append(b, "Connection: close\r\n"...)
+	} else if !r.req.http11 {
+		b = append(b, "Connection: keep-alive\r\n"...)
+	}
+	return append(b, "\r\n"...)
+}
+
+// Returns whether responses with the given status may have a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// Status lines of known status codes
+var statusLines = func() (lines [600][]byte) {
+	for code := range lines {
+		if text := http.StatusText(code); text != "" {
+			lines[code] = []byte("HTTP/1.1 " + strconv.Itoa(code) + " " + text + "\r\n")
+		}
+	}
+	return
+}()
+
+// Appends status line
+func appendStatusLine(b []byte, status int) []byte {
+	if status >= 0 && status < len(statusLines) && statusLines[status] != nil {
+		return append(b, statusLines[status]...)
+	}
+	b = append(b, "HTTP/1.1 "...)
+	b = strconv.AppendInt(b, int64(status), 10)
+	return append(b, " Unknown\r\n"...)
+}
+
+// Formatted Date header value of a second
+type date struct {
+	unix  int64
+	value []byte
+}
+
+var currentDate atomic.Value
+
+// Appends current date in HTTP format (formatted once per second)
+func appendDate(b []byte) []byte {
+	now := time.Now()
+	d, _ := currentDate.Load().(*date)
+	if d == nil || d.unix != now.Unix() {
+		d = &date{unix: now.Unix(), value: appendTime(nil, now)}
+		currentDate.Store(d)
+	}
+	return append(b, d.value...)
+}
+
+// Appends t in HTTP date format (RFC 7231, 7.1.1.1)
+func appendTime(b []byte, t time.Time) []byte {
+	const days = "SunMonTueWedThuFriSat"
+	const months = "JanFebMarAprMayJunJulAugSepOctNovDec"
+
+	t = t.UTC()
+	yy, mm, dd := t.Date()
+	hh, mn, ss := t.Clock()
+	day := days[3*t.Weekday():]
+	mon := months[3*(mm-1):]
+
+	return append(b,
+		day[0], day[1], day[2], ',', ' ',
+		byte('0'+dd/10), byte('0'+dd%10), ' ',
+		mon[0], mon[1], mon[2], ' ',
+		byte('0'+yy/1000), byte('0'+(yy/100)%10), byte('0'+(yy/10)%10), byte('0'+yy%10), ' ',
+		byte('0'+hh/10), byte('0'+hh%10), ':',
+		byte('0'+mn/10), byte('0'+mn%10), ':',
+		byte('0'+ss/10), byte('0'+ss%10), ' ',
+		'G', 'M', 'T')
+}
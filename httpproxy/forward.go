@@ -0,0 +1,99 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Hop-by-hop headers removed from forwarded requests and responses
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Forwards a plain HTTP request with absolute URI; returns whether the client
+// connection can be kept alive
+func (h *handler) forward(ctx context.Context, conn tcpserver.Connection, req *http.Request) (keepAlive bool, err error) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		_ = writeStatus(conn, http.StatusBadRequest, "")
+		return false, nil
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	if !h.allowed(addr) {
+		_ = writeStatus(conn, http.StatusForbidden, "")
+		return false, ErrNotAllowed
+	}
+
+	upstream, err := h.dial(ctx, addr)
+	if err != nil {
+		_ = writeStatus(conn, statusForError(err), "")
+		return false, err
+	}
+	defer upstream.Close()
+
+	clientClose := req.Close
+	removeHopHeaders(req.Header)
+	req.Close = true
+	if h.config.Upstream != nil {
+		if h.upstreamAuth != "" {
+			req.Header.Set("Proxy-Authorization", h.upstreamAuth)
+		}
+		err = req.WriteProxy(upstream)
+	} else {
+		err = req.Write(upstream)
+	}
+	if err != nil {
+		_ = writeStatus(conn, http.StatusBadGateway, "")
+		return false, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(upstream), req)
+	if err != nil {
+		_ = writeStatus(conn, http.StatusBadGateway, "")
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	// without length or chunked encoding the body ends when the connection is
+	// closed
+	untilClose := resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && resp.Body != http.NoBody
+	resp.Close = clientClose || untilClose
+	if err = resp.Write(conn); err != nil {
+		return false, err
+	}
+	return !resp.Close, nil
+}
+
+// Removes hop-by-hop headers (including the ones listed in Connection)
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
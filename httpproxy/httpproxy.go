@@ -0,0 +1,339 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package httpproxy implements an HTTP/1.1 forward proxy as tcpserver request
+// handler. CONNECT requests are tunneled using tcpserver.Proxy (zero-copy on
+// Linux); forwarding plain HTTP requests with absolute URIs is optional.
+//
+//	handler, err := httpproxy.NewHandler(&httpproxy.Config{
+//		Credentials:  httpproxy.StaticCredentials{"user": "secret"},
+//		AllowedHosts: []string{"*.example.com", "10.0.0.0/8"},
+//		AllowedPorts: []int{443},
+//	})
+//	server.SetRequestHandler(handler)
+//
+// Requests can be chained through an upstream HTTP proxy (Config.Upstream).
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Returned by the handler if the client sent invalid credentials
+var ErrAuthFailed = errors.New("httpproxy: authentication failed")
+
+// Returned by the handler if the destination isn't allowed
+var ErrNotAllowed = errors.New("httpproxy: destination not allowed")
+
+// Returned by the handler if the request header exceeds MaxHeaderBytes
+var ErrHeaderTooLarge = errors.New("httpproxy: request header too large")
+
+// Dialer function type
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Upstream proxy config
+type UpstreamProxy struct {
+	// Address (host:port)
+	Addr string
+	// Credentials sent to the upstream proxy (optional)
+	Username string
+	Password string
+}
+
+// Handler config
+type Config struct {
+	// Credentials for Proxy-Authorization (Basic); if nil, no authentication
+	// is required
+	Credentials CredentialStore
+	// Realm sent in Proxy-Authenticate (defaults to "proxy")
+	Realm string
+	// Allowed destination hosts: host names ("*.example.com" matches all
+	// subdomains of example.com), IPs and networks in CIDR notation (only
+	// match destinations given as IP); empty means all hosts are allowed
+	AllowedHosts []string
+	// Allowed destination ports; empty means all ports are allowed
+	AllowedPorts []int
+	// Forward plain HTTP requests with absolute URIs (otherwise only CONNECT
+	// is supported)
+	ForwardHTTP bool
+	// Upstream proxy all requests are sent through (defaults to nil which
+	// means destinations are connected directly)
+	Upstream *UpstreamProxy
+	// Function used to connect to destinations or the upstream proxy
+	// (defaults to net.Dialer.DialContext); zero-copy requires *net.TCPConn
+	// connections
+	Dialer DialerFunc
+	// Timeout for reading a request header; also limits the time keep-alive
+	// connections may be idle (defaults to 10s)
+	HeaderTimeout time.Duration
+	// Timeout for connecting to destinations (including the upstream proxy
+	// handshake; defaults to 10s)
+	ConnectTimeout time.Duration
+	// Time without data being transferred in either direction after which
+	// CONNECT tunnels are closed (defaults to 0 which means no timeout)
+	IdleTimeout time.Duration
+	// Maximum size of a request header (defaults to 1 MiB)
+	MaxHeaderBytes int
+}
+
+// Validates username/password credentials
+type CredentialStore interface {
+	// Returns whether the credentials are valid
+	Valid(username, password string) bool
+}
+
+// Credentials as map of usernames to passwords
+type StaticCredentials map[string]string
+
+// Returns whether the credentials are valid
+func (s StaticCredentials) Valid(username, password string) bool {
+	pw, ok := s[username]
+	return ok && subtle.ConstantTimeCompare([]byte(pw), []byte(password)) == 1
+}
+
+type handler struct {
+	config       Config
+	allowedHosts []string
+	allowedNets  []*net.IPNet
+	upstreamAuth string
+}
+
+// Returns a request handler acting as HTTP forward proxy. Errors (e.g.
+// invalid credentials, denied destinations or failed connection attempts)
+// are set on the connection (see tcpserver.Connection.SetError).
+func NewHandler(config *Config) (tcpserver.RequestHandlerFunc, error) {
+	h := &handler{}
+	if config != nil {
+		h.config = *config
+	}
+	if h.config.Realm == "" {
+		h.config.Realm = "proxy"
+	}
+	if h.config.Dialer == nil {
+		h.config.Dialer = (&net.Dialer{}).DialContext
+	}
+	if h.config.HeaderTimeout <= 0 {
+		h.config.HeaderTimeout = 10 * time.Second
+	}
+	if h.config.ConnectTimeout <= 0 {
+		h.config.ConnectTimeout = 10 * time.Second
+	}
+	if h.config.MaxHeaderBytes <= 0 {
+		h.config.MaxHeaderBytes = 1 << 20
+	}
+
+	for _, host := range h.config.AllowedHosts {
+		if strings.Contains(host, "/") {
+			_, ipNet, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network '%s': %s", host, err)
+			}
+			h.allowedNets = append(h.allowedNets, ipNet)
+		} else if ip := net.ParseIP(host); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			h.allowedNets = append(h.allowedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			h.allowedHosts = append(h.allowedHosts, strings.ToLower(host))
+		}
+	}
+
+	if up := h.config.Upstream; up != nil {
+		if _, _, err := net.SplitHostPort(up.Addr); err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy address '%s': %s", up.Addr, err)
+		}
+		if up.Username != "" {
+			h.upstreamAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(up.Username+":"+up.Password))
+		}
+	}
+
+	return func(conn tcpserver.Connection) {
+		if err := h.serve(conn); err != nil {
+			conn.SetError(err)
+		}
+	}, nil
+}
+
+// Serves requests until the connection is closed or turned into a tunnel
+func (h *handler) serve(conn tcpserver.Connection) error {
+	ctx := context.Background()
+	if c := conn.GetContext(); c != nil {
+		ctx = *c
+	}
+
+	lr := &headerLimiter{r: conn}
+	br := bufio.NewReader(lr)
+	for {
+		lr.n = int64(h.config.MaxHeaderBytes)
+		_ = conn.SetReadDeadline(time.Now().Add(h.config.HeaderTimeout))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if lr.n == 0 {
+				_ = writeStatus(conn, http.StatusRequestHeaderFieldsTooLarge, "")
+				return ErrHeaderTooLarge
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil
+			}
+			_ = writeStatus(conn, http.StatusBadRequest, "")
+			return err
+		}
+		lr.n = -1
+		_ = conn.SetReadDeadline(time.Time{})
+
+		if ok, provided := h.authorize(req); !ok {
+			_ = writeStatus(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm="+strconv.Quote(h.config.Realm)+"\r\n")
+			if provided {
+				return ErrAuthFailed
+			}
+			return nil
+		}
+
+		if req.Method == http.MethodConnect {
+			return h.connect(ctx, conn, br, req)
+		}
+		if !h.config.ForwardHTTP {
+			_ = writeStatus(conn, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+			return nil
+		}
+		if keepAlive, err := h.forward(ctx, conn, req); err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+// Checks Proxy-Authorization; returns whether the request is authorized and
+// whether credentials have been provided
+func (h *handler) authorize(req *http.Request) (ok bool, provided bool) {
+	if h.config.Credentials == nil {
+		return true, false
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return false, false
+	}
+	const prefix = "basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false, true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false, true
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return false, true
+	}
+	return h.config.Credentials.Valid(username, password), true
+}
+
+// Returns whether the destination (host:port) is allowed
+func (h *handler) allowed(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if len(h.config.AllowedPorts) > 0 {
+		p, err := strconv.Atoi(port)
+		if err != nil || !containsPort(h.config.AllowedPorts, p) {
+			return false
+		}
+	}
+
+	if len(h.config.AllowedHosts) == 0 {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range h.allowedNets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range h.allowedHosts {
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+		} else if p == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Connects to addr (directly, or to the upstream proxy if configured)
+func (h *handler) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if h.config.Upstream != nil {
+		addr = h.config.Upstream.Addr
+	}
+	dctx, cancel := context.WithTimeout(ctx, h.config.ConnectTimeout)
+	defer cancel()
+	return h.config.Dialer(dctx, "tcp", addr)
+}
+
+// Writes a response without body and closes the connection afterwards
+func writeStatus(w io.Writer, code int, header string) error {
+	_, err := io.WriteString(w, "HTTP/1.1 "+strconv.Itoa(code)+" "+http.StatusText(code)+"\r\n"+
+		header+"Content-Length: 0\r\nConnection: close\r\n\r\n")
+	return err
+}
+
+// Returns the response status for a failed connection attempt
+func statusForError(err error) int {
+	if ne, ok := err.(net.Error); (ok && ne.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func containsPort(list []int, port int) bool {
+	for _, v := range list {
+		if v == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Reader limiting the number of bytes read for a request header; n < 0 means
+// unlimited
+type headerLimiter struct {
+	r io.Reader
+	n int64
+}
+
+func (l *headerLimiter) Read(p []byte) (int, error) {
+	if l.n == 0 {
+		return 0, ErrHeaderTooLarge
+	}
+	if l.n > 0 && int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	if l.n > 0 {
+		l.n -= int64(n)
+	}
+	return n, err
+}
@@ -0,0 +1,383 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package httpproxy_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/httpproxy"
+)
+
+// Starts a TCP echo server on 127.0.0.1; returns its address
+func startEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return l.Addr().String()
+}
+
+// Starts an HTTP server answering every request with response; the requests
+// are sent to the returned channel
+func startHTTPUpstream(t *testing.T, response string) (string, chan *http.Request) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *http.Request, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				requests <- req
+				_, _ = io.WriteString(conn, response)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return l.Addr().String(), requests
+}
+
+// Starts a proxy server with the given config; returns its address
+func startProxy(t *testing.T, config *httpproxy.Config) string {
+	t.Helper()
+	handler, err := httpproxy.NewHandler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetRequestHandler(handler)
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	})
+	return s.GetListenAddr().String()
+}
+
+// Connects to the proxy
+func dial(t *testing.T, proxyAddr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// Sends a CONNECT request for addr (followed by early data); returns the
+// response and a reader for the tunnel
+func connect(t *testing.T, proxyAddr, addr, header, early string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	conn := dial(t, proxyAddr)
+	if _, err := io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n"+header+"\r\n"+early); err != nil {
+		t.Fatal(err)
+	}
+	rd := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rd, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		// the tunnel must work in both directions
+		if _, err = io.WriteString(conn, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(early)+4)
+		if _, err = io.ReadFull(rd, buf); err != nil || string(buf) != early+"ping" {
+			t.Fatalf("expected echo, got %q (%v)", buf, err)
+		}
+	}
+	return resp, rd
+}
+
+// Returns a Proxy-Authorization header line
+func basicAuth(username, password string) string {
+	return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)) + "\r\n"
+}
+
+func TestAuth(t *testing.T) {
+	echo := startEcho(t)
+	proxyAddr := startProxy(t, &httpproxy.Config{
+		Credentials: httpproxy.StaticCredentials{"user": "secret"},
+		Realm:       "test",
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no credentials", "", http.StatusProxyAuthRequired},
+		{"wrong password", basicAuth("user", "wrong"), http.StatusProxyAuthRequired},
+		{"unknown user", basicAuth("other", "secret"), http.StatusProxyAuthRequired},
+		{"invalid scheme", "Proxy-Authorization: Bearer secret\r\n", http.StatusProxyAuthRequired},
+		{"invalid encoding", "Proxy-Authorization: Basic !!!\r\n", http.StatusProxyAuthRequired},
+		{"valid", basicAuth("user", "secret"), http.StatusOK},
+		{"lower case scheme", "Proxy-Authorization: basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")) + "\r\n", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := connect(t, proxyAddr, echo, tt.header, "")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if tt.status == http.StatusProxyAuthRequired {
+				if v := resp.Header.Get("Proxy-Authenticate"); v != `Basic realm="test"` {
+					t.Errorf("unexpected Proxy-Authenticate %q", v)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowedDestinations(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	echoPort, _ := strconv.Atoi(port)
+
+	tests := []struct {
+		name    string
+		hosts   []string
+		ports   []int
+		host    string
+		allowed bool
+	}{
+		{"no lists", nil, nil, "127.0.0.1", true},
+		{"allowed network", []string{"127.0.0.0/8"}, nil, "127.0.0.1", true},
+		{"allowed IP", []string{"127.0.0.1"}, nil, "127.0.0.1", true},
+		{"other IP", []string{"127.0.0.2"}, nil, "127.0.0.1", false},
+		{"network doesn't match names", []string{"127.0.0.0/8"}, nil, "localhost", false},
+		{"allowed host", []string{"localhost"}, nil, "localhost", true},
+		{"allowed host case-insensitive", []string{"LocalHost"}, nil, "localhost", true},
+		{"other host", []string{"example.com"}, nil, "localhost", false},
+		{"wildcard", []string{"*.localhost"}, nil, "localhost", false},
+		{"allowed port", nil, []int{echoPort}, "127.0.0.1", true},
+		{"other port", nil, []int{echoPort + 1}, "127.0.0.1", false},
+		{"allowed host and other port", []string{"127.0.0.1"}, []int{echoPort + 1}, "127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyAddr := startProxy(t, &httpproxy.Config{AllowedHosts: tt.hosts, AllowedPorts: tt.ports})
+			resp, _ := connect(t, proxyAddr, net.JoinHostPort(tt.host, port), "", "")
+			if tt.allowed && resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected destination to be allowed, got status %d", resp.StatusCode)
+			}
+			if !tt.allowed && resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+			}
+		})
+	}
+
+	// plain HTTP requests are checked as well
+	proxyAddr := startProxy(t, &httpproxy.Config{ForwardHTTP: true, AllowedPorts: []int{echoPort}})
+	conn := dial(t, proxyAddr)
+	_, _ = io.WriteString(conn, "GET http://127.0.0.1:1/ HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %v (%v)", http.StatusForbidden, resp, err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	echo := startEcho(t)
+	proxyAddr := startProxy(t, nil)
+
+	// data sent right after the request is passed on
+	resp, _ := connect(t, proxyAddr, echo, "", "early")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// invalid target
+	conn := dial(t, proxyAddr)
+	_, _ = io.WriteString(conn, "CONNECT localhost HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %v (%v)", http.StatusBadRequest, resp, err)
+	}
+
+	// unreachable destination
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	resp, _ = connect(t, proxyAddr, closed, "", "")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+
+	// plain HTTP requests aren't forwarded by default
+	conn = dial(t, proxyAddr)
+	_, _ = io.WriteString(conn, "GET http://"+echo+"/ HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "CONNECT" {
+		t.Fatalf("expected status %d, got %v (%v)", http.StatusMethodNotAllowed, resp, err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	upstream, requests := startHTTPUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n"+
+		"Connection: X-Secret\r\nX-Secret: 1\r\nKeep-Alive: timeout=5\r\nX-Public: 1\r\n\r\nok")
+	proxyAddr := startProxy(t, &httpproxy.Config{
+		Credentials: httpproxy.StaticCredentials{"user": "secret"},
+		ForwardHTTP: true,
+	})
+
+	conn := dial(t, proxyAddr)
+	rd := bufio.NewReader(conn)
+	// the client connection is kept alive
+	for i := 0; i < 2; i++ {
+		_, err := io.WriteString(conn, "GET http://"+upstream+"/path?q=1 HTTP/1.1\r\nHost: "+upstream+"\r\n"+
+			basicAuth("user", "secret")+"Connection: X-Foo\r\nX-Foo: 1\r\nKeep-Alive: 300\r\n"+
+			"Proxy-Connection: keep-alive\r\nTe: trailers\r\nX-Keep: 1\r\n\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(rd, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || string(body) != "ok" {
+			t.Fatalf("expected body ok, got %q (%v)", body, err)
+		}
+		for _, name := range []string{"X-Secret", "Keep-Alive"} {
+			if v := resp.Header.Get(name); v != "" {
+				t.Errorf("response header %s hasn't been removed: %q", name, v)
+			}
+		}
+		if resp.Header.Get("X-Public") != "1" {
+			t.Error("response header X-Public is missing")
+		}
+
+		req := <-requests
+		if req.RequestURI != "/path?q=1" || req.Host != upstream {
+			t.Errorf("unexpected request %s (host %s)", req.RequestURI, req.Host)
+		}
+		for _, name := range []string{"X-Foo", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te"} {
+			if v := req.Header.Get(name); v != "" {
+				t.Errorf("request header %s hasn't been removed: %q", name, v)
+			}
+		}
+		if req.Header.Get("X-Keep") != "1" {
+			t.Error("request header X-Keep is missing")
+		}
+	}
+
+	// only http:// URIs are supported
+	conn = dial(t, proxyAddr)
+	_, _ = io.WriteString(conn, "GET https://"+upstream+"/ HTTP/1.1\r\nHost: "+upstream+"\r\n"+basicAuth("user", "secret")+"\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %v (%v)", http.StatusBadRequest, resp, err)
+	}
+}
+
+func TestForwardUntilClose(t *testing.T) {
+	// without length the response body ends when the connection is closed
+	upstream, _ := startHTTPUpstream(t, "HTTP/1.1 200 OK\r\n\r\nuntil close")
+	proxyAddr := startProxy(t, &httpproxy.Config{ForwardHTTP: true})
+
+	conn := dial(t, proxyAddr)
+	_, _ = io.WriteString(conn, "GET http://"+upstream+"/ HTTP/1.1\r\nHost: "+upstream+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "until close" || !resp.Close {
+		t.Fatalf("expected body and close, got %q (close %v, %v)", body, resp.Close, err)
+	}
+}
+
+func TestUpstreamChaining(t *testing.T) {
+	echo := startEcho(t)
+	upstream, requests := startHTTPUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	chained := startProxy(t, &httpproxy.Config{
+		Credentials: httpproxy.StaticCredentials{"chain": "secret"},
+		ForwardHTTP: true,
+	})
+	proxyAddr := startProxy(t, &httpproxy.Config{
+		ForwardHTTP: true,
+		Upstream:    &httpproxy.UpstreamProxy{Addr: chained, Username: "chain", Password: "secret"},
+	})
+
+	resp, _ := connect(t, proxyAddr, echo, "", "early")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	conn := dial(t, proxyAddr)
+	_, _ = io.WriteString(conn, "GET http://"+upstream+"/chained HTTP/1.1\r\nHost: "+upstream+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %v (%v)", http.StatusOK, resp, err)
+	}
+	req := <-requests
+	if req.RequestURI != "/chained" || req.Header.Get("Proxy-Authorization") != "" {
+		t.Errorf("unexpected request %s (%v)", req.RequestURI, req.Header)
+	}
+
+	// the chained proxy rejects the credentials
+	proxyAddr = startProxy(t, &httpproxy.Config{
+		Upstream: &httpproxy.UpstreamProxy{Addr: chained, Username: "chain", Password: "wrong"},
+	})
+	resp, _ = connect(t, proxyAddr, echo, "", "")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Handles CONNECT requests
+func (h *handler) connect(ctx context.Context, conn tcpserver.Connection, br *bufio.Reader, req *http.Request) error {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		_ = writeStatus(conn, http.StatusBadRequest, "")
+		return fmt.Errorf("httpproxy: invalid CONNECT target '%s'", addr)
+	}
+	if !h.allowed(addr) {
+		_ = writeStatus(conn, http.StatusForbidden, "")
+		return ErrNotAllowed
+	}
+
+	upstream, pending, err := h.dialTunnel(ctx, addr)
+	if err != nil {
+		_ = writeStatus(conn, statusForError(err), "")
+		return err
+	}
+	defer upstream.Close()
+
+	if _, err = conn.Write(append([]byte("HTTP/1.1 200 Connection established\r\n\r\n"), pending...)); err != nil {
+		return err
+	}
+
+	// data sent by the client right after the request
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		if _, err = upstream.Write(b); err != nil {
+			return err
+		}
+	}
+
+	_, err = tcpserver.Proxy(conn, upstream, &tcpserver.ProxyOptions{IdleTimeout: h.config.IdleTimeout})
+	return err
+}
+
+// Connects to addr; if an upstream proxy is configured, a tunnel through it is
+// established. Returns the connection and data the upstream proxy sent after
+// its response.
+func (h *handler) dialTunnel(ctx context.Context, addr string) (net.Conn, []byte, error) {
+	upstream, err := h.dial(ctx, addr)
+	if err != nil || h.config.Upstream == nil {
+		return upstream, nil, err
+	}
+
+	_ = upstream.SetDeadline(time.Now().Add(h.config.ConnectTimeout))
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if h.upstreamAuth != "" {
+		req += "Proxy-Authorization: " + h.upstreamAuth + "\r\n"
+	}
+	if _, err = upstream.Write([]byte(req + "\r\n")); err != nil {
+		upstream.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		upstream.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		upstream.Close()
+		return nil, nil, fmt.Errorf("httpproxy: upstream proxy responded with '%s'", resp.Status)
+	}
+	_ = upstream.SetDeadline(time.Time{})
+
+	var pending []byte
+	if n := br.Buffered(); n > 0 {
+		pending, _ = br.Peek(n)
+	}
+	return upstream, pending, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Time to wait for killed connections to be closed by the poller's workers
+// after the shutdown deadline has been reached
+const hybridCloseTimeout = time.Second
+
+// Readable handler function type used in hybrid mode (see SetReadableHandler).
+// It is called whenever data is available on the connection and should
+// process what has arrived so far (e.g. one request) and return; returning
+// nil waits for more data, any error closes the connection (io.EOF counts as
+// a normal close).
+type ReadableHandlerFunc func(conn Connection) error
+
+// Sets the readable handler and enables the hybrid event-driven mode (Linux
+// only, TLS isn't supported). Instead of occupying a worker goroutine for the
+// whole lifetime of a connection, idle connections wait for data in an epoll
+// based poller and are handed over to a worker pool only when data arrives.
+// This keeps the memory footprint low with many mostly idle keep-alive
+// connections. Readable connections are served by the dispatcher (so
+// MaxWorkers, priority classes and the overload policy apply to them as
+// well); middlewares and the request handler are not used in hybrid mode.
+// Must be called before Serve().
+func (s *Server) SetReadableHandler(f ReadableHandlerFunc) {
+	s.readableHandler = f
+}
+
+// Returns whether the hybrid event-driven mode is enabled
+func (s *Server) IsHybridMode() bool {
+	return s.readableHandler != nil
+}
+
+// Adds an accepted connection to the poller (hybrid mode)
+func (s *Server) startPolling(conn *TCPConn) {
+	atomic.AddInt32(&s.queuedConnections, -1)
+	atomic.AddInt32(&s.activeConnections, 1)
+
+	conn.setState(ConnStateIdle)
+	if err := s.poller.add(conn); err != nil {
+		s.closeConn(conn, CloseReasonError, err)
+	}
+}
+
+// Serves a readable connection (called from the dispatcher in hybrid mode)
+func (s *Server) serveReadable(c Connection) {
+	s.handleReadable(c.(*TCPConn))
+}
+
+// Hands a readable connection over to the dispatcher; the connection is
+// closed if the dispatcher rejects it (called from the poller's dispatch
+// goroutine)
+func (s *Server) dispatchReadable(conn *TCPConn) {
+	if err := s.dispatcher.Dispatch(conn); err != nil {
+		s.closeConn(conn, CloseReasonError, err)
+	}
+}
+
+// Calls the readable handler and either re-arms the poller or closes the
+// connection (called from the dispatcher)
+func (s *Server) handleReadable(conn *TCPConn) {
+	if atomic.LoadUint32(&conn.killReason) != 0 {
+		s.closeConn(conn, CloseReasonKilled, nil)
+		return
+	}
+
+	if s.pprofLabels {
+		s.setPprofLabels(conn, append([]string{"listener", s.GetName()}, conn.pprofLabels...)...)
+		defer s.resetPprofLabels()
+	}
+
+	reason, err := s.callReadableHandler(conn)
+	if err == nil {
+		// the state has to be set before checking for shutdown as idle
+		// connections are closed right after shutdown has been set
+		conn.setState(ConnStateIdle)
+		if atomic.LoadInt32(&s.shutdown) == 1 {
+			s.closeConn(conn, CloseReasonShutdown, nil)
+			return
+		}
+
+		if err = s.poller.rearm(conn); err == nil {
+			return
+		}
+		reason = CloseReasonError
+	} else if errors.Is(err, io.EOF) {
+		err = nil
+	} else if s.errorHandler != nil {
+		s.errorHandler(conn, err)
+	}
+	s.closeConn(conn, reason, err)
+}
+
+// Calls the readable handler and recovers from panics
+func (s *Server) callReadableHandler(conn *TCPConn) (reason CloseReason, err error) {
+	conn.setState(ConnStateActive)
+
+	if conn.span != nil {
+		conn.span.AddEvent("handler.readable")
+	}
+
+	for _, f := range s.hooks.onHandlerStart {
+		f(conn)
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			reason = CloseReasonPanic
+			err = s.handlePanic(conn, v)
+		}
+	}()
+
+	err = s.readableHandler(conn)
+	if err == nil {
+		err = conn.err
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		return CloseReasonNormal, err
+	}
+	if _, ok := err.(*PanicError); ok {
+		return CloseReasonPanic, err
+	}
+	return CloseReasonError, err
+}
+
+// Closes all idle connections of a hybrid mode server (on shutdown)
+func (s *Server) closeIdleConnections() int {
+	return s.registry.kill(CloseReasonShutdown, func(conn *TCPConn) bool {
+		return ConnState(atomic.LoadUint32(&conn.state)) == ConnStateIdle
+	})
+}
+
+// Wakes up a hybrid mode connection without closing the socket: idle
+// connections become readable and pending reads and writes of a running
+// handler fail; the worker closes the connection afterwards. Closing the
+// socket would silently remove it from the poller.
+func wakeConn(rawConn net.Conn) {
+	if tcpConn, ok := rawConn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseRead()
+	}
+	_ = rawConn.SetDeadline(time.Unix(1, 0))
+}
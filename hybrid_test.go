@@ -0,0 +1,127 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux
+// +build linux
+
+package tcpserver
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHybridModeMaxWorkers(t *testing.T) {
+	var running, maxRunning int32
+	s := startServer(t, nil, func(s *Server) {
+		s.SetWorkerPoolConfig(&WorkerPoolConfig{MaxWorkers: 1, MaxQueued: 16})
+		s.SetReadableHandler(func(conn Connection) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			buf := make([]byte, 1)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return err
+			}
+			_, err := conn.Write(buf)
+			return err
+		})
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		c := dial(t, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := []byte("x")
+			for j := 0; j < 3; j++ {
+				if _, err := c.Write(buf); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := io.ReadFull(c, buf); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max := atomic.LoadInt32(&maxRunning); max != 1 {
+		t.Errorf("expected at most 1 running readable handler, got %d", max)
+	}
+	if s.GetWorkers() == 0 {
+		t.Error("expected readable connections to be served by the dispatcher")
+	}
+}
+
+func TestHybridModeBlockedDispatch(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetWorkerPoolConfig(&WorkerPoolConfig{MaxWorkers: 1, OverloadPolicy: OverloadBlock})
+	s.SetReadableHandler(func(conn Connection) error {
+		// occupies the only worker until the connection is killed
+		_, err := io.ReadAll(conn)
+		return err
+	})
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+
+	queued := func() int {
+		n := 0
+		for _, info := range s.GetConnections() {
+			if info.State == ConnStateQueued {
+				n++
+			}
+		}
+		return n
+	}
+
+	// the first connection occupies the worker, dispatching the second one
+	// blocks; the poller still has to notice the third one
+	for i := 0; i < 3; i++ {
+		c := dial(t, s)
+		waitFor(t, "registered connection", func() bool {
+			return len(s.GetConnections()) == i+1
+		})
+		if _, err = c.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			waitFor(t, "active connection", func() bool {
+				return len(s.GetConnections()) == 1 && s.GetConnections()[0].State == ConnStateActive
+			})
+		}
+	}
+	waitFor(t, "queued readable connections", func() bool {
+		return queued() == 2
+	})
+
+	_ = s.Shutdown(200 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Serve() didn't return after the shutdown deadline (%d connections)", len(s.GetConnections()))
+	}
+}
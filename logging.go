@@ -0,0 +1,87 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"log/slog"
+)
+
+// Logger used for connections if the server has no logger set
+var discardLogger = slog.New(discardHandler{})
+
+// Sets structured logger (defaults to nil which disables logging)
+func (s *Server) SetLogger(l *slog.Logger) {
+	s.logger = l
+}
+
+// Returns structured logger (nil if none set)
+func (s *Server) GetLogger() *slog.Logger {
+	return s.logger
+}
+
+// Returns whether logging is enabled for given level
+func (s *Server) logEnabled(level slog.Level) bool {
+	return s.logger != nil && s.logger.Enabled(context.Background(), level)
+}
+
+// Logs a server scoped event (no-op if no logger is set)
+func (s *Server) log(level slog.Level, msg string, args ...any) {
+	if !s.logEnabled(level) {
+		return
+	}
+	s.logger.Log(context.Background(), level, msg, append(args, slog.String("listener", s.GetName()))...)
+}
+
+// Logs a recovered panic (falls back to the standard logger if no logger is set)
+func (s *Server) logPanic(conn Connection, v interface{}, stack []byte) {
+	if s.logger == nil {
+		log.Printf("tcpserver: panic serving %s: %v\n%s", conn.RemoteAddr(), v, stack)
+		return
+	}
+	conn.Logger().Error("panic in request handler", slog.Any("panic", v), slog.String("stack", string(stack)))
+}
+
+// Returns connection scoped logger with connection ID, client address, listener and SNI
+// (if TLS is used) attributes; never returns nil. The logger isn't cached before the TLS
+// handshake is complete, so that the SNI attribute is added once it's known.
+func (conn *TCPConn) Logger() *slog.Logger {
+	if conn.logger != nil {
+		return conn.logger
+	}
+
+	s := conn.GetServer()
+	if s == nil || s.logger == nil {
+		return discardLogger
+	}
+
+	cache := true
+	attrs := make([]any, 0, 4)
+	attrs = append(attrs, slog.Uint64("conn_id", conn.id), slog.String("client", conn.RemoteAddr().String()), slog.String("listener", s.GetName()))
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if state.ServerName != "" {
+			attrs = append(attrs, slog.String("sni", state.ServerName))
+		}
+		cache = state.HandshakeComplete
+	} else if s.tlsEnabled {
+		// TLS handshake not started yet
+		cache = false
+	}
+	l := s.logger.With(attrs...)
+	if cache {
+		conn.logger = l
+	}
+	return l
+}
+
+// slog handler discarding all records
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,51 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLoggerSNIAfterEarlyUse(t *testing.T) {
+	var out syncBuffer
+	cert := testCertificate(t, "example.test")
+	s := startServer(t, func(conn Connection) {
+		_, _ = io.ReadFull(conn, make([]byte, 1))
+		conn.Logger().Info("handler")
+	}, func(s *Server) {
+		s.SetLogger(slog.New(slog.NewTextHandler(&out, nil)))
+		s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := s.EnableTLS(); err != nil {
+			t.Fatal(err)
+		}
+		s.AddHooks(Hooks{
+			OnAccept: func(conn Connection) error {
+				// before the TLS handshake
+				conn.Logger().Info("accept")
+				return nil
+			},
+		})
+	})
+
+	c, err := tls.Dial("tcp", s.GetListenAddr().String(), &tls.Config{ServerName: "example.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, _ = c.Write([]byte("x"))
+	_, _ = io.ReadAll(c)
+
+	waitFor(t, "handler log record", func() bool {
+		return strings.Contains(out.String(), "msg=handler")
+	})
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, "msg=handler") && !strings.Contains(line, "sni=example.test") {
+			t.Errorf("sni attribute missing: %s", line)
+		}
+	}
+}
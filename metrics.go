@@ -0,0 +1,412 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reason why a connection has been closed
+type CloseReason uint8
+
+const (
+	// Request handler returned normally
+	CloseReasonNormal CloseReason = iota
+	// TLS handshake failed (handler was never called)
+	CloseReasonTLSHandshake
+	// Request handler (RequestHandlerErrFunc) returned an error
+	CloseReasonError
+	// Request handler panicked
+	CloseReasonPanic
+	// Closed using Server.CloseConnection() or Server.CloseConnections()
+	CloseReasonKilled
+	// Forcibly closed after the shutdown deadline has been reached
+	CloseReasonShutdown
+
+	numCloseReasons
+)
+
+var closeReasonNames = [numCloseReasons]string{
+	CloseReasonNormal:       "normal",
+	CloseReasonTLSHandshake: "tls_handshake",
+	CloseReasonError:        "error",
+	CloseReasonPanic:        "panic",
+	CloseReasonKilled:       "killed",
+	CloseReasonShutdown:     "shutdown",
+}
+
+// Returns close reason as used in metric labels
+func (r CloseReason) String() string {
+	if r < numCloseReasons {
+		return closeReasonNames[r]
+	}
+	return "unknown"
+}
+
+// Reason why an accepted connection has been rejected before being served
+type RejectReason uint8
+
+const (
+	// Maximum number of accepted connections reached (see SetMaxAcceptConnections)
+	RejectReasonMaxAccept RejectReason = iota
+	// Rejected by an OnAccept hook
+	RejectReasonHook
+	// Server is in drain mode (see Server.SetDraining)
+	RejectReasonDrain
+	// Dispatcher returned an error
+	RejectReasonDispatch
+	// Worker pool is overloaded (see WorkerPoolConfig.OverloadPolicy)
+	RejectReasonOverload
+
+	numRejectReasons
+)
+
+var rejectReasonNames = [numRejectReasons]string{
+	RejectReasonMaxAccept: "max_accept",
+	RejectReasonHook:      "hook",
+	RejectReasonDrain:     "drain",
+	RejectReasonDispatch:  "dispatch",
+	RejectReasonOverload:  "overload",
+}
+
+// Returns reject reason as used in metric labels
+func (r RejectReason) String() string {
+	if r < numRejectReasons {
+		return rejectReasonNames[r]
+	}
+	return "unknown"
+}
+
+var (
+	connDurationBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+	tlsDurationBuckets  = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+)
+
+// Metrics collects server metrics and exposes them in the Prometheus text
+// exposition format. A single Metrics instance may be shared by several
+// servers; each server is labelled by its name (see Server.SetName). If
+// several servers share a name, all but the first registered one get a "#2",
+// "#3", ... suffix.
+type Metrics struct {
+	mutex     sync.Mutex
+	listeners []*listenerMetrics
+}
+
+// Per listener (server) metrics
+type listenerMetrics struct {
+	accepted             uint64
+	acceptErrors         uint64
+	rejected             [numRejectReasons]uint64
+	closed               [numCloseReasons]uint64
+	connDuration         histogram
+	tlsHandshakeDuration histogram
+	tlsFailuresMutex     sync.Mutex
+	tlsFailures          map[string]uint64
+	server               *Server
+}
+
+// Simple cumulative histogram with fixed buckets (upper bounds in seconds)
+type histogram struct {
+	count   uint64
+	sum     uint64 // in nanoseconds
+	buckets []float64
+	counts  []uint64
+}
+
+// Creates a new metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Registers server with the metrics collector
+func (m *Metrics) register(s *Server) *listenerMetrics {
+	lm := &listenerMetrics{
+		connDuration:         newHistogram(connDurationBuckets),
+		tlsHandshakeDuration: newHistogram(tlsDurationBuckets),
+		tlsFailures:          make(map[string]uint64),
+		server:               s,
+	}
+
+	m.mutex.Lock()
+	m.listeners = append(m.listeners, lm)
+	m.mutex.Unlock()
+
+	return lm
+}
+
+// Removes server from the metrics collector
+func (m *Metrics) unregister(lm *listenerMetrics) {
+	m.mutex.Lock()
+	for i, l := range m.listeners {
+		if l == lm {
+			m.listeners = append(m.listeners[:i], m.listeners[i+1:]...)
+			break
+		}
+	}
+	m.mutex.Unlock()
+}
+
+// Serves metrics in the Prometheus text exposition format (implements http.Handler)
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WritePrometheus(w)
+}
+
+// Writes all metrics in the Prometheus text exposition format to w
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mutex.Lock()
+	listeners := make([]*listenerMetrics, len(m.listeners))
+	copy(listeners, m.listeners)
+	m.mutex.Unlock()
+
+	names := make([]string, len(listeners))
+	seen := make(map[string]int, len(listeners))
+	for i, lm := range listeners {
+		name := lm.server.GetName()
+		seen[name]++
+		if n := seen[name]; n > 1 {
+			// keep series of servers sharing a name apart
+			name += "#" + strconv.Itoa(n)
+		}
+		names[i] = escapeLabelValue(name)
+	}
+	sort.Sort(byName{names, listeners})
+
+	// byte counters include connections that are still open
+	bytesRead := make(map[*listenerMetrics]uint64, len(listeners))
+	bytesWritten := make(map[*listenerMetrics]uint64, len(listeners))
+	for _, lm := range listeners {
+		bytesRead[lm], bytesWritten[lm] = lm.server.registry.byteCounters()
+	}
+
+	bw := bufio.NewWriter(w)
+	b := make([]byte, 0, 256)
+
+	writeCounter := func(name, help string, value func(lm *listenerMetrics) uint64) {
+		b = appendHeader(b[:0], name, help, "counter")
+		for i, lm := range listeners {
+			b = appendSample(b, name, names[i], "", "", float64(value(lm)))
+		}
+		bw.Write(b)
+	}
+	writeGauge := func(name, help string, value func(lm *listenerMetrics) float64) {
+		b = appendHeader(b[:0], name, help, "gauge")
+		for i, lm := range listeners {
+			b = appendSample(b, name, names[i], "", "", value(lm))
+		}
+		bw.Write(b)
+	}
+	writeHistogram := func(name, help string, h func(lm *listenerMetrics) *histogram) {
+		b = appendHeader(b[:0], name, help, "histogram")
+		for i, lm := range listeners {
+			b = h(lm).append(b, name, names[i])
+		}
+		bw.Write(b)
+	}
+
+	writeCounter("tcpserver_connections_accepted_total", "Total number of accepted connections.", func(lm *listenerMetrics) uint64 {
+		return atomic.LoadUint64(&lm.accepted)
+	})
+
+	b = appendHeader(b[:0], "tcpserver_connections_rejected_total", "Total number of accepted but rejected connections by reason.", "counter")
+	for i, lm := range listeners {
+		for r := RejectReason(0); r < numRejectReasons; r++ {
+			b = appendSample(b, "tcpserver_connections_rejected_total", names[i], "reason", r.String(), float64(atomic.LoadUint64(&lm.rejected[r])))
+		}
+	}
+	bw.Write(b)
+
+	b = appendHeader(b[:0], "tcpserver_connections_closed_total", "Total number of closed connections by reason.", "counter")
+	for i, lm := range listeners {
+		for r := CloseReason(0); r < numCloseReasons; r++ {
+			b = appendSample(b, "tcpserver_connections_closed_total", names[i], "reason", r.String(), float64(atomic.LoadUint64(&lm.closed[r])))
+		}
+	}
+	bw.Write(b)
+
+	writeGauge("tcpserver_connections_active", "Number of currently active connections.", func(lm *listenerMetrics) float64 {
+		return float64(lm.server.GetActiveConnections())
+	})
+	writeHistogram("tcpserver_connection_duration_seconds", "Duration of connections in seconds.", func(lm *listenerMetrics) *histogram {
+		return &lm.connDuration
+	})
+	writeCounter("tcpserver_read_bytes_total", "Total number of bytes read from connections.", func(lm *listenerMetrics) uint64 {
+		return bytesRead[lm]
+	})
+	writeCounter("tcpserver_written_bytes_total", "Total number of bytes written to connections.", func(lm *listenerMetrics) uint64 {
+		return bytesWritten[lm]
+	})
+	writeHistogram("tcpserver_tls_handshake_duration_seconds", "Duration of successful TLS handshakes in seconds.", func(lm *listenerMetrics) *histogram {
+		return &lm.tlsHandshakeDuration
+	})
+
+	b = appendHeader(b[:0], "tcpserver_tls_handshake_failures_total", "Total number of failed TLS handshakes by alert.", "counter")
+	for i, lm := range listeners {
+		lm.tlsFailuresMutex.Lock()
+		alerts := make([]string, 0, len(lm.tlsFailures))
+		for alert := range lm.tlsFailures {
+			alerts = append(alerts, alert)
+		}
+		sort.Strings(alerts)
+		for _, alert := range alerts {
+			b = appendSample(b, "tcpserver_tls_handshake_failures_total", names[i], "alert", alert, float64(lm.tlsFailures[alert]))
+		}
+		lm.tlsFailuresMutex.Unlock()
+	}
+	bw.Write(b)
+
+	writeCounter("tcpserver_accept_errors_total", "Total number of errors returned by accept().", func(lm *listenerMetrics) uint64 {
+		return atomic.LoadUint64(&lm.acceptErrors)
+	})
+	writeGauge("tcpserver_workerpool_workers", "Number of spawned worker pool go routines.", func(lm *listenerMetrics) float64 {
+		return float64(lm.server.GetWorkers())
+	})
+	writeGauge("tcpserver_workerpool_queued", "Number of accepted connections waiting for a worker.", func(lm *listenerMetrics) float64 {
+		return float64(lm.server.GetQueuedConnections())
+	})
+
+	return bw.Flush()
+}
+
+// Records a closed connection
+func (lm *listenerMetrics) connectionClosed(conn *TCPConn, reason CloseReason) {
+	atomic.AddUint64(&lm.closed[reason], 1)
+	lm.connDuration.observe(time.Duration(time.Now().UnixNano() - conn.ts))
+}
+
+// Records a TLS handshake
+func (lm *listenerMetrics) tlsHandshake(d time.Duration, err error) {
+	if err == nil {
+		lm.tlsHandshakeDuration.observe(d)
+		return
+	}
+	alert := tlsAlertLabel(err)
+	lm.tlsFailuresMutex.Lock()
+	lm.tlsFailures[alert]++
+	lm.tlsFailuresMutex.Unlock()
+}
+
+// Returns a metric label describing why a TLS handshake failed
+func tlsAlertLabel(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		// alert sent by the client, e.g. "tls: bad certificate"
+		return strings.ReplaceAll(strings.TrimPrefix(opErr.Err.Error(), "tls: "), " ", "_")
+	}
+
+	var recErr tls.RecordHeaderError
+	if errors.As(err, &recErr) {
+		return "bad_record_header"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "eof"
+	}
+
+	return "other"
+}
+
+// Creates a new histogram with given bucket upper bounds (in seconds)
+func newHistogram(buckets []float64) histogram {
+	return histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Adds an observation
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	for i, le := range h.buckets {
+		if s <= le {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.sum, uint64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Appends histogram samples in text exposition format
+func (h *histogram) append(b []byte, name, listener string) []byte {
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		b = appendSample(b, name+"_bucket", listener, "le", strconv.FormatFloat(le, 'g', -1, 64), float64(cumulative))
+	}
+	count := atomic.LoadUint64(&h.count)
+	b = appendSample(b, name+"_bucket", listener, "le", "+Inf", float64(count))
+	b = appendSample(b, name+"_sum", listener, "", "", time.Duration(atomic.LoadUint64(&h.sum)).Seconds())
+	b = appendSample(b, name+"_count", listener, "", "", float64(count))
+	return b
+}
+
+// Appends HELP and TYPE lines
+func appendHeader(b []byte, name, help, typ string) []byte {
+	b = append(b, "# HELP "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, help...)
+	b = append(b, "\n# TYPE "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, typ...)
+	b = append(b, '\n')
+	return b
+}
+
+// Appends a single sample line with listener label and an optional additional label
+func appendSample(b []byte, name, listener, labelName, labelValue string, value float64) []byte {
+	b = append(b, name...)
+	b = append(b, `{listener="`...)
+	b = append(b, listener...)
+	b = append(b, '"')
+	if labelName != "" {
+		b = append(b, ',')
+		b = append(b, labelName...)
+		b = append(b, `="`...)
+		b = append(b, escapeLabelValue(labelValue)...)
+		b = append(b, '"')
+	}
+	b = append(b, "} "...)
+	b = strconv.AppendFloat(b, value, 'g', -1, 64)
+	b = append(b, '\n')
+	return b
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Escapes a label value according to the text exposition format
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// Sorts listener metrics by (escaped) listener name
+type byName struct {
+	names     []string
+	listeners []*listenerMetrics
+}
+
+func (b byName) Len() int           { return len(b.names) }
+func (b byName) Less(i, j int) bool { return b.names[i] < b.names[j] }
+func (b byName) Swap(i, j int) {
+	b.names[i], b.names[j] = b.names[j], b.names[i]
+	b.listeners[i], b.listeners[j] = b.listeners[j], b.listeners[i]
+}
@@ -0,0 +1,83 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Returns the value of a metric line starting with prefix
+func metricValue(t *testing.T, m *Metrics, prefix string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line[strings.LastIndexByte(line, ' ')+1:]
+		}
+	}
+	t.Fatalf("metric %q not found in:\n%s", prefix, buf.String())
+	return ""
+}
+
+func TestMetricsLiveByteCounters(t *testing.T) {
+	m := NewMetrics()
+	s := startServer(t, func(conn Connection) {
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err = conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}, func(s *Server) {
+		s.SetName("echo")
+		s.SetMetrics(m)
+	})
+
+	c := dial(t, s)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// connection is still open
+	if v := metricValue(t, m, `tcpserver_read_bytes_total{listener="echo"}`); v != "5" {
+		t.Errorf("read bytes of open connection = %s, want 5", v)
+	}
+	if v := metricValue(t, m, `tcpserver_written_bytes_total{listener="echo"}`); v != "5" {
+		t.Errorf("written bytes of open connection = %s, want 5", v)
+	}
+
+	c.Close()
+	waitFor(t, "connection close", func() bool {
+		return metricValue(t, m, `tcpserver_connections_closed_total{listener="echo",reason="normal"}`) == "1"
+	})
+	if v := metricValue(t, m, `tcpserver_read_bytes_total{listener="echo"}`); v != "5" {
+		t.Errorf("read bytes after close = %s, want 5", v)
+	}
+}
+
+func TestMetricsDuplicateNames(t *testing.T) {
+	m := NewMetrics()
+	for i := 0; i < 3; i++ {
+		startServer(t, func(conn Connection) {}, func(s *Server) {
+			s.SetName("dup")
+			s.SetMetrics(m)
+		})
+	}
+	for _, name := range []string{"dup", "dup#2", "dup#3"} {
+		metricValue(t, m, `tcpserver_connections_accepted_total{listener="`+name+`"}`)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"runtime/trace"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a request handler.
+//
+// Middlewares may pass a wrapped Connection to the next handler, e.g. to
+// intercept Read/Write. Wrappers should embed the original Connection so that
+// all other methods, especially GetNetConn() for zero-copy access to the
+// underlying socket, keep working.
+type Middleware func(next RequestHandlerFunc) RequestHandlerFunc
+
+// Adds middlewares; the first middleware added is the outermost one.
+// Must be called before Serve().
+func (s *Server) Use(mw ...Middleware) {
+	s.middlewares = append(s.middlewares, mw...)
+}
+
+// Builds the request handler chain
+func (s *Server) buildHandler() RequestHandlerFunc {
+	h := s.requestHandler
+	if f := s.requestHandlerErr; f != nil {
+		h = func(conn Connection) {
+			if err := f(conn); err != nil {
+				conn.SetError(err)
+			}
+		}
+	}
+
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	return h
+}
+
+// Returns a middleware that recovers from panics in the following handlers
+// and reports them as *PanicError using conn.SetError(). The panic is logged
+// and OnHandlerPanic hooks are called just like for panics recovered by the
+// server itself, but outer middlewares still see the connection.
+func Recover() Middleware {
+	return func(next RequestHandlerFunc) RequestHandlerFunc {
+		return func(conn Connection) {
+			defer func() {
+				if v := recover(); v != nil {
+					conn.SetError(conn.GetServer().handlePanic(conn, v))
+				}
+			}()
+			next(conn)
+		}
+	}
+}
+
+// Returns a middleware that logs a record per connection after the following
+// handlers returned (server address, duration, bytes read/written and error if
+// any) using the connection's logger at info level (see Server.SetLogger)
+func AccessLog() Middleware {
+	return func(next RequestHandlerFunc) RequestHandlerFunc {
+		return func(conn Connection) {
+			next(conn)
+
+			l := conn.Logger()
+			if !l.Enabled(context.Background(), slog.LevelInfo) {
+				return
+			}
+			stats := conn.GetStats()
+			attrs := make([]any, 0, 5)
+			attrs = append(attrs,
+				slog.String("server", conn.GetServerAddr().String()),
+				slog.Duration("duration", time.Since(conn.GetStartTime())),
+				slog.Uint64("read", stats.BytesRead),
+				slog.Uint64("written", stats.BytesWritten),
+			)
+			if err := conn.GetError(); err != nil {
+				attrs = append(attrs, slog.Any("error", err))
+			}
+			l.Info("access", attrs...)
+		}
+	}
+}
+
+// Returns a middleware that sets an absolute read/write deadline of d after
+// the connection has been accepted
+func Deadline(d time.Duration) Middleware {
+	return func(next RequestHandlerFunc) RequestHandlerFunc {
+		return func(conn Connection) {
+			_ = conn.SetDeadline(conn.GetStartTime().Add(d))
+			next(conn)
+		}
+	}
+}
+
+// Aggregated byte counter (e.g. per tenant or per listener) used by CountBytes
+type ByteCounter struct {
+	read    uint64
+	written uint64
+}
+
+// Returns number of bytes read
+func (bc *ByteCounter) BytesRead() uint64 {
+	return atomic.LoadUint64(&bc.read)
+}
+
+// Returns number of bytes written
+func (bc *ByteCounter) BytesWritten() uint64 {
+	return atomic.LoadUint64(&bc.written)
+}
+
+// Returns a middleware that adds all bytes read and written by the following
+// handlers to bc. Traffic that bypasses the Connection using GetNetConn() is
+// not counted.
+func CountBytes(bc *ByteCounter) Middleware {
+	return func(next RequestHandlerFunc) RequestHandlerFunc {
+		return func(conn Connection) {
+			next(&countingConn{Connection: conn, bc: bc})
+		}
+	}
+}
+
+// Connection wrapper counting bytes into a ByteCounter
+type countingConn struct {
+	Connection
+	bc *ByteCounter
+}
+
+// Reads data from the connection
+func (c *countingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Connection.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&c.bc.read, uint64(n))
+	}
+	return
+}
+
+// Writes data to the connection
+func (c *countingConn) Write(b []byte) (n int, err error) {
+	n, err = c.Connection.Write(b)
+	if n > 0 {
+		atomic.AddUint64(&c.bc.written, uint64(n))
+	}
+	return
+}
+
+// Reads from r until EOF and writes to the connection (implements io.ReaderFrom)
+func (c *countingConn) ReadFrom(r io.Reader) (n int64, err error) {
+	if rf, ok := c.Connection.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(writerOnly{c.Connection}, r)
+	}
+	atomic.AddUint64(&c.bc.written, uint64(n))
+	return
+}
+
+// Writes to w until there's no more data to read (implements io.WriterTo)
+func (c *countingConn) WriteTo(w io.Writer) (n int64, err error) {
+	if wt, ok := c.Connection.(io.WriterTo); ok {
+		n, err = wt.WriteTo(w)
+	} else {
+		n, err = io.Copy(w, readerOnly{c.Connection})
+	}
+	atomic.AddUint64(&c.bc.read, uint64(n))
+	return
+}
+
+// Returns a middleware that creates a runtime/trace task per connection
+// (see "go tool trace"). The task's context is set as connection context so
+// that handlers can add regions and log messages.
+func Trace() Middleware {
+	return func(next RequestHandlerFunc) RequestHandlerFunc {
+		return func(conn Connection) {
+			if !trace.IsEnabled() {
+				next(conn)
+				return
+			}
+
+			ctx, task := trace.NewTask(*conn.GetContext(), "tcpserver.conn")
+			defer task.End()
+
+			trace.Log(ctx, "client", conn.GetClientAddr().String())
+			conn.SetContext(&ctx)
+			trace.WithRegion(ctx, "handler", func() {
+				next(conn)
+			})
+
+			if err := conn.GetError(); err != nil {
+				trace.Log(ctx, "error", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// Thread safe buffer for log output
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	var out syncBuffer
+	s := startServer(t, nil, func(s *Server) {
+		s.SetName("test")
+		s.SetLogger(slog.New(slog.NewJSONHandler(&out, nil)))
+		s.Use(AccessLog())
+		s.SetRequestHandlerErr(func(conn Connection) error {
+			_, _ = io.ReadFull(conn, make([]byte, 3))
+			_, _ = conn.Write([]byte("hello"))
+			return errors.New("boom")
+		})
+	})
+
+	c := dial(t, s)
+	_, _ = c.Write([]byte("abc"))
+	_, _ = io.ReadAll(c)
+
+	var record map[string]interface{}
+	waitFor(t, "access log record", func() bool {
+		for _, line := range bytes.Split([]byte(out.String()), []byte("\n")) {
+			if bytes.Contains(line, []byte(`"msg":"access"`)) {
+				return json.Unmarshal(line, &record) == nil
+			}
+		}
+		return false
+	})
+
+	want := map[string]interface{}{
+		"level":    "INFO",
+		"listener": "test",
+		"read":     float64(3),
+		"written":  float64(5),
+		"error":    "boom",
+	}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("%s = %v, want %v", k, record[k], v)
+		}
+	}
+	if _, ok := record["conn_id"]; !ok {
+		t.Errorf("conn_id attribute missing: %v", record)
+	}
+}
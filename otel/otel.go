@@ -0,0 +1,135 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package otel adapts OpenTelemetry tracing to tcpserver.Tracer. It is a
+// separate module so that the core module doesn't depend on OpenTelemetry.
+//
+//	server.SetTracer(otel.NewTracer(nil))
+//
+// Connection spans are created with span kind "server"; child spans started
+// with tcpserver.StartSpan() are "internal" spans. Handlers may also use the
+// OpenTelemetry API directly with the connection's context.
+package otel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Instrumentation scope name
+const ScopeName = "github.com/maurice2k/tcpserver"
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+type span struct {
+	span trace.Span
+}
+
+// Returns a tcpserver.Tracer creating OpenTelemetry spans using given tracer
+// provider (the global one if tp is nil)
+func NewTracer(tp trace.TracerProvider, opts ...trace.TracerOption) tcpserver.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &tracer{
+		tracer: tp.Tracer(ScopeName, opts...),
+	}
+}
+
+// Starts a new span as child of the span carried by ctx (if any)
+func (t *tracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, tcpserver.Span) {
+	kind := trace.SpanKindInternal
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		kind = trace.SpanKindServer
+	}
+	ctx, sp := t.tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(convertAttrs(attrs)...))
+	return ctx, &span{span: sp}
+}
+
+// Sets span attributes
+func (s *span) SetAttributes(attrs ...slog.Attr) {
+	s.span.SetAttributes(convertAttrs(attrs)...)
+}
+
+// Adds a timestamped event
+func (s *span) AddEvent(name string, attrs ...slog.Attr) {
+	s.span.AddEvent(name, trace.WithAttributes(convertAttrs(attrs)...))
+}
+
+// Records an error and sets the span status to error
+func (s *span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// Ends the span
+func (s *span) End() {
+	s.span.End()
+}
+
+// Converts slog attributes to OpenTelemetry attributes (groups are flattened
+// using "." as separator)
+func convertAttrs(attrs []slog.Attr) []attribute.KeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kvs = appendAttr(kvs, "", a)
+	}
+	return kvs
+}
+
+func appendAttr(kvs []attribute.KeyValue, prefix string, a slog.Attr) []attribute.KeyValue {
+	key := a.Key
+	if prefix != "" {
+		key = prefix + "." + key
+	}
+
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return append(kvs, attribute.String(key, v.String()))
+	case slog.KindInt64:
+		return append(kvs, attribute.Int64(key, v.Int64()))
+	case slog.KindUint64:
+		if u := v.Uint64(); u <= math.MaxInt64 {
+			return append(kvs, attribute.Int64(key, int64(u)))
+		}
+		return append(kvs, attribute.String(key, v.String()))
+	case slog.KindFloat64:
+		return append(kvs, attribute.Float64(key, v.Float64()))
+	case slog.KindBool:
+		return append(kvs, attribute.Bool(key, v.Bool()))
+	case slog.KindDuration:
+		return append(kvs, attribute.String(key, v.Duration().String()))
+	case slog.KindTime:
+		return append(kvs, attribute.String(key, v.Time().Format(time.RFC3339Nano)))
+	case slog.KindGroup:
+		for _, ga := range v.Group() {
+			kvs = appendAttr(kvs, key, ga)
+		}
+		return kvs
+	}
+
+	switch x := v.Any().(type) {
+	case []string:
+		return append(kvs, attribute.StringSlice(key, x))
+	case error:
+		return append(kvs, attribute.String(key, x.Error()))
+	case fmt.Stringer:
+		return append(kvs, attribute.String(key, x.String()))
+	}
+	return append(kvs, attribute.String(key, fmt.Sprint(v.Any())))
+}
@@ -0,0 +1,273 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package pipeline
+
+import (
+	"context"
+	"io"
+	"runtime/debug"
+	"sync"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/codec"
+)
+
+// Per connection pipeline state
+type pipe struct {
+	fn     HandlerFunc
+	config *Config
+	conn   tcpserver.Connection
+	c      *codec.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// requests passed to idle workers
+	jobs    chan *Request
+	spawned int
+	// one entry per request in flight
+	slots   chan struct{}
+	pending sync.WaitGroup
+
+	mu sync.Mutex
+	// whether a worker is currently writing responses
+	writing bool
+	// sequence number of the next response to write (InOrder)
+	next uint64
+	// completed requests indexed by seq % MaxInFlight (InOrder)
+	ring []*Request
+	// completed requests (OutOfOrder)
+	done []*Request
+	// responses being written
+	batch []*Request
+	err   error
+
+	panicked *WorkerPanic
+}
+
+func newPipe(conn tcpserver.Connection, fn HandlerFunc, config *Config, codecConfig *codec.Config) *pipe {
+	p := &pipe{
+		fn:     fn,
+		config: config,
+		conn:   conn,
+		c:      codec.NewConn(conn, config.Framer, codecConfig),
+		jobs:   make(chan *Request),
+		slots:  make(chan struct{}, config.MaxInFlight),
+	}
+	p.ctx, p.cancel = context.WithCancel(*conn.GetContext())
+	if config.Ordering == InOrder {
+		p.ring = make([]*Request, config.MaxInFlight)
+	}
+	return p
+}
+
+// Reads and dispatches requests until the connection is closed or fails;
+// waits for pending requests before returning
+func (p *pipe) run() error {
+	stop := context.AfterFunc(p.ctx, func() {
+		// interrupt a blocked read
+		_ = p.conn.SetReadDeadline(aLongTimeAgo)
+	})
+
+	var seq uint64
+	var err error
+	for {
+		var frame []byte
+		if frame, err = p.c.ReadFrame(); err != nil {
+			break
+		}
+
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.ctx.Done():
+			err = p.ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+
+		r := acquireRequest()
+		r.conn = p.conn
+		r.seq = seq
+		r.data = append(r.data[:0], frame...)
+		seq++
+
+		p.pending.Add(1)
+		p.dispatch(r)
+	}
+
+	close(p.jobs)
+	p.pending.Wait()
+	stop()
+
+	p.mu.Lock()
+	if p.err != nil {
+		err = p.err
+	} else if ctxErr := p.ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	panicked := p.panicked
+	p.mu.Unlock()
+
+	p.cancel()
+	p.c.Release()
+
+	if panicked != nil {
+		// let the server handle the panic
+		panic(panicked)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Passes a request to an idle worker or starts a new one; blocks if all
+// workers are busy
+func (p *pipe) dispatch(r *Request) {
+	select {
+	case p.jobs <- r:
+	default:
+		if p.spawned < p.config.Workers {
+			p.spawned++
+			go p.work(r)
+			return
+		}
+		p.jobs <- r
+	}
+}
+
+// Handles r and further requests until the reader is done
+func (p *pipe) work(r *Request) {
+	for ; r != nil; r = <-p.jobs {
+		p.handle(r)
+	}
+}
+
+// Calls the handler and writes the response
+func (p *pipe) handle(r *Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			p.mu.Lock()
+			if p.panicked == nil {
+				p.panicked = &WorkerPanic{Value: v, Stack: debug.Stack()}
+			}
+			p.mu.Unlock()
+			p.fail(errHandlerPanicked)
+
+			r.resp = nil
+			p.complete(r)
+		}
+	}()
+
+	r.resp = nil
+	if p.ctx.Err() == nil {
+		if r.buf == nil {
+			r.buf = make([]byte, 0, responseBufferSize)
+		}
+		resp, err := p.fn(p.ctx, r, r.buf[:0])
+		if err != nil {
+			p.fail(err)
+		} else {
+			r.resp = resp
+		}
+	}
+	p.complete(r)
+}
+
+// Marks r as completed; the first worker to complete a request becomes the
+// writer and writes all responses that are (or become) ready meanwhile
+func (p *pipe) complete(r *Request) {
+	p.mu.Lock()
+	if p.config.Ordering == InOrder {
+		p.ring[r.seq%uint64(len(p.ring))] = r
+	} else {
+		p.done = append(p.done, r)
+	}
+	if p.writing {
+		p.mu.Unlock()
+		return
+	}
+
+	p.writing = true
+	for {
+		batch := p.collect()
+		if len(batch) == 0 {
+			p.writing = false
+			p.mu.Unlock()
+			return
+		}
+		failed := p.err != nil
+		p.mu.Unlock()
+
+		p.write(batch, failed)
+
+		p.mu.Lock()
+	}
+}
+
+// Returns the responses that can be written now; p.mu must be held
+func (p *pipe) collect() []*Request {
+	batch := p.batch[:0]
+	if p.config.Ordering == InOrder {
+		n := uint64(len(p.ring))
+		for {
+			i := p.next % n
+			r := p.ring[i]
+			if r == nil {
+				break
+			}
+			p.ring[i] = nil
+			p.next++
+			batch = append(batch, r)
+		}
+	} else {
+		batch = append(batch, p.done...)
+		for i := range p.done {
+			p.done[i] = nil
+		}
+		p.done = p.done[:0]
+	}
+	p.batch = batch
+	return batch
+}
+
+// Writes responses with a single flush (unless the connection failed) and
+// releases the requests
+func (p *pipe) write(batch []*Request, failed bool) {
+	var err error
+	if !failed {
+		for _, r := range batch {
+			if r.resp == nil {
+				continue
+			}
+			if err = p.c.QueueFrame(r.resp); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = p.c.Flush()
+		}
+	}
+
+	for i, r := range batch {
+		releaseRequest(r)
+		batch[i] = nil
+		<-p.slots
+		p.pending.Done()
+	}
+	if err != nil {
+		p.fail(err)
+	}
+}
+
+// Records the first error and cancels the connection's context (which stops
+// reading and handling requests)
+func (p *pipe) fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	p.cancel()
+}
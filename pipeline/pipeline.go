@@ -0,0 +1,180 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package pipeline implements a request/response handler model on top of
+// framed connections: the connection's goroutine reads and decodes requests
+// and dispatches them to a bounded set of per-connection workers, so that
+// multiple requests of a connection are handled concurrently.
+//
+//	server.SetRequestHandler(pipeline.NewHandler(func(ctx context.Context, req *pipeline.Request, resp []byte) ([]byte, error) {
+//		return append(resp, req.GetData()...), nil
+//	}, &pipeline.Config{Framer: codec.LengthPrefixed{Size: 4}, Workers: 8}))
+//
+// Responses are written in request order (InOrder) or as soon as they are
+// ready (OutOfOrder, requires request IDs in the protocol). Responses that
+// are ready at the same time are sent with a single write. Reading pauses
+// while MaxInFlight requests are pending (backpressure).
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/codec"
+)
+
+// Response ordering
+type Ordering uint8
+
+const (
+	// Responses are written in the order the requests have been received
+	InOrder Ordering = iota
+	// Responses are written as soon as they are ready; the protocol has to
+	// carry request IDs so that clients can match responses to requests
+	OutOfOrder
+)
+
+var orderingNames = [...]string{
+	InOrder:    "in_order",
+	OutOfOrder: "out_of_order",
+}
+
+// Returns ordering name
+func (o Ordering) String() string {
+	if int(o) < len(orderingNames) {
+		return orderingNames[o]
+	}
+	return "unknown"
+}
+
+// Request handler; appends the response to resp and returns it (nil for no
+// response). The returned slice must not be modified until the response has
+// been written. ctx is canceled once the connection fails. Returning an error
+// closes the connection (responses of other pending requests aren't written
+// anymore).
+type HandlerFunc func(ctx context.Context, req *Request, resp []byte) ([]byte, error)
+
+// Pipeline config
+type Config struct {
+	// Frame format of requests and responses (defaults to a 4 byte big endian
+	// length prefix)
+	Framer codec.Framer
+	// Maximum size of a request or response (defaults to 1 MiB)
+	MaxFrameSize int
+	// Maximum number of worker goroutines per connection; workers are started
+	// on demand (defaults to runtime.GOMAXPROCS(0))
+	Workers int
+	// Maximum number of requests per connection that have been read but
+	// whose response hasn't been written yet; reading pauses once reached
+	// (defaults to 2 * Workers)
+	MaxInFlight int
+	// Response ordering (defaults to InOrder)
+	Ordering Ordering
+}
+
+// Returned as connection error if a worker panicked (before the panic is
+// passed on to the server)
+var errHandlerPanicked = errors.New("pipeline: handler panicked")
+
+// Panic value passed on to the server (and thus its panic hooks) if a handler
+// panicked in a worker goroutine
+type WorkerPanic struct {
+	// Value passed to panic
+	Value interface{}
+	// Stack trace of the worker goroutine
+	Stack []byte
+}
+
+func (p *WorkerPanic) Error() string {
+	return fmt.Sprintf("%v\n\nworker %s", p.Value, p.Stack)
+}
+
+// Request and response buffers larger than this aren't kept in the pool
+const maxPooledBufferSize = 64 * 1024
+
+// Initial capacity of the response buffer
+const responseBufferSize = 512
+
+// Deadline used to interrupt a blocked read
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Returns a request handler reading requests with config.Framer and passing
+// them to fn
+func NewHandler(fn HandlerFunc, config *Config) tcpserver.RequestHandlerFunc {
+	cfg := &Config{}
+	if config != nil {
+		*cfg = *config
+	}
+	if cfg.Framer == nil {
+		cfg.Framer = codec.LengthPrefixed{Size: 4}
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = 1024 * 1024
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = 2 * cfg.Workers
+	}
+	codecConfig := &codec.Config{MaxFrameSize: cfg.MaxFrameSize}
+
+	return func(conn tcpserver.Connection) {
+		p := newPipe(conn, fn, cfg, codecConfig)
+		if err := p.run(); err != nil {
+			conn.SetError(err)
+		}
+	}
+}
+
+// Request read from a connection
+type Request struct {
+	conn tcpserver.Connection
+	seq  uint64
+	data []byte
+	buf  []byte
+	resp []byte
+}
+
+// Returns the connection the request has been read from
+func (r *Request) GetConn() tcpserver.Connection {
+	return r.conn
+}
+
+// Returns the request frame; it is only valid until the handler returns
+func (r *Request) GetData() []byte {
+	return r.data
+}
+
+// Returns the request's sequence number (0 for the first request of a
+// connection)
+func (r *Request) GetSeq() uint64 {
+	return r.seq
+}
+
+var requestPool = sync.Pool{
+	New: func() interface{} {
+		return &Request{}
+	},
+}
+
+func acquireRequest() *Request {
+	return requestPool.Get().(*Request)
+}
+
+func releaseRequest(r *Request) {
+	r.conn = nil
+	r.resp = nil
+	if cap(r.data) > maxPooledBufferSize {
+		r.data = nil
+	}
+	if cap(r.buf) > maxPooledBufferSize {
+		r.buf = nil
+	}
+	requestPool.Put(r)
+}
@@ -0,0 +1,280 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package pipeline_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/pipeline"
+)
+
+// Starts a server passing connections to a pipeline handler (with a
+// cancelable connection context passed to setCancel if not nil); the close
+// infos of connections are sent to the returned channel
+func startServer(t *testing.T, fn pipeline.HandlerFunc, config *pipeline.Config, setCancel func(context.CancelFunc)) (string, chan tcpserver.CloseInfo) {
+	t.Helper()
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	handler := pipeline.NewHandler(fn, config)
+	s.SetRequestHandler(func(conn tcpserver.Connection) {
+		if setCancel != nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			conn.SetContext(&ctx)
+			setCancel(cancel)
+		}
+		handler(conn)
+	})
+	closed := make(chan tcpserver.CloseInfo, 1)
+	s.AddHooks(tcpserver.Hooks{
+		OnClose: func(conn tcpserver.Connection, info tcpserver.CloseInfo) {
+			closed <- info
+		},
+	})
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	})
+	return s.GetListenAddr().String(), closed
+}
+
+// Connects to the server
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// Sends requests with a 4 byte length prefix using a single write
+func send(t *testing.T, conn net.Conn, requests ...string) {
+	t.Helper()
+	var b []byte
+	for _, req := range requests {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(req)))
+		b = append(b, req...)
+	}
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads a response
+func receive(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	var h [4]byte
+	if _, err := io.ReadFull(conn, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, binary.BigEndian.Uint32(h[:]))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// Checks that the server closed the connection without sending anything
+func expectEOF(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %d bytes (%v)", n, err)
+	}
+}
+
+// Waits for the connection to be closed by the server
+func waitClosed(t *testing.T, closed chan tcpserver.CloseInfo) tcpserver.CloseInfo {
+	t.Helper()
+	select {
+	case info := <-closed:
+		return info
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the connection to be closed")
+		return tcpserver.CloseInfo{}
+	}
+}
+
+// Answers with "<seq>:<data>"
+func echoSeq(ctx context.Context, req *pipeline.Request, resp []byte) ([]byte, error) {
+	resp = strconv.AppendUint(resp, req.GetSeq(), 10)
+	resp = append(resp, ':')
+	return append(resp, req.GetData()...), nil
+}
+
+func TestInOrder(t *testing.T) {
+	// later requests finish first
+	addr, _ := startServer(t, func(ctx context.Context, req *pipeline.Request, resp []byte) ([]byte, error) {
+		delay, _ := strconv.Atoi(string(req.GetData()))
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+		return echoSeq(ctx, req, resp)
+	}, &pipeline.Config{Workers: 4}, nil)
+
+	conn := dial(t, addr)
+	delays := []string{"80", "60", "40", "20", "0", "30"}
+	send(t, conn, delays...)
+	for i, delay := range delays {
+		if resp := receive(t, conn); resp != strconv.Itoa(i)+":"+delay {
+			t.Fatalf("response %d: unexpected %q", i, resp)
+		}
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	release := make(chan struct{})
+	addr, _ := startServer(t, func(ctx context.Context, req *pipeline.Request, resp []byte) ([]byte, error) {
+		if string(req.GetData()) == "slow" {
+			<-release
+		}
+		return echoSeq(ctx, req, resp)
+	}, &pipeline.Config{Workers: 2, Ordering: pipeline.OutOfOrder}, nil)
+
+	conn := dial(t, addr)
+	send(t, conn, "slow", "fast")
+	if resp := receive(t, conn); resp != "1:fast" {
+		t.Fatalf("expected fast response first, got %q", resp)
+	}
+	close(release)
+	if resp := receive(t, conn); resp != "0:slow" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	var started int32
+	release := make(chan struct{})
+	addr, _ := startServer(t, func(ctx context.Context, req *pipeline.Request, resp []byte) ([]byte, error) {
+		atomic.AddInt32(&started, 1)
+		<-release
+		return echoSeq(ctx, req, resp)
+	}, &pipeline.Config{Workers: 4, MaxInFlight: 2}, nil)
+
+	conn := dial(t, addr)
+	send(t, conn, "a", "b", "c", "d", "e")
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Fatalf("expected 2 requests in flight, got %d", n)
+	}
+
+	close(release)
+	for i, data := range []string{"a", "b", "c", "d", "e"} {
+		if resp := receive(t, conn); resp != strconv.Itoa(i)+":"+data {
+			t.Fatalf("response %d: unexpected %q", i, resp)
+		}
+	}
+}
+
+func TestHandlerError(t *testing.T) {
+	errFailed := errors.New("failed")
+	addr, closed := startServer(t, func(ctx context.Context, req *pipeline.Request, resp []byte) ([]byte, error) {
+		if string(req.GetData()) == "fail" {
+			return nil, errFailed
+		}
+		return echoSeq(ctx, req, resp)
+	}, &pipeline.Config{Workers: 2}, nil)
+
+	conn := dial(t, addr)
+	send(t, conn, "ok")
+	if resp := receive(t, conn); resp != "0:ok" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+
+	// the connection is closed although the client keeps it open
+	send(t, conn, "fail")
+	expectEOF(t, conn)
+	info := waitClosed(t, closed)
+	if info.Reason != tcpserver.CloseReasonError || !errors.Is(info.Err, errFailed) {
+		t.Fatalf("expected handler error, got %v (%v)", info.Reason, info.Err)
+	}
+}
+
+func TestWorkerPanic(t *testing.T) {
+	addr, closed := startServer(t, func(ctx context.Context, req *pipeline.Request, resp []byte) ([]byte, error) {
+		panic("boom")
+	}, nil, nil)
+
+	conn := dial(t, addr)
+	send(t, conn, "hello")
+	expectEOF(t, conn)
+
+	// re-raised on the connection's goroutine so that the server handles it
+	info := waitClosed(t, closed)
+	var pe *tcpserver.PanicError
+	if info.Reason != tcpserver.CloseReasonPanic || !errors.As(info.Err, &pe) {
+		t.Fatalf("expected panic, got %v (%v)", info.Reason, info.Err)
+	}
+	wp, ok := pe.Value.(*pipeline.WorkerPanic)
+	if !ok {
+		t.Fatalf("expected *pipeline.WorkerPanic, got %T", pe.Value)
+	}
+	if wp.Value != "boom" || len(wp.Stack) == 0 {
+		t.Fatalf("unexpected worker panic %v", wp.Value)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []string
+		started  int32
+	}{
+		// blocked reading the next request
+		{"idle", nil, 0},
+		// blocked waiting for an in-flight slot
+		{"backpressure", []string{"block", "next"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancels := make(chan context.CancelFunc, 1)
+			var started int32
+			addr, closed := startServer(t, func(ctx context.Context, req *pipeline.Request, resp []byte) ([]byte, error) {
+				atomic.AddInt32(&started, 1)
+				<-ctx.Done()
+				return nil, nil
+			}, &pipeline.Config{Workers: 2, MaxInFlight: 1}, func(cancel context.CancelFunc) {
+				cancels <- cancel
+			})
+
+			conn := dial(t, addr)
+			if len(tt.requests) > 0 {
+				send(t, conn, tt.requests...)
+			}
+			cancel := <-cancels
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			info := waitClosed(t, closed)
+			if !errors.Is(info.Err, context.Canceled) {
+				t.Fatalf("expected %v, got %v", context.Canceled, info.Err)
+			}
+			if n := atomic.LoadInt32(&started); n != tt.started {
+				t.Fatalf("unexpected number of handled requests %d", n)
+			}
+			expectEOF(t, conn)
+		})
+	}
+}
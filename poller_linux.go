@@ -0,0 +1,192 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux
+// +build linux
+
+package tcpserver
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"syscall"
+)
+
+// Maximum number of events returned by a single epoll_wait call
+const pollerEvents = 256
+
+// Registration flags: level triggered, disarmed after each event
+const pollerFlags = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// Epoll based poller waiting for idle connections to become readable (hybrid
+// mode). Readable connections are queued and handed over to the dispatcher by
+// a separate goroutine, so the poller keeps handling events while Dispatch
+// blocks (OverloadBlock); every connection is queued at most once as it isn't
+// re-armed before it has been served.
+type poller struct {
+	server       *Server
+	epfd         int
+	wakeR        int
+	wakeW        int
+	done         chan struct{}
+	readyMutex   sync.Mutex
+	ready        []*TCPConn
+	readySignal  chan struct{}
+	dispatchDone chan struct{}
+}
+
+// Creates a new poller
+func newPoller(s *Server) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create1 failed: %s", err)
+	}
+
+	var pipe [2]int
+	if err = syscall.Pipe2(pipe[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, fmt.Errorf("unable to create wake-up pipe: %s", err)
+	}
+
+	// connection IDs start at 1, so 0 identifies the wake-up pipe
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN}
+	if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, pipe[0], &ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+		return nil, fmt.Errorf("unable to register wake-up pipe: %s", err)
+	}
+
+	p := &poller{
+		server:       s,
+		epfd:         epfd,
+		wakeR:        pipe[0],
+		wakeW:        pipe[1],
+		done:         make(chan struct{}),
+		readySignal:  make(chan struct{}, 1),
+		dispatchDone: make(chan struct{}),
+	}
+
+	go p.run()
+	go p.dispatchReady()
+	return p, nil
+}
+
+// Registers a new connection
+func (p *poller) add(conn *TCPConn) error {
+	return p.ctl(conn, syscall.EPOLL_CTL_ADD)
+}
+
+// Re-arms a connection after it has been handled
+func (p *poller) rearm(conn *TCPConn) error {
+	return p.ctl(conn, syscall.EPOLL_CTL_MOD)
+}
+
+// Adds or modifies the connection's registration; the file descriptor is
+// used within RawConn.Control so that it can't be closed (and reused)
+// concurrently
+func (p *poller) ctl(conn *TCPConn, op int) error {
+	sc, ok := conn.rawConn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("connection doesn't provide a file descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ev := syscall.EpollEvent{
+		Events: pollerFlags,
+		Fd:     int32(uint32(conn.id)),
+		Pad:    int32(uint32(conn.id >> 32)),
+	}
+	var ctlErr error
+	err = rc.Control(func(fd uintptr) {
+		ctlErr = syscall.EpollCtl(p.epfd, op, int(fd), &ev)
+	})
+	if err != nil {
+		return err
+	}
+	if ctlErr != nil {
+		return fmt.Errorf("epoll_ctl failed: %s", ctlErr)
+	}
+	return nil
+}
+
+// Waits for events and hands readable connections over to the dispatcher
+func (p *poller) run() {
+	defer close(p.done)
+
+	events := make([]syscall.EpollEvent, pollerEvents)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			p.server.log(slog.LevelError, "epoll_wait failed; poller stopped", slog.Any("error", err))
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			id := uint64(uint32(events[i].Fd)) | uint64(uint32(events[i].Pad))<<32
+			if id == 0 {
+				return
+			}
+			p.readable(id)
+		}
+	}
+}
+
+// Queues a readable connection for the dispatcher
+func (p *poller) readable(id uint64) {
+	sh := p.server.registry.shard(id)
+	sh.mutex.Lock()
+	conn, ok := sh.conns[id]
+	ok = ok && conn.casState(ConnStateIdle, ConnStateQueued)
+	sh.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	p.readyMutex.Lock()
+	p.ready = append(p.ready, conn)
+	p.readyMutex.Unlock()
+	select {
+	case p.readySignal <- struct{}{}:
+	default:
+	}
+}
+
+// Hands queued readable connections over to the dispatcher; with the
+// OverloadBlock policy this waits until a worker becomes available (or the
+// server is shut down)
+func (p *poller) dispatchReady() {
+	defer close(p.dispatchDone)
+
+	var batch []*TCPConn
+	for range p.readySignal {
+		p.readyMutex.Lock()
+		batch, p.ready = p.ready, batch[:0]
+		p.readyMutex.Unlock()
+
+		for i, conn := range batch {
+			p.server.dispatchReadable(conn)
+			batch[i] = nil
+		}
+	}
+}
+
+// Stops the poller (after all connections have been closed)
+func (p *poller) stop() {
+	_, _ = syscall.Write(p.wakeW, []byte{1})
+	<-p.done
+	// the poller was the only sender
+	close(p.readySignal)
+	<-p.dispatchDone
+
+	syscall.Close(p.epfd)
+	syscall.Close(p.wakeR)
+	syscall.Close(p.wakeW)
+}
@@ -0,0 +1,29 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build !linux
+// +build !linux
+
+package tcpserver
+
+import (
+	"fmt"
+)
+
+// Poller (hybrid mode is only supported on Linux)
+type poller struct{}
+
+func newPoller(s *Server) (*poller, error) {
+	return nil, fmt.Errorf("hybrid mode is only supported on Linux")
+}
+
+func (p *poller) add(conn *TCPConn) error {
+	return fmt.Errorf("hybrid mode is only supported on Linux")
+}
+
+func (p *poller) rearm(conn *TCPConn) error {
+	return fmt.Errorf("hybrid mode is only supported on Linux")
+}
+
+func (p *poller) stop() {
+}
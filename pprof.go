@@ -0,0 +1,53 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"crypto/tls"
+	"runtime/pprof"
+)
+
+// Enables/disables runtime/pprof goroutine labels while serving connections
+// so that CPU and goroutine profiles can be sliced per listener or traffic
+// class. Labels are "listener", "sni" and "alpn" (TLS only) plus labels set
+// with conn.SetPprofLabel(). Must be called before Serve().
+func (s *Server) SetPprofLabels(enabled bool) {
+	s.pprofLabels = enabled
+}
+
+// Adds a pprof label for the connection (see Server.SetPprofLabels); must be
+// called before the connection is served, e.g. from an OnAccept hook
+func (conn *TCPConn) SetPprofLabel(key, value string) {
+	conn.pprofLabels = append(conn.pprofLabels, key, value)
+}
+
+// Sets the worker goroutine's labels for the connection; labels are also
+// added to the connection context so that handlers can use pprof.Do() to add
+// further labels
+func (s *Server) setPprofLabels(conn *TCPConn, labels ...string) {
+	ctx := pprof.WithLabels(*conn.GetContext(), pprof.Labels(labels...))
+	conn.ctx = &ctx
+	pprof.SetGoroutineLabels(ctx)
+}
+
+// Adds SNI and ALPN labels after a successful TLS handshake
+func (s *Server) setTLSPprofLabels(conn *TCPConn, tlsConn *tls.Conn) {
+	state := tlsConn.ConnectionState()
+	labels := make([]string, 0, 4)
+	if state.ServerName != "" {
+		labels = append(labels, "sni", state.ServerName)
+	}
+	if state.NegotiatedProtocol != "" {
+		labels = append(labels, "alpn", state.NegotiatedProtocol)
+	}
+	if len(labels) > 0 {
+		s.setPprofLabels(conn, labels...)
+	}
+}
+
+// Resets the worker goroutine's labels to those of the server context
+// before it returns to the worker pool
+func (s *Server) resetPprofLabels() {
+	pprof.SetGoroutineLabels(*s.GetContext())
+}
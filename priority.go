@@ -0,0 +1,307 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Assigns a connection to a priority class of the worker pool (see
+// WorkerPoolConfig.PriorityClasses) by returning the class index; indexes
+// out of range fall into the last (lowest) class
+type ClassifierFunc func(info ClassifyInfo) int
+
+// Information passed to the classifier
+type ClassifyInfo struct {
+	// Server name (see Server.SetName)
+	Listener string
+	// Client address
+	ClientAddr *net.TCPAddr
+	// Server name indicated by the TLS client (empty if TLS isn't enabled or
+	// the client didn't send one)
+	ServerName string
+	// Connection (not yet served)
+	Conn Connection
+}
+
+// Time to wait for the TLS ClientHello when classifying by server name
+const clientHelloTimeout = time.Second
+
+// Default maximum number of TLS connections waiting for their ClientHello
+const defaultMaxClassifying = 1024
+
+var errClientHelloRead = errors.New("client hello read")
+
+// Sets the classifier assigning connections to priority classes; must be
+// called before Serve(). If TLS is enabled, the TLS ClientHello is read
+// before dispatching the connection (in a separate goroutine so that the
+// accept loop isn't blocked) to classify by server name.
+func (s *Server) SetClassifier(f ClassifierFunc) {
+	s.classifier = f
+}
+
+// Sets the maximum number of TLS connections waiting for their ClientHello
+// to be classified (defaults to 1024); if reached, the worker pool's
+// overload policy is applied to new connections (OverloadBlock for other
+// dispatchers). Must be called before Serve().
+func (s *Server) SetMaxClassifying(n int) {
+	s.maxClassifying = n
+}
+
+// Returns the maximum number of TLS connections waiting for their ClientHello
+func (s *Server) GetMaxClassifying() int {
+	if s.maxClassifying <= 0 {
+		return defaultMaxClassifying
+	}
+	return s.maxClassifying
+}
+
+// Reserves a slot for reading the ClientHello of a new connection; returns
+// ErrOverloaded if the connection has to be rejected due to the overload
+// policy or ErrShutdown if the server is shut down while waiting for a slot
+func (s *Server) acquireClassifySlot() error {
+	policy := OverloadBlock
+	if d, ok := s.dispatcher.(*workerPoolDispatcher); ok {
+		policy = d.config.OverloadPolicy
+	}
+	if policy == OverloadBlock {
+		select {
+		case s.classifySlots <- struct{}{}:
+			return nil
+		case <-s.shutdownChan:
+			return ErrShutdown
+		}
+	}
+	select {
+	case s.classifySlots <- struct{}{}:
+		return nil
+	default:
+		return ErrOverloaded
+	}
+}
+
+// Returns stats per priority class (nil if the dispatcher doesn't support
+// priority classes, i.e. MaxWorkers isn't set)
+func (s *Server) GetPriorityClassStats() []PriorityClassStats {
+	if d, ok := s.dispatcher.(interface {
+		GetPriorityClassStats() []PriorityClassStats
+	}); ok {
+		return d.GetPriorityClassStats()
+	}
+	return nil
+}
+
+// Returns the connection's priority class index
+func (conn *TCPConn) GetPriorityClass() int {
+	return int(conn.priorityClass)
+}
+
+// Classifies and dispatches the connection
+func (s *Server) classifyAndDispatch(conn *TCPConn) {
+	info := ClassifyInfo{
+		Listener:   s.GetName(),
+		ClientAddr: conn.GetClientAddr(),
+		Conn:       conn,
+	}
+	if s.tlsEnabled {
+		info.ServerName = conn.peekServerName()
+		<-s.classifySlots
+	}
+
+	class := s.classifier(info)
+	if class < 0 || class > 255 {
+		class = 255
+	}
+	conn.priorityClass = uint8(class)
+	if conn.span != nil {
+		conn.span.SetAttributes(slog.Int("tcpserver.priority_class", class))
+	}
+
+	s.dispatch(conn)
+}
+
+// Reads the TLS ClientHello and returns the server name; the read bytes are
+// replayed to the TLS handshake later on
+func (conn *TCPConn) peekServerName() (serverName string) {
+	buf := &bytes.Buffer{}
+	netConn := conn.Conn
+
+	_ = netConn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	_ = tls.Server(&peekConn{Conn: netConn, r: io.TeeReader(netConn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	_ = netConn.SetReadDeadline(time.Time{})
+
+	if buf.Len() > 0 {
+		conn.Conn = &prefixConn{Conn: netConn, prefix: buf.Bytes()}
+	}
+	return serverName
+}
+
+// Connection used to read the TLS ClientHello (discards writes)
+type peekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *peekConn) Close() error {
+	return nil
+}
+
+// Connection returning prefix before reading from the underlying connection
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) == 0 {
+		return c.Conn.Read(b)
+	}
+	n := copy(b, c.prefix)
+	c.prefix = c.prefix[n:]
+	return n, nil
+}
+
+// Rule of a rule based classifier; all non-empty criteria have to match
+type PriorityRule struct {
+	// Class index assigned to matching connections
+	Class int
+	// Server names (see Server.SetName)
+	Listeners []string
+	// Client networks in CIDR notation (e.g. "10.0.0.0/8") or single IPs
+	ClientNetworks []string
+	// TLS server names; "*.example.com" matches all subdomains of example.com
+	ServerNames []string
+}
+
+// Compiled priority rule
+type priorityRule struct {
+	class       int
+	listeners   []string
+	networks    []netip.Prefix
+	serverNames []string
+}
+
+// Creates a classifier assigning connections to the class of the first
+// matching rule or to defaultClass if no rule matches
+func NewRuleClassifier(defaultClass int, rules ...PriorityRule) (ClassifierFunc, error) {
+	compiled := make([]priorityRule, len(rules))
+	for i, r := range rules {
+		compiled[i] = priorityRule{
+			class:     r.Class,
+			listeners: r.Listeners,
+		}
+		for _, n := range r.ClientNetworks {
+			prefix, err := parsePrefix(n)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client network %q: %s", n, err)
+			}
+			compiled[i].networks = append(compiled[i].networks, prefix)
+		}
+		for _, name := range r.ServerNames {
+			compiled[i].serverNames = append(compiled[i].serverNames, strings.ToLower(name))
+		}
+	}
+
+	return func(info ClassifyInfo) int {
+		for i := range compiled {
+			if compiled[i].matches(&info) {
+				return compiled[i].class
+			}
+		}
+		return defaultClass
+	}, nil
+}
+
+// Parses a CIDR prefix or a single IP
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return prefix, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Checks whether the rule matches
+func (r *priorityRule) matches(info *ClassifyInfo) bool {
+	if len(r.listeners) > 0 && !containsString(r.listeners, info.Listener) {
+		return false
+	}
+	if len(r.networks) > 0 {
+		if info.ClientAddr == nil {
+			return false
+		}
+		addr := info.ClientAddr.AddrPort().Addr().Unmap()
+		found := false
+		for _, n := range r.networks {
+			if n.Contains(addr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.serverNames) > 0 {
+		name := strings.ToLower(info.ServerName)
+		found := false
+		for _, pattern := range r.serverNames {
+			if matchServerName(pattern, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches a server name against a pattern ("*.example.com" matches all
+// subdomains of example.com)
+func matchServerName(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return len(name) > len(pattern)-1 && strings.HasSuffix(name, pattern[1:])
+	}
+	return pattern == name
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
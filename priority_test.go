@@ -0,0 +1,137 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"crypto/tls"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClassifierServerName(t *testing.T) {
+	cert := testCertificate(t, "example.test")
+	classifier, err := NewRuleClassifier(1, PriorityRule{Class: 0, ServerNames: []string{"*.example.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startServer(t, func(conn Connection) {
+		_, _ = conn.Write([]byte{byte('0' + conn.(*TCPConn).GetPriorityClass())})
+	}, func(s *Server) {
+		s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := s.EnableTLS(); err != nil {
+			t.Fatal(err)
+		}
+		s.SetWorkerPoolConfig(&WorkerPoolConfig{
+			MaxWorkers:      4,
+			PriorityClasses: []PriorityClass{{Name: "high"}, {Name: "low"}},
+		})
+		s.SetClassifier(classifier)
+	})
+
+	for _, tc := range []struct {
+		serverName string
+		class      string
+	}{
+		{"www.example.test", "0"},
+		{"example.org", "1"},
+	} {
+		c, err := tls.Dial("tcp", s.GetListenAddr().String(), &tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(c)
+		c.Close()
+		if string(b) != tc.class {
+			t.Errorf("%s: expected class %s, got %q", tc.serverName, tc.class, b)
+		}
+	}
+}
+
+func TestClassifierLimit(t *testing.T) {
+	cert := testCertificate(t, "example.test")
+	var overloaded int32
+	s := startServer(t, func(conn Connection) {}, func(s *Server) {
+		s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := s.EnableTLS(); err != nil {
+			t.Fatal(err)
+		}
+		s.SetWorkerPoolConfig(&WorkerPoolConfig{OverloadPolicy: OverloadClose})
+		s.SetClassifier(func(info ClassifyInfo) int { return 0 })
+		s.SetMaxClassifying(1)
+		s.AddHooks(Hooks{
+			OnReject: func(conn Connection, reason RejectReason) {
+				if reason == RejectReasonOverload {
+					atomic.AddInt32(&overloaded, 1)
+				}
+			},
+		})
+	})
+
+	// doesn't send a ClientHello and keeps the only slot busy
+	dial(t, s)
+	waitFor(t, "queued connection", func() bool {
+		return s.GetQueuedConnections() == 1
+	})
+
+	c := dial(t, s)
+	waitFor(t, "rejected connection", func() bool {
+		return atomic.LoadInt32(&overloaded) == 1
+	})
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("expected rejected connection to be closed")
+	}
+
+	// the slot is released once the ClientHello timeout is reached
+	waitFor(t, "released slot", func() bool {
+		return len(s.classifySlots) == 0
+	})
+}
+
+func TestClassifierShutdown(t *testing.T) {
+	cert := testCertificate(t, "example.test")
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetLoops(1)
+	s.SetRequestHandler(func(conn Connection) {})
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err = s.EnableTLS(); err != nil {
+		t.Fatal(err)
+	}
+	s.SetClassifier(func(info ClassifyInfo) int { return 0 })
+	s.SetMaxClassifying(1)
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+
+	// the first connection doesn't send a ClientHello and keeps the only
+	// slot busy (until clientHelloTimeout), the accept loop blocks on the
+	// second one
+	start := time.Now()
+	dial(t, s)
+	waitFor(t, "queued connection", func() bool {
+		return s.GetQueuedConnections() == 1
+	})
+	dial(t, s)
+	time.Sleep(50 * time.Millisecond)
+
+	_ = s.Shutdown(50 * time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() didn't return")
+	}
+	if elapsed := time.Since(start); elapsed >= clientHelloTimeout {
+		t.Errorf("expected Serve() to return before the slot has been released, took %s", elapsed)
+	}
+}
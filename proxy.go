@@ -0,0 +1,269 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by Proxy if no data has been transferred within the idle timeout
+var ErrProxyIdleTimeout = errors.New("tcpserver: proxy idle timeout")
+
+// Proxy options (see Proxy)
+type ProxyOptions struct {
+	// Time without data being transferred in either direction after which
+	// proxying is aborted (defaults to 0 which means no timeout)
+	IdleTimeout time.Duration
+	// Size of the copy buffers used if zero-copy isn't possible (defaults to
+	// 32 KiB)
+	BufferSize int
+}
+
+// Number of bytes transferred by Proxy
+type ProxyStats struct {
+	// Bytes copied from the client to upstream
+	ClientToUpstream int64 `json:"client_to_upstream"`
+	// Bytes copied from upstream to the client
+	UpstreamToClient int64 `json:"upstream_to_client"`
+	// Whether splice has been used (both ends plain TCP on Linux)
+	ZeroCopy bool `json:"zero_copy"`
+}
+
+// Default size of the copy buffers
+const defaultProxyBufferSize = 32 * 1024
+
+// Maximum number of bytes spliced at once (activity is recorded in between)
+const proxySpliceChunkSize = 4 * 1024 * 1024
+
+var proxyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, defaultProxyBufferSize)
+		return &b
+	},
+}
+
+// Copies data between the client connection and upstream in both directions
+// until both sides have finished sending (or an error occurred) and returns
+// the number of bytes copied per direction.
+//
+// If one side finishes sending, the write side of the other connection is
+// shut down (half-close) while data keeps flowing in the other direction.
+// Zero-copy (splice) is used if conn is not wrapped by a middleware and
+// both conn and upstream are plain TCP connections; otherwise pooled buffers
+// are used (e.g. with TLS).
+//
+// Neither connection is closed, but their deadlines are reset; conn is closed
+// by the server once the request handler returns, upstream has to be closed
+// by the caller.
+func Proxy(conn Connection, upstream net.Conn, opts *ProxyOptions) (stats ProxyStats, err error) {
+	p := &proxy{
+		bufferSize: defaultProxyBufferSize,
+	}
+	if opts != nil {
+		p.idleTimeout = opts.IdleTimeout
+		if opts.BufferSize > 0 {
+			p.bufferSize = opts.BufferSize
+		}
+	}
+
+	client := net.Conn(conn)
+	if tc, ok := conn.(*TCPConn); ok && runtime.GOOS == "linux" {
+		// bytes are accounted for by copy(), so the connection isn't marked
+		// as handed out (see GetNetConn)
+		if raw, ok := tc.Conn.(*net.TCPConn); ok {
+			if _, ok := upstream.(*net.TCPConn); ok {
+				p.zeroCopy = true
+				p.clientConn = tc
+				client = raw
+			}
+		}
+	}
+	stats.ZeroCopy = p.zeroCopy
+	p.touch()
+	if p.idleTimeout > 0 {
+		p.mutex.Lock()
+		p.timer = time.AfterFunc(p.idleTimeout, func() {
+			p.watch(client, upstream)
+		})
+		p.mutex.Unlock()
+	}
+
+	var upstreamErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stats.ClientToUpstream, upstreamErr = p.copy(upstream, client, false)
+		upstreamErr = p.finish(upstreamErr, upstream, client, upstream)
+	}()
+	stats.UpstreamToClient, err = p.copy(client, upstream, true)
+	err = p.finish(err, underlyingConn(conn), client, upstream)
+
+	<-done
+	if err == nil {
+		err = upstreamErr
+	}
+	if p.timer != nil {
+		p.mutex.Lock()
+		p.timer.Stop()
+		p.stopped = true
+		p.mutex.Unlock()
+	}
+
+	_ = client.SetDeadline(time.Time{})
+	_ = upstream.SetDeadline(time.Time{})
+	return stats, err
+}
+
+// Returns the connection's underlying net.Conn (without marking a TCPConn's
+// connection as handed out)
+func underlyingConn(conn Connection) net.Conn {
+	if tc, ok := conn.(*TCPConn); ok {
+		return tc.Conn
+	}
+	return conn.GetNetConn()
+}
+
+// State shared by both copy directions of Proxy
+type proxy struct {
+	idleTimeout  time.Duration
+	bufferSize   int
+	zeroCopy     bool
+	clientConn   *TCPConn
+	lastActivity int64
+	aborted      int32
+	idle         int32
+	mutex        sync.Mutex
+	timer        *time.Timer
+	stopped      bool
+}
+
+// Records activity for the idle timeout
+func (p *proxy) touch() {
+	if p.idleTimeout > 0 {
+		atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+	}
+}
+
+// Aborts proxying if no data has been transferred within the idle timeout
+// (called by the idle timer). There are no write deadlines as an expiring
+// deadline would drop the data of an interrupted splice.
+func (p *proxy) watch(conns ...net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped {
+		return
+	}
+	last := time.Unix(0, atomic.LoadInt64(&p.lastActivity))
+	if d := time.Until(last.Add(p.idleTimeout)); d > 0 {
+		p.timer.Reset(d)
+		return
+	}
+	atomic.StoreInt32(&p.idle, 1)
+	for _, c := range conns {
+		_ = c.SetDeadline(time.Unix(1, 0))
+	}
+}
+
+// Returns whether copying has to stop due to the idle timeout or an error in
+// the other direction
+func (p *proxy) isAborted() bool {
+	return atomic.LoadInt32(&p.idle) == 1 || atomic.LoadInt32(&p.aborted) == 1
+}
+
+// Copies from src to dst until EOF; toClient is set for the upstream to client
+// direction
+func (p *proxy) copy(dst net.Conn, src net.Conn, toClient bool) (written int64, err error) {
+	var buf []byte
+	if !p.zeroCopy {
+		if p.bufferSize == defaultProxyBufferSize {
+			bp := proxyBufferPool.Get().(*[]byte)
+			defer proxyBufferPool.Put(bp)
+			buf = *bp
+		} else {
+			buf = make([]byte, p.bufferSize)
+		}
+	}
+
+	for {
+		if p.zeroCopy && p.idleTimeout > 0 {
+			// splice only returns at EOF or after a whole chunk; return
+			// regularly so that trickling data is recorded as activity
+			// (an expiring read deadline doesn't drop any data)
+			_ = src.SetReadDeadline(time.Now().Add(p.idleTimeout / 2))
+			if p.isAborted() {
+				// the deadline set on abort might have been overwritten
+				_ = src.SetReadDeadline(time.Unix(1, 0))
+			}
+		}
+
+		var (
+			n   int64
+			eof bool
+		)
+		if p.zeroCopy {
+			n, err = dst.(io.ReaderFrom).ReadFrom(&io.LimitedReader{R: src, N: proxySpliceChunkSize})
+			eof = err == nil && n < proxySpliceChunkSize
+			if toClient {
+				p.clientConn.addWritten(n)
+			} else {
+				p.clientConn.addRead(n)
+			}
+		} else {
+			var nr int
+			nr, err = src.Read(buf)
+			if nr > 0 {
+				var nw int
+				nw, err = dst.Write(buf[:nr])
+				n = int64(nw)
+			}
+			if err == io.EOF {
+				err, eof = nil, true
+			}
+		}
+
+		if n > 0 {
+			written += n
+			p.touch()
+		}
+		if err != nil {
+			if atomic.LoadInt32(&p.idle) == 1 {
+				return written, ErrProxyIdleTimeout
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && p.zeroCopy && p.idleTimeout > 0 && !p.isAborted() {
+				continue
+			}
+			return written, err
+		}
+		if eof {
+			return written, nil
+		}
+	}
+}
+
+// Finishes a copy direction: on EOF the write side of dst is shut down (if
+// supported, e.g. by *net.TCPConn and *tls.Conn), on error the other
+// direction is aborted. Returns the error to be reported (errors caused by
+// aborting are not reported).
+func (p *proxy) finish(err error, dst net.Conn, conns ...net.Conn) error {
+	if err == nil {
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		return nil
+	}
+
+	if !atomic.CompareAndSwapInt32(&p.aborted, 0, 1) {
+		return nil
+	}
+	for _, c := range conns {
+		_ = c.SetDeadline(time.Unix(1, 0))
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Active health check config; upstreams are checked by connecting to them
+type HealthCheckConfig struct {
+	// Time between checks (defaults to 10s)
+	Interval time.Duration
+	// Timeout for connecting (defaults to 2s)
+	Timeout time.Duration
+	// Number of consecutive successful checks after which an unhealthy
+	// upstream is healthy again (defaults to 2)
+	HealthyThreshold int
+	// Number of consecutive failed checks after which an upstream is
+	// unhealthy (defaults to 3)
+	UnhealthyThreshold int
+}
+
+func (c *HealthCheckConfig) setDefaults() {
+	if c.Interval <= 0 {
+		c.Interval = 10 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 2 * time.Second
+	}
+	if c.HealthyThreshold <= 0 {
+		c.HealthyThreshold = 2
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = 3
+	}
+}
+
+// Passive outlier detection config; upstreams failing to accept connections
+// are ejected for some time
+type OutlierDetectionConfig struct {
+	// Number of consecutive failed connection attempts after which an
+	// upstream is ejected (defaults to 5)
+	ConsecutiveFailures int
+	// Time an upstream stays ejected (defaults to 30s)
+	EjectionTime time.Duration
+	// Maximum percentage of upstreams ejected at the same time (defaults to
+	// 50); at least one upstream may always be ejected
+	MaxEjectionPercent int
+}
+
+func (c *OutlierDetectionConfig) setDefaults() {
+	if c.ConsecutiveFailures <= 0 {
+		c.ConsecutiveFailures = 5
+	}
+	if c.EjectionTime <= 0 {
+		c.EjectionTime = 30 * time.Second
+	}
+	if c.MaxEjectionPercent <= 0 {
+		c.MaxEjectionPercent = 50
+	}
+}
+
+// Checks an upstream periodically until the pool is stopped
+func (p *Pool) healthCheckLoop(u *Upstream, i int) {
+	defer p.wg.Done()
+	hc := p.config.HealthCheck
+
+	// spread the checks of all upstreams over the interval
+	timer := time.NewTimer(hc.Interval * time.Duration(i) / time.Duration(len(p.upstreams)))
+	defer timer.Stop()
+
+	successes, failures := 0, 0
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-timer.C:
+		}
+
+		if p.check(u) {
+			successes, failures = successes+1, 0
+			if successes >= hc.HealthyThreshold {
+				atomic.StoreInt32(&u.unhealthy, 0)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if failures >= hc.UnhealthyThreshold {
+				atomic.StoreInt32(&u.unhealthy, 1)
+			}
+		}
+		timer.Reset(hc.Interval)
+	}
+}
+
+// Returns whether a connection to the upstream can be established
+func (p *Pool) check(u *Upstream) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthCheck.Timeout)
+	defer cancel()
+	conn, err := p.config.Dialer(ctx, "tcp", u.addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Records a failed connection attempt and ejects the upstream if it has
+// failed too often
+func (p *Pool) recordFailure(u *Upstream) {
+	od := p.config.OutlierDetection
+	if od == nil || int(atomic.AddInt32(&u.consecutiveFailures, 1)) < od.ConsecutiveFailures {
+		return
+	}
+
+	maxEjected := len(p.upstreams) * od.MaxEjectionPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	if p.countEjected() >= maxEjected {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	until := atomic.LoadInt64(&u.ejectedUntil)
+	if now < until || !atomic.CompareAndSwapInt64(&u.ejectedUntil, until, now+int64(od.EjectionTime)) {
+		return
+	}
+	atomic.StoreInt32(&u.consecutiveFailures, 0)
+	atomic.AddUint64(&u.ejections, 1)
+}
+
+// Returns number of currently ejected upstreams
+func (p *Pool) countEjected() int {
+	n := 0
+	for _, u := range p.upstreams {
+		if u.IsEjected() {
+			n++
+		}
+	}
+	return n
+}
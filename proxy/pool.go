@@ -0,0 +1,408 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by Pool.Dial if no upstream is available
+var ErrNoUpstream = errors.New("proxy: no upstream available")
+
+// Strategy used to pick an upstream
+type Strategy uint8
+
+const (
+	// Picks available upstreams in turn (weights are ignored)
+	RoundRobin Strategy = iota
+	// Picks the upstream with the fewest active connections relative to its
+	// weight
+	LeastConnections
+	// Picks the upstream by hashing the client IP (clients stick to an
+	// upstream as long as it is available)
+	ConsistentHash
+	// Picks available upstreams in turn according to their weights (smooth
+	// weighted round robin)
+	WeightedRoundRobin
+)
+
+var strategyNames = [...]string{
+	RoundRobin:         "round_robin",
+	LeastConnections:   "least_connections",
+	ConsistentHash:     "consistent_hash",
+	WeightedRoundRobin: "weighted_round_robin",
+}
+
+// Returns strategy name
+func (s Strategy) String() string {
+	if int(s) < len(strategyNames) {
+		return strategyNames[s]
+	}
+	return "unknown"
+}
+
+// Dialer function type used to connect to upstreams
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Upstream config
+type UpstreamConfig struct {
+	// Address (host:port)
+	Addr string
+	// Weight (defaults to 1); used by all strategies but RoundRobin
+	Weight int
+}
+
+// Pool config
+type PoolConfig struct {
+	Upstreams []UpstreamConfig
+	// Strategy used to pick an upstream (defaults to RoundRobin)
+	Strategy Strategy
+	// Timeout for connecting to an upstream (defaults to 5s)
+	ConnectTimeout time.Duration
+	// Maximum number of upstreams tried per connection if connecting fails
+	// (defaults to 3)
+	MaxAttempts int
+	// Function used to connect to upstreams and for health checks (defaults
+	// to net.Dialer.DialContext)
+	Dialer DialerFunc
+	// Active health checks (defaults to nil which means disabled)
+	HealthCheck *HealthCheckConfig
+	// Passive outlier detection (defaults to nil which means disabled)
+	OutlierDetection *OutlierDetectionConfig
+}
+
+// Number of points per weight unit on the consistent hashing ring
+const ringPointsPerWeight = 160
+
+// Pool of upstreams
+type Pool struct {
+	config    PoolConfig
+	upstreams []*Upstream
+	ring      []ringPoint
+	next      uint64
+	wrrMutex  sync.Mutex
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Point on the consistent hashing ring
+type ringPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// Upstream and its state
+type Upstream struct {
+	addr                string
+	weight              int
+	active              int64
+	total               uint64
+	failures            uint64
+	unhealthy           int32
+	consecutiveFailures int32
+	ejectedUntil        int64
+	ejections           uint64
+	currentWeight       int
+}
+
+// Creates a new upstream pool (uses defaults if config is nil; at least one
+// upstream is required though)
+func NewPool(config *PoolConfig) (*Pool, error) {
+	if config == nil {
+		config = &PoolConfig{}
+	}
+	p := &Pool{
+		config: *config,
+	}
+	if len(p.config.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams given")
+	}
+	if int(p.config.Strategy) >= len(strategyNames) {
+		return nil, fmt.Errorf("unknown strategy %d", p.config.Strategy)
+	}
+	if p.config.ConnectTimeout <= 0 {
+		p.config.ConnectTimeout = 5 * time.Second
+	}
+	if p.config.MaxAttempts <= 0 {
+		p.config.MaxAttempts = 3
+	}
+	if p.config.Dialer == nil {
+		p.config.Dialer = (&net.Dialer{}).DialContext
+	}
+	if p.config.HealthCheck != nil {
+		hc := *p.config.HealthCheck
+		hc.setDefaults()
+		p.config.HealthCheck = &hc
+	}
+	if p.config.OutlierDetection != nil {
+		od := *p.config.OutlierDetection
+		od.setDefaults()
+		p.config.OutlierDetection = &od
+	}
+
+	for _, uc := range p.config.Upstreams {
+		if _, _, err := net.SplitHostPort(uc.Addr); err != nil {
+			return nil, fmt.Errorf("invalid upstream address '%s': %s", uc.Addr, err)
+		}
+		if uc.Weight < 0 {
+			return nil, fmt.Errorf("invalid weight %d for upstream '%s'", uc.Weight, uc.Addr)
+		}
+		u := &Upstream{addr: uc.Addr, weight: uc.Weight}
+		if u.weight == 0 {
+			u.weight = 1
+		}
+		p.upstreams = append(p.upstreams, u)
+
+		for i := 0; i < u.weight*ringPointsPerWeight; i++ {
+			p.ring = append(p.ring, ringPoint{hash: hashString(u.addr + "#" + strconv.Itoa(i)), upstream: u})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+	return p, nil
+}
+
+// Starts active health checks (if enabled)
+func (p *Pool) Start() {
+	if p.config.HealthCheck == nil || p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	for i, u := range p.upstreams {
+		p.wg.Add(1)
+		go p.healthCheckLoop(u, i)
+	}
+}
+
+// Stops active health checks
+func (p *Pool) Stop() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.stop = nil
+}
+
+// Returns the pool's strategy
+func (p *Pool) GetStrategy() Strategy {
+	return p.config.Strategy
+}
+
+// Returns all upstreams
+func (p *Pool) GetUpstreams() []*Upstream {
+	return p.upstreams
+}
+
+// Connects to an upstream picked by the pool's strategy; if connecting fails,
+// other upstreams are tried (up to MaxAttempts). Release has to be called
+// with the returned upstream once the connection has been closed.
+func (p *Pool) Dial(ctx context.Context, client *net.TCPAddr) (conn net.Conn, u *Upstream, err error) {
+	var (
+		ip    net.IP
+		tried []*Upstream
+	)
+	if client != nil {
+		ip = client.IP
+	}
+
+	for attempt := 0; attempt < p.config.MaxAttempts; attempt++ {
+		if u = p.pick(ip, tried); u == nil {
+			break
+		}
+		tried = append(tried, u)
+
+		atomic.AddInt64(&u.active, 1)
+		dctx, cancel := context.WithTimeout(ctx, p.config.ConnectTimeout)
+		conn, err = p.config.Dialer(dctx, "tcp", u.addr)
+		cancel()
+		if err == nil {
+			atomic.AddUint64(&u.total, 1)
+			atomic.StoreInt32(&u.consecutiveFailures, 0)
+			return conn, u, nil
+		}
+
+		atomic.AddInt64(&u.active, -1)
+		atomic.AddUint64(&u.failures, 1)
+		p.recordFailure(u)
+		err = fmt.Errorf("unable to connect to upstream %s: %s", u.addr, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = ErrNoUpstream
+	}
+	return nil, nil, err
+}
+
+// Releases an upstream returned by Dial
+func (p *Pool) Release(u *Upstream) {
+	atomic.AddInt64(&u.active, -1)
+}
+
+// Picks an available upstream that hasn't been tried yet (nil if there is none)
+func (p *Pool) pick(ip net.IP, tried []*Upstream) *Upstream {
+	n := len(p.upstreams)
+	usable := func(u *Upstream) bool {
+		return u.IsAvailable() && !containsUpstream(tried, u)
+	}
+
+	switch p.config.Strategy {
+	case LeastConnections:
+		var best *Upstream
+		var bestActive int64
+		start := int(atomic.AddUint64(&p.next, 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			u := p.upstreams[(start+i)%n]
+			if !usable(u) {
+				continue
+			}
+			active := atomic.LoadInt64(&u.active)
+			if best == nil || active*int64(best.weight) < bestActive*int64(u.weight) {
+				best, bestActive = u, active
+			}
+		}
+		return best
+
+	case ConsistentHash:
+		h := hashBytes(ip.To16())
+		start := sort.Search(len(p.ring), func(i int) bool {
+			return p.ring[i].hash >= h
+		})
+		for i := 0; i < len(p.ring); i++ {
+			if u := p.ring[(start+i)%len(p.ring)].upstream; usable(u) {
+				return u
+			}
+		}
+		return nil
+
+	case WeightedRoundRobin:
+		p.wrrMutex.Lock()
+		defer p.wrrMutex.Unlock()
+		var best *Upstream
+		total := 0
+		for _, u := range p.upstreams {
+			if !usable(u) {
+				continue
+			}
+			u.currentWeight += u.weight
+			total += u.weight
+			if best == nil || u.currentWeight > best.currentWeight {
+				best = u
+			}
+		}
+		if best != nil {
+			best.currentWeight -= total
+		}
+		return best
+
+	default:
+		start := int(atomic.AddUint64(&p.next, 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			if u := p.upstreams[(start+i)%n]; usable(u) {
+				return u
+			}
+		}
+		return nil
+	}
+}
+
+// Returns upstream address
+func (u *Upstream) GetAddr() string {
+	return u.addr
+}
+
+// Returns upstream weight
+func (u *Upstream) GetWeight() int {
+	return u.weight
+}
+
+// Returns number of active connections (including connection attempts)
+func (u *Upstream) GetActiveConnections() int64 {
+	return atomic.LoadInt64(&u.active)
+}
+
+// Returns number of established connections
+func (u *Upstream) GetTotalConnections() uint64 {
+	return atomic.LoadUint64(&u.total)
+}
+
+// Returns number of failed connection attempts
+func (u *Upstream) GetFailures() uint64 {
+	return atomic.LoadUint64(&u.failures)
+}
+
+// Returns number of times the upstream has been ejected
+func (u *Upstream) GetEjections() uint64 {
+	return atomic.LoadUint64(&u.ejections)
+}
+
+// Returns whether the upstream passes the active health checks (always true
+// if disabled)
+func (u *Upstream) IsHealthy() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+// Returns whether the upstream is currently ejected by outlier detection
+func (u *Upstream) IsEjected() bool {
+	until := atomic.LoadInt64(&u.ejectedUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// Returns whether new connections may be sent to the upstream
+func (u *Upstream) IsAvailable() bool {
+	return u.IsHealthy() && !u.IsEjected()
+}
+
+// Returns whether list contains u
+func containsUpstream(list []*Upstream, u *Upstream) bool {
+	for _, v := range list {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns 32 bit FNV-1a hash of s (see hashBytes)
+func hashString(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return mixHash(h)
+}
+
+// Returns 32 bit FNV-1a hash of b; the result is mixed so that keys differing
+// only in their last bytes (like neighboring IPs) are spread over the ring
+func hashBytes(b []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return mixHash(h)
+}
+
+// Finalizer of MurmurHash3
+func mixHash(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,75 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package proxy implements an L4 (TCP) reverse proxy / load balancer on top
+// of tcpserver.
+//
+//	pool, err := proxy.NewPool(&proxy.PoolConfig{
+//		Upstreams: []proxy.UpstreamConfig{{Addr: "10.0.0.1:80"}, {Addr: "10.0.0.2:80", Weight: 2}},
+//		Strategy:  proxy.LeastConnections,
+//	})
+//	pool.Start()
+//	defer pool.Stop()
+//	server.SetRequestHandler(proxy.NewHandler(pool, nil))
+//
+// Upstreams are picked by a strategy (round robin, least connections,
+// consistent hashing by client IP or weighted round robin) among the ones
+// that pass the active health checks and aren't ejected by the passive
+// outlier detection. If connecting fails, other upstreams are tried.
+//
+// The dialer is pluggable (PoolConfig.Dialer), so pools can be pointed at
+// local stand-in upstreams or in-memory connections.
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Handler config
+type HandlerConfig struct {
+	// Time without data being transferred in either direction after which
+	// the connection is closed (defaults to 0 which means no timeout)
+	IdleTimeout time.Duration
+	// Send a PROXY protocol v2 header with the client and server addresses
+	// to upstreams
+	ProxyProtocol bool
+}
+
+// Returns a request handler proxying connections to upstreams of the given
+// pool. Errors (e.g. if no upstream is available) are set on the connection
+// (see tcpserver.Connection.SetError).
+func NewHandler(pool *Pool, config *HandlerConfig) tcpserver.RequestHandlerFunc {
+	var hc HandlerConfig
+	if config != nil {
+		hc = *config
+	}
+
+	return func(conn tcpserver.Connection) {
+		ctx := context.Background()
+		if c := conn.GetContext(); c != nil {
+			ctx = *c
+		}
+
+		upstream, u, err := pool.Dial(ctx, conn.GetClientAddr())
+		if err != nil {
+			conn.SetError(err)
+			return
+		}
+		defer pool.Release(u)
+		defer upstream.Close()
+
+		if hc.ProxyProtocol {
+			if _, err = upstream.Write(AppendProxyHeaderV2(nil, conn.GetClientAddr(), conn.GetServerAddr())); err != nil {
+				conn.SetError(err)
+				return
+			}
+		}
+
+		if _, err = tcpserver.Proxy(conn, upstream, &tcpserver.ProxyOptions{IdleTimeout: hc.IdleTimeout}); err != nil {
+			conn.SetError(err)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/proxy"
+)
+
+// Starts a local stand-in upstream calling handler for every connection
+func startUpstream(t *testing.T, handler func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+	return l.Addr().String()
+}
+
+// Starts n upstreams writing their index and closing the connection
+func startUpstreams(t *testing.T, n int) []proxy.UpstreamConfig {
+	t.Helper()
+	upstreams := make([]proxy.UpstreamConfig, n)
+	for i := range upstreams {
+		id := byte('0' + i)
+		upstreams[i].Addr = startUpstream(t, func(conn net.Conn) {
+			_, _ = conn.Write([]byte{id})
+		})
+	}
+	return upstreams
+}
+
+// Dialer failing for all addresses marked as down
+type flakyDialer struct {
+	mutex sync.Mutex
+	down  map[string]bool
+	dials map[string]int
+}
+
+func newFlakyDialer() *flakyDialer {
+	return &flakyDialer{down: map[string]bool{}, dials: map[string]int{}}
+}
+
+func (d *flakyDialer) setDown(addr string, down bool) {
+	d.mutex.Lock()
+	d.down[addr] = down
+	d.mutex.Unlock()
+}
+
+func (d *flakyDialer) getDials(addr string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.dials[addr]
+}
+
+func (d *flakyDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.dials[addr]++
+	down := d.down[addr]
+	d.mutex.Unlock()
+	if down {
+		return nil, errors.New("connection refused")
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+// Dials the pool and returns the index written by the picked upstream
+func pickIndex(t *testing.T, pool *proxy.Pool, client *net.TCPAddr) int {
+	t.Helper()
+	conn, u, err := pool.Dial(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Release(u)
+	defer conn.Close()
+	b, err := io.ReadAll(conn)
+	if err != nil || len(b) != 1 {
+		t.Fatalf("unexpected upstream response %q (%v)", b, err)
+	}
+	return int(b[0] - '0')
+}
+
+// Polls cond until it returns true or the timeout is reached
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewPoolNil(t *testing.T) {
+	if _, err := proxy.NewPool(nil); err == nil {
+		t.Error("expected error for pool without upstreams")
+	}
+}
+
+func TestBalancing(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+	tests := []struct {
+		name     string
+		strategy proxy.Strategy
+		weights  []int
+		picks    int
+		expected []int
+	}{
+		{"round robin", proxy.RoundRobin, []int{1, 5, 1}, 30, []int{10, 10, 10}},
+		{"weighted round robin", proxy.WeightedRoundRobin, []int{1, 2, 3}, 30, []int{5, 10, 15}},
+		{"consistent hash", proxy.ConsistentHash, []int{1, 1, 1}, 10, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			upstreams := startUpstreams(t, len(tc.weights))
+			for i, w := range tc.weights {
+				upstreams[i].Weight = w
+			}
+			pool, err := proxy.NewPool(&proxy.PoolConfig{Upstreams: upstreams, Strategy: tc.strategy})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counts := make([]int, len(upstreams))
+			for i := 0; i < tc.picks; i++ {
+				counts[pickIndex(t, pool, client)]++
+			}
+			if tc.expected == nil {
+				// all connections of the client go to the same upstream
+				for _, c := range counts {
+					if c != 0 && c != tc.picks {
+						t.Errorf("expected client to stick to one upstream, got %v", counts)
+					}
+				}
+				return
+			}
+			for i := range counts {
+				if counts[i] != tc.expected[i] {
+					t.Errorf("expected %v, got %v", tc.expected, counts)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	upstreams := make([]proxy.UpstreamConfig, 2)
+	for i := range upstreams {
+		upstreams[i].Addr = startUpstream(t, func(conn net.Conn) {
+			_, _ = io.Copy(io.Discard, conn)
+		})
+	}
+	upstreams[1].Weight = 2
+	pool, err := proxy.NewPool(&proxy.PoolConfig{Upstreams: upstreams, Strategy: proxy.LeastConnections})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// held connections are spread according to the weights
+	for i := 0; i < 6; i++ {
+		conn, u, err := pool.Dial(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pool.Release(u)
+		defer conn.Close()
+	}
+	for i, u := range pool.GetUpstreams() {
+		if expected := int64(2 * (i + 1)); u.GetActiveConnections() != expected {
+			t.Errorf("upstream %d: expected %d active connections, got %d", i, expected, u.GetActiveConnections())
+		}
+	}
+}
+
+func TestConsistentHashFailover(t *testing.T) {
+	upstreams := startUpstreams(t, 3)
+	dialer := newFlakyDialer()
+	pool, err := proxy.NewPool(&proxy.PoolConfig{
+		Upstreams: upstreams,
+		Strategy:  proxy.ConsistentHash,
+		Dialer:    dialer.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 1234}
+	first := pickIndex(t, pool, client)
+	dialer.setDown(upstreams[first].Addr, true)
+	if second := pickIndex(t, pool, client); second == first {
+		t.Errorf("expected failover away from upstream %d", first)
+	}
+	if failures := pool.GetUpstreams()[first].GetFailures(); failures != 1 {
+		t.Errorf("expected 1 failure, got %d", failures)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	upstreams := startUpstreams(t, 2)
+	dialer := newFlakyDialer()
+	pool, err := proxy.NewPool(&proxy.PoolConfig{
+		Upstreams: upstreams,
+		Dialer:    dialer.dial,
+		HealthCheck: &proxy.HealthCheckConfig{
+			Interval:           5 * time.Millisecond,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Start()
+	defer pool.Stop()
+
+	down := pool.GetUpstreams()[0]
+	dialer.setDown(down.GetAddr(), true)
+	waitFor(t, "unhealthy upstream", func() bool {
+		return !down.IsHealthy()
+	})
+
+	// the unhealthy upstream isn't dialed anymore
+	pool.Stop()
+	dials := dialer.getDials(down.GetAddr())
+	for i := 0; i < 4; i++ {
+		if idx := pickIndex(t, pool, nil); idx != 1 {
+			t.Errorf("expected upstream 1, got %d", idx)
+		}
+	}
+	if n := dialer.getDials(down.GetAddr()); n != dials {
+		t.Errorf("expected no dials to the unhealthy upstream, got %d", n-dials)
+	}
+
+	dialer.setDown(down.GetAddr(), false)
+	pool.Start()
+	waitFor(t, "healthy upstream", func() bool {
+		return down.IsHealthy()
+	})
+}
+
+func TestOutlierDetection(t *testing.T) {
+	upstreams := startUpstreams(t, 4)
+	dialer := newFlakyDialer()
+	pool, err := proxy.NewPool(&proxy.PoolConfig{
+		Upstreams:   upstreams,
+		Dialer:      dialer.dial,
+		MaxAttempts: 1,
+		OutlierDetection: &proxy.OutlierDetectionConfig{
+			ConsecutiveFailures: 2,
+			EjectionTime:        100 * time.Millisecond,
+			MaxEjectionPercent:  25,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer.setDown(upstreams[0].Addr, true)
+	dialer.setDown(upstreams[1].Addr, true)
+
+	for i := 0; i < 8; i++ {
+		_, u, err := pool.Dial(context.Background(), nil)
+		if err == nil {
+			pool.Release(u)
+		}
+	}
+
+	// only one upstream (25%) may be ejected at the same time
+	ejected := 0
+	for _, u := range pool.GetUpstreams()[:2] {
+		if u.IsEjected() {
+			ejected++
+			if u.GetEjections() != 1 {
+				t.Errorf("expected 1 ejection, got %d", u.GetEjections())
+			}
+		}
+	}
+	if ejected != 1 {
+		t.Fatalf("expected 1 ejected upstream, got %d", ejected)
+	}
+
+	waitFor(t, "ejection to expire", func() bool {
+		for _, u := range pool.GetUpstreams() {
+			if u.IsEjected() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestNoUpstream(t *testing.T) {
+	upstreams := startUpstreams(t, 2)
+	dialer := newFlakyDialer()
+	for _, u := range upstreams {
+		dialer.setDown(u.Addr, true)
+	}
+	pool, err := proxy.NewPool(&proxy.PoolConfig{Upstreams: upstreams, Dialer: dialer.dial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = pool.Dial(context.Background(), nil); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, u := range upstreams {
+		if n := dialer.getDials(u.Addr); n != 1 {
+			t.Errorf("expected 1 dial to %s, got %d", u.Addr, n)
+		}
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		name     string
+		src, dst *net.TCPAddr
+		expected string
+	}{
+		{
+			"ipv4",
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324},
+			&net.TCPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 443},
+			sig + "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\xc6\x33\x64\x02" + "\xdc\x04" + "\x01\xbb",
+		},
+		{
+			"ipv6",
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2},
+			sig + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x00\x01" + "\x00\x02",
+		},
+		{
+			"mixed",
+			&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2},
+			sig + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xc0\x00\x02\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x00\x01" + "\x00\x02",
+		},
+		{
+			"local",
+			nil,
+			nil,
+			sig + "\x20\x00\x00\x00",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			prefix := []byte("x")
+			b := proxy.AppendProxyHeaderV2(prefix, tc.src, tc.dst)
+			if !bytes.Equal(b, append([]byte("x"), tc.expected...)) {
+				t.Errorf("expected %q, got %q", tc.expected, b[1:])
+			}
+		})
+	}
+}
+
+func TestHandlerProxyProtocol(t *testing.T) {
+	headers := make(chan []byte, 1)
+	upstream := startUpstream(t, func(conn net.Conn) {
+		// IPv4 header: 16 bytes fixed part and 12 bytes addresses
+		header := make([]byte, 28)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		headers <- header
+		_, _ = io.Copy(conn, conn)
+	})
+	pool, err := proxy.NewPool(&proxy.PoolConfig{Upstreams: []proxy.UpstreamConfig{{Addr: upstream}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetRequestHandler(proxy.NewHandler(pool, &proxy.HandlerConfig{ProxyProtocol: true}))
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	defer func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	}()
+
+	c, err := net.Dial("tcp", s.GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo, got %q (%v)", buf, err)
+	}
+
+	client := c.LocalAddr().(*net.TCPAddr)
+	expected := proxy.AppendProxyHeaderV2(nil, client, s.GetListenAddr())
+	if header := <-headers; !bytes.Equal(header, expected) {
+		t.Errorf("expected header %q, got %q", expected, header)
+	}
+	if active := pool.GetUpstreams()[0].GetActiveConnections(); active != 1 {
+		t.Errorf("expected 1 active upstream connection, got %d", active)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// PROXY protocol v2 signature
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2CmdProxy = 0x21 // version 2, PROXY command
+	proxyV2CmdLocal = 0x20 // version 2, LOCAL command
+	proxyV2TCP4     = 0x11
+	proxyV2TCP6     = 0x21
+)
+
+// Appends a PROXY protocol v2 header for a TCP connection from src to dst to
+// b; if src or dst is nil, a LOCAL header (without addresses) is appended
+func AppendProxyHeaderV2(b []byte, src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	b = append(b, proxyV2Signature...)
+	if src == nil || dst == nil {
+		return append(b, proxyV2CmdLocal, 0, 0, 0)
+	}
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		b = append(b, proxyV2CmdProxy, proxyV2TCP4, 0, 12)
+		b = append(b, src4...)
+		b = append(b, dst4...)
+	} else {
+		b = append(b, proxyV2CmdProxy, proxyV2TCP6, 0, 36)
+		b = append(b, src.IP.To16()...)
+		b = append(b, dst.IP.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+}
@@ -0,0 +1,241 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Hides the *net.TCPConn type so that Proxy uses buffered copies
+type bufferedConn struct {
+	*net.TCPConn
+}
+
+// Result of a Proxy call
+type proxyResult struct {
+	stats     ProxyStats
+	err       error
+	connStats ConnStats
+}
+
+// Starts an upstream calling handler for every connection; returns its address
+func startProxyUpstream(t *testing.T, handler func(conn *net.TCPConn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn.(*net.TCPConn))
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return l.Addr().String()
+}
+
+// Starts a server proxying connections to upstream; the results of the Proxy
+// calls are sent to the returned channel
+func startProxy(t *testing.T, upstream string, buffered bool, opts *ProxyOptions) (*Server, chan proxyResult) {
+	t.Helper()
+	results := make(chan proxyResult, 1)
+	s := startServer(t, func(conn Connection) {
+		up, err := net.Dial("tcp", upstream)
+		if err != nil {
+			results <- proxyResult{err: err}
+			return
+		}
+		defer up.Close()
+
+		var upConn net.Conn = up
+		if buffered {
+			upConn = bufferedConn{up.(*net.TCPConn)}
+		}
+		stats, err := Proxy(conn, upConn, opts)
+		results <- proxyResult{stats, err, conn.(*TCPConn).GetStats()}
+	}, nil)
+	return s, results
+}
+
+// Waits for the result of a Proxy call
+func waitProxyResult(t *testing.T, results chan proxyResult) proxyResult {
+	t.Helper()
+	select {
+	case res := <-results:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Proxy to return")
+		return proxyResult{}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	response := []byte("thanks")
+
+	for _, tc := range []struct {
+		name     string
+		buffered bool
+		zeroCopy bool
+	}{
+		{"splice", false, runtime.GOOS == "linux"},
+		{"buffered", true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			received := make(chan []byte, 1)
+			upstream := startProxyUpstream(t, func(conn *net.TCPConn) {
+				// EOF is only seen if the client's half-close is passed on
+				b, _ := io.ReadAll(conn)
+				received <- b
+				_, _ = conn.Write(response)
+			})
+			s, results := startProxy(t, upstream, tc.buffered, nil)
+
+			c := dial(t, s)
+			if _, err := c.Write(payload); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b, err := io.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(<-received, payload) {
+				t.Error("upstream received unexpected data")
+			}
+			if !bytes.Equal(b, response) {
+				t.Errorf("expected response %q, got %q", response, b)
+			}
+			res := waitProxyResult(t, results)
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			expected := ProxyStats{ClientToUpstream: int64(len(payload)), UpstreamToClient: int64(len(response)), ZeroCopy: tc.zeroCopy}
+			if res.stats != expected {
+				t.Errorf("expected stats %+v, got %+v", expected, res.stats)
+			}
+			// spliced bytes are accounted for as well
+			if res.connStats.BytesRead != uint64(len(payload)) || res.connStats.BytesWritten != uint64(len(response)) {
+				t.Errorf("expected %d bytes read and %d written, got %d and %d", len(payload), len(response), res.connStats.BytesRead, res.connStats.BytesWritten)
+			}
+		})
+	}
+}
+
+func TestProxyHalfClose(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		// upstream finishes sending first while the client keeps sending
+		upstream := startProxyUpstream(t, func(conn *net.TCPConn) {
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.CloseWrite()
+			_, _ = io.Copy(io.Discard, conn)
+		})
+		s, results := startProxy(t, upstream, buffered, nil)
+
+		c := dial(t, s)
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		b, err := io.ReadAll(c)
+		if err != nil || string(b) != "hello" {
+			t.Fatalf("expected hello and EOF, got %q (%v)", b, err)
+		}
+		if _, err = c.Write([]byte("still open")); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.(*net.TCPConn).CloseWrite()
+
+		res := waitProxyResult(t, results)
+		if res.err != nil || res.stats.ClientToUpstream != 10 || res.stats.UpstreamToClient != 5 {
+			t.Errorf("buffered=%v: unexpected result %+v (%v)", buffered, res.stats, res.err)
+		}
+	}
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		upstream := startProxyUpstream(t, func(conn *net.TCPConn) {
+			_, _ = io.Copy(io.Discard, conn)
+		})
+		s, results := startProxy(t, upstream, buffered, &ProxyOptions{IdleTimeout: 100 * time.Millisecond})
+
+		// no data at all
+		dial(t, s)
+		start := time.Now()
+		res := waitProxyResult(t, results)
+		if !errors.Is(res.err, ErrProxyIdleTimeout) {
+			t.Errorf("buffered=%v: expected ErrProxyIdleTimeout, got %v", buffered, res.err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("buffered=%v: idle timeout fired after %s", buffered, elapsed)
+		}
+
+		// data flowing in one direction keeps both directions alive
+		c := dial(t, s)
+		for i := 0; i < 10; i++ {
+			if _, err := c.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+		_ = c.(*net.TCPConn).CloseWrite()
+		res = waitProxyResult(t, results)
+		if res.err != nil || res.stats.ClientToUpstream != 10 {
+			t.Errorf("buffered=%v: unexpected result %+v (%v)", buffered, res.stats, res.err)
+		}
+	}
+}
+
+func TestProxyIdleTimeoutSlowReader(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	for _, buffered := range []bool{false, true} {
+		upstream := startProxyUpstream(t, func(conn *net.TCPConn) {
+			_, _ = conn.Write(payload)
+			_ = conn.CloseWrite()
+			_, _ = io.Copy(io.Discard, conn)
+		})
+		s, results := startProxy(t, upstream, buffered, &ProxyOptions{IdleTimeout: 100 * time.Millisecond})
+
+		// the client doesn't read for longer than the idle timeout while it
+		// keeps sending; writes to it time out but no data may get lost
+		c := dial(t, s)
+		for i := 0; i < 10; i++ {
+			if _, err := c.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := io.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, payload) {
+			t.Errorf("buffered=%v: expected %d bytes, got %d", buffered, len(payload), len(b))
+		}
+		_ = c.(*net.TCPConn).CloseWrite()
+
+		res := waitProxyResult(t, results)
+		if res.err != nil || res.stats.UpstreamToClient != int64(len(payload)) {
+			t.Errorf("buffered=%v: unexpected result %+v (%v)", buffered, res.stats, res.err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Connection state
+type ConnState uint32
+
+const (
+	// Accepted, waiting for a worker
+	ConnStateQueued ConnState = iota
+	// TLS handshake in progress
+	ConnStateHandshake
+	// Request handler running
+	ConnStateActive
+	// Connection is being closed
+	ConnStateClosing
+	// Waiting for data in the poller (hybrid mode)
+	ConnStateIdle
+)
+
+var connStateNames = [...]string{
+	ConnStateQueued:    "queued",
+	ConnStateHandshake: "handshake",
+	ConnStateActive:    "active",
+	ConnStateClosing:   "closing",
+	ConnStateIdle:      "idle",
+}
+
+// Returns state name
+func (st ConnState) String() string {
+	if int(st) < len(connStateNames) {
+		return connStateNames[st]
+	}
+	return "unknown"
+}
+
+// Snapshot of a connection as returned by the connection registry
+type ConnInfo struct {
+	ID         uint64
+	ClientAddr *net.TCPAddr
+	ServerAddr *net.TCPAddr
+	StartTime  time.Time
+	State      ConnState
+	Stats      ConnStats
+}
+
+// Number of registry shards (must be a power of two)
+const registryShards = 64
+
+// Registry of all connections of a server, sharded by connection ID
+type connRegistry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShardData struct {
+	mutex sync.Mutex
+	conns map[uint64]*TCPConn
+	// bytes read from/written to removed connections
+	bytesRead    uint64
+	bytesWritten uint64
+}
+
+// Shard padded to a multiple of the cache line size (avoids false sharing
+// between shards)
+type registryShard struct {
+	registryShardData
+	_ [(cacheLineSize - unsafe.Sizeof(registryShardData{})%cacheLineSize) % cacheLineSize]byte
+}
+
+// Fails to compile if registryShard isn't a multiple of the cache line size
+var _ = [1]struct{}{}[unsafe.Sizeof(registryShard{})%cacheLineSize]
+
+// Assumed CPU cache line size
+const cacheLineSize = 64
+
+// Process wide connection ID counter
+var lastConnID uint64
+
+// Returns next unique connection ID
+func nextConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
+
+// Creates a new connection registry
+func newConnRegistry() *connRegistry {
+	r := &connRegistry{}
+	for i := range r.shards {
+		r.shards[i].conns = make(map[uint64]*TCPConn)
+	}
+	return r
+}
+
+// Returns shard for given connection ID
+func (r *connRegistry) shard(id uint64) *registryShard {
+	return &r.shards[id&(registryShards-1)]
+}
+
+// Adds connection
+func (r *connRegistry) add(conn *TCPConn) {
+	sh := r.shard(conn.id)
+	sh.mutex.Lock()
+	sh.conns[conn.id] = conn
+	sh.mutex.Unlock()
+}
+
+// Removes connection and adds its byte counters to the shard's totals
+func (r *connRegistry) remove(conn *TCPConn) {
+	sh := r.shard(conn.id)
+	sh.mutex.Lock()
+	delete(sh.conns, conn.id)
+	sh.bytesRead += atomic.LoadUint64(&conn.bytesRead)
+	sh.bytesWritten += atomic.LoadUint64(&conn.bytesWritten)
+	sh.mutex.Unlock()
+}
+
+// Returns the number of bytes read from and written to all connections (open
+// and closed ones); connections are moved to the totals under the shard's
+// lock, so the result never decreases
+func (r *connRegistry) byteCounters() (read, written uint64) {
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mutex.Lock()
+		read += sh.bytesRead
+		written += sh.bytesWritten
+		for _, conn := range sh.conns {
+			read += atomic.LoadUint64(&conn.bytesRead)
+			written += atomic.LoadUint64(&conn.bytesWritten)
+		}
+		sh.mutex.Unlock()
+	}
+	return read, written
+}
+
+// Calls f for every registered connection while holding the shard's lock;
+// stops iterating if f returns false
+func (r *connRegistry) each(f func(conn *TCPConn) bool) {
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mutex.Lock()
+		for _, conn := range sh.conns {
+			if !f(conn) {
+				sh.mutex.Unlock()
+				return
+			}
+		}
+		sh.mutex.Unlock()
+	}
+}
+
+// Returns a snapshot of all active connections sorted by ID
+func (s *Server) GetConnections() []ConnInfo {
+	infos := make([]ConnInfo, 0, s.GetActiveConnections()+s.GetQueuedConnections())
+	s.registry.each(func(conn *TCPConn) bool {
+		infos = append(infos, conn.info())
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Returns a snapshot of the connection with given ID
+func (s *Server) GetConnection(id uint64) (info ConnInfo, ok bool) {
+	sh := s.registry.shard(id)
+	sh.mutex.Lock()
+	conn, ok := sh.conns[id]
+	if ok {
+		info = conn.info()
+	}
+	sh.mutex.Unlock()
+	return info, ok
+}
+
+// Closes the connection with given ID; returns false if there is no such connection
+func (s *Server) CloseConnection(id uint64) bool {
+	sh := s.registry.shard(id)
+	sh.mutex.Lock()
+	conn, ok := sh.conns[id]
+	var target killTarget
+	if ok {
+		target = conn.markKilled(CloseReasonKilled)
+	}
+	sh.mutex.Unlock()
+
+	if ok {
+		target.close()
+	}
+	return ok
+}
+
+// Closes all connections for which pred returns true; returns the number of closed connections
+func (s *Server) CloseConnections(pred func(info ConnInfo) bool) int {
+	return s.registry.kill(CloseReasonKilled, func(conn *TCPConn) bool {
+		return pred(conn.info())
+	})
+}
+
+// Forcibly closes all connections (after the shutdown deadline has been reached)
+func (s *Server) closeAllConnections() int {
+	return s.registry.kill(CloseReasonShutdown, func(conn *TCPConn) bool {
+		return true
+	})
+}
+
+// Closes all connections for which pred returns true; the sockets are closed
+// after releasing the shard locks. Returns the number of closed connections.
+func (r *connRegistry) kill(reason CloseReason, pred func(conn *TCPConn) bool) int {
+	var targets []killTarget
+	r.each(func(conn *TCPConn) bool {
+		if pred(conn) {
+			targets = append(targets, conn.markKilled(reason))
+		}
+		return true
+	})
+	for _, target := range targets {
+		target.close()
+	}
+	return len(targets)
+}
+
+// Returns connection ID (unique within the process)
+func (conn *TCPConn) GetID() uint64 {
+	return conn.id
+}
+
+// Returns connection snapshot
+func (conn *TCPConn) info() ConnInfo {
+	return ConnInfo{
+		ID:         conn.id,
+		ClientAddr: conn.rawConn.RemoteAddr().(*net.TCPAddr),
+		ServerAddr: conn.rawConn.LocalAddr().(*net.TCPAddr),
+		StartTime:  conn.GetStartTime(),
+		State:      ConnState(atomic.LoadUint32(&conn.state)),
+		Stats:      conn.GetStats(),
+	}
+}
+
+// Sets connection state
+func (conn *TCPConn) setState(st ConnState) {
+	atomic.StoreUint32(&conn.state, uint32(st))
+}
+
+// Sets connection state if the current state is old
+func (conn *TCPConn) casState(old, st ConnState) bool {
+	return atomic.CompareAndSwapUint32(&conn.state, uint32(old), uint32(st))
+}
+
+// Socket of a connection to be closed from outside the request handler
+type killTarget struct {
+	rawConn net.Conn
+	// hybrid mode connection (see wakeConn)
+	wake bool
+}
+
+// Records the close reason and returns the socket to close; must be called
+// while holding the connection's registry shard lock (so that the connection
+// can't be reused meanwhile), the socket should be closed after releasing it
+func (conn *TCPConn) markKilled(reason CloseReason) killTarget {
+	atomic.CompareAndSwapUint32(&conn.killReason, 0, uint32(reason))
+	return killTarget{
+		rawConn: conn.rawConn,
+		wake:    conn.server != nil && conn.server.poller != nil,
+	}
+}
+
+// Closes the socket; the handler will see an error on its next read or write
+func (t killTarget) close() {
+	if t.wake {
+		wakeConn(t.rawConn)
+		return
+	}
+
+	// close the raw socket (doesn't block on sending a TLS close_notify)
+	_ = t.rawConn.Close()
+}
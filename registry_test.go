@@ -0,0 +1,58 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"io"
+	"testing"
+	"unsafe"
+)
+
+func TestRegistryShardSize(t *testing.T) {
+	if size := unsafe.Sizeof(registryShard{}); size%cacheLineSize != 0 {
+		t.Errorf("registry shard size %d isn't a multiple of %d", size, cacheLineSize)
+	}
+}
+
+func TestCloseConnections(t *testing.T) {
+	reasons := make(chan CloseReason, 4)
+	s := startServer(t, func(conn Connection) {
+		_, _ = io.Copy(io.Discard, conn)
+	}, func(s *Server) {
+		s.AddHooks(Hooks{
+			OnClose: func(conn Connection, info CloseInfo) {
+				reasons <- info.Reason
+			},
+		})
+	})
+
+	for i := 0; i < 3; i++ {
+		dial(t, s)
+	}
+	waitFor(t, "connections", func() bool {
+		return len(s.GetConnections()) == 3
+	})
+
+	conns := s.GetConnections()
+	if !s.CloseConnection(conns[0].ID) {
+		t.Fatal("CloseConnection returned false")
+	}
+	if s.CloseConnection(conns[0].ID + 1000) {
+		t.Error("CloseConnection returned true for an unknown ID")
+	}
+	if closed := s.CloseConnections(func(info ConnInfo) bool {
+		return info.ID != conns[0].ID
+	}); closed != 2 {
+		t.Errorf("CloseConnections closed %d connections, want 2", closed)
+	}
+
+	for i := 0; i < 3; i++ {
+		if reason := <-reasons; reason != CloseReasonKilled {
+			t.Errorf("close reason = %s, want killed", reason)
+		}
+	}
+	waitFor(t, "registry to be empty", func() bool {
+		return len(s.GetConnections()) == 0
+	})
+}
@@ -0,0 +1,319 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// SOCKS5 client
+type Client struct {
+	// Address of the SOCKS5 server (host:port)
+	ProxyAddr string
+	// Username and password for username/password authentication (optional)
+	Username string
+	Password string
+	// Function used to connect to the SOCKS5 server (defaults to
+	// net.Dialer.DialContext)
+	Dialer DialerFunc
+}
+
+// Connects to addr through the SOCKS5 server (CONNECT)
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// Connects to addr through the SOCKS5 server (CONNECT); the context is used
+// for connecting to and negotiating with the server
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network '%s'", network)
+	}
+	conn, _, err := c.request(ctx, CommandConnect, addr)
+	return conn, err
+}
+
+// Asks the SOCKS5 server to accept a connection from addr (BIND); addr
+// may have an unspecified IP (0.0.0.0) to accept connections from any peer
+func (c *Client) Bind(ctx context.Context, addr string) (*BindConn, error) {
+	conn, bound, err := c.request(ctx, CommandBind, addr)
+	if err != nil {
+		return nil, err
+	}
+	if bound.IP != nil && bound.IP.IsUnspecified() {
+		bound.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+	return &BindConn{conn: conn, addr: bound}, nil
+}
+
+// Creates a UDP association with the SOCKS5 server (UDP ASSOCIATE)
+func (c *Client) Associate(ctx context.Context) (*UDPConn, error) {
+	var d net.Dialer
+	dial := c.Dialer
+	if dial == nil {
+		dial = d.DialContext
+	}
+	ctrl, err := dial(ctx, "tcp", c.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// send datagrams from the IP used for the control connection
+	var localIP net.IP
+	if la, ok := ctrl.LocalAddr().(*net.TCPAddr); ok {
+		localIP = la.IP
+	}
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	relay, err := c.negotiate(ctx, ctrl, CommandAssociate, addrFromNetAddr(udp.LocalAddr()))
+	if err != nil {
+		udp.Close()
+		ctrl.Close()
+		return nil, err
+	}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		if ra, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = ra.IP
+		}
+	}
+
+	u := &UDPConn{
+		udp:   udp,
+		ctrl:  ctrl,
+		relay: &net.UDPAddr{IP: relay.IP, Port: relay.Port},
+	}
+	// the association ends once the control connection is closed
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		u.Close()
+	}()
+	return u, nil
+}
+
+// Connects to the SOCKS5 server and sends a request; returns the control
+// connection and the bound address of the reply
+func (c *Client) request(ctx context.Context, cmd Command, addr string) (net.Conn, *Addr, error) {
+	dst, err := ParseAddr(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var d net.Dialer
+	dial := c.Dialer
+	if dial == nil {
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, "tcp", c.ProxyAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bound, err := c.negotiate(ctx, conn, cmd, dst)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, bound, nil
+}
+
+// Authenticates and sends a request on conn; returns the bound address of
+// the reply
+func (c *Client) negotiate(ctx context.Context, conn net.Conn, cmd Command, dst *Addr) (*Addr, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	greeting := []byte{socksVersion, 1, methodNoAuth}
+	if c.Username != "" {
+		greeting = []byte{socksVersion, 2, methodNoAuth, methodUserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, fmt.Errorf("socks5: unsupported version %d", buf[0])
+	}
+
+	switch buf[1] {
+	case methodNoAuth:
+	case methodUserPass:
+		if c.Username == "" || len(c.Username) > 255 || len(c.Password) > 255 {
+			return nil, ErrAuthFailed
+		}
+		b := append([]byte{authVersion, byte(len(c.Username))}, c.Username...)
+		b = append(b, byte(len(c.Password)))
+		b = append(b, c.Password...)
+		if _, err := conn.Write(b); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, ErrAuthFailed
+		}
+	default:
+		return nil, ErrAuthFailed
+	}
+
+	if _, err := conn.Write(appendAddr([]byte{socksVersion, byte(cmd), 0}, dst)); err != nil {
+		return nil, err
+	}
+	return readReply(conn)
+}
+
+// Reads a reply; returns a *ReplyError if the reply isn't successful
+func readReply(conn net.Conn) (*Addr, error) {
+	var buf [3]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, fmt.Errorf("socks5: unsupported version %d", buf[0])
+	}
+	addr, err := readAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	if Reply(buf[1]) != ReplySucceeded {
+		return nil, &ReplyError{Reply: Reply(buf[1])}
+	}
+	return addr, nil
+}
+
+// Pending BIND request (see Client.Bind)
+type BindConn struct {
+	conn net.Conn
+	addr *Addr
+}
+
+// Returns the address the SOCKS5 server listens on for the incoming
+// connection
+func (b *BindConn) Addr() *Addr {
+	return b.addr
+}
+
+// Waits for the incoming connection; returns the connection to the peer and
+// the peer's address
+func (b *BindConn) Accept() (net.Conn, *Addr, error) {
+	peer, err := readReply(b.conn)
+	if err != nil {
+		b.conn.Close()
+		return nil, nil, err
+	}
+	return b.conn, peer, nil
+}
+
+// Closes the BIND request
+func (b *BindConn) Close() error {
+	return b.conn.Close()
+}
+
+// UDP association implementing net.PacketConn (see Client.Associate)
+type UDPConn struct {
+	udp       *net.UDPConn
+	ctrl      net.Conn
+	relay     *net.UDPAddr
+	readMutex sync.Mutex
+	readBuf   []byte
+	closeOnce sync.Once
+}
+
+// Sends a datagram to addr (*net.UDPAddr or *Addr) through the relay
+func (u *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	switch addr.(type) {
+	case *net.UDPAddr, *Addr:
+	default:
+		return 0, fmt.Errorf("socks5: unsupported address type %T", addr)
+	}
+	dst := addrFromNetAddr(addr)
+	pkt := appendAddr(make([]byte, 3, 3+262+len(b)), dst)
+	pkt = append(pkt, b...)
+	if _, err := u.udp.WriteToUDP(pkt, u.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Reads a datagram relayed from addr
+func (u *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	u.readMutex.Lock()
+	defer u.readMutex.Unlock()
+	if len(u.readBuf) < 3+262+len(b) {
+		u.readBuf = make([]byte, 3+262+len(b))
+	}
+
+	for {
+		n, from, err := u.udp.ReadFromUDP(u.readBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(u.relay.IP) || from.Port != u.relay.Port || n < 4 || u.readBuf[2] != 0 {
+			continue
+		}
+		rd := bytes.NewReader(u.readBuf[3:n])
+		addr, err := readAddr(rd)
+		if err != nil {
+			continue
+		}
+		var src net.Addr = addr
+		if addr.IP != nil {
+			src = &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+		}
+		return copy(b, u.readBuf[n-rd.Len():n]), src, nil
+	}
+}
+
+// Closes the association
+func (u *UDPConn) Close() error {
+	var err error
+	u.closeOnce.Do(func() {
+		err = u.udp.Close()
+		u.ctrl.Close()
+	})
+	return err
+}
+
+// Returns the local UDP address
+func (u *UDPConn) LocalAddr() net.Addr {
+	return u.udp.LocalAddr()
+}
+
+// Returns the address of the SOCKS5 server's UDP relay
+func (u *UDPConn) RelayAddr() *net.UDPAddr {
+	return u.relay
+}
+
+// Sets read and write deadlines
+func (u *UDPConn) SetDeadline(t time.Time) error {
+	return u.udp.SetDeadline(t)
+}
+
+// Sets read deadline
+func (u *UDPConn) SetReadDeadline(t time.Time) error {
+	return u.udp.SetReadDeadline(t)
+}
+
+// Sets write deadline
+func (u *UDPConn) SetWriteDeadline(t time.Time) error {
+	return u.udp.SetWriteDeadline(t)
+}
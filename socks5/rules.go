@@ -0,0 +1,238 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SOCKS request as evaluated by the rules
+type Request struct {
+	Command Command
+	// Authenticated username (empty if no authentication has been used)
+	Username string
+	// Client address of the control connection
+	ClientAddr *net.TCPAddr
+	// Destination address; for BIND the address of the expected peer, for UDP
+	// ASSOCIATE the destination of a datagram (nil when the association itself
+	// is requested)
+	DestAddr *Addr
+	// IP the destination has been resolved to if it is given as domain name
+	// (CONNECT if rules are configured and UDP datagrams; nil otherwise)
+	ResolvedIP net.IP
+}
+
+// Access control for SOCKS requests
+type RuleSet interface {
+	// Returns whether the request is allowed
+	Allow(ctx context.Context, req *Request) bool
+}
+
+// RuleSetFunc is an adapter to use a function as RuleSet
+type RuleSetFunc func(ctx context.Context, req *Request) bool
+
+// Calls f(ctx, req)
+func (f RuleSetFunc) Allow(ctx context.Context, req *Request) bool {
+	return f(ctx, req)
+}
+
+// Returns a rule set allowing all requests
+func PermitAll() RuleSet {
+	return RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		return true
+	})
+}
+
+// Returns a rule set allowing only the given commands
+func PermitCommands(commands ...Command) RuleSet {
+	return RuleSetFunc(func(ctx context.Context, req *Request) bool {
+		for _, c := range commands {
+			if c == req.Command {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Access rule; a request matches if it matches all given conditions (empty
+// conditions match everything). UDP association requests are matched by rules
+// with destination conditions only if these allow requests.
+type Rule struct {
+	// Allow or deny matching requests
+	Allow bool
+	// Commands
+	Commands []Command
+	// Authenticated usernames
+	Users []string
+	// Client networks in CIDR notation or single IPs
+	ClientNetworks []string
+	// Destination networks in CIDR notation or single IPs; match destinations
+	// given as IP and the resolved IPs of CONNECT and UDP destinations given
+	// as domain name (BIND destinations given as domain name never match)
+	DestNetworks []string
+	// Destination host names; "*.example.com" matches all subdomains of
+	// example.com; only match destinations given as domain name
+	DestHosts []string
+	// Destination ports
+	DestPorts []int
+}
+
+type compiledRule struct {
+	Rule
+	clientNets []*net.IPNet
+	destNets   []*net.IPNet
+}
+
+// Rule set evaluating rules in order; the first matching rule decides
+type rules struct {
+	rules        []compiledRule
+	defaultAllow bool
+}
+
+// Returns a rule set evaluating the given rules in order; the first matching
+// rule decides, defaultAllow is used if no rule matches
+func NewRules(defaultAllow bool, list ...Rule) (RuleSet, error) {
+	rs := &rules{defaultAllow: defaultAllow}
+	for _, r := range list {
+		cr := compiledRule{Rule: r}
+		for _, n := range r.ClientNetworks {
+			ipNet, err := parseNetwork(n)
+			if err != nil {
+				return nil, err
+			}
+			cr.clientNets = append(cr.clientNets, ipNet)
+		}
+		for _, n := range r.DestNetworks {
+			ipNet, err := parseNetwork(n)
+			if err != nil {
+				return nil, err
+			}
+			cr.destNets = append(cr.destNets, ipNet)
+		}
+		cr.DestHosts = nil
+		for _, h := range r.DestHosts {
+			cr.DestHosts = append(cr.DestHosts, strings.ToLower(h))
+		}
+		rs.rules = append(rs.rules, cr)
+	}
+	return rs, nil
+}
+
+// Returns whether the request is allowed
+func (rs *rules) Allow(ctx context.Context, req *Request) bool {
+	for i := range rs.rules {
+		if rs.rules[i].matches(req) {
+			return rs.rules[i].Allow
+		}
+	}
+	return rs.defaultAllow
+}
+
+// Returns whether the request matches all conditions of the rule
+func (r *compiledRule) matches(req *Request) bool {
+	if len(r.Commands) > 0 && !containsCommand(r.Commands, req.Command) {
+		return false
+	}
+	if len(r.Users) > 0 && !containsString(r.Users, req.Username) {
+		return false
+	}
+	if len(r.clientNets) > 0 && (req.ClientAddr == nil || !containsIP(r.clientNets, req.ClientAddr.IP)) {
+		return false
+	}
+	if req.DestAddr == nil {
+		// UDP association request; destinations are checked per datagram, so
+		// only rules that might allow some of them match
+		return r.Allow || (len(r.destNets) == 0 && len(r.DestHosts) == 0 && len(r.DestPorts) == 0)
+	}
+	if len(r.destNets) > 0 {
+		ip := req.DestAddr.IP
+		if ip == nil {
+			ip = req.ResolvedIP
+		}
+		if ip == nil || !containsIP(r.destNets, ip) {
+			return false
+		}
+	}
+	if len(r.DestHosts) > 0 && (req.DestAddr.Host == "" || !matchHost(r.DestHosts, req.DestAddr.Host)) {
+		return false
+	}
+	if len(r.DestPorts) > 0 && !containsPort(r.DestPorts, req.DestAddr.Port) {
+		return false
+	}
+	return true
+}
+
+// Parses a network in CIDR notation or a single IP
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid network '%s'", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network '%s': %s", s, err)
+	}
+	return ipNet, nil
+}
+
+func containsCommand(list []Command, c Command) bool {
+	for _, v := range list {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(list []int, port int) bool {
+	for _, v := range list {
+		if v == port {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether host matches one of the patterns (exact or "*.domain")
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(host, p[1:]) {
+				return true
+			}
+		} else if p == host {
+			return true
+		}
+	}
+	return false
+}
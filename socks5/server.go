@@ -0,0 +1,370 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package socks5
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Server config
+type Config struct {
+	// Credentials for username/password authentication; if nil, only "no
+	// authentication" is accepted
+	Credentials CredentialStore
+	// Accept "no authentication" even if Credentials is set
+	AllowNoAuth bool
+	// Access control (defaults to nil which means all requests are allowed)
+	Rules RuleSet
+	// Function used to connect to CONNECT destinations (defaults to
+	// net.Dialer.DialContext); zero-copy requires *net.TCPConn connections
+	Dialer DialerFunc
+	// Resolver used for destinations given as domain name (defaults to
+	// net.DefaultResolver); if Rules is set, CONNECT destinations are
+	// resolved before dialing so that DestNetworks apply to them as well
+	Resolver *net.Resolver
+	// Timeout for authentication and reading the request (defaults to 10s)
+	HandshakeTimeout time.Duration
+	// Timeout for connecting to CONNECT destinations (defaults to 10s)
+	ConnectTimeout time.Duration
+	// Time without data being transferred in either direction after which
+	// CONNECT and BIND tunnels are closed (defaults to 0 which means no
+	// timeout)
+	IdleTimeout time.Duration
+	// Time to wait for the incoming connection of a BIND request (defaults to
+	// 60s)
+	BindTimeout time.Duration
+	// Time without datagrams after which a UDP association is closed
+	// (defaults to 2m)
+	UDPIdleTimeout time.Duration
+	// IP used for BIND listeners and UDP relays (defaults to the server IP of
+	// the control connection)
+	BindIP net.IP
+}
+
+// Validates username/password credentials
+type CredentialStore interface {
+	// Returns whether the credentials are valid
+	Valid(username, password string) bool
+}
+
+// Credentials as map of usernames to passwords
+type StaticCredentials map[string]string
+
+// Returns whether the credentials are valid
+func (s StaticCredentials) Valid(username, password string) bool {
+	pw, ok := s[username]
+	return ok && subtle.ConstantTimeCompare([]byte(pw), []byte(password)) == 1
+}
+
+type handler struct {
+	config Config
+	// whether CONNECT destinations given as domain name are resolved and
+	// checked before dialing (only if rules are configured)
+	resolve bool
+}
+
+// Returns a request handler speaking SOCKS5. Errors (e.g. failed
+// authentication, denied requests or unreachable destinations) are set on
+// the connection (see tcpserver.Connection.SetError).
+func NewHandler(config *Config) tcpserver.RequestHandlerFunc {
+	h := &handler{}
+	if config != nil {
+		h.config = *config
+	}
+	if h.config.Rules == nil {
+		h.config.Rules = PermitAll()
+	} else {
+		h.resolve = true
+	}
+	if h.config.Resolver == nil {
+		h.config.Resolver = net.DefaultResolver
+	}
+	if h.config.Dialer == nil {
+		h.config.Dialer = (&net.Dialer{}).DialContext
+	}
+	if h.config.HandshakeTimeout <= 0 {
+		h.config.HandshakeTimeout = 10 * time.Second
+	}
+	if h.config.ConnectTimeout <= 0 {
+		h.config.ConnectTimeout = 10 * time.Second
+	}
+	if h.config.BindTimeout <= 0 {
+		h.config.BindTimeout = 60 * time.Second
+	}
+	if h.config.UDPIdleTimeout <= 0 {
+		h.config.UDPIdleTimeout = 2 * time.Minute
+	}
+
+	return func(conn tcpserver.Connection) {
+		if err := h.serve(conn); err != nil {
+			conn.SetError(err)
+		}
+	}
+}
+
+// Serves a SOCKS5 connection
+func (h *handler) serve(conn tcpserver.Connection) error {
+	ctx := context.Background()
+	if c := conn.GetContext(); c != nil {
+		ctx = *c
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(h.config.HandshakeTimeout))
+	username, err := h.authenticate(conn)
+	if err != nil {
+		return err
+	}
+
+	req, err := h.readRequest(conn, username)
+	if err != nil {
+		if err == errAddressNotSupported {
+			_ = writeReply(conn, ReplyAddressNotSupported, nil)
+		}
+		return err
+	}
+	if req.Command < CommandConnect || req.Command > CommandAssociate {
+		_ = writeReply(conn, ReplyCommandNotSupported, nil)
+		return fmt.Errorf("socks5: unsupported command %d", req.Command)
+	}
+
+	check := *req
+	if req.Command == CommandAssociate {
+		check.DestAddr = nil
+	}
+	if req.Command == CommandConnect && req.DestAddr.Host != "" && h.resolve {
+		// the destination is dialed by the checked IP so that the name
+		// can't resolve to a different (denied) IP afterwards
+		lctx, cancel := context.WithTimeout(ctx, h.config.ConnectTimeout)
+		req.ResolvedIP, err = h.resolveAllowed(lctx, req)
+		cancel()
+		if err != nil {
+			reply := ReplyNotAllowed
+			if err != ErrNotAllowed {
+				reply = replyForError(err)
+			}
+			_ = writeReply(conn, reply, nil)
+			return err
+		}
+	} else if !h.config.Rules.Allow(ctx, &check) {
+		_ = writeReply(conn, ReplyNotAllowed, nil)
+		return ErrNotAllowed
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch req.Command {
+	case CommandConnect:
+		return h.connect(ctx, conn, req)
+	case CommandBind:
+		return h.bind(conn, req)
+	default:
+		return h.associate(ctx, conn, req)
+	}
+}
+
+// Negotiates the authentication method and authenticates the client; returns
+// the username (empty for "no authentication")
+func (h *handler) authenticate(conn net.Conn) (string, error) {
+	var buf [256]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socksVersion {
+		return "", fmt.Errorf("socks5: unsupported version %d", buf[0])
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodUserPass && h.config.Credentials != nil {
+			method = methodUserPass
+			break
+		}
+		if m == methodNoAuth && (h.config.Credentials == nil || h.config.AllowNoAuth) {
+			method = methodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+
+	switch method {
+	case methodNoAuth:
+		return "", nil
+	case methodNoAcceptable:
+		return "", ErrAuthFailed
+	}
+
+	// username/password authentication (RFC 1929)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != authVersion {
+		return "", fmt.Errorf("socks5: unsupported authentication version %d", buf[0])
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(conn, buf[:ulen+1]); err != nil {
+		return "", err
+	}
+	username := string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(conn, buf[:plen]); err != nil {
+		return "", err
+	}
+	password := string(buf[:plen])
+
+	status := byte(0)
+	valid := h.config.Credentials.Valid(username, password)
+	if !valid {
+		status = 1
+	}
+	if _, err := conn.Write([]byte{authVersion, status}); err != nil {
+		return "", err
+	}
+	if !valid {
+		return "", ErrAuthFailed
+	}
+	return username, nil
+}
+
+// Reads the SOCKS request
+func (h *handler) readRequest(conn tcpserver.Connection, username string) (*Request, error) {
+	var buf [3]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, fmt.Errorf("socks5: unsupported version %d", buf[0])
+	}
+	addr, err := readAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{
+		Command:    Command(buf[1]),
+		Username:   username,
+		ClientAddr: conn.GetClientAddr(),
+		DestAddr:   addr,
+	}, nil
+}
+
+// Handles CONNECT requests
+func (h *handler) connect(ctx context.Context, conn tcpserver.Connection, req *Request) error {
+	addr := req.DestAddr.String()
+	if req.ResolvedIP != nil {
+		addr = net.JoinHostPort(req.ResolvedIP.String(), strconv.Itoa(req.DestAddr.Port))
+	}
+	dctx, cancel := context.WithTimeout(ctx, h.config.ConnectTimeout)
+	upstream, err := h.config.Dialer(dctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		_ = writeReply(conn, replyForError(err), nil)
+		return err
+	}
+	defer upstream.Close()
+
+	if err = writeReply(conn, ReplySucceeded, addrFromNetAddr(upstream.LocalAddr())); err != nil {
+		return err
+	}
+	_, err = tcpserver.Proxy(conn, upstream, &tcpserver.ProxyOptions{IdleTimeout: h.config.IdleTimeout})
+	return err
+}
+
+// Resolves the destination (given as domain name) and evaluates the rules
+// for each of its IPs (see Request.ResolvedIP); returns the first allowed IP
+// or ErrNotAllowed
+func (h *handler) resolveAllowed(ctx context.Context, req *Request) (net.IP, error) {
+	ips, err := h.config.Resolver.LookupIP(ctx, "ip", req.DestAddr.Host)
+	if err != nil {
+		return nil, err
+	}
+	check := *req
+	for _, ip := range ips {
+		check.ResolvedIP = ip
+		if h.config.Rules.Allow(ctx, &check) {
+			return ip, nil
+		}
+	}
+	return nil, ErrNotAllowed
+}
+
+// Handles BIND requests
+func (h *handler) bind(conn tcpserver.Connection, req *Request) error {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: h.bindIP(conn)})
+	if err != nil {
+		_ = writeReply(conn, ReplyGeneralFailure, nil)
+		return err
+	}
+	defer ln.Close()
+
+	if err = writeReply(conn, ReplySucceeded, addrFromNetAddr(ln.Addr())); err != nil {
+		return err
+	}
+
+	_ = ln.SetDeadline(time.Now().Add(h.config.BindTimeout))
+	peer, err := ln.AcceptTCP()
+	if err != nil {
+		_ = writeReply(conn, ReplyGeneralFailure, nil)
+		return err
+	}
+	ln.Close()
+	defer peer.Close()
+
+	peerAddr := addrFromNetAddr(peer.RemoteAddr())
+	if ip := req.DestAddr.IP; ip != nil && !ip.IsUnspecified() && !ip.Equal(peerAddr.IP) {
+		_ = writeReply(conn, ReplyNotAllowed, nil)
+		return ErrNotAllowed
+	}
+	if err = writeReply(conn, ReplySucceeded, peerAddr); err != nil {
+		return err
+	}
+	_, err = tcpserver.Proxy(conn, peer, &tcpserver.ProxyOptions{IdleTimeout: h.config.IdleTimeout})
+	return err
+}
+
+// Returns the IP used for BIND listeners and UDP relays
+func (h *handler) bindIP(conn tcpserver.Connection) net.IP {
+	if h.config.BindIP != nil {
+		return h.config.BindIP
+	}
+	if addr := conn.GetServerAddr(); addr != nil {
+		return addr.IP
+	}
+	return nil
+}
+
+// Writes a reply
+func writeReply(conn net.Conn, reply Reply, addr *Addr) error {
+	if addr == nil {
+		addr = &Addr{}
+	}
+	_, err := conn.Write(appendAddr([]byte{socksVersion, byte(reply), 0}, addr))
+	return err
+}
+
+// Returns the reply code for a dial error
+func replyForError(err error) Reply {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr), errors.Is(err, context.DeadlineExceeded):
+		return ReplyHostUnreachable
+	}
+	return ReplyGeneralFailure
+}
@@ -0,0 +1,226 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package socks5 implements a SOCKS5 server (RFC 1928) as tcpserver request
+// handler supporting CONNECT, BIND and UDP ASSOCIATE, "no authentication" and
+// username/password authentication (RFC 1929), pluggable dialers and
+// rule-based access control. Tunneled TCP traffic is copied using
+// tcpserver.Proxy (zero-copy on Linux).
+//
+//	server.SetRequestHandler(socks5.NewHandler(&socks5.Config{
+//		Credentials: socks5.StaticCredentials{"user": "secret"},
+//	}))
+//
+// A client is included as well (see Client).
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socksVersion = 0x05
+	authVersion  = 0x01
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Returned by the handler if the client failed to authenticate
+var ErrAuthFailed = errors.New("socks5: authentication failed")
+
+// Returned by the handler if a request is denied by the rules
+var ErrNotAllowed = errors.New("socks5: request not allowed")
+
+// Dialer function type
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// SOCKS command
+type Command uint8
+
+const (
+	CommandConnect   Command = 0x01
+	CommandBind      Command = 0x02
+	CommandAssociate Command = 0x03
+)
+
+var commandNames = [...]string{
+	CommandConnect:   "connect",
+	CommandBind:      "bind",
+	CommandAssociate: "udp_associate",
+}
+
+// Returns command name
+func (c Command) String() string {
+	if int(c) < len(commandNames) && commandNames[c] != "" {
+		return commandNames[c]
+	}
+	return "unknown"
+}
+
+// Reply code
+type Reply uint8
+
+const (
+	ReplySucceeded Reply = iota
+	ReplyGeneralFailure
+	ReplyNotAllowed
+	ReplyNetworkUnreachable
+	ReplyHostUnreachable
+	ReplyConnectionRefused
+	ReplyTTLExpired
+	ReplyCommandNotSupported
+	ReplyAddressNotSupported
+)
+
+var replyNames = [...]string{
+	ReplySucceeded:           "succeeded",
+	ReplyGeneralFailure:      "general SOCKS server failure",
+	ReplyNotAllowed:          "connection not allowed by ruleset",
+	ReplyNetworkUnreachable:  "network unreachable",
+	ReplyHostUnreachable:     "host unreachable",
+	ReplyConnectionRefused:   "connection refused",
+	ReplyTTLExpired:          "TTL expired",
+	ReplyCommandNotSupported: "command not supported",
+	ReplyAddressNotSupported: "address type not supported",
+}
+
+// Returns reply description
+func (r Reply) String() string {
+	if int(r) < len(replyNames) {
+		return replyNames[r]
+	}
+	return "unknown reply " + strconv.Itoa(int(r))
+}
+
+// Error returned by the client if the server replied with an error code
+type ReplyError struct {
+	Reply Reply
+}
+
+// Returns reply description as error string
+func (e *ReplyError) Error() string {
+	return "socks5: " + e.Reply.String()
+}
+
+// SOCKS address; either Host (domain name) or IP is set
+type Addr struct {
+	Host string
+	IP   net.IP
+	Port int
+}
+
+// Returns "socks5"
+func (a *Addr) Network() string {
+	return "socks5"
+}
+
+// Returns address as host:port
+func (a *Addr) String() string {
+	host := a.Host
+	if host == "" {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+// Parses an address in host:port format
+func ParseAddr(s string) (*Addr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 0xffff {
+		return nil, fmt.Errorf("invalid port '%s'", port)
+	}
+
+	a := &Addr{Port: p}
+	if a.IP = net.ParseIP(host); a.IP == nil {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("invalid host '%s'", host)
+		}
+		a.Host = host
+	}
+	return a, nil
+}
+
+// Converts a *net.TCPAddr or *net.UDPAddr (or *Addr) to *Addr
+func addrFromNetAddr(na net.Addr) *Addr {
+	switch na := na.(type) {
+	case *net.TCPAddr:
+		return &Addr{IP: na.IP, Port: na.Port}
+	case *net.UDPAddr:
+		return &Addr{IP: na.IP, Port: na.Port}
+	case *Addr:
+		return na
+	}
+	return &Addr{IP: net.IPv4zero}
+}
+
+// Appends the wire format (ATYP, ADDR, PORT) of a to b
+func appendAddr(b []byte, a *Addr) []byte {
+	switch ip4 := a.IP.To4(); {
+	case a.Host != "":
+		b = append(b, atypDomain, byte(len(a.Host)))
+		b = append(b, a.Host...)
+	case ip4 != nil:
+		b = append(b, atypIPv4)
+		b = append(b, ip4...)
+	case a.IP != nil:
+		b = append(b, atypIPv6)
+		b = append(b, a.IP.To16()...)
+	default:
+		b = append(b, atypIPv4, 0, 0, 0, 0)
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port))
+}
+
+// Reads an address in wire format (ATYP, ADDR, PORT)
+func readAddr(r io.Reader) (*Addr, error) {
+	var buf [256]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+
+	a := &Addr{}
+	switch buf[0] {
+	case atypIPv4:
+		if _, err := io.ReadFull(r, buf[:4+2]); err != nil {
+			return nil, err
+		}
+		a.IP = net.IP(append([]byte(nil), buf[:4]...))
+		a.Port = int(buf[4])<<8 | int(buf[5])
+	case atypIPv6:
+		if _, err := io.ReadFull(r, buf[:16+2]); err != nil {
+			return nil, err
+		}
+		a.IP = net.IP(append([]byte(nil), buf[:16]...))
+		a.Port = int(buf[16])<<8 | int(buf[17])
+	case atypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return nil, err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:n+2]); err != nil {
+			return nil, err
+		}
+		a.Host = string(buf[:n])
+		a.Port = int(buf[n])<<8 | int(buf[n+1])
+	default:
+		return nil, errAddressNotSupported
+	}
+	return a, nil
+}
+
+var errAddressNotSupported = errors.New("socks5: address type not supported")
@@ -0,0 +1,206 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package socks5_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/socks5"
+)
+
+// Starts a TCP echo server on 127.0.0.1; returns its port
+func startEcho(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Starts a UDP echo server on 127.0.0.1; returns its port
+func startUDPEcho(t *testing.T) int {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	t.Cleanup(func() {
+		pc.Close()
+	})
+	return pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Starts a SOCKS5 server with the given rules; returns a client using it
+func startServer(t *testing.T, rules ...socks5.Rule) *socks5.Client {
+	t.Helper()
+	rs, err := socks5.NewRules(true, rules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetRequestHandler(socks5.NewHandler(&socks5.Config{Rules: rs}))
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	})
+	return &socks5.Client{ProxyAddr: s.GetListenAddr().String()}
+}
+
+// Sends a message through conn and checks the echo
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo, got %q (%v)", buf, err)
+	}
+}
+
+func TestConnectRules(t *testing.T) {
+	port := strconv.Itoa(startEcho(t))
+	loopback := []string{"127.0.0.0/8", "::1"}
+
+	tests := []struct {
+		name    string
+		rules   []socks5.Rule
+		addr    string
+		allowed bool
+	}{
+		{"no rules", nil, "127.0.0.1", true},
+		{"denied network by IP", []socks5.Rule{{DestNetworks: loopback}}, "127.0.0.1", false},
+		{"denied network by name", []socks5.Rule{{DestNetworks: loopback}}, "localhost", false},
+		{"denied network by name and port", []socks5.Rule{{DestNetworks: loopback, DestPorts: []int{startEcho(t)}}}, "localhost", true},
+		{"other network by name", []socks5.Rule{{DestNetworks: []string{"10.0.0.0/8", "169.254.169.254"}}}, "localhost", true},
+		{"allowed network by name", []socks5.Rule{
+			{Allow: true, DestNetworks: []string{"127.0.0.1"}},
+			{},
+		}, "localhost", true},
+		{"denied host", []socks5.Rule{{DestHosts: []string{"localhost"}}}, "localhost", false},
+		{"denied host by IP", []socks5.Rule{{DestHosts: []string{"localhost"}}}, "127.0.0.1", true},
+		{"denied host and network", []socks5.Rule{{DestHosts: []string{"*.localhost"}, DestNetworks: loopback}}, "localhost", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := startServer(t, tt.rules...)
+			conn, err := client.Dial("tcp", net.JoinHostPort(tt.addr, port))
+			if !tt.allowed {
+				var re *socks5.ReplyError
+				if !errors.As(err, &re) || re.Reply != socks5.ReplyNotAllowed {
+					t.Fatalf("expected reply %v, got %v", socks5.ReplyNotAllowed, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			checkEcho(t, conn)
+		})
+	}
+}
+
+func TestConnectUnresolvable(t *testing.T) {
+	client := startServer(t, socks5.Rule{DestNetworks: []string{"10.0.0.0/8"}})
+	_, err := client.Dial("tcp", "nonexistent.invalid:80")
+	var re *socks5.ReplyError
+	if !errors.As(err, &re) || re.Reply == socks5.ReplySucceeded {
+		t.Fatalf("expected error reply, got %v", err)
+	}
+}
+
+func TestAssociateRules(t *testing.T) {
+	port := startUDPEcho(t)
+	client := startServer(t, socks5.Rule{DestNetworks: []string{"127.0.0.0/8", "::1"}, DestPorts: []int{port}})
+
+	udp, err := client.Associate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	// denied by network, even though given as name
+	for _, addr := range []string{"127.0.0.1", "localhost"} {
+		dst, err := socks5.ParseAddr(net.JoinHostPort(addr, strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = udp.WriteTo([]byte("ping"), dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = udp.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 16)
+	if n, from, err := udp.ReadFrom(buf); err == nil {
+		t.Fatalf("expected datagrams to be dropped, got %q from %v", buf[:n], from)
+	}
+
+	// allowed (the rule only denies the echo port)
+	other := startUDPEcho(t)
+	dst, err := socks5.ParseAddr(net.JoinHostPort("localhost", strconv.Itoa(other)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = udp.WriteTo([]byte("ping"), dst); err != nil {
+		t.Fatal(err)
+	}
+	_ = udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := udp.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("expected echo, got %q (%v)", buf[:n], err)
+	}
+}
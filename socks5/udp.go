@@ -0,0 +1,154 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Maximum number of resolved destinations cached per UDP association
+const maxUDPDestinations = 1024
+
+// UDP relay of an association
+type udpRelay struct {
+	handler *handler
+	ctx     context.Context
+	conn    tcpserver.Connection
+	udp     *net.UDPConn
+	req     *Request
+	// client address datagrams are accepted from (learned from the first
+	// datagram unless given in the request)
+	client *net.UDPAddr
+	// allowed and resolved destinations
+	dests map[string]*net.UDPAddr
+	// destinations datagrams have been sent to (replies are only accepted
+	// from these)
+	remotes map[string]bool
+}
+
+// Handles UDP ASSOCIATE requests; the association lasts until the control
+// connection is closed or no datagrams have been relayed within
+// UDPIdleTimeout
+func (h *handler) associate(ctx context.Context, conn tcpserver.Connection, req *Request) error {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: h.bindIP(conn)})
+	if err != nil {
+		_ = writeReply(conn, ReplyGeneralFailure, nil)
+		return err
+	}
+	defer udp.Close()
+
+	r := &udpRelay{
+		handler: h,
+		ctx:     ctx,
+		conn:    conn,
+		udp:     udp,
+		req:     req,
+		dests:   make(map[string]*net.UDPAddr),
+		remotes: make(map[string]bool),
+	}
+	if ip := req.DestAddr.IP; ip != nil && !ip.IsUnspecified() && req.DestAddr.Port != 0 {
+		r.client = &net.UDPAddr{IP: ip, Port: req.DestAddr.Port}
+	}
+
+	if err = writeReply(conn, ReplySucceeded, addrFromNetAddr(udp.LocalAddr())); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.run()
+		// unblock the control connection read below
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+	}()
+
+	// the control connection carries no data; wait for it to be closed
+	_, _ = io.Copy(io.Discard, conn)
+	_ = udp.Close()
+	<-done
+	return nil
+}
+
+// Relays datagrams until the UDP socket is closed or the association is idle
+func (r *udpRelay) run() {
+	buf := make([]byte, 64*1024)
+	out := make([]byte, 0, 64*1024+262)
+	clientIP := r.conn.GetClientAddr().IP
+
+	for {
+		_ = r.udp.SetReadDeadline(time.Now().Add(r.handler.config.UDPIdleTimeout))
+		n, from, err := r.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if r.client == nil && from.IP.Equal(clientIP) {
+			r.client = from
+		}
+
+		if r.client != nil && from.IP.Equal(r.client.IP) && from.Port == r.client.Port {
+			// client -> destination
+			dst, payload := r.parseDatagram(buf[:n])
+			if dst != nil {
+				_, _ = r.udp.WriteToUDP(payload, dst)
+			}
+			continue
+		}
+
+		// destination -> client
+		if r.client == nil || !r.remotes[from.String()] {
+			continue
+		}
+		out = append(out[:0], 0, 0, 0)
+		out = appendAddr(out, addrFromNetAddr(from))
+		out = append(out, buf[:n]...)
+		_, _ = r.udp.WriteToUDP(out, r.client)
+	}
+}
+
+// Parses a datagram sent by the client; returns its destination (nil if the
+// datagram has to be dropped) and payload
+func (r *udpRelay) parseDatagram(b []byte) (*net.UDPAddr, []byte) {
+	// RSV (2), FRAG (1); fragmentation isn't supported
+	if len(b) < 4 || b[2] != 0 {
+		return nil, nil
+	}
+	rd := bytes.NewReader(b[3:])
+	addr, err := readAddr(rd)
+	if err != nil {
+		return nil, nil
+	}
+	payload := b[len(b)-rd.Len():]
+
+	key := addr.String()
+	if dst, ok := r.dests[key]; ok {
+		return dst, payload
+	}
+
+	req := *r.req
+	req.DestAddr = addr
+	ip := addr.IP
+	if addr.Host != "" {
+		if ip, err = r.handler.resolveAllowed(r.ctx, &req); err != nil {
+			return nil, nil
+		}
+	} else if !r.handler.config.Rules.Allow(r.ctx, &req) {
+		return nil, nil
+	}
+	dst := &net.UDPAddr{IP: ip, Port: addr.Port}
+
+	if len(r.dests) >= maxUDPDestinations {
+		r.dests = make(map[string]*net.UDPAddr)
+		r.remotes = make(map[string]bool)
+	}
+	r.dests[key] = dst
+	r.remotes[dst.String()] = true
+	return dst, payload
+}
@@ -0,0 +1,239 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Per connection byte and operation counters
+type ConnStats struct {
+	// Number of bytes read from the connection
+	BytesRead uint64
+	// Number of bytes written to the connection
+	BytesWritten uint64
+	// Number of read calls (including io.WriterTo calls)
+	Reads uint64
+	// Number of write calls (including io.ReaderFrom calls)
+	Writes uint64
+	// Time the first byte was read or written (zero if none)
+	FirstByte time.Time
+	// Time the last byte was read or written (zero if none); accurate to
+	// coarseClockInterval while the server is running
+	LastByte time.Time
+}
+
+// Resolution of the clock used for last byte timestamps
+const coarseClockInterval = 10 * time.Millisecond
+
+// Clock updated every coarseClockInterval while at least one server is
+// running; saves a time.Now() call on every read and write
+var (
+	coarseNow        int64
+	coarseClockUsers int32
+	coarseClockMutex sync.Mutex
+	coarseClockStop  chan struct{}
+)
+
+// Starts the coarse clock (or adds a user if it's already running)
+func startCoarseClock() {
+	coarseClockMutex.Lock()
+	defer coarseClockMutex.Unlock()
+
+	if atomic.LoadInt32(&coarseClockUsers) == 0 {
+		atomic.StoreInt64(&coarseNow, time.Now().UnixNano())
+		coarseClockStop = make(chan struct{})
+		go runCoarseClock(coarseClockStop)
+	}
+	atomic.AddInt32(&coarseClockUsers, 1)
+}
+
+// Removes a user of the coarse clock and stops it if it was the last one
+func stopCoarseClock() {
+	coarseClockMutex.Lock()
+	defer coarseClockMutex.Unlock()
+
+	if atomic.AddInt32(&coarseClockUsers, -1) == 0 {
+		close(coarseClockStop)
+	}
+}
+
+func runCoarseClock(stop chan struct{}) {
+	ticker := time.NewTicker(coarseClockInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			atomic.StoreInt64(&coarseNow, t.UnixNano())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Returns the current time in unix nanoseconds from the coarse clock (or the
+// exact time if it isn't running)
+func coarseTime() int64 {
+	if atomic.LoadInt32(&coarseClockUsers) > 0 {
+		return atomic.LoadInt64(&coarseNow)
+	}
+	return time.Now().UnixNano()
+}
+
+// Reads data from the connection
+func (conn *TCPConn) Read(b []byte) (n int, err error) {
+	n, err = conn.Conn.Read(b)
+	conn.addRead(int64(n))
+	return
+}
+
+// Writes data to the connection
+func (conn *TCPConn) Write(b []byte) (n int, err error) {
+	n, err = conn.Conn.Write(b)
+	conn.addWritten(int64(n))
+	return
+}
+
+// Reads from r until EOF and writes to the connection (implements io.ReaderFrom).
+// If both ends are plain TCP connections, splice/sendfile is used on Linux and
+// the transferred bytes are still accounted for.
+func (conn *TCPConn) ReadFrom(r io.Reader) (n int64, err error) {
+	src, _ := r.(*TCPConn)
+	if src != nil {
+		r = src.Conn
+	}
+
+	if rf, ok := conn.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(writerOnly{conn.Conn}, r)
+	}
+
+	conn.addWritten(n)
+	if src != nil {
+		src.addRead(n)
+	}
+	return
+}
+
+// Writes to w until there's no more data to read from the connection
+// (implements io.WriterTo). See ReadFrom for zero-copy details.
+func (conn *TCPConn) WriteTo(w io.Writer) (n int64, err error) {
+	dst, _ := w.(*TCPConn)
+	if dst != nil {
+		w = dst.Conn
+	}
+
+	n, err = io.Copy(w, conn.Conn)
+
+	conn.addRead(n)
+	if dst != nil {
+		dst.addWritten(n)
+	}
+	return
+}
+
+// Writes bufs to the connection (see net.Buffers.WriteTo); plain TCP
+// connections use vectored writes (writev), others write the buffers one by
+// one
+func (conn *TCPConn) WriteBuffers(bufs *net.Buffers) (n int64, err error) {
+	n, err = bufs.WriteTo(conn.Conn)
+	conn.addWritten(n)
+	return
+}
+
+// Returns connection's current stats; may be called concurrently
+func (conn *TCPConn) GetStats() ConnStats {
+	return ConnStats{
+		BytesRead:    atomic.LoadUint64(&conn.bytesRead),
+		BytesWritten: atomic.LoadUint64(&conn.bytesWritten),
+		Reads:        atomic.LoadUint64(&conn.reads),
+		Writes:       atomic.LoadUint64(&conn.writes),
+		FirstByte:    unixNanoToTime(atomic.LoadInt64(&conn.firstByteTs)),
+		LastByte:     unixNanoToTime(atomic.LoadInt64(&conn.lastByteTs)),
+	}
+}
+
+// Accounts a read operation
+func (conn *TCPConn) addRead(n int64) {
+	atomic.AddUint64(&conn.reads, 1)
+	if n > 0 {
+		atomic.AddUint64(&conn.bytesRead, uint64(n))
+		conn.touch()
+	}
+}
+
+// Accounts a write operation
+func (conn *TCPConn) addWritten(n int64) {
+	atomic.AddUint64(&conn.writes, 1)
+	if n > 0 {
+		atomic.AddUint64(&conn.bytesWritten, uint64(n))
+		conn.touch()
+	}
+}
+
+// Updates first/last byte timestamps; the last byte timestamp is only
+// written if the coarse clock advanced
+func (conn *TCPConn) touch() {
+	if atomic.LoadInt64(&conn.firstByteTs) == 0 {
+		now := time.Now().UnixNano()
+		if atomic.CompareAndSwapInt64(&conn.firstByteTs, 0, now) {
+			atomic.StoreInt64(&conn.lastByteTs, now)
+			return
+		}
+	}
+	if now := coarseTime(); now > atomic.LoadInt64(&conn.lastByteTs) {
+		atomic.StoreInt64(&conn.lastByteTs, now)
+	}
+}
+
+// Reconciles byte counters with the kernel's TCP_INFO counters (if available)
+// to also account for traffic that bypassed TCPConn by using GetNetConn().
+// Only done if the underlying connection has been handed out, as the kernel
+// also counts received bytes the application never read. Must be called
+// before the connection is closed.
+func (conn *TCPConn) finalizeStats() {
+	if atomic.LoadUint32(&conn.netConnUsed) == 0 {
+		return
+	}
+	tcpConn, ok := conn.Conn.(*net.TCPConn)
+	if !ok {
+		// kernel counters would include TLS overhead
+		return
+	}
+
+	received, acked, ok := getTCPByteCounters(tcpConn)
+	if !ok {
+		return
+	}
+
+	if received > atomic.LoadUint64(&conn.bytesRead) {
+		atomic.StoreUint64(&conn.bytesRead, received)
+	}
+	if acked > atomic.LoadUint64(&conn.bytesWritten) {
+		atomic.StoreUint64(&conn.bytesWritten, acked)
+	}
+}
+
+// Converts unix nano timestamp to time.Time (zero time for 0)
+func unixNanoToTime(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ts)
+}
+
+// Hides all but the Write method (prevents ReadFrom recursion)
+type writerOnly struct {
+	io.Writer
+}
+
+// Hides all but the Read method (prevents WriteTo recursion)
+type readerOnly struct {
+	io.Reader
+}
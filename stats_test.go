@@ -0,0 +1,132 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Returns the stats passed to the close handler of the next closed connection
+func closedStats(t *testing.T, handler RequestHandlerFunc, send []byte) ConnStats {
+	t.Helper()
+	statsChan := make(chan ConnStats, 1)
+	s := startServer(t, handler, func(s *Server) {
+		s.SetCloseHandler(func(conn Connection, stats ConnStats) {
+			statsChan <- stats
+		})
+	})
+	c := dial(t, s)
+	if _, err := c.Write(send); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.(*net.TCPConn).CloseWrite()
+	_, _ = io.Copy(io.Discard, c)
+
+	select {
+	case stats := <-statsChan:
+		return stats
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for close handler")
+	}
+	return ConnStats{}
+}
+
+func TestStatsUnreadBytesNotCounted(t *testing.T) {
+	stats := closedStats(t, func(conn Connection) {
+		// wait until all data has arrived but read only 10 bytes
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.ReadFull(conn, make([]byte, 10))
+	}, make([]byte, 1000))
+
+	if stats.BytesRead != 10 {
+		t.Errorf("BytesRead = %d, want 10", stats.BytesRead)
+	}
+	if stats.Reads == 0 || stats.FirstByte.IsZero() || stats.LastByte.Before(stats.FirstByte) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestStatsNetConnReconciled(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO byte counters are only available on Linux")
+	}
+	stats := closedStats(t, func(conn Connection) {
+		_, _ = io.Copy(io.Discard, conn.GetNetConn())
+	}, make([]byte, 1000))
+
+	if stats.BytesRead != 1000 {
+		t.Errorf("BytesRead = %d, want 1000 (from TCP_INFO)", stats.BytesRead)
+	}
+}
+
+// Returns a connected pair of TCP connections
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// Compares writes to a plain net.Conn with writes through TCPConn (which
+// counts bytes, calls and timestamps)
+func BenchmarkWrite(b *testing.B) {
+	startCoarseClock()
+	defer stopCoarseClock()
+
+	buf := make([]byte, 64)
+	run := func(b *testing.B, wrap func(c net.Conn) net.Conn) {
+		client, server := tcpPair(b)
+		go func() {
+			_, _ = io.Copy(io.Discard, server)
+		}()
+		w := wrap(client)
+		b.SetBytes(int64(len(buf)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := w.Write(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("net.Conn", func(b *testing.B) {
+		run(b, func(c net.Conn) net.Conn { return c })
+	})
+	b.Run("TCPConn", func(b *testing.B) {
+		run(b, func(c net.Conn) net.Conn {
+			conn := &TCPConn{}
+			conn.Reset(c)
+			return conn
+		})
+	})
+}
+
+// Measures the accounting overhead of a single read or write call
+func BenchmarkAccounting(b *testing.B) {
+	startCoarseClock()
+	defer stopCoarseClock()
+
+	conn := &TCPConn{}
+	for i := 0; i < b.N; i++ {
+		conn.addWritten(64)
+	}
+}
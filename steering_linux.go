@@ -0,0 +1,87 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux && !386
+// +build linux,!386
+
+package tcpserver
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soAttachReusePortCBPF = 51
+
+	// classic BPF instructions and ancillary data offset (see include/uapi/linux/filter.h)
+	bpfLdWAbs = 0x00 | 0x00 | 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfModK   = 0x04 | 0x90 | 0x00 // BPF_ALU | BPF_MOD | BPF_K
+	bpfRetA   = 0x06 | 0x10        // BPF_RET | BPF_A
+	skfAdCPU  = 0xfffff000 + 36    // SKF_AD_OFF + SKF_AD_CPU
+)
+
+// Attaches a classic BPF program to the SO_REUSEPORT group that selects the
+// socket by the CPU that received the connection (cpu % number of sockets)
+func attachCPUSteering(listeners []*net.TCPListener) error {
+	filter := []syscall.SockFilter{
+		{Code: bpfLdWAbs, K: skfAdCPU},
+		{Code: bpfModK, K: uint32(len(listeners))},
+		{Code: bpfRetA},
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	// the program is attached to the whole SO_REUSEPORT group
+	rc, err := listeners[0].SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, syscall.SOL_SOCKET, soAttachReusePortCBPF,
+			uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0)
+		if errno != 0 {
+			err = fmt.Errorf("unable to attach SO_REUSEPORT CPU steering program: %s", errno)
+		}
+	})
+	runtime.KeepAlive(filter)
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Returns the CPUs (out of the ones the process may run on) whose connections
+// are steered to the accept loop with given id
+func steeringCPUs(id int, loops int) []int {
+	var cpus []int
+	for _, cpu := range processCPUs() {
+		if cpu%loops == id {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
+
+// Restricts the current OS thread to given CPUs (the calling go routine has
+// to be locked to its thread)
+func pinThread(cpus []int) error {
+	if len(cpus) == 0 {
+		return fmt.Errorf("no CPU given")
+	}
+
+	var mask [maxAffinityCPUs / 64]uint64
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return fmt.Errorf("sched_setaffinity failed: %s", errno)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build !linux || 386
+// +build !linux 386
+
+package tcpserver
+
+import (
+	"fmt"
+	"net"
+)
+
+func attachCPUSteering(listeners []*net.TCPListener) error {
+	return fmt.Errorf("socket CPU steering is not supported on this platform")
+}
+
+func steeringCPUs(id int, loops int) []int {
+	return nil
+}
+
+func pinThread(cpus []int) error {
+	return fmt.Errorf("thread pinning is not supported on this platform")
+}
@@ -0,0 +1,61 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux && !386
+// +build linux,!386
+
+package tcpserver
+
+import (
+	"io"
+	"sort"
+	"testing"
+)
+
+func TestCPUSteering(t *testing.T) {
+	s := startServer(t, func(conn Connection) {
+		_, _ = io.Copy(conn, conn)
+	}, func(s *Server) {
+		s.SetListenConfig(&ListenConfig{
+			SocketReusePort:   true,
+			SocketSharding:    true,
+			SocketCPUSteering: true,
+		})
+		s.SetLoops(4)
+	})
+
+	for i := 0; i < 8; i++ {
+		c := dial(t, s)
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSteeringCPUs(t *testing.T) {
+	const loops = 3
+	var all []int
+	for id := 0; id < loops; id++ {
+		for _, cpu := range steeringCPUs(id, loops) {
+			if cpu%loops != id {
+				t.Errorf("CPU %d steered to loop %d", cpu, id)
+			}
+			all = append(all, cpu)
+		}
+	}
+	sort.Ints(all)
+
+	cpus := processCPUs()
+	if len(all) != len(cpus) {
+		t.Fatalf("expected CPUs %v, got %v", cpus, all)
+	}
+	for i := range cpus {
+		if all[i] != cpus[i] {
+			t.Fatalf("expected CPUs %v, got %v", cpus, all)
+		}
+	}
+}
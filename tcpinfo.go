@@ -0,0 +1,62 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"fmt"
+	"net"
+)
+
+// Subset of the kernel's TCP_INFO for a connection (only available on Linux).
+// Fields not supported by the running kernel are zero.
+type TCPInfo struct {
+	// TCP state (e.g. "established", "close_wait")
+	State string `json:"state"`
+	// Smoothed round trip time in microseconds
+	RTT uint32 `json:"rtt_us"`
+	// Round trip time variance in microseconds
+	RTTVar uint32 `json:"rttvar_us"`
+	// Minimum observed round trip time in microseconds
+	MinRTT uint32 `json:"min_rtt_us"`
+	// Retransmission timeout in microseconds
+	RTO uint32 `json:"rto_us"`
+	// Sender MSS
+	SndMSS uint32 `json:"snd_mss"`
+	// Receiver MSS
+	RcvMSS uint32 `json:"rcv_mss"`
+	// Congestion window in segments
+	SndCwnd uint32 `json:"snd_cwnd"`
+	// Slow start threshold
+	SndSsthresh uint32 `json:"snd_ssthresh"`
+	// Number of unacknowledged segments
+	Unacked uint32 `json:"unacked"`
+	// Number of segments considered lost
+	Lost uint32 `json:"lost"`
+	// Total number of retransmitted segments
+	TotalRetrans uint32 `json:"total_retrans"`
+	// Bytes written to the socket but not yet sent
+	NotSentBytes uint32 `json:"notsent_bytes"`
+	// Bytes acknowledged by the peer
+	BytesAcked uint64 `json:"bytes_acked"`
+	// Bytes received from the peer
+	BytesReceived uint64 `json:"bytes_received"`
+	// Bytes sent (including retransmissions; Linux >=4.19)
+	BytesSent uint64 `json:"bytes_sent"`
+	// Bytes retransmitted (Linux >=4.19)
+	BytesRetrans uint64 `json:"bytes_retrans"`
+	// Delivery rate in bytes per second
+	DeliveryRate uint64 `json:"delivery_rate"`
+	// Pacing rate in bytes per second
+	PacingRate uint64 `json:"pacing_rate"`
+}
+
+// Returns the kernel's TCP_INFO for the connection (only supported on Linux);
+// may be called concurrently
+func (conn *TCPConn) GetTCPInfo() (*TCPInfo, error) {
+	tcpConn, ok := conn.rawConn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	return getTCPInfo(tcpConn)
+}
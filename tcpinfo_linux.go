@@ -0,0 +1,177 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux && !386
+// +build linux,!386
+
+package tcpserver
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Mirrors struct tcp_info from include/uapi/linux/tcp.h (up to tcpi_snd_wnd)
+type rawTCPInfo struct {
+	state         uint8
+	caState       uint8
+	retransmits   uint8
+	probes        uint8
+	backoff       uint8
+	options       uint8
+	wscale        uint8
+	flags         uint8
+	rto           uint32
+	ato           uint32
+	sndMss        uint32
+	rcvMss        uint32
+	unacked       uint32
+	sacked        uint32
+	lost          uint32
+	retrans       uint32
+	fackets       uint32
+	lastDataSent  uint32
+	lastAckSent   uint32
+	lastDataRecv  uint32
+	lastAckRecv   uint32
+	pmtu          uint32
+	rcvSsthresh   uint32
+	rtt           uint32
+	rttvar        uint32
+	sndSsthresh   uint32
+	sndCwnd       uint32
+	advmss        uint32
+	reordering    uint32
+	rcvRtt        uint32
+	rcvSpace      uint32
+	totalRetrans  uint32
+	pacingRate    uint64
+	maxPacingRate uint64
+	bytesAcked    uint64
+	bytesReceived uint64
+	segsOut       uint32
+	segsIn        uint32
+	notsentBytes  uint32
+	minRtt        uint32
+	dataSegsIn    uint32
+	dataSegsOut   uint32
+	deliveryRate  uint64
+	busyTime      uint64
+	rwndLimited   uint64
+	sndbufLimited uint64
+	delivered     uint32
+	deliveredCe   uint32
+	bytesSent     uint64
+	bytesRetrans  uint64
+	dsackDups     uint32
+	reordSeen     uint32
+	rcvOoopack    uint32
+	sndWnd        uint32
+}
+
+// TCP states (include/net/tcp_states.h)
+const (
+	tcpStateFinWait2  = 5
+	tcpStateTimeWait  = 6
+	tcpStateCloseWait = 8
+	tcpStateLastAck   = 9
+	tcpStateClosing   = 11
+)
+
+var tcpStateNames = [...]string{
+	1:  "established",
+	2:  "syn_sent",
+	3:  "syn_recv",
+	4:  "fin_wait1",
+	5:  "fin_wait2",
+	6:  "time_wait",
+	7:  "close",
+	8:  "close_wait",
+	9:  "last_ack",
+	10: "listen",
+	11: "closing",
+	12: "new_syn_recv",
+}
+
+// Size of struct tcp_info up to (and including) tcpi_bytes_received (Linux >=4.1)
+const tcpInfoSizeWithByteCounters = 136
+
+// Queries TCP_INFO for given connection; returns the number of bytes filled in by the kernel
+func getRawTCPInfo(c *net.TCPConn, info *rawTCPInfo) (size uint32, err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	size = uint32(unsafe.Sizeof(*info))
+	cerr := rc.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			err = errno
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return size, err
+}
+
+// Returns the kernel's received and acked byte counters for given connection
+func getTCPByteCounters(c *net.TCPConn) (received, acked uint64, ok bool) {
+	var info rawTCPInfo
+	size, err := getRawTCPInfo(c, &info)
+	if err != nil || size < tcpInfoSizeWithByteCounters {
+		return 0, 0, false
+	}
+	received, acked = info.bytesReceived, info.bytesAcked
+
+	// the kernel counts FIN as one byte of sequence space
+	switch info.state {
+	case tcpStateCloseWait, tcpStateLastAck, tcpStateClosing:
+		received--
+	case tcpStateTimeWait:
+		received--
+		acked--
+	case tcpStateFinWait2:
+		acked--
+	}
+	return received, acked, true
+}
+
+// Returns TCP_INFO for given connection
+func getTCPInfo(c *net.TCPConn) (*TCPInfo, error) {
+	var info rawTCPInfo
+	if _, err := getRawTCPInfo(c, &info); err != nil {
+		return nil, fmt.Errorf("error getting TCP_INFO: %s", err)
+	}
+
+	state := "unknown"
+	if int(info.state) < len(tcpStateNames) && tcpStateNames[info.state] != "" {
+		state = tcpStateNames[info.state]
+	}
+
+	return &TCPInfo{
+		State:         state,
+		RTT:           info.rtt,
+		RTTVar:        info.rttvar,
+		MinRTT:        info.minRtt,
+		RTO:           info.rto,
+		SndMSS:        info.sndMss,
+		RcvMSS:        info.rcvMss,
+		SndCwnd:       info.sndCwnd,
+		SndSsthresh:   info.sndSsthresh,
+		Unacked:       info.unacked,
+		Lost:          info.lost,
+		TotalRetrans:  info.totalRetrans,
+		NotSentBytes:  info.notsentBytes,
+		BytesAcked:    info.bytesAcked,
+		BytesReceived: info.bytesReceived,
+		BytesSent:     info.bytesSent,
+		BytesRetrans:  info.bytesRetrans,
+		DeliveryRate:  info.deliveryRate,
+		PacingRate:    info.pacingRate,
+	}, nil
+}
@@ -0,0 +1,23 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build !linux || 386
+// +build !linux 386
+
+package tcpserver
+
+import (
+	"fmt"
+	"net"
+)
+
+// TCP_INFO byte counters are only available on Linux (except 386 where getsockopt
+// is multiplexed through socketcall)
+func getTCPByteCounters(c *net.TCPConn) (received, acked uint64, ok bool) {
+	return 0, 0, false
+}
+
+// TCP_INFO is only supported on Linux
+func getTCPInfo(c *net.TCPConn) (*TCPInfo, error) {
+	return nil, fmt.Errorf("TCP_INFO not supported on this platform")
+}
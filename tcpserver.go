@@ -13,23 +13,30 @@ package tcpserver
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/maurice2k/ultrapool"
 )
 
 // Server struct
 type Server struct {
 	listenAddr           *net.TCPAddr
 	listener             *net.TCPListener
-	shutdown             bool
+	listeners            []*net.TCPListener
+	shutdown             int32
+	shutdownChan         chan struct{}
 	shutdownDeadline     time.Time
 	requestHandler       RequestHandlerFunc
+	requestHandlerErr    RequestHandlerErrFunc
+	middlewares          []Middleware
+	handler              RequestHandlerFunc
+	errorHandler         ErrorHandlerFunc
 	connectionCreator    ConnectionCreatorFunc
 	ctx                  *context.Context
 	activeConnections    int32
@@ -41,9 +48,34 @@ type Server struct {
 	connWaitGroup        sync.WaitGroup
 	connStructPool       sync.Pool
 	loops                int
-	wp                   *ultrapool.WorkerPool
+	dispatcher           Dispatcher
+	workerPoolConfig     *WorkerPoolConfig
 	allowThreadLocking   bool
 	ballast              []byte
+	name                 string
+	queuedConnections    int32
+	metrics              *Metrics
+	lm                   *listenerMetrics
+	closeHandler         CloseHandlerFunc
+	hooks                hookChain
+	logger               *slog.Logger
+	shutdownStarted      int32
+	registry             *connRegistry
+	draining             int32
+	certificate          *certificateFiles
+	tracer               Tracer
+	pprofLabels          bool
+	classifier           ClassifierFunc
+	maxClassifying       int
+	classifySlots        chan struct{}
+	readableHandler      ReadableHandlerFunc
+	poller               *poller
+	backend              Backend
+	loopAffinity         [][]int
+	loopCPUs             [][]int
+	nodeLocalWorkers     bool
+	workerCPUs           [][]int
+	processCPUs          []int
 }
 
 // Connection interface
@@ -53,9 +85,15 @@ type Connection interface {
 	GetServer() *Server
 	GetClientAddr() *net.TCPAddr
 	GetServerAddr() *net.TCPAddr
+	GetID() uint64
 	GetStartTime() time.Time
+	GetStats() ConnStats
+	SetError(err error)
+	GetError() error
+	Logger() *slog.Logger
 	SetContext(ctx *context.Context)
 	GetContext() *context.Context
+	SetPprofLabel(key, value string)
 
 	// used internally
 	Start()
@@ -66,10 +104,26 @@ type Connection interface {
 // TCPConn struct implementing Connection and embedding net.Conn
 type TCPConn struct {
 	net.Conn
-	server            *Server
-	ctx               *context.Context
-	ts                int64
-	_cacheLinePadding [24]byte
+	rawConn       net.Conn
+	id            uint64
+	state         uint32
+	killReason    uint32
+	netConnUsed   uint32
+	server        *Server
+	ctx           *context.Context
+	ts            int64
+	bytesRead     uint64
+	bytesWritten  uint64
+	reads         uint64
+	writes        uint64
+	firstByteTs   int64
+	lastByteTs    int64
+	err           error
+	logger        *slog.Logger
+	span          Span
+	pprofLabels   []string
+	loop          uint16
+	priorityClass uint8
 }
 
 // Listener config struct
@@ -88,14 +142,43 @@ type ListenConfig struct {
 	SocketFastOpenQueueLen int
 	// Enable/disable TCP_DEFER_ACCEPT (requires Linux >=2.4)
 	SocketDeferAccept bool
+	// Enable/disable opening one SO_REUSEPORT socket per accept loop instead
+	// of sharing a single listener (requires SocketReusePort; Linux only)
+	SocketSharding bool
+	// Enable/disable steering connections to the accept loop matching the CPU
+	// that received them using SO_ATTACH_REUSEPORT_CBPF (requires
+	// SocketSharding and Linux >=4.6)
+	SocketCPUSteering bool
 }
 
 // Request handler function type
 type RequestHandlerFunc func(conn Connection)
 
+// Request handler function type that is able to report an error
+type RequestHandlerErrFunc func(conn Connection) error
+
+// Error handler function type (called with errors returned by a
+// RequestHandlerErrFunc and with *PanicError for recovered panics)
+type ErrorHandlerFunc func(conn Connection, err error)
+
+// Error passed to the error handler if the request handler panicked
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Returns panic value as error string
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in request handler: %v", e.Value)
+}
+
 // Connection creator function
 type ConnectionCreatorFunc func() Connection
 
+// Close handler function type (called with the connection's final stats
+// after it has been closed)
+type CloseHandlerFunc func(conn Connection, stats ConnStats)
+
 var defaultListenConfig *ListenConfig = &ListenConfig{
 	SocketReusePort: true,
 }
@@ -109,8 +192,11 @@ func NewServer(listenAddr string) (*Server, error) {
 	var s *Server
 
 	s = &Server{
-		listenAddr:   la,
-		listenConfig: defaultListenConfig,
+		listenAddr:       la,
+		listenConfig:     defaultListenConfig,
+		workerPoolConfig: defaultWorkerPoolConfig,
+		registry:         newConnRegistry(),
+		shutdownChan:     make(chan struct{}),
 		connStructPool: sync.Pool{
 			New: func() interface{} {
 				conn := s.connectionCreator()
@@ -130,8 +216,13 @@ func NewServer(listenAddr string) (*Server, error) {
 }
 
 // Sets TLS config but does not enable TLS yet. TLS can be either enabled
-// by using server.ListenTLS() or later by using connection.StartTLS()
+// by using server.ListenTLS() or later by using connection.StartTLS().
+// If certificate files have been set using SetTLSCertificateFiles(), their
+// (reloadable) certificate replaces the config's certificates.
 func (s *Server) SetTLSConfig(config *tls.Config) {
+	if config != nil && s.certificate != nil {
+		config = s.certificate.apply(config)
+	}
 	s.tlsConfig = config
 }
 
@@ -176,10 +267,70 @@ func (s *Server) Listen() (err error) {
 	} else {
 		return fmt.Errorf("listener must be of type net.TCPListener")
 	}
+	s.listeners = []*net.TCPListener{s.listener}
+
+	if s.listenConfig.SocketSharding {
+		if err = s.listenShards(network); err != nil {
+			s.closeListeners()
+			return err
+		}
+	}
+
+	s.log(slog.LevelInfo, "listening", slog.Bool("tls", s.tlsEnabled), slog.Int("sockets", len(s.listeners)))
+
+	for _, f := range s.hooks.onListen {
+		f(s)
+	}
+
+	return nil
+}
+
+// Opens the remaining per-loop SO_REUSEPORT sockets on the address of the
+// first listener
+func (s *Server) listenShards(network string) error {
+	if !s.listenConfig.SocketReusePort {
+		return fmt.Errorf("socket sharding requires SO_REUSEPORT")
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("socket sharding is only supported on Linux")
+	}
+
+	addr := s.listener.Addr().String()
+	for i := 1; i < s.GetLoops(); i++ {
+		l, err := s.listenConfig.lc.Listen(*s.GetContext(), network, addr)
+		if err != nil {
+			return fmt.Errorf("unable to open socket for accept loop %d: %s", i, err)
+		}
+		s.listeners = append(s.listeners, l.(*net.TCPListener))
+	}
 
+	if s.listenConfig.SocketCPUSteering {
+		return attachCPUSteering(s.listeners)
+	}
 	return nil
 }
 
+// Returns the listener used by accept loop with given id
+func (s *Server) getListener(id int) *net.TCPListener {
+	return s.listeners[id%len(s.listeners)]
+}
+
+// Closes all listeners
+func (s *Server) closeListeners() (err error) {
+	for _, l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Returns number of listening sockets (equals the number of accept loops with
+// socket sharding enabled, 1 otherwise)
+func (s *Server) GetListenSockets() int {
+	return len(s.listeners)
+}
+
 // Starts listening using TLS
 func (s *Server) ListenTLS() (err error) {
 	err = s.EnableTLS()
@@ -195,9 +346,27 @@ func (s *Server) SetMaxAcceptConnections(limit int32) {
 	atomic.StoreInt32(&s.maxAcceptConnections, limit)
 }
 
+// Enables/disables drain mode. While draining, the server keeps listening but
+// closes all newly accepted connections right away; existing connections are
+// not affected.
+func (s *Server) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.draining, v) != v {
+		s.log(slog.LevelInfo, "drain mode changed", slog.Bool("draining", draining))
+	}
+}
+
+// Returns whether drain mode is enabled
+func (s *Server) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
 // Returns number of currently active connections
 func (s *Server) GetActiveConnections() int32 {
-	return s.activeConnections
+	return atomic.LoadInt32(&s.activeConnections)
 }
 
 // Returns number of accepted connections
@@ -205,6 +374,52 @@ func (s *Server) GetAcceptedConnections() int32 {
 	return s.acceptedConnections
 }
 
+// Returns number of accepted connections that are waiting for a worker
+func (s *Server) GetQueuedConnections() int32 {
+	return atomic.LoadInt32(&s.queuedConnections)
+}
+
+// Returns number of currently spawned worker pool go routines
+func (s *Server) GetWorkers() int {
+	if s.dispatcher == nil {
+		return 0
+	}
+	return s.dispatcher.GetWorkers()
+}
+
+// Sets server name (used as "listener" label in metrics and logs)
+func (s *Server) SetName(name string) {
+	s.name = name
+}
+
+// Returns server name (defaults to the listening address)
+func (s *Server) GetName() string {
+	if s.name != "" {
+		return s.name
+	}
+	if la := s.GetListenAddr(); la != nil {
+		return la.String()
+	}
+	return s.listenAddr.String()
+}
+
+// Sets metrics collector; use nil to disable metrics
+func (s *Server) SetMetrics(m *Metrics) {
+	if s.metrics != nil {
+		s.metrics.unregister(s.lm)
+		s.lm = nil
+	}
+	s.metrics = m
+	if m != nil {
+		s.lm = m.register(s)
+	}
+}
+
+// Returns metrics collector
+func (s *Server) GetMetrics() *Metrics {
+	return s.metrics
+}
+
 // Returns listening address
 func (s *Server) GetListenAddr() *net.TCPAddr {
 	if s.listener == nil {
@@ -216,12 +431,28 @@ func (s *Server) GetListenAddr() *net.TCPAddr {
 // Gracefully shutdown server but wait no longer than d for active connections.
 // Use d = 0 to wait indefinitely for active connections.
 func (s *Server) Shutdown(d time.Duration) (err error) {
+	if atomic.CompareAndSwapInt32(&s.shutdownStarted, 0, 1) {
+		s.log(slog.LevelInfo, "shutdown started", slog.Duration("timeout", d), slog.Int("active_connections", int(s.GetActiveConnections())))
+		for _, f := range s.hooks.onShutdown {
+			f(s)
+		}
+		close(s.shutdownChan)
+		// accept loops (and the poller) may be blocked in Dispatch
+		if d, ok := s.dispatcher.(interface{ Abort() }); ok {
+			d.Abort()
+		}
+	}
+
 	s.shutdownDeadline = time.Time{}
-	if d > 0 {
+	if d != 0 {
+		// negative durations result in a deadline in the past (don't wait at all)
 		s.shutdownDeadline = time.Now().Add(d)
 	}
-	s.shutdown = true
-	err = s.listener.Close()
+	atomic.StoreInt32(&s.shutdown, 1)
+	if s.backend != nil {
+		s.backend.StopAccepting()
+	}
+	err = s.closeListeners()
 	if err != nil {
 		return err
 	}
@@ -241,23 +472,75 @@ func (s *Server) Serve() error {
 
 	maxProcs := runtime.GOMAXPROCS(0)
 	loops := s.GetLoops()
+	if len(s.listeners) > 1 && len(s.listeners) != loops {
+		return fmt.Errorf("number of accept loops (%d) doesn't match number of sockets (%d); call SetLoops() before Listen()", loops, len(s.listeners))
+	}
+	if err := s.resolveAffinity(loops); err != nil {
+		return err
+	}
+
+	if s.dispatcher == nil {
+		s.dispatcher = NewWorkerPoolDispatcher(s.workerPoolConfig)
+	}
+	s.handler = s.buildHandler()
 
-	s.wp = ultrapool.NewWorkerPool(s.serveConn)
-	s.wp.SetNumShards(maxProcs * 2)
-	s.wp.SetIdleWorkerLifetime(5 * time.Second)
-	s.wp.Start()
-	defer s.wp.Stop()
+	serve := s.serveConn
+	if s.readableHandler != nil {
+		// hybrid mode: the dispatcher serves readable connections
+		serve = s.serveReadable
+	}
+	if err := s.dispatcher.Start(serve); err != nil {
+		return fmt.Errorf("error starting dispatcher: %s", err)
+	}
+	defer s.dispatcher.Stop()
+
+	if s.classifier != nil && s.tlsEnabled {
+		s.classifySlots = make(chan struct{}, s.GetMaxClassifying())
+	}
+
+	startCoarseClock()
+	defer stopCoarseClock()
+
+	if s.backend == nil {
+		s.backend = NewNetBackend()
+	}
+	if err := s.backend.Start(s, s.handleAccepted); err != nil {
+		return fmt.Errorf("error starting %s backend: %s", s.backend.Name(), err)
+	}
+	defer s.backend.Stop()
+
+	if s.readableHandler != nil {
+		if s.tlsEnabled {
+			return fmt.Errorf("hybrid mode doesn't support TLS")
+		}
+		if _, ok := s.backend.(*netBackend); !ok {
+			return fmt.Errorf("hybrid mode requires the net backend")
+		}
+		p, err := newPoller(s)
+		if err != nil {
+			return fmt.Errorf("error starting poller: %s", err)
+		}
+		s.poller = p
+		defer p.stop()
+	}
 
 	errChan := make(chan error, loops)
 
 	for i := 0; i < loops; i++ {
 		go func(id int) {
-			if s.allowThreadLocking && maxProcs >= 2 && id < loops/2 {
+			if cpus := s.loopCPUs[id]; len(cpus) > 0 {
+				// the thread is terminated (not unlocked) when the loop
+				// exits, so its CPU affinity doesn't leak to other go routines
+				runtime.LockOSThread()
+				if err := pinThread(cpus); err != nil {
+					s.log(slog.LevelWarn, "unable to pin accept loop", slog.Any("error", err), slog.Int("loop", id))
+				}
+			} else if s.allowThreadLocking && maxProcs >= 2 && id < loops/2 {
 				runtime.LockOSThread()
 				defer runtime.UnlockOSThread()
 			}
 
-			errChan <- s.acceptLoop(id)
+			errChan <- s.backend.AcceptLoop(id)
 		}(i)
 	}
 
@@ -268,22 +551,55 @@ func (s *Server) Serve() error {
 		}
 	}
 
-	if s.activeConnections == 0 {
-		return nil
+	s.log(slog.LevelInfo, "accept loops stopped")
+
+	if s.poller != nil {
+		if closed := s.closeIdleConnections(); closed > 0 {
+			s.log(slog.LevelInfo, "closed idle connections", slog.Int("closed_connections", closed))
+		}
 	}
 
+	connsDone := make(chan struct{})
+	go func() {
+		s.connWaitGroup.Wait()
+		close(connsDone)
+	}()
+
 	if s.shutdownDeadline.IsZero() {
 		// just wait for all connections to be closed
-		s.connWaitGroup.Wait()
+		s.log(slog.LevelInfo, "waiting for active connections", slog.Int("active_connections", int(s.GetActiveConnections())))
+		<-connsDone
 
 	} else {
 		diff := s.shutdownDeadline.Sub(time.Now())
 		if diff > 0 {
 			// wait specified time for still active connections to be closed
-			time.Sleep(diff)
+			s.log(slog.LevelInfo, "waiting for active connections", slog.Int("active_connections", int(s.GetActiveConnections())), slog.Duration("timeout", diff))
+			timer := time.NewTimer(diff)
+			select {
+			case <-connsDone:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+
+		if closed := s.closeAllConnections(); closed > 0 {
+			s.log(slog.LevelWarn, "shutdown deadline reached; forcibly closed connections", slog.Int("closed_connections", closed))
+
+			if s.poller != nil {
+				// killed connections are closed by the poller's workers
+				timer := time.NewTimer(hybridCloseTimeout)
+				select {
+				case <-connsDone:
+				case <-timer.C:
+				}
+				timer.Stop()
+			}
 		}
 	}
 
+	s.log(slog.LevelInfo, "shutdown complete")
+
 	return nil
 }
 
@@ -296,6 +612,24 @@ func (s *Server) SetConnectionCreator(f ConnectionCreatorFunc) {
 // Sets request handler function
 func (s *Server) SetRequestHandler(f RequestHandlerFunc) {
 	s.requestHandler = f
+	s.requestHandlerErr = nil
+}
+
+// Sets request handler function that may return an error
+// (replaces the request handler set by SetRequestHandler)
+func (s *Server) SetRequestHandlerErr(f RequestHandlerErrFunc) {
+	s.requestHandlerErr = f
+	s.requestHandler = nil
+}
+
+// Sets error handler function (called before the connection is closed)
+func (s *Server) SetErrorHandler(f ErrorHandlerFunc) {
+	s.errorHandler = f
+}
+
+// Sets close handler function that receives each connection's final stats
+func (s *Server) SetCloseHandler(f CloseHandlerFunc) {
+	s.closeHandler = f
 }
 
 // Sets context to the server that is later passed to the handleRequest method
@@ -325,7 +659,8 @@ func (s *Server) GetLoops() int {
 	return s.loops
 }
 
-// Whether or not allow thread locking in accept loops
+// Whether or not allow thread locking in accept loops; with socket CPU
+// steering, all accept loops are pinned to the CPUs they receive connections from
 func (s *Server) SetAllowThreadLocking(allow bool) {
 	s.allowThreadLocking = allow
 }
@@ -345,6 +680,7 @@ func (s *Server) acceptLoop(id int) error {
 		tempDelay time.Duration
 		tcpConn   net.Conn
 		err       error
+		listener  = s.getListener(id)
 	)
 
 	for {
@@ -352,12 +688,12 @@ func (s *Server) acceptLoop(id int) error {
 			s.Shutdown(0)
 		}
 
-		if s.shutdown {
-			_ = s.listener.Close()
+		if atomic.LoadInt32(&s.shutdown) == 1 {
+			_ = listener.Close()
 			break
 		}
 
-		tcpConn, err = s.listener.AcceptTCP()
+		tcpConn, err = listener.AcceptTCP()
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok {
 
@@ -366,11 +702,15 @@ func (s *Server) acceptLoop(id int) error {
 					continue
 				}
 
-				if !(opErr.Temporary() && opErr.Timeout()) && s.shutdown {
+				if !(opErr.Temporary() && opErr.Timeout()) && atomic.LoadInt32(&s.shutdown) == 1 {
 					break
 				}
 
 				if opErr.Temporary() {
+					if s.lm != nil {
+						atomic.AddUint64(&s.lm.acceptErrors, 1)
+					}
+
 					if tempDelay == 0 {
 						tempDelay = 10 * time.Millisecond
 					} else {
@@ -381,53 +721,282 @@ func (s *Server) acceptLoop(id int) error {
 						tempDelay = max
 					}
 
+					s.log(slog.LevelWarn, "accept error; backing off", slog.Any("error", err), slog.Int("loop", id), slog.Duration("delay", tempDelay))
 					time.Sleep(tempDelay)
 					continue
 				}
 
 			}
 
-			s.listener.Close()
+			if s.lm != nil {
+				atomic.AddUint64(&s.lm.acceptErrors, 1)
+			}
+			s.log(slog.LevelError, "accept error", slog.Any("error", err), slog.Int("loop", id))
+			listener.Close()
 			return err
 		}
 
 		tempDelay = 0
-
-		newAcceptedConns := atomic.AddInt32(&s.acceptedConnections, 1)
-		if s.maxAcceptConnections > 0 && newAcceptedConns > s.maxAcceptConnections {
-			// We have accepted too much connections which might happen due to
-			// the fact that we use multiple accept loops without locking.
-			// In this case we just close the connection (we shouldn't have accepted
-			// in the first place) and continue for shutting down the server.
-			tcpConn.Close()
-			continue
-		}
-
-		s.wp.AddTask(tcpConn)
-		//go s.serveConn(tcpConn)
+		s.handleAccepted(id, tcpConn)
 		tcpConn = nil
 	}
 	return nil
 }
 
-// Serve a single connection (called from ultrapool)
-func (s *Server) serveConn(task ultrapool.Task) {
+// Handles a newly accepted connection (called from the accept loops)
+func (s *Server) handleAccepted(loop int, netConn net.Conn) {
+	if s.lm != nil {
+		atomic.AddUint64(&s.lm.accepted, 1)
+	}
+
+	newAcceptedConns := atomic.AddInt32(&s.acceptedConnections, 1)
+	if s.maxAcceptConnections > 0 && newAcceptedConns > s.maxAcceptConnections {
+		// We have accepted too much connections which might happen due to
+		// the fact that we use multiple accept loops without locking.
+		// In this case we just close the connection (we shouldn't have accepted
+		// in the first place) and continue for shutting down the server.
+		netConn.Close()
+		if s.lm != nil {
+			atomic.AddUint64(&s.lm.rejected[RejectReasonMaxAccept], 1)
+		}
+		return
+	}
+
 	conn := s.connStructPool.Get().(*TCPConn)
-	netConn := task.(net.Conn)
+	conn.Reset(netConn)
+	conn.id = nextConnID()
+	conn.loop = uint16(loop)
+	conn.Start()
+
+	if s.tracer != nil {
+		s.startConnSpan(conn)
+	}
+
+	if atomic.LoadInt32(&s.draining) == 1 {
+		s.rejectConn(conn, RejectReasonDrain, nil)
+		return
+	}
+
+	if len(s.hooks.onAccept) > 0 {
+		if err := s.callAcceptHooks(conn); err != nil {
+			s.rejectConn(conn, RejectReasonHook, err)
+			return
+		}
+	}
+
+	s.connWaitGroup.Add(1)
+	s.registry.add(conn)
+	atomic.AddInt32(&s.queuedConnections, 1)
+
+	if s.classifier == nil {
+		s.dispatch(conn)
+	} else if s.tlsEnabled {
+		// reading the TLS server name must not block the accept loop
+		if err := s.acquireClassifySlot(); err != nil {
+			atomic.AddInt32(&s.queuedConnections, -1)
+			s.registry.remove(conn)
+			s.connWaitGroup.Done()
+			if err == ErrOverloaded {
+				s.rejectConn(conn, RejectReasonOverload, err)
+			} else {
+				s.rejectConn(conn, RejectReasonDispatch, err)
+			}
+			return
+		}
+		go s.classifyAndDispatch(conn)
+	} else {
+		s.classifyAndDispatch(conn)
+	}
+}
 
+// Hands the connection over to the dispatcher (or the poller in hybrid mode)
+func (s *Server) dispatch(conn *TCPConn) {
+	if s.poller != nil {
+		s.startPolling(conn)
+		return
+	}
+
+	err := s.dispatcher.Dispatch(conn)
+	if err == nil {
+		return
+	}
+
+	atomic.AddInt32(&s.queuedConnections, -1)
+	s.registry.remove(conn)
+	s.connWaitGroup.Done()
+
+	if errors.Is(err, ErrOverloaded) {
+		s.rejectConn(conn, RejectReasonOverload, err)
+	} else {
+		s.rejectConn(conn, RejectReasonDispatch, err)
+	}
+}
+
+// Closes an accepted connection that is not going to be served
+func (s *Server) rejectConn(conn *TCPConn, reason RejectReason, err error) {
+	s.callRejectHooks(conn, reason)
+	conn.Close()
+
+	if s.lm != nil {
+		atomic.AddUint64(&s.lm.rejected[reason], 1)
+	}
+
+	if reason == RejectReasonDispatch && err != ErrShutdown {
+		s.log(slog.LevelWarn, "error dispatching connection", slog.Any("error", err))
+	} else if s.logEnabled(slog.LevelDebug) {
+		conn.Logger().Debug("connection rejected", slog.String("reason", reason.String()))
+	}
+
+	if conn.span != nil {
+		conn.span.AddEvent("reject", slog.String("reason", reason.String()))
+		if reason == RejectReasonDispatch {
+			conn.span.RecordError(err)
+		}
+		conn.span.End()
+		conn.span = nil
+	}
+	s.connStructPool.Put(conn)
+}
+
+// Serves a single connection (called from the dispatcher)
+func (s *Server) serveConn(c Connection) {
+	conn := c.(*TCPConn)
+
+	atomic.AddInt32(&s.queuedConnections, -1)
 	atomic.AddInt32(&s.activeConnections, 1)
 
+	var (
+		reason = CloseReasonNormal
+		err    error
+	)
+
+	if s.pprofLabels {
+		s.setPprofLabels(conn, append([]string{"listener", s.GetName()}, conn.pprofLabels...)...)
+		defer s.resetPprofLabels()
+	}
+
+	if s.workerCPUs != nil {
+		s.pinWorker(conn)
+	}
+
 	if s.tlsEnabled {
-		netConn = tls.Server(netConn, s.GetTLSConfig())
+		conn.setState(ConnStateHandshake)
+		tlsConn := tls.Server(conn.Conn, s.GetTLSConfig())
+		conn.Conn = tlsConn
+		if err = s.handshakeTLS(conn, tlsConn); err != nil {
+			reason = CloseReasonTLSHandshake
+		} else if s.pprofLabels {
+			s.setTLSPprofLabels(conn, tlsConn)
+		}
 	}
 
-	conn.Reset(netConn)
-	conn.Start()
-	s.requestHandler(conn)
+	if reason == CloseReasonNormal {
+		reason, err = s.handleRequest(conn)
+		if err != nil && s.errorHandler != nil {
+			s.errorHandler(conn, err)
+		}
+	}
+
+	s.closeConn(conn, reason, err)
+}
+
+// Calls the request handler and recovers from panics
+func (s *Server) handleRequest(conn *TCPConn) (reason CloseReason, err error) {
+	conn.setState(ConnStateActive)
+
+	if conn.span != nil {
+		conn.span.AddEvent("handler.start")
+	}
+
+	for _, f := range s.hooks.onHandlerStart {
+		f(conn)
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			reason = CloseReasonPanic
+			err = s.handlePanic(conn, v)
+		}
+	}()
+
+	s.handler(conn)
+
+	err = conn.err
+	if err == nil {
+		return CloseReasonNormal, nil
+	}
+	if _, ok := err.(*PanicError); ok {
+		return CloseReasonPanic, err
+	}
+	return CloseReasonError, err
+}
+
+// Logs a recovered panic and calls OnHandlerPanic hooks
+func (s *Server) handlePanic(conn Connection, v interface{}) error {
+	stack := debug.Stack()
+	s.logPanic(conn, v, stack)
+
+	for _, f := range s.hooks.onHandlerPanic {
+		f(conn, v, stack)
+	}
+	return &PanicError{Value: v, Stack: stack}
+}
+
+// Closes the connection and returns it to the pool
+func (s *Server) closeConn(conn *TCPConn, reason CloseReason, err error) {
+	conn.setState(ConnStateClosing)
+	if killReason := atomic.LoadUint32(&conn.killReason); killReason != 0 && reason != CloseReasonPanic {
+		reason = CloseReason(killReason)
+	}
+
+	if s.lm != nil || s.closeHandler != nil || len(s.hooks.onClose) > 0 {
+		conn.finalizeStats()
+	}
 	conn.Close()
 	atomic.AddInt32(&s.activeConnections, -1)
 
+	if s.logEnabled(slog.LevelDebug) {
+		l := conn.Logger()
+		if err != nil {
+			l = l.With(slog.Any("error", err))
+		}
+		l.Debug("connection closed", slog.String("reason", reason.String()), slog.Duration("duration", time.Since(conn.GetStartTime())))
+	}
+
+	if s.closeHandler != nil {
+		s.closeHandler(conn, conn.GetStats())
+	}
+
+	s.callCloseHooks(conn, reason, err)
+
+	if conn.span != nil {
+		conn.endSpan(reason, err)
+	}
+
+	if s.lm != nil {
+		s.lm.connectionClosed(conn, reason)
+	}
+
+	s.registry.remove(conn)
 	s.connStructPool.Put(conn)
+	s.connWaitGroup.Done()
+}
+
+// Performs the server side TLS handshake
+func (s *Server) handshakeTLS(conn *TCPConn, tlsConn *tls.Conn) error {
+	start := time.Now()
+	err := tlsConn.Handshake()
+	if s.lm != nil {
+		s.lm.tlsHandshake(time.Since(start), err)
+	}
+	if err != nil && s.logEnabled(slog.LevelInfo) {
+		conn.Logger().Info("TLS handshake failed", slog.String("alert", tlsAlertLabel(err)), slog.Any("error", err))
+	}
+	if conn.span != nil {
+		conn.traceTLSHandshake(tlsConn, err)
+	}
+	s.callTLSHandshakeHooks(conn, tlsConn, err)
+	return err
 }
 
 // Returns client IP and port
@@ -459,13 +1028,25 @@ func (conn *TCPConn) GetContext() *context.Context {
 	return conn.ctx
 }
 
+// Sets error that occurred while handling the connection
+func (conn *TCPConn) SetError(err error) {
+	conn.err = err
+}
+
+// Returns error set by the request handler (or a middleware)
+func (conn *TCPConn) GetError() error {
+	return conn.err
+}
+
 // Returns underlying net.Conn connection (most likely either *net.TCPConn or *tls.Conn)
 func (conn *TCPConn) GetNetConn() net.Conn {
+	atomic.StoreUint32(&conn.netConnUsed, 1)
 	return conn.Conn
 }
 
 // Returns underlying net.Conn connection as *net.TCPConn or nil if net.Conn is something else
 func (conn *TCPConn) GetNetTCPConn() (c *net.TCPConn) {
+	atomic.StoreUint32(&conn.netConnUsed, 1)
 	c, _ = conn.Conn.(*net.TCPConn)
 	return
 }
@@ -480,10 +1061,32 @@ func (conn *TCPConn) GetServer() *Server {
 	return conn.server
 }
 
+// Returns id of the accept loop that accepted the connection
+func (conn *TCPConn) GetLoop() int {
+	return int(conn.loop)
+}
+
 // Resets the TCPConn for re-use
 func (conn *TCPConn) Reset(netConn net.Conn) {
 	conn.Conn = netConn
+	conn.rawConn = netConn
+	conn.id = 0
+	conn.state = uint32(ConnStateQueued)
+	conn.killReason = 0
+	conn.netConnUsed = 0
 	conn.ctx = nil
+	conn.bytesRead = 0
+	conn.bytesWritten = 0
+	conn.reads = 0
+	conn.writes = 0
+	conn.firstByteTs = 0
+	conn.lastByteTs = 0
+	conn.err = nil
+	conn.logger = nil
+	conn.span = nil
+	conn.pprofLabels = conn.pprofLabels[:0]
+	conn.loop = 0
+	conn.priorityClass = 0
 }
 
 // Sets start timer to "now"
@@ -500,6 +1103,8 @@ func (conn *TCPConn) StartTLS(config *tls.Config) error {
 		return fmt.Errorf("no valid TLS config given")
 	}
 	conn.Conn = tls.Server(conn.Conn, config)
+	// rebuilt with SNI after the handshake
+	conn.logger = nil
 	return nil
 }
 
@@ -0,0 +1,183 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package tracetest provides an in-memory tcpserver.Tracer that records all
+// spans, e.g. to assert on connection spans in tests.
+package tracetest
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Tracer recording all spans in memory (implements tcpserver.Tracer)
+type Recorder struct {
+	mutex  sync.Mutex
+	spans  []*span
+	lastID uint64
+}
+
+// Snapshot of a recorded span
+type SpanData struct {
+	// Span ID (unique within the recorder, starting at 1)
+	ID uint64
+	// Parent span ID (0 for root spans)
+	ParentID uint64
+	Name     string
+	Start    time.Time
+	// End time (zero if the span hasn't ended yet)
+	End    time.Time
+	Attrs  []slog.Attr
+	Events []Event
+	Errors []error
+}
+
+// Span event
+type Event struct {
+	Name  string
+	Time  time.Time
+	Attrs []slog.Attr
+}
+
+// Recorded span (implements tcpserver.Span)
+type span struct {
+	rec  *Recorder
+	data SpanData
+}
+
+type contextKey struct{}
+
+// Creates a new recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Starts a new span as child of the span carried by ctx (if any)
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, tcpserver.Span) {
+	r.mutex.Lock()
+	r.lastID++
+	sp := &span{
+		rec: r,
+		data: SpanData{
+			ID:    r.lastID,
+			Name:  name,
+			Start: time.Now(),
+			Attrs: append([]slog.Attr(nil), attrs...),
+		},
+	}
+	if parent, ok := ctx.Value(contextKey{}).(*span); ok && parent.rec == r {
+		sp.data.ParentID = parent.data.ID
+	}
+	r.spans = append(r.spans, sp)
+	r.mutex.Unlock()
+
+	return context.WithValue(ctx, contextKey{}, sp), sp
+}
+
+// Returns snapshots of all spans (in start order)
+func (r *Recorder) Spans() []SpanData {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	spans := make([]SpanData, len(r.spans))
+	for i, sp := range r.spans {
+		spans[i] = sp.data.clone()
+	}
+	return spans
+}
+
+// Returns snapshots of all ended spans (in start order)
+func (r *Recorder) Ended() []SpanData {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	spans := make([]SpanData, 0, len(r.spans))
+	for _, sp := range r.spans {
+		if !sp.data.End.IsZero() {
+			spans = append(spans, sp.data.clone())
+		}
+	}
+	return spans
+}
+
+// Removes all recorded spans
+func (r *Recorder) Reset() {
+	r.mutex.Lock()
+	r.spans = nil
+	r.mutex.Unlock()
+}
+
+// Returns the value of the last attribute with given key
+func (sd SpanData) Attr(key string) (slog.Value, bool) {
+	for i := len(sd.Attrs) - 1; i >= 0; i-- {
+		if sd.Attrs[i].Key == key {
+			return sd.Attrs[i].Value, true
+		}
+	}
+	return slog.Value{}, false
+}
+
+// Returns the first event with given name
+func (sd SpanData) Event(name string) (Event, bool) {
+	for _, ev := range sd.Events {
+		if ev.Name == name {
+			return ev, true
+		}
+	}
+	return Event{}, false
+}
+
+// Returns span duration (zero if the span hasn't ended yet)
+func (sd SpanData) Duration() time.Duration {
+	if sd.End.IsZero() {
+		return 0
+	}
+	return sd.End.Sub(sd.Start)
+}
+
+// Returns a deep copy
+func (sd SpanData) clone() SpanData {
+	sd.Attrs = append([]slog.Attr(nil), sd.Attrs...)
+	sd.Events = append([]Event(nil), sd.Events...)
+	sd.Errors = append([]error(nil), sd.Errors...)
+	return sd
+}
+
+// Sets span attributes
+func (sp *span) SetAttributes(attrs ...slog.Attr) {
+	sp.rec.mutex.Lock()
+	sp.data.Attrs = append(sp.data.Attrs, attrs...)
+	sp.rec.mutex.Unlock()
+}
+
+// Adds a timestamped event
+func (sp *span) AddEvent(name string, attrs ...slog.Attr) {
+	ev := Event{
+		Name:  name,
+		Time:  time.Now(),
+		Attrs: append([]slog.Attr(nil), attrs...),
+	}
+	sp.rec.mutex.Lock()
+	sp.data.Events = append(sp.data.Events, ev)
+	sp.rec.mutex.Unlock()
+}
+
+// Records an error
+func (sp *span) RecordError(err error) {
+	sp.rec.mutex.Lock()
+	sp.data.Errors = append(sp.data.Errors, err)
+	sp.rec.mutex.Unlock()
+}
+
+// Ends the span (subsequent calls are ignored)
+func (sp *span) End() {
+	sp.rec.mutex.Lock()
+	if sp.data.End.IsZero() {
+		sp.data.End = time.Now()
+	}
+	sp.rec.mutex.Unlock()
+}
@@ -0,0 +1,272 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tracetest_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/tracetest"
+)
+
+// Starts a traced server; setup (if not nil) is called before Listen()
+func startServer(t *testing.T, rec *tracetest.Recorder, handler tcpserver.RequestHandlerErrFunc, setup func(s *tcpserver.Server)) *tcpserver.Server {
+	t.Helper()
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetName("traced")
+	s.SetTracer(rec)
+	s.SetRequestHandlerErr(handler)
+	if setup != nil {
+		setup(s)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	})
+	return s
+}
+
+// Waits until n spans have ended and returns them
+func waitEnded(t *testing.T, rec *tracetest.Recorder, n int) []tracetest.SpanData {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if spans := rec.Ended(); len(spans) >= n {
+			return spans
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d ended spans (got %d)", n, len(rec.Ended()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func assertAttr(t *testing.T, sd tracetest.SpanData, key, want string) {
+	t.Helper()
+	v, ok := sd.Attr(key)
+	if !ok {
+		t.Errorf("span %q: attribute %s missing", sd.Name, key)
+		return
+	}
+	if got := v.String(); got != want {
+		t.Errorf("span %q: %s = %q, want %q", sd.Name, key, got, want)
+	}
+}
+
+func TestConnectionSpan(t *testing.T) {
+	rec := tracetest.NewRecorder()
+	s := startServer(t, rec, func(conn tcpserver.Connection) error {
+		_, span := tcpserver.StartSpan(conn, "request")
+		defer span.End()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		_, err := conn.Write(buf)
+		return err
+	}, nil)
+
+	c, err := net.Dial("tcp", s.GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = c.Write([]byte("ping"))
+	_, _ = io.ReadAll(c)
+	client := c.LocalAddr().(*net.TCPAddr)
+	c.Close()
+
+	spans := waitEnded(t, rec, 2)
+	connSpan, reqSpan := spans[0], spans[1]
+	if connSpan.Name != "tcpserver.conn" || reqSpan.Name != "request" {
+		t.Fatalf("unexpected spans %q, %q", connSpan.Name, reqSpan.Name)
+	}
+	if reqSpan.ParentID != connSpan.ID {
+		t.Errorf("request span parent = %d, want %d", reqSpan.ParentID, connSpan.ID)
+	}
+
+	assertAttr(t, connSpan, "network.transport", "tcp")
+	assertAttr(t, connSpan, "client.address", client.IP.String())
+	assertAttr(t, connSpan, "client.port", strconv.Itoa(client.Port))
+	assertAttr(t, connSpan, "server.port", strconv.Itoa(s.GetListenAddr().Port))
+	assertAttr(t, connSpan, "tcpserver.listener", "traced")
+	assertAttr(t, connSpan, "tcpserver.close_reason", "normal")
+	assertAttr(t, connSpan, "tcpserver.bytes_read", "4")
+	assertAttr(t, connSpan, "tcpserver.bytes_written", "4")
+
+	for _, name := range []string{"handler.start", "close"} {
+		if _, ok := connSpan.Event(name); !ok {
+			t.Errorf("event %q missing", name)
+		}
+	}
+	if len(connSpan.Errors) != 0 {
+		t.Errorf("unexpected errors %v", connSpan.Errors)
+	}
+	if connSpan.Duration() <= 0 || reqSpan.End.After(connSpan.End) {
+		t.Errorf("unexpected span times: conn %s-%s, request %s-%s", connSpan.Start, connSpan.End, reqSpan.Start, reqSpan.End)
+	}
+}
+
+func TestConnectionSpanError(t *testing.T) {
+	rec := tracetest.NewRecorder()
+	errBoom := errors.New("boom")
+	s := startServer(t, rec, func(conn tcpserver.Connection) error {
+		return errBoom
+	}, nil)
+
+	c, err := net.Dial("tcp", s.GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(c)
+	c.Close()
+
+	sd := waitEnded(t, rec, 1)[0]
+	assertAttr(t, sd, "tcpserver.close_reason", "error")
+	if len(sd.Errors) != 1 || !errors.Is(sd.Errors[0], errBoom) {
+		t.Errorf("errors = %v, want [boom]", sd.Errors)
+	}
+	if ev, ok := sd.Event("close"); !ok || len(ev.Attrs) == 0 || ev.Attrs[0].Value.String() != "error" {
+		t.Errorf("close event = %+v", ev)
+	}
+}
+
+func TestConnectionSpanReject(t *testing.T) {
+	rec := tracetest.NewRecorder()
+	s := startServer(t, rec, func(conn tcpserver.Connection) error {
+		t.Error("handler called for rejected connection")
+		return nil
+	}, func(s *tcpserver.Server) {
+		s.AddHooks(tcpserver.Hooks{
+			OnAccept: func(conn tcpserver.Connection) error {
+				return errors.New("blocked")
+			},
+		})
+	})
+
+	c, err := net.Dial("tcp", s.GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(c)
+	c.Close()
+
+	sd := waitEnded(t, rec, 1)[0]
+	ev, ok := sd.Event("reject")
+	if !ok || len(ev.Attrs) == 0 || ev.Attrs[0].Value.String() != "hook" {
+		t.Errorf("reject event = %+v", ev)
+	}
+	if _, ok := sd.Event("handler.start"); ok {
+		t.Error("handler.start event for rejected connection")
+	}
+}
+
+func TestConnectionSpanTLSHandshake(t *testing.T) {
+	rec := tracetest.NewRecorder()
+	s := startServer(t, rec, func(conn tcpserver.Connection) error {
+		_, err := conn.Write([]byte("ok"))
+		return err
+	}, func(s *tcpserver.Server) {
+		s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+		if err := s.EnableTLS(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	addr := s.GetListenAddr().String()
+
+	// successful handshake
+	c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "example.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(c)
+	c.Close()
+
+	sd := waitEnded(t, rec, 1)[0]
+	ev, ok := sd.Event("tls.handshake")
+	if !ok {
+		t.Fatal("tls.handshake event missing")
+	}
+	attrs := make(map[string]string)
+	for _, a := range ev.Attrs {
+		attrs[a.Key] = a.Value.String()
+	}
+	if attrs["tls.server_name"] != "example.test" || attrs["tls.version"] != "TLS 1.3" || attrs["tls.cipher"] == "" {
+		t.Errorf("unexpected handshake attributes %v", attrs)
+	}
+	assertAttr(t, sd, "tcpserver.close_reason", "normal")
+
+	// failed handshake
+	rec.Reset()
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = raw.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, _ = io.ReadAll(raw)
+	raw.Close()
+
+	sd = waitEnded(t, rec, 1)[0]
+	ev, ok = sd.Event("tls.handshake")
+	if !ok {
+		t.Fatal("tls.handshake event missing for failed handshake")
+	}
+	alert := ""
+	for _, a := range ev.Attrs {
+		if a.Key == "tls.alert" {
+			alert = a.Value.String()
+		}
+	}
+	if alert != "bad_record_header" {
+		t.Errorf("tls.alert = %q, want bad_record_header", alert)
+	}
+	assertAttr(t, sd, "tcpserver.close_reason", "tls_handshake")
+	if len(sd.Errors) != 1 {
+		t.Errorf("errors = %v, want handshake error", sd.Errors)
+	}
+}
+
+// Returns a self-signed certificate
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.test"},
+		DNSNames:     []string{"example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package tcpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"strconv"
+)
+
+// Tracer creates spans. It is deliberately small so that any tracing system
+// can be plugged in without the core module depending on it; see the otel
+// module for an OpenTelemetry adapter and the tracetest package for an
+// in-memory tracer for tests.
+type Tracer interface {
+	// Starts a new span as child of the span carried by ctx (if any) and
+	// returns a context carrying the new span
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+}
+
+// Span created by a Tracer
+type Span interface {
+	// Sets span attributes
+	SetAttributes(attrs ...slog.Attr)
+	// Adds a timestamped event
+	AddEvent(name string, attrs ...slog.Attr)
+	// Records an error and marks the span as failed
+	RecordError(err error)
+	// Ends the span
+	End()
+}
+
+// Sets tracer; every connection produces a "tcpserver.conn" span covering
+// accept, TLS handshake and request handler. Use nil to disable tracing.
+// Must be called before Serve().
+func (s *Server) SetTracer(t Tracer) {
+	s.tracer = t
+}
+
+// Returns tracer (nil if none set)
+func (s *Server) GetTracer() Tracer {
+	return s.tracer
+}
+
+// Starts a child span of the connection's span, e.g. per logical request
+// handled on the connection. The returned context carries the new span. If
+// the server has no tracer, a no-op span is returned.
+func StartSpan(conn Connection, name string, attrs ...slog.Attr) (context.Context, Span) {
+	ctx := *conn.GetContext()
+	if s := conn.GetServer(); s != nil && s.tracer != nil {
+		return s.tracer.Start(ctx, name, attrs...)
+	}
+	return ctx, noopSpan{}
+}
+
+// Starts the connection's span and sets its context as connection context
+func (s *Server) startConnSpan(conn *TCPConn) {
+	client := conn.GetClientAddr()
+	server := conn.GetServerAddr()
+	ctx, span := s.tracer.Start(*s.GetContext(), "tcpserver.conn",
+		slog.String("network.transport", "tcp"),
+		slog.String("client.address", client.IP.String()),
+		slog.Int("client.port", client.Port),
+		slog.String("server.address", server.IP.String()),
+		slog.Int("server.port", server.Port),
+		slog.String("tcpserver.listener", s.GetName()),
+		slog.String("tcpserver.conn_id", strconv.FormatUint(conn.id, 10)),
+	)
+	conn.span = span
+	conn.ctx = &ctx
+}
+
+// Adds TLS handshake event to the connection's span
+func (conn *TCPConn) traceTLSHandshake(tlsConn *tls.Conn, err error) {
+	if err != nil {
+		conn.span.AddEvent("tls.handshake", slog.String("tls.alert", tlsAlertLabel(err)), slog.String("error", err.Error()))
+		return
+	}
+
+	state := tlsConn.ConnectionState()
+	attrs := []slog.Attr{
+		slog.String("tls.version", tls.VersionName(state.Version)),
+		slog.String("tls.cipher", tls.CipherSuiteName(state.CipherSuite)),
+		slog.Bool("tls.resumed", state.DidResume),
+	}
+	if state.ServerName != "" {
+		attrs = append(attrs, slog.String("tls.server_name", state.ServerName))
+	}
+	if state.NegotiatedProtocol != "" {
+		attrs = append(attrs, slog.String("tls.protocol", state.NegotiatedProtocol))
+	}
+	conn.span.AddEvent("tls.handshake", attrs...)
+}
+
+// Adds close event to the connection's span and ends it
+func (conn *TCPConn) endSpan(reason CloseReason, err error) {
+	stats := conn.GetStats()
+	conn.span.SetAttributes(
+		slog.String("tcpserver.close_reason", reason.String()),
+		slog.Uint64("tcpserver.bytes_read", stats.BytesRead),
+		slog.Uint64("tcpserver.bytes_written", stats.BytesWritten),
+	)
+	conn.span.AddEvent("close", slog.String("reason", reason.String()))
+	if err != nil {
+		conn.span.RecordError(err)
+	}
+	conn.span.End()
+	conn.span = nil
+}
+
+// Span doing nothing
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...slog.Attr)    {}
+func (noopSpan) AddEvent(string, ...slog.Attr) {}
+func (noopSpan) RecordError(error)             {}
+func (noopSpan) End()                          {}
@@ -0,0 +1,428 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package tcpserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Kind of operation (lowest byte of an entry's user data)
+const (
+	uringKindWake uint64 = iota
+	uringKindAccept
+	uringKindRecv
+	uringKindSend
+	uringKindCancel
+	uringKindProvide
+)
+
+// Buffer group ID of the provided receive buffers
+const uringBufferGroup = 1
+
+// Returns user data for given operation kind and connection slot
+func uringUserData(kind uint64, slot uint32) uint64 {
+	return kind | uint64(slot)<<8
+}
+
+// Returns whether the io_uring backend is supported by the running kernel
+func IsUringSupported() bool {
+	return checkUring() == nil
+}
+
+// Backend using one io_uring instance per accept loop
+type uringBackend struct {
+	config   UringConfig
+	server   *Server
+	accepted func(loop int, conn net.Conn)
+	loops    []*uringLoop
+}
+
+// Accept loop with its own io_uring instance serving the I/O of all
+// connections accepted by it
+type uringLoop struct {
+	backend   *uringBackend
+	ring      *uring
+	listenFd  int
+	bufs      []byte
+	bufSize   int
+	multishot bool
+
+	connMutex sync.Mutex
+	conns     []*uringConn
+	freeSlots []uint32
+
+	acceptMutex   sync.Mutex
+	acceptQueue   []uringAccepted
+	acceptNotify  chan struct{}
+	acceptStopped int32
+}
+
+// Accepted connection (or accept error) passed from the completion go
+// routine to the accept loop
+type uringAccepted struct {
+	fd   int
+	err  error
+	done bool
+}
+
+// Creates a new experimental io_uring based backend (Linux >= 5.7 on amd64
+// and arm64; multishot accept requires Linux >= 5.19, older kernels fall back
+// to single shot accepts). Returns an error if the kernel doesn't support
+// io_uring (or it is disabled, e.g. by seccomp or kernel.io_uring_disabled).
+func NewUringBackend(config *UringConfig) (Backend, error) {
+	if err := checkUring(); err != nil {
+		return nil, err
+	}
+
+	b := &uringBackend{}
+	if config != nil {
+		b.config = *config
+	}
+	if b.config.Entries <= 0 {
+		b.config.Entries = 4096
+	}
+	if b.config.Buffers <= 0 {
+		b.config.Buffers = 512
+	}
+	if b.config.Buffers > 1<<15 {
+		return nil, fmt.Errorf("too many buffers (max. %d)", 1<<15)
+	}
+	if b.config.BufferSize <= 0 {
+		b.config.BufferSize = 4096
+	}
+	return b, nil
+}
+
+// Returns "io_uring"
+func (b *uringBackend) Name() string {
+	return "io_uring"
+}
+
+// Creates an io_uring instance per accept loop
+func (b *uringBackend) Start(s *Server, accepted func(loop int, conn net.Conn)) error {
+	b.server = s
+	b.accepted = accepted
+
+	for i := 0; i < s.GetLoops(); i++ {
+		listenFd, err := listenerFd(s.getListener(i))
+		if err != nil {
+			b.Stop()
+			return err
+		}
+		r, err := newUring(uint32(b.config.Entries))
+		if err != nil {
+			b.Stop()
+			return err
+		}
+		l := &uringLoop{
+			backend:      b,
+			ring:         r,
+			listenFd:     listenFd,
+			bufs:         make([]byte, b.config.Buffers*b.config.BufferSize),
+			bufSize:      b.config.BufferSize,
+			multishot:    true,
+			acceptNotify: make(chan struct{}, 1),
+		}
+		b.loops = append(b.loops, l)
+		go l.run()
+
+		if err = l.provideBuffers(0, b.config.Buffers); err != nil {
+			b.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// Accepts connections using (multishot) accept operations
+func (b *uringBackend) AcceptLoop(id int) error {
+	s := b.server
+	l := b.loops[id]
+	if err := l.armAccept(); err != nil {
+		return err
+	}
+
+	var tempDelay time.Duration
+	for range l.acceptNotify {
+		for _, a := range l.takeAccepted() {
+			if a.done {
+				return nil
+			}
+
+			if a.err != nil {
+				if s.lm != nil {
+					atomic.AddUint64(&s.lm.acceptErrors, 1)
+				}
+				if errno, ok := a.err.(syscall.Errno); !ok || !errno.Temporary() {
+					s.log(slog.LevelError, "accept error", slog.Any("error", a.err), slog.Int("loop", id))
+					return a.err
+				}
+
+				if tempDelay == 0 {
+					tempDelay = 10 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				s.log(slog.LevelWarn, "accept error; backing off", slog.Any("error", a.err), slog.Int("loop", id), slog.Duration("delay", tempDelay))
+				time.Sleep(tempDelay)
+
+				if err := l.armAccept(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			tempDelay = 0
+			conn, err := l.newConn(a.fd)
+			if err != nil {
+				s.log(slog.LevelWarn, "unable to set up accepted connection", slog.Any("error", err), slog.Int("loop", id))
+				continue
+			}
+			b.accepted(id, conn)
+
+			if s.maxAcceptConnections > 0 && atomic.LoadInt32(&s.acceptedConnections) >= s.maxAcceptConnections {
+				s.Shutdown(0)
+			}
+		}
+	}
+	return nil
+}
+
+// Cancels the accept operations
+func (b *uringBackend) StopAccepting() {
+	for _, l := range b.loops {
+		atomic.StoreInt32(&l.acceptStopped, 1)
+		_ = l.ring.submit(&uringSQE{
+			opcode:   uringOpAsyncCancel,
+			addr:     uringUserData(uringKindAccept, 0),
+			userData: uringUserData(uringKindCancel, 0),
+		})
+	}
+}
+
+// Releases all io_uring instances
+func (b *uringBackend) Stop() {
+	for _, l := range b.loops {
+		l.ring.stop()
+	}
+	b.loops = nil
+}
+
+// Runs the ring's completion go routine; if it fails, the accept loop is
+// stopped with its error
+func (l *uringLoop) run() {
+	if err := l.ring.run(l.handleCompletion); err != nil {
+		l.queueAccepted(uringAccepted{err: err})
+	}
+}
+
+// Submits an accept operation (unless accepting has been stopped)
+func (l *uringLoop) armAccept() error {
+	if atomic.LoadInt32(&l.acceptStopped) == 1 {
+		l.queueAccepted(uringAccepted{done: true})
+		return nil
+	}
+
+	sqe := uringSQE{
+		opcode:   uringOpAccept,
+		fd:       int32(l.listenFd),
+		opFlags:  syscall.SOCK_CLOEXEC,
+		userData: uringUserData(uringKindAccept, 0),
+	}
+	if l.multishot {
+		sqe.ioprio = uringAcceptMultishot
+	}
+	return l.ring.submit(&sqe)
+}
+
+// Queues an accepted connection for the accept loop
+func (l *uringLoop) queueAccepted(a uringAccepted) {
+	l.acceptMutex.Lock()
+	l.acceptQueue = append(l.acceptQueue, a)
+	l.acceptMutex.Unlock()
+
+	select {
+	case l.acceptNotify <- struct{}{}:
+	default:
+	}
+}
+
+// Returns all queued accepted connections
+func (l *uringLoop) takeAccepted() []uringAccepted {
+	l.acceptMutex.Lock()
+	queue := l.acceptQueue
+	l.acceptQueue = nil
+	l.acceptMutex.Unlock()
+	return queue
+}
+
+// Hands receive buffers (back) to the kernel
+func (l *uringLoop) provideBuffers(bid int, n int) error {
+	return l.ring.submit(&uringSQE{
+		opcode:   uringOpProvideBuffers,
+		fd:       int32(n),
+		addr:     uint64(uintptr(unsafe.Pointer(&l.bufs[bid*l.bufSize]))),
+		len:      uint32(l.bufSize),
+		off:      uint64(bid),
+		bufIndex: uringBufferGroup,
+		userData: uringUserData(uringKindProvide, 0),
+	})
+}
+
+// Returns provided receive buffer with given ID
+func (l *uringLoop) buffer(bid int) []byte {
+	return l.bufs[bid*l.bufSize : (bid+1)*l.bufSize]
+}
+
+// Handles a completion (called from the ring's completion go routine)
+func (l *uringLoop) handleCompletion(cqe *uringCQE) {
+	switch cqe.userData & 0xff {
+	case uringKindAccept:
+		l.handleAccept(cqe)
+
+	case uringKindRecv, uringKindSend:
+		slot := uint32(cqe.userData >> 8)
+		var conn *uringConn
+		l.connMutex.Lock()
+		if slot < uint32(len(l.conns)) {
+			conn = l.conns[slot]
+		}
+		l.connMutex.Unlock()
+		if conn != nil {
+			conn.complete(cqe)
+		} else if cqe.flags&uringCQEFBuffer != 0 {
+			// late completion of a released connection; hand the buffer back
+			_ = l.provideBuffers(int(cqe.flags>>uringCQEBufferShift), 1)
+		}
+
+	case uringKindProvide:
+		if cqe.res < 0 {
+			l.backend.server.log(slog.LevelError, "io_uring provide buffers failed", slog.Any("error", syscall.Errno(-cqe.res)))
+		}
+	}
+}
+
+// Handles an accept completion
+func (l *uringLoop) handleAccept(cqe *uringCQE) {
+	more := cqe.flags&uringCQEFMore != 0
+
+	switch {
+	case cqe.res >= 0:
+		l.queueAccepted(uringAccepted{fd: int(cqe.res)})
+		if !more {
+			if err := l.armAccept(); err != nil {
+				l.queueAccepted(uringAccepted{err: err})
+			}
+		}
+
+	case syscall.Errno(-cqe.res) == syscall.ECANCELED:
+		l.queueAccepted(uringAccepted{done: true})
+
+	case syscall.Errno(-cqe.res) == syscall.EINVAL && l.multishot:
+		// multishot accept isn't supported (Linux < 5.19)
+		l.multishot = false
+		if err := l.armAccept(); err != nil {
+			l.queueAccepted(uringAccepted{err: err})
+		}
+
+	default:
+		// re-armed by the accept loop after backing off
+		l.queueAccepted(uringAccepted{err: syscall.Errno(-cqe.res)})
+	}
+}
+
+// Sets up an accepted socket
+func (l *uringLoop) newConn(fd int) (*uringConn, error) {
+	_ = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+	_ = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+
+	local, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	remote, err := syscall.Getpeername(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	conn := &uringConn{
+		loop:  l,
+		fd:    fd,
+		laddr: sockaddrToTCPAddr(local),
+		raddr: sockaddrToTCPAddr(remote),
+		recvC: make(chan uringCQE, 1),
+		sendC: make(chan uringCQE, 1),
+		bid:   -1,
+	}
+	conn.readDeadline.init()
+	conn.writeDeadline.init()
+
+	l.connMutex.Lock()
+	if n := len(l.freeSlots); n > 0 {
+		conn.slot = l.freeSlots[n-1]
+		l.freeSlots = l.freeSlots[:n-1]
+		l.conns[conn.slot] = conn
+	} else {
+		conn.slot = uint32(len(l.conns))
+		l.conns = append(l.conns, conn)
+	}
+	l.connMutex.Unlock()
+	return conn, nil
+}
+
+// Releases the connection's slot
+func (l *uringLoop) freeConn(conn *uringConn) {
+	l.connMutex.Lock()
+	l.conns[conn.slot] = nil
+	l.freeSlots = append(l.freeSlots, conn.slot)
+	l.connMutex.Unlock()
+}
+
+// Returns the file descriptor of given listener
+func listenerFd(l *net.TCPListener) (int, error) {
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	listenFd := -1
+	if err = rc.Control(func(fd uintptr) {
+		listenFd = int(fd)
+	}); err != nil {
+		return -1, err
+	}
+	return listenFd, nil
+}
+
+// Converts a socket address to *net.TCPAddr
+func sockaddrToTCPAddr(sa syscall.Sockaddr) *net.TCPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		addr := &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return &net.TCPAddr{}
+}
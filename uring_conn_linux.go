@@ -0,0 +1,378 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package tcpserver
+
+import (
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Connection accepted by the io_uring backend (implements net.Conn)
+type uringConn struct {
+	loop  *uringLoop
+	fd    int
+	slot  uint32
+	laddr *net.TCPAddr
+	raddr *net.TCPAddr
+
+	// serializes submitting operations with closing the connection
+	opMutex     sync.Mutex
+	closed      bool
+	recvPending bool
+	sendPending bool
+
+	readMutex    sync.Mutex
+	recvC        chan uringCQE
+	buffered     []byte
+	bid          int
+	readDeadline uringDeadline
+
+	writeMutex    sync.Mutex
+	sendC         chan uringCQE
+	writeDeadline uringDeadline
+}
+
+// Read or write deadline
+type uringDeadline struct {
+	t       int64
+	changed chan struct{}
+}
+
+func (d *uringDeadline) init() {
+	d.changed = make(chan struct{}, 1)
+}
+
+// Sets the deadline and wakes up a waiting operation
+func (d *uringDeadline) set(t time.Time) {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	atomic.StoreInt64(&d.t, ns)
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the time until the deadline (ok is false if there is none)
+func (d *uringDeadline) remaining() (remaining time.Duration, ok bool) {
+	ns := atomic.LoadInt64(&d.t)
+	if ns == 0 {
+		return 0, false
+	}
+	return time.Until(time.Unix(0, ns)), true
+}
+
+// Passes a completion to the waiting operation (called from the ring's
+// completion go routine)
+func (c *uringConn) complete(cqe *uringCQE) {
+	if cqe.userData&0xff == uringKindRecv {
+		c.recvC <- *cqe
+	} else {
+		c.sendC <- *cqe
+	}
+}
+
+// Submits an operation and waits for its completion; the operation is
+// cancelled if the deadline is reached or the connection is closed (timedOut
+// is set if cancelled due to the deadline)
+func (c *uringConn) do(sqe *uringSQE, kind uint64, pending *bool, done chan uringCQE, d *uringDeadline) (cqe uringCQE, timedOut bool, err error) {
+	if remaining, ok := d.remaining(); ok && remaining <= 0 {
+		return cqe, true, os.ErrDeadlineExceeded
+	}
+
+	sqe.userData = uringUserData(kind, c.slot)
+	c.opMutex.Lock()
+	if c.closed {
+		c.opMutex.Unlock()
+		return cqe, false, net.ErrClosed
+	}
+	if err = c.loop.ring.submit(sqe); err != nil {
+		c.opMutex.Unlock()
+		return cqe, false, err
+	}
+	*pending = true
+	c.opMutex.Unlock()
+
+	var (
+		timer     *time.Timer
+		timerC    <-chan time.Time
+		cancelled bool
+	)
+	for {
+		if !cancelled {
+			if timer != nil {
+				timer.Stop()
+				timerC = nil
+			}
+			if remaining, ok := d.remaining(); ok {
+				if remaining <= 0 {
+					c.cancel(sqe.userData)
+					cancelled, timedOut = true, true
+				} else {
+					timer = time.NewTimer(remaining)
+					timerC = timer.C
+				}
+			}
+		}
+
+		select {
+		case cqe = <-done:
+			if timer != nil {
+				timer.Stop()
+			}
+			c.opMutex.Lock()
+			*pending = false
+			c.opMutex.Unlock()
+			return cqe, timedOut, nil
+		case <-timerC:
+			timerC = nil
+			c.cancel(sqe.userData)
+			cancelled, timedOut = true, true
+		case <-d.changed:
+		case <-c.loop.ring.done:
+			// the completion go routine has failed; no completion will arrive
+			if timer != nil {
+				timer.Stop()
+			}
+			if err = c.loop.ring.failed(); err == nil {
+				err = net.ErrClosed
+			}
+			return cqe, false, err
+		}
+	}
+}
+
+// Cancels the operation with given user data
+func (c *uringConn) cancel(userData uint64) {
+	_ = c.loop.ring.submit(&uringSQE{
+		opcode:   uringOpAsyncCancel,
+		addr:     userData,
+		userData: uringUserData(uringKindCancel, c.slot),
+	})
+}
+
+// Returns the error of a failed operation
+func (c *uringConn) opError(op string, res int32, timedOut bool) error {
+	var err error
+	switch {
+	case timedOut && syscall.Errno(-res) == syscall.ECANCELED:
+		err = os.ErrDeadlineExceeded
+	case syscall.Errno(-res) == syscall.ECANCELED:
+		err = net.ErrClosed
+	default:
+		err = os.NewSyscallError(op, syscall.Errno(-res))
+	}
+	return &net.OpError{Op: op, Net: "tcp", Source: c.laddr, Addr: c.raddr, Err: err}
+}
+
+// Reads data using provided buffers
+func (c *uringConn) Read(b []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	if len(c.buffered) > 0 {
+		return c.readBuffered(b), nil
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	sqe := uringSQE{
+		opcode:   uringOpRecv,
+		flags:    uringSQEBufferSelect,
+		fd:       int32(c.fd),
+		len:      uint32(c.loop.bufSize),
+		bufIndex: uringBufferGroup,
+	}
+
+	for {
+		cqe, timedOut, err := c.do(&sqe, uringKindRecv, &c.recvPending, c.recvC, &c.readDeadline)
+		if err != nil {
+			return 0, &net.OpError{Op: "read", Net: "tcp", Source: c.laddr, Addr: c.raddr, Err: err}
+		}
+
+		if cqe.flags&uringCQEFBuffer != 0 {
+			c.bid = int(cqe.flags >> uringCQEBufferShift)
+			c.buffered = c.loop.buffer(c.bid)[:max(cqe.res, 0)]
+			if len(c.buffered) == 0 {
+				c.releaseBuffer()
+			}
+		}
+
+		switch {
+		case cqe.res > 0:
+			return c.readBuffered(b), nil
+		case cqe.res == 0:
+			return 0, io.EOF
+		case syscall.Errno(-cqe.res) == syscall.ENOBUFS:
+			// all provided buffers are in use; receive into b directly
+			return c.recvDirect(b)
+		case syscall.Errno(-cqe.res) == syscall.EINTR || syscall.Errno(-cqe.res) == syscall.EAGAIN:
+			continue
+		}
+		return 0, c.opError("read", cqe.res, timedOut)
+	}
+}
+
+// Receives data into b (without using a provided buffer)
+func (c *uringConn) recvDirect(b []byte) (int, error) {
+	var pinner runtime.Pinner
+	pinner.Pin(&b[0])
+	defer pinner.Unpin()
+
+	sqe := uringSQE{
+		opcode: uringOpRecv,
+		fd:     int32(c.fd),
+		addr:   uint64(uintptr(unsafe.Pointer(&b[0]))),
+		len:    uint32(len(b)),
+	}
+	cqe, timedOut, err := c.do(&sqe, uringKindRecv, &c.recvPending, c.recvC, &c.readDeadline)
+	if err != nil {
+		return 0, &net.OpError{Op: "read", Net: "tcp", Source: c.laddr, Addr: c.raddr, Err: err}
+	}
+	switch {
+	case cqe.res > 0:
+		return int(cqe.res), nil
+	case cqe.res == 0:
+		return 0, io.EOF
+	}
+	return 0, c.opError("read", cqe.res, timedOut)
+}
+
+// Copies buffered data to b and hands the buffer back once it's consumed
+func (c *uringConn) readBuffered(b []byte) int {
+	n := copy(b, c.buffered)
+	c.buffered = c.buffered[n:]
+	if len(c.buffered) == 0 {
+		c.releaseBuffer()
+	}
+	return n
+}
+
+// Hands the current provided buffer back to the kernel
+func (c *uringConn) releaseBuffer() {
+	if c.bid >= 0 {
+		_ = c.loop.provideBuffers(c.bid, 1)
+		c.bid = -1
+	}
+	c.buffered = nil
+}
+
+// Writes data; sends of all connections of a loop are submitted in batches
+func (c *uringConn) Write(b []byte) (n int, err error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var pinner runtime.Pinner
+	pinner.Pin(&b[0])
+	defer pinner.Unpin()
+
+	for n < len(b) {
+		sqe := uringSQE{
+			opcode:  uringOpSend,
+			fd:      int32(c.fd),
+			addr:    uint64(uintptr(unsafe.Pointer(&b[n]))),
+			len:     uint32(len(b) - n),
+			opFlags: syscall.MSG_NOSIGNAL,
+		}
+		cqe, timedOut, err := c.do(&sqe, uringKindSend, &c.sendPending, c.sendC, &c.writeDeadline)
+		if err != nil {
+			return n, &net.OpError{Op: "write", Net: "tcp", Source: c.laddr, Addr: c.raddr, Err: err}
+		}
+		if cqe.res < 0 {
+			if errno := syscall.Errno(-cqe.res); errno == syscall.EINTR || errno == syscall.EAGAIN {
+				continue
+			}
+			return n, c.opError("write", cqe.res, timedOut)
+		}
+		n += int(cqe.res)
+	}
+	return n, nil
+}
+
+// Closes the connection; pending reads and writes are cancelled
+func (c *uringConn) Close() error {
+	c.opMutex.Lock()
+	if c.closed {
+		c.opMutex.Unlock()
+		return &net.OpError{Op: "close", Net: "tcp", Source: c.laddr, Addr: c.raddr, Err: net.ErrClosed}
+	}
+	c.closed = true
+	if c.recvPending {
+		c.cancel(uringUserData(uringKindRecv, c.slot))
+	}
+	if c.sendPending {
+		c.cancel(uringUserData(uringKindSend, c.slot))
+	}
+	c.opMutex.Unlock()
+
+	// wait for pending operations to complete
+	c.readMutex.Lock()
+	c.releaseBuffer()
+	c.readMutex.Unlock()
+	c.writeMutex.Lock()
+	c.writeMutex.Unlock()
+
+	c.loop.freeConn(c)
+	return syscall.Close(c.fd)
+}
+
+// Shuts down the writing side of the connection
+func (c *uringConn) CloseWrite() error {
+	c.opMutex.Lock()
+	defer c.opMutex.Unlock()
+	if c.closed {
+		return &net.OpError{Op: "close", Net: "tcp", Source: c.laddr, Addr: c.raddr, Err: net.ErrClosed}
+	}
+	if err := syscall.Shutdown(c.fd, syscall.SHUT_WR); err != nil {
+		return &net.OpError{Op: "close", Net: "tcp", Source: c.laddr, Addr: c.raddr, Err: os.NewSyscallError("shutdown", err)}
+	}
+	return nil
+}
+
+// Returns local address
+func (c *uringConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// Returns remote address
+func (c *uringConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// Sets read and write deadlines
+func (c *uringConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// Sets read deadline
+func (c *uringConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// Sets write deadline
+func (c *uringConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,384 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package tcpserver
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysIOUringSetup    = 425
+	sysIOUringEnter    = 426
+	sysIOUringRegister = 427
+
+	uringOffSQRing = 0
+	uringOffSQEs   = 0x10000000
+
+	uringSetupCQSize = 1 << 3
+	uringSetupClamp  = 1 << 4
+
+	uringEnterGetEvents = 1 << 0
+
+	uringRegisterProbe  = 8
+	uringOpSupported    = 1 << 0
+	uringFeatSingleMmap = 1 << 0
+	uringFeatNoDrop     = 1 << 1
+	uringFeatFastPoll   = 1 << 5
+
+	uringOpNop            = 0
+	uringOpAccept         = 13
+	uringOpAsyncCancel    = 14
+	uringOpSend           = 26
+	uringOpRecv           = 27
+	uringOpProvideBuffers = 31
+
+	uringSQEBufferSelect = 1 << 5
+	uringAcceptMultishot = 1 << 0
+
+	uringCQEFBuffer     = 1 << 0
+	uringCQEFMore       = 1 << 1
+	uringCQEBufferShift = 16
+)
+
+// Mirrors struct io_uring_params
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+// Mirrors struct io_sqring_offsets
+type uringSQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+// Mirrors struct io_cqring_offsets
+type uringCQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+// Mirrors struct io_uring_sqe
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// Mirrors struct io_uring_cqe
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// Operations required by the io_uring backend
+var uringRequiredOps = []uint8{uringOpNop, uringOpAccept, uringOpAsyncCancel, uringOpSend, uringOpRecv, uringOpProvideBuffers}
+
+var (
+	uringCheckOnce sync.Once
+	uringCheckErr  error
+)
+
+// Checks whether the kernel supports everything needed by the io_uring
+// backend (Linux >= 5.7); the result is cached
+func checkUring() error {
+	uringCheckOnce.Do(func() {
+		r, err := newUring(8)
+		if err != nil {
+			uringCheckErr = err
+			return
+		}
+		defer r.close()
+		uringCheckErr = r.probe(uringRequiredOps)
+	})
+	return uringCheckErr
+}
+
+// io_uring instance; submissions may be queued from any go routine while
+// completions are reaped by a single go routine (see run)
+type uring struct {
+	fd        int
+	ringMem   []byte
+	sqeMem    []byte
+	sqHead    *uint32
+	sqTail    *uint32
+	sqMask    uint32
+	sqEntries uint32
+	sqes      []uringSQE
+	cqHead    *uint32
+	cqTail    *uint32
+	cqMask    uint32
+	cqes      []uringCQE
+
+	mutex    sync.Mutex
+	tail     uint32
+	waiting  bool
+	overflow []uringSQE
+	err      error
+	stopping int32
+	done     chan struct{}
+}
+
+// Sets up a new io_uring instance with given number of submission queue entries
+func newUring(entries uint32) (*uring, error) {
+	p := uringParams{
+		flags:     uringSetupCQSize | uringSetupClamp,
+		cqEntries: entries * 4,
+	}
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup failed: %s", errno)
+	}
+
+	r := &uring{fd: int(fd), done: make(chan struct{})}
+	required := uint32(uringFeatSingleMmap | uringFeatNoDrop | uringFeatFastPoll)
+	if p.features&required != required {
+		r.close()
+		return nil, fmt.Errorf("io_uring features missing (requires Linux >= 5.7)")
+	}
+
+	ringSize := p.sqOff.array + p.sqEntries*4
+	if cqSize := p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})); cqSize > ringSize {
+		ringSize = cqSize
+	}
+	var err error
+	r.ringMem, err = syscall.Mmap(r.fd, uringOffSQRing, int(ringSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, fmt.Errorf("unable to map io_uring rings: %s", err)
+	}
+	r.sqeMem, err = syscall.Mmap(r.fd, uringOffSQEs, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{})), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, fmt.Errorf("unable to map io_uring submission queue entries: %s", err)
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.ringMem[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.ringMem[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.ringMem[p.sqOff.ringMask]))
+	r.sqEntries = p.sqEntries
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.ringMem[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.ringMem[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.ringMem[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.ringMem[p.cqOff.cqes])), p.cqEntries)
+	r.tail = atomic.LoadUint32(r.sqTail)
+
+	// submission queue entries are always used in ring order
+	array := unsafe.Slice((*uint32)(unsafe.Pointer(&r.ringMem[p.sqOff.array])), p.sqEntries)
+	for i := range array {
+		array[i] = uint32(i)
+	}
+	return r, nil
+}
+
+// Checks whether all given operations are supported
+func (r *uring) probe(ops []uint8) error {
+	// struct io_uring_probe (16 bytes) followed by 256 struct io_uring_probe_op (8 bytes each)
+	buf := make([]byte, 16+256*8)
+	_, _, errno := syscall.Syscall6(sysIOUringRegister, uintptr(r.fd), uringRegisterProbe, uintptr(unsafe.Pointer(&buf[0])), 256, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("io_uring probe failed: %s", errno)
+	}
+
+	lastOp := buf[0]
+	for _, op := range ops {
+		flags := uint16(buf[16+int(op)*8+2]) | uint16(buf[16+int(op)*8+3])<<8
+		if op > lastOp || flags&uringOpSupported == 0 {
+			return fmt.Errorf("io_uring operation %d not supported", op)
+		}
+	}
+	return nil
+}
+
+// Calls io_uring_enter
+func (r *uring) enter(toSubmit uint32, minComplete uint32, flags uint32) (int, error) {
+	for {
+		n, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return int(n), errno
+		}
+		return int(n), nil
+	}
+}
+
+// Submits queued entries (must be called with mutex held)
+func (r *uring) flush() error {
+	pending := r.tail - atomic.LoadUint32(r.sqHead)
+	if pending == 0 {
+		return nil
+	}
+	_, err := r.enter(pending, 0, 0)
+	return err
+}
+
+// Queues a submission queue entry. Entries are submitted in batches by the
+// completion go routine; if it is waiting for completions, they are submitted
+// right away. If the submission queue is full, the entry is kept in an
+// overflow queue moved to the submission queue by the completion go routine
+// after reaping completions, so submit never blocks (it's called from the
+// completion go routine as well). Returns an error if the completion go
+// routine has failed.
+func (r *uring) submit(sqe *uringSQE) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.overflow) == 0 && r.full() {
+		if err := r.flush(); err != nil && err != syscall.EBUSY && err != syscall.EAGAIN {
+			return err
+		}
+	}
+	if len(r.overflow) > 0 || r.full() {
+		// keeps the order of submissions (e.g. cancel after recv)
+		r.overflow = append(r.overflow, *sqe)
+		return nil
+	}
+
+	r.push(sqe)
+	if r.waiting {
+		return r.flush()
+	}
+	return nil
+}
+
+// Returns whether the submission queue is full (must be called with mutex held)
+func (r *uring) full() bool {
+	return r.tail-atomic.LoadUint32(r.sqHead) >= r.sqEntries
+}
+
+// Adds an entry to the submission queue (must be called with mutex held)
+func (r *uring) push(sqe *uringSQE) {
+	r.sqes[r.tail&r.sqMask] = *sqe
+	r.tail++
+	atomic.StoreUint32(r.sqTail, r.tail)
+}
+
+// Moves entries of the overflow queue to the submission queue as long as
+// there is room (must be called with mutex held)
+func (r *uring) drainOverflow() {
+	n := 0
+	for n < len(r.overflow) && !r.full() {
+		r.push(&r.overflow[n])
+		n++
+	}
+	if n == len(r.overflow) {
+		r.overflow = r.overflow[:0]
+	} else {
+		r.overflow = append(r.overflow[:0], r.overflow[n:]...)
+	}
+}
+
+// Submits queued entries and reaps completions until stopped; returns an
+// error if io_uring_enter fails (further submissions fail with that error)
+func (r *uring) run(handle func(cqe *uringCQE)) (err error) {
+	defer close(r.done)
+
+	for {
+		r.mutex.Lock()
+		r.drainOverflow()
+		pending := r.tail - atomic.LoadUint32(r.sqHead)
+		r.waiting = true
+		r.mutex.Unlock()
+
+		_, err = r.enter(pending, 1, uringEnterGetEvents)
+
+		r.mutex.Lock()
+		r.waiting = false
+		if err != nil && err != syscall.EBUSY && err != syscall.EAGAIN {
+			r.err = fmt.Errorf("io_uring_enter failed: %s", err)
+			r.mutex.Unlock()
+			return r.err
+		}
+		r.mutex.Unlock()
+
+		head := atomic.LoadUint32(r.cqHead)
+		tail := atomic.LoadUint32(r.cqTail)
+		for ; head != tail; head++ {
+			cqe := r.cqes[head&r.cqMask]
+			handle(&cqe)
+		}
+		atomic.StoreUint32(r.cqHead, head)
+
+		if atomic.LoadInt32(&r.stopping) == 1 {
+			return nil
+		}
+	}
+}
+
+// Returns the error that stopped the completion go routine (nil if it's
+// still running or has been stopped regularly)
+func (r *uring) failed() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+// Stops the completion go routine and releases the ring
+func (r *uring) stop() {
+	atomic.StoreInt32(&r.stopping, 1)
+	_ = r.submit(&uringSQE{opcode: uringOpNop})
+	<-r.done
+	r.close()
+}
+
+// Releases the ring
+func (r *uring) close() {
+	if r.sqeMem != nil {
+		_ = syscall.Munmap(r.sqeMem)
+		r.sqeMem = nil
+	}
+	if r.ringMem != nil {
+		_ = syscall.Munmap(r.ringMem)
+		r.ringMem = nil
+	}
+	_ = syscall.Close(r.fd)
+}
@@ -0,0 +1,21 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package tcpserver
+
+import (
+	"fmt"
+)
+
+// Returns whether the io_uring backend is supported by the running kernel
+func IsUringSupported() bool {
+	return false
+}
+
+// The io_uring backend is only supported on Linux (amd64 and arm64)
+func NewUringBackend(config *UringConfig) (Backend, error) {
+	return nil, fmt.Errorf("io_uring backend is only supported on Linux (amd64 and arm64)")
+}
@@ -0,0 +1,144 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package tcpserver
+
+import (
+	"io"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// Backends compared by the benchmarks
+var benchBackends = []struct {
+	name string
+	new  func() (Backend, error)
+}{
+	{"net", func() (Backend, error) { return NewNetBackend(), nil }},
+	{"io_uring", func() (Backend, error) { return NewUringBackend(nil) }},
+}
+
+func requireUring(t testing.TB) {
+	t.Helper()
+	if err := checkUring(); err != nil {
+		t.Skipf("io_uring not available: %s", err)
+	}
+}
+
+func TestUringEcho(t *testing.T) {
+	requireUring(t)
+	s := startServer(t, func(conn Connection) {
+		_, _ = io.Copy(conn, conn)
+	}, func(s *Server) {
+		backend, err := NewUringBackend(&UringConfig{Entries: 8, Buffers: 4, BufferSize: 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetBackend(backend)
+	})
+
+	// more connections and data than entries and buffers
+	msg := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	for i := 0; i < 16; i++ {
+		c := dial(t, s)
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(msg) {
+			t.Fatalf("expected %q, got %q", msg, buf)
+		}
+	}
+}
+
+func TestUringSubmitOverflow(t *testing.T) {
+	requireUring(t)
+	r, err := newUring(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// doesn't block although the submission queue is full
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := r.submit(&uringSQE{opcode: uringOpNop, userData: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var completed int32
+	go func() {
+		_ = r.run(func(cqe *uringCQE) {
+			if cqe.userData == 1 {
+				atomic.AddInt32(&completed, 1)
+			}
+		})
+	}()
+	waitFor(t, "completions", func() bool {
+		return atomic.LoadInt32(&completed) == n
+	})
+	r.stop()
+}
+
+func TestUringRunError(t *testing.T) {
+	requireUring(t)
+	r, err := newUring(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	// io_uring_enter fails with EBADF
+	fd := r.fd
+	_ = syscall.Close(fd)
+	r.fd = -1
+	if err = r.run(func(cqe *uringCQE) {}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err = r.submit(&uringSQE{opcode: uringOpNop}); err == nil {
+		t.Error("expected submit to fail after the completion go routine failed")
+	}
+	if r.failed() == nil {
+		t.Error("expected ring to be failed")
+	}
+}
+
+// Round trips over keep-alive connections
+func BenchmarkBackendKeepAlive(b *testing.B) {
+	requireUring(b)
+	for _, bb := range benchBackends {
+		b.Run(bb.name, func(b *testing.B) {
+			backend, err := bb.new()
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchKeepAlive(b, func(s *Server) {
+				s.SetBackend(backend)
+			})
+		})
+	}
+}
+
+// Single round trip per connection
+func BenchmarkBackendShortLived(b *testing.B) {
+	requireUring(b)
+	for _, bb := range benchBackends {
+		b.Run(bb.name, func(b *testing.B) {
+			backend, err := bb.new()
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchShortLived(b, func(s *Server) {
+				s.SetBackend(backend)
+			})
+		})
+	}
+}
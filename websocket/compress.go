@@ -0,0 +1,99 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Returned by Conn.ReadMessage if a compressed message can't be decompressed
+// (close code 1007)
+var ErrInvalidCompressedData = errors.New("websocket: invalid compressed data")
+
+// Appended to compressed messages before decompression: the removed sync
+// marker (RFC 7692, 7.2.2) followed by a final empty block so that the
+// decompressor ends with io.EOF
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// Compressor writers per compression level (flate.HuffmanOnly to
+// flate.BestCompression)
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func acquireFlateWriter(w io.Writer, level int) *flate.Writer {
+	pool := &flateWriterPools[level-flate.HuffmanOnly]
+	if fw, _ := pool.Get().(*flate.Writer); fw != nil {
+		fw.Reset(w)
+		return fw
+	}
+	fw, _ := flate.NewWriter(w, level)
+	return fw
+}
+
+func releaseFlateWriter(fw *flate.Writer, level int) {
+	fw.Reset(nil)
+	flateWriterPools[level-flate.HuffmanOnly].Put(fw)
+}
+
+// Removes the sync marker (0x00 0x00 0xff 0xff) a flush ends with
+func stripSyncMarker(b []byte) []byte {
+	if bytes.HasSuffix(b, deflateTail[:4]) {
+		return b[:len(b)-4]
+	}
+	return b
+}
+
+// Decompressor with its input
+type inflater struct {
+	input bytes.Reader
+	fr    io.ReadCloser
+}
+
+var inflaterPool sync.Pool
+
+// Decompresses a message into c.inflated; data must be c.readBuf.b
+func (c *Conn) inflate(data []byte) ([]byte, error) {
+	c.readBuf.b = append(data, deflateTail...)
+	f, _ := inflaterPool.Get().(*inflater)
+	if f == nil {
+		f = &inflater{}
+		f.input.Reset(c.readBuf.b)
+		f.fr = flate.NewReader(&f.input)
+	} else {
+		f.input.Reset(c.readBuf.b)
+		_ = f.fr.(flate.Resetter).Reset(&f.input, nil)
+	}
+	defer func() {
+		f.input.Reset(nil)
+		inflaterPool.Put(f)
+	}()
+
+	c.inflated = acquireBuffer()
+	b := c.inflated.b
+	for {
+		if len(b) == cap(b) {
+			if len(b) > c.config.MaxMessageSize {
+				return nil, ErrMessageTooBig
+			}
+			b = grow(b, 4096)[:len(b)]
+		}
+		n, err := f.fr.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.inflated.b = b
+			return nil, ErrInvalidCompressedData
+		}
+	}
+	c.inflated.b = b
+	if len(b) > c.config.MaxMessageSize {
+		return nil, ErrMessageTooBig
+	}
+	return b, nil
+}
@@ -0,0 +1,599 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package websocket
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Frame opcodes (RFC 6455, 5.2)
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsv2Bit = 0x20
+	rsv3Bit = 0x10
+	maskBit = 0x80
+)
+
+// Maximum payload size of control frames
+const maxControlPayload = 125
+
+// Payloads up to this size are copied into a single buffer together with
+// the frame header to be sent with one write
+const maxCopySize = 16 * 1024
+
+// Returned by Conn.WriteMessage and Conn.NewMessageWriter for message types
+// other than TextMessage and BinaryMessage
+var ErrInvalidMessageType = errors.New("websocket: invalid message type")
+
+// Returned by Conn.WritePing for payloads larger than 125 bytes
+var ErrControlTooLong = errors.New("websocket: control frame payload too long")
+
+// Returned by Conn.WriteClose for close codes that must not be sent
+var ErrInvalidCloseCode = errors.New("websocket: invalid close code")
+
+// WebSocket connection; messages may be written concurrently, but only one
+// goroutine may read at a time
+type Conn struct {
+	conn        tcpserver.Connection
+	config      *Config
+	request     *http.Request
+	subprotocol string
+	compress    bool
+
+	// read state
+	pending     []byte
+	header      [14]byte
+	control     [maxControlPayload]byte
+	readBuf     *buffer
+	inflated    *buffer
+	readErr     error
+	violation   error
+	pongHandler func(data []byte)
+
+	messageMu   sync.Mutex
+	writeMu     sync.Mutex
+	writeHeader [10]byte
+	closeSent   bool
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	opcode byte
+	length int64
+	mask   [4]byte
+}
+
+// Returns the underlying connection
+func (c *Conn) GetConn() tcpserver.Connection {
+	return c.conn
+}
+
+// Returns the upgrade request
+func (c *Conn) GetRequest() *http.Request {
+	return c.request
+}
+
+// Returns the negotiated subprotocol ("" if none)
+func (c *Conn) GetSubprotocol() string {
+	return c.subprotocol
+}
+
+// Returns whether permessage-deflate has been negotiated
+func (c *Conn) IsCompressionEnabled() bool {
+	return c.compress
+}
+
+// Sets function called with the payload of received pong frames (while
+// reading messages)
+func (c *Conn) SetPongHandler(f func(data []byte)) {
+	c.pongHandler = f
+}
+
+// Returns the next data message; pings received in between are answered and
+// pongs passed to the pong handler. The returned data is only valid until the
+// next call. Returns *CloseError once the peer closed the connection (the
+// close frame has been answered).
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.releaseReadBuffers()
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, data, err := c.readMessage()
+	if err != nil {
+		c.releaseReadBuffers()
+		c.readErr = err
+		return 0, nil, err
+	}
+	return typ, data, nil
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var typ MessageType
+	compressed := false
+	for {
+		h, err := c.readFrameHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+		if h.opcode >= opClose {
+			if err = c.readControl(&h); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		if h.opcode == opContinuation {
+			if typ == 0 {
+				return 0, nil, c.fail(ErrProtocolError)
+			}
+		} else {
+			if typ != 0 {
+				// new message before the last frame of a fragmented one
+				return 0, nil, c.fail(ErrProtocolError)
+			}
+			typ, compressed = MessageType(h.opcode), h.rsv1
+		}
+
+		if c.readBuf == nil {
+			c.readBuf = acquireBuffer()
+		}
+		size := len(c.readBuf.b)
+		if h.length > int64(c.config.MaxMessageSize-size) {
+			return 0, nil, c.fail(ErrMessageTooBig)
+		}
+		c.readBuf.b = grow(c.readBuf.b, int(h.length))
+		payload := c.readBuf.b[size:]
+		if err = c.readFull(payload); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		maskBytes(h.mask, payload)
+		if h.fin {
+			break
+		}
+	}
+
+	data := c.readBuf.b
+	if compressed {
+		var err error
+		if data, err = c.inflate(data); err != nil {
+			return 0, nil, c.fail(err)
+		}
+	}
+	if typ == TextMessage && !utf8.Valid(data) {
+		return 0, nil, c.fail(ErrInvalidUTF8)
+	}
+	return typ, data, nil
+}
+
+// Reads and validates a frame header
+func (c *Conn) readFrameHeader() (h frameHeader, err error) {
+	b := c.header[:]
+	if err = c.readFull(b[:2]); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&finBit != 0
+	h.rsv1 = b[0]&rsv1Bit != 0
+	h.opcode = b[0] & 0x0f
+	h.length = int64(b[1] & 0x7f)
+
+	switch {
+	case b[1]&maskBit == 0:
+		// client frames must be masked (RFC 6455, 5.1)
+		return h, c.fail(ErrProtocolError)
+	case b[0]&(rsv2Bit|rsv3Bit) != 0:
+		return h, c.fail(ErrProtocolError)
+	case h.rsv1 && (!c.compress || (h.opcode != opText && h.opcode != opBinary)):
+		// only set on the first frame of compressed messages (RFC 7692, 6)
+		return h, c.fail(ErrProtocolError)
+	case h.opcode >= opClose:
+		if h.opcode > opPong || !h.fin || h.length > maxControlPayload {
+			return h, c.fail(ErrProtocolError)
+		}
+	case h.opcode > opBinary:
+		return h, c.fail(ErrProtocolError)
+	}
+
+	n := 4
+	switch h.length {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if err = c.readFull(b[2 : 2+n]); err != nil {
+		return h, unexpectedEOF(err)
+	}
+	switch h.length {
+	case 126:
+		h.length = int64(binary.BigEndian.Uint16(b[2:]))
+		if h.length < 126 {
+			return h, c.fail(ErrProtocolError)
+		}
+	case 127:
+		v := binary.BigEndian.Uint64(b[2:])
+		if v>>63 != 0 || v <= 0xffff {
+			return h, c.fail(ErrProtocolError)
+		}
+		h.length = int64(v)
+	}
+	copy(h.mask[:], b[n-2:n+2])
+	return h, nil
+}
+
+// Reads and handles a control frame
+func (c *Conn) readControl(h *frameHeader) error {
+	payload := c.control[:h.length]
+	if err := c.readFull(payload); err != nil {
+		return unexpectedEOF(err)
+	}
+	maskBytes(h.mask, payload)
+
+	switch h.opcode {
+	case opPing:
+		if err := c.writeFrame(opPong|finBit, false, payload); err != nil && err != ErrCloseSent {
+			return err
+		}
+	case opPong:
+		if c.pongHandler != nil {
+			c.pongHandler(payload)
+		}
+	case opClose:
+		code, text := CloseNoStatus, ""
+		if len(payload) == 1 {
+			return c.fail(ErrProtocolError)
+		}
+		if len(payload) >= 2 {
+			code = CloseCode(binary.BigEndian.Uint16(payload))
+			if !code.isValid() {
+				return c.fail(ErrProtocolError)
+			}
+			if !utf8.Valid(payload[2:]) {
+				return c.fail(ErrInvalidUTF8)
+			}
+			text = string(payload[2:])
+		}
+		// echo the close code (RFC 6455, 5.5.1)
+		if err := c.WriteClose(code, ""); err != nil && err != ErrCloseSent {
+			return err
+		}
+		return &CloseError{Code: code, Text: text}
+	}
+	return nil
+}
+
+// Reads len(p) bytes (starting with data received together with the upgrade
+// request)
+func (c *Conn) readFull(p []byte) error {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		if c.pending = c.pending[n:]; len(c.pending) == 0 {
+			c.pending = nil
+		}
+		if p = p[n:]; len(p) == 0 {
+			return nil
+		}
+	}
+	_, err := io.ReadFull(c.conn, p)
+	return err
+}
+
+// Sends a close frame for a protocol violation of the peer and returns err
+func (c *Conn) fail(err error) error {
+	code := CloseProtocolError
+	switch err {
+	case ErrInvalidUTF8, ErrInvalidCompressedData:
+		code = CloseInvalidPayload
+	case ErrMessageTooBig:
+		code = CloseMessageTooBig
+	}
+	c.violation = err
+	_ = c.WriteClose(code, "")
+	return err
+}
+
+// Returns buffers of the last message to the pool
+func (c *Conn) releaseReadBuffers() {
+	if c.readBuf != nil {
+		releaseBuffer(c.readBuf)
+		c.readBuf = nil
+	}
+	if c.inflated != nil {
+		releaseBuffer(c.inflated)
+		c.inflated = nil
+	}
+}
+
+// Sends a message (compressed if permessage-deflate has been negotiated and
+// data isn't smaller than CompressionThreshold); safe for concurrent use
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return ErrInvalidMessageType
+	}
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+
+	if !c.compress || len(data) < c.config.CompressionThreshold {
+		return c.writeFrame(byte(typ)|finBit, false, data)
+	}
+	buf := acquireBuffer()
+	defer releaseBuffer(buf)
+	fw := acquireFlateWriter(buf, c.config.CompressionLevel)
+	_, err := fw.Write(data)
+	if err == nil {
+		err = fw.Flush()
+	}
+	releaseFlateWriter(fw, c.config.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(byte(typ)|finBit, true, stripSyncMarker(buf.b))
+}
+
+// Sends a ping frame
+func (c *Conn) WritePing(data []byte) error {
+	if len(data) > maxControlPayload {
+		return ErrControlTooLong
+	}
+	return c.writeFrame(opPing|finBit, false, data)
+}
+
+// Sends a close frame with the given code and reason (truncated to 123
+// bytes); no frames can be sent afterwards. CloseNoStatus sends a close frame
+// without code.
+func (c *Conn) WriteClose(code CloseCode, reason string) error {
+	if code == CloseNoStatus {
+		return c.writeFrame(opClose|finBit, false, nil)
+	}
+	if !code.isValid() {
+		return ErrInvalidCloseCode
+	}
+	if len(reason) > maxControlPayload-2 {
+		n := maxControlPayload - 2
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	var payload [maxControlPayload]byte
+	binary.BigEndian.PutUint16(payload[:], uint16(code))
+	n := 2 + copy(payload[2:], reason)
+	return c.writeFrame(opClose|finBit, false, payload[:n])
+}
+
+// Sends a close frame with CloseNormal unless one has been sent already; the
+// underlying connection is closed by the server once the request handler
+// returns
+func (c *Conn) Close() error {
+	if err := c.WriteClose(CloseNormal, ""); err != nil && err != ErrCloseSent {
+		return err
+	}
+	return nil
+}
+
+// Sends a frame; b0 is the first header byte without RSV1
+func (c *Conn) writeFrame(b0 byte, rsv1 bool, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if b0&0x0f == opClose {
+		c.closeSent = true
+	}
+
+	h := c.writeHeader[:]
+	h[0] = b0
+	if rsv1 {
+		h[0] |= rsv1Bit
+	}
+	n := 2
+	switch l := len(payload); {
+	case l <= 125:
+		h[1] = byte(l)
+	case l <= 0xffff:
+		h[1] = 126
+		binary.BigEndian.PutUint16(h[2:], uint16(l))
+		n += 2
+	default:
+		h[1] = 127
+		binary.BigEndian.PutUint64(h[2:], uint64(l))
+		n += 8
+	}
+
+	if len(payload) > maxCopySize {
+		if _, err := c.conn.Write(h[:n]); err != nil {
+			return err
+		}
+		_, err := c.conn.Write(payload)
+		return err
+	}
+	buf := acquireBuffer()
+	buf.b = append(append(buf.b, h[:n]...), payload...)
+	_, err := c.conn.Write(buf.b)
+	releaseBuffer(buf)
+	return err
+}
+
+// Writer sending a message in fragments; each Write sends a frame
+type MessageWriter struct {
+	c      *Conn
+	b0     byte
+	fw     *flate.Writer
+	buf    *buffer
+	tail   [4]byte
+	closed bool
+}
+
+// Returns a writer sending a message of the given type in fragments; other
+// messages are sent once the writer has been closed (control frames may be
+// sent in between)
+func (c *Conn) NewMessageWriter(typ MessageType) (*MessageWriter, error) {
+	if typ != TextMessage && typ != BinaryMessage {
+		return nil, ErrInvalidMessageType
+	}
+	c.messageMu.Lock()
+	w := &MessageWriter{c: c, b0: byte(typ)}
+	if c.compress {
+		w.buf = acquireBuffer()
+		w.fw = acquireFlateWriter(w.buf, c.config.CompressionLevel)
+	}
+	return w, nil
+}
+
+// Sends p as a frame of the message
+func (w *MessageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.fw == nil {
+		return len(p), w.writeFrame(0, p)
+	}
+	if err := w.deflate(p); err != nil {
+		return 0, err
+	}
+	return len(p), w.writeFrame(0, w.buf.b)
+}
+
+// Sends the final frame and releases the writer
+func (w *MessageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.messageMu.Unlock()
+
+	if w.fw == nil {
+		return w.writeFrame(finBit, nil)
+	}
+	defer w.release()
+	// the final frame consists of an empty block whose sync marker is removed
+	// (RFC 7692, 7.2.1)
+	if err := w.deflate(nil); err != nil {
+		return err
+	}
+	return w.writeFrame(finBit, stripSyncMarker(w.buf.b))
+}
+
+// Compresses p into w.buf (prefixed with the sync marker held back from the
+// previous frame); the sync marker of this flush is held back
+func (w *MessageWriter) deflate(p []byte) error {
+	w.buf.b = w.buf.b[:0]
+	if w.b0 == opContinuation {
+		w.buf.b = append(w.buf.b, w.tail[:]...)
+	}
+	if _, err := w.fw.Write(p); err != nil {
+		return err
+	}
+	if err := w.fw.Flush(); err != nil {
+		return err
+	}
+	if len(p) > 0 {
+		copy(w.tail[:], w.buf.b[len(w.buf.b)-4:])
+		w.buf.b = w.buf.b[:len(w.buf.b)-4]
+	}
+	return nil
+}
+
+func (w *MessageWriter) writeFrame(fin byte, payload []byte) error {
+	rsv1 := w.fw != nil && w.b0 != opContinuation
+	err := w.c.writeFrame(w.b0|fin, rsv1, payload)
+	w.b0 = opContinuation
+	return err
+}
+
+func (w *MessageWriter) release() {
+	releaseFlateWriter(w.fw, w.c.config.CompressionLevel)
+	releaseBuffer(w.buf)
+	w.fw, w.buf = nil, nil
+}
+
+// XORs b with the masking key (RFC 6455, 5.3)
+func maskBytes(key [4]byte, b []byte) {
+	if len(b) >= 8 {
+		k := uint64(binary.LittleEndian.Uint32(key[:]))
+		k |= k << 32
+		for len(b) >= 8 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^k)
+			b = b[8:]
+		}
+	}
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Pooled buffer
+type buffer struct {
+	b []byte
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.b = append(b.b, p...)
+	return len(p), nil
+}
+
+// Buffers larger than this aren't kept in the pool
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &buffer{}
+	},
+}
+
+func acquireBuffer() *buffer {
+	return bufferPool.Get().(*buffer)
+}
+
+func releaseBuffer(b *buffer) {
+	if cap(b.b) > maxPooledBufferSize {
+		b.b = nil
+	}
+	b.b = b.b[:0]
+	bufferPool.Put(b)
+}
+
+// Extends b by n bytes
+func grow(b []byte, n int) []byte {
+	if cap(b)-len(b) < n {
+		size := 2 * cap(b)
+		if size < len(b)+n {
+			size = len(b) + n
+		}
+		nb := make([]byte, len(b), size)
+		copy(nb, b)
+		b = nb
+	}
+	return b[:len(b)+n]
+}
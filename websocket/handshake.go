@@ -0,0 +1,220 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// GUID used to compute Sec-WebSocket-Accept (RFC 6455, 1.3)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var readerPool sync.Pool
+
+// Reads the upgrade request from conn and sends the handshake response; an
+// error response is sent if the request isn't a valid upgrade request
+func (u *Upgrader) Upgrade(conn tcpserver.Connection) (*Conn, error) {
+	config := &u.config
+	lr := &headerLimiter{r: conn, n: int64(config.MaxHeaderSize)}
+	br := acquireReader(lr)
+	defer releaseReader(br)
+
+	_ = conn.SetReadDeadline(time.Now().Add(config.HandshakeTimeout))
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		if lr.n == 0 {
+			_ = writeStatus(conn, http.StatusRequestHeaderFieldsTooLarge, "")
+			return nil, ErrHeaderTooLarge
+		}
+		if ne, ok := err.(net.Error); err == io.EOF || (ok && ne.Timeout()) {
+			return nil, err
+		}
+		_ = writeStatus(conn, http.StatusBadRequest, "")
+		return nil, ErrBadHandshake
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 ||
+		req.Method != http.MethodGet || !req.ProtoAtLeast(1, 1) || req.ContentLength != 0 ||
+		!headerContainsToken(req.Header, "Connection", "upgrade") ||
+		!headerContainsToken(req.Header, "Upgrade", "websocket") {
+		_ = writeStatus(conn, http.StatusBadRequest, "")
+		return nil, ErrBadHandshake
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		_ = writeStatus(conn, http.StatusUpgradeRequired, "Sec-WebSocket-Version: 13\r\n")
+		return nil, ErrBadHandshake
+	}
+	if !config.CheckOrigin(req) {
+		_ = writeStatus(conn, http.StatusForbidden, "")
+		return nil, ErrOriginNotAllowed
+	}
+
+	c := &Conn{conn: conn, config: config, request: req}
+	c.subprotocol = selectSubprotocol(req.Header, config.Subprotocols)
+	c.compress = config.EnableCompression && acceptDeflate(req.Header)
+	if n := br.Buffered(); n > 0 {
+		// frames sent right after the request
+		c.pending = make([]byte, n)
+		_, _ = io.ReadFull(br, c.pending)
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if c.subprotocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + c.subprotocol + "\r\n"
+	}
+	if c.compress {
+		// contexts are never taken over so that compressors can be pooled
+		resp += "Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n"
+	}
+	if _, err = io.WriteString(conn, resp+"\r\n"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns Sec-WebSocket-Accept value for the given key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Allows requests without Origin or with an origin whose host equals Host
+func checkSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// Returns whether a comma separated list in the header field contains token
+// (case insensitive)
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the first of the supported subprotocols offered by the client
+func selectSubprotocol(header http.Header, supported []string) string {
+	for _, p := range supported {
+		if headerContainsToken(header, "Sec-WebSocket-Protocol", p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Returns whether the client offered permessage-deflate with parameters that
+// are compatible with the response sent (RFC 7692, 7.1)
+func acceptDeflate(header http.Header) bool {
+	for _, v := range header["Sec-Websocket-Extensions"] {
+		for _, offer := range strings.Split(v, ",") {
+			params := strings.Split(offer, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			if deflateParamsSupported(params[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns whether the offered permessage-deflate parameters are supported
+func deflateParamsSupported(params []string) bool {
+	seen := make(map[string]bool, len(params))
+	for _, p := range params {
+		name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[name] {
+			return false
+		}
+		seen[name] = true
+
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if value != "" {
+				return false
+			}
+		case "server_max_window_bits":
+			// compress/flate always uses a 32 KiB window
+			if value != "15" {
+				return false
+			}
+		case "client_max_window_bits":
+			// any window size can be decompressed
+			if value != "" {
+				if bits, err := strconv.Atoi(value); err != nil || bits < 8 || bits > 15 {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func acquireReader(r io.Reader) *bufio.Reader {
+	if br, _ := readerPool.Get().(*bufio.Reader); br != nil {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, 4096)
+}
+
+func releaseReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readerPool.Put(br)
+}
+
+// Reader limiting the number of bytes read for the request header
+type headerLimiter struct {
+	r io.Reader
+	n int64
+}
+
+func (l *headerLimiter) Read(p []byte) (int, error) {
+	if l.n == 0 {
+		return 0, ErrHeaderTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func writeStatus(w io.Writer, code int, header string) error {
+	_, err := io.WriteString(w, "HTTP/1.1 "+strconv.Itoa(code)+" "+http.StatusText(code)+"\r\n"+
+		header+"Content-Length: 0\r\nConnection: close\r\n\r\n")
+	return err
+}
@@ -0,0 +1,243 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+// Package websocket implements WebSocket (RFC 6455) connections accepted on
+// a tcpserver listener, including the permessage-deflate extension (RFC 7692).
+//
+//	server.SetRequestHandler(websocket.NewHandler(func(c *websocket.Conn) {
+//		for {
+//			typ, msg, err := c.ReadMessage()
+//			if err != nil {
+//				return
+//			}
+//			if err = c.WriteMessage(typ, msg); err != nil {
+//				return
+//			}
+//		}
+//	}, nil))
+//
+// Connections don't hold any buffers while waiting for the next frame;
+// message, write and compression buffers are taken from pools when needed.
+package websocket
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Handshake errors
+var (
+	// The request isn't a valid WebSocket upgrade request (400 Bad Request
+	// or 426 Upgrade Required has been sent)
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	// The origin check failed (403 Forbidden has been sent)
+	ErrOriginNotAllowed = errors.New("websocket: origin not allowed")
+	// The request header exceeds MaxHeaderSize (431 Request Header Fields Too
+	// Large has been sent)
+	ErrHeaderTooLarge = errors.New("websocket: request header too large")
+)
+
+// Errors returned by Conn.ReadMessage if the peer violated the protocol; the
+// connection has been closed with the corresponding close code
+var (
+	// Close code 1002
+	ErrProtocolError = errors.New("websocket: protocol error")
+	// Close code 1007
+	ErrInvalidUTF8 = errors.New("websocket: invalid UTF-8 in text message")
+	// Close code 1009
+	ErrMessageTooBig = errors.New("websocket: message too big")
+)
+
+// Returned when writing after a close frame has been sent
+var ErrCloseSent = errors.New("websocket: close sent")
+
+// Message type
+type MessageType uint8
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Returns message type name
+func (t MessageType) String() string {
+	switch t {
+	case TextMessage:
+		return "text"
+	case BinaryMessage:
+		return "binary"
+	}
+	return "unknown"
+}
+
+// Close code (RFC 6455, 7.4)
+type CloseCode uint16
+
+const (
+	CloseNormal            CloseCode = 1000
+	CloseGoingAway         CloseCode = 1001
+	CloseProtocolError     CloseCode = 1002
+	CloseUnsupportedData   CloseCode = 1003
+	CloseNoStatus          CloseCode = 1005 // never sent, no code received
+	CloseAbnormal          CloseCode = 1006 // never sent
+	CloseInvalidPayload    CloseCode = 1007
+	ClosePolicyViolation   CloseCode = 1008
+	CloseMessageTooBig     CloseCode = 1009
+	CloseMandatoryExt      CloseCode = 1010
+	CloseInternalError     CloseCode = 1011
+	CloseServiceRestart    CloseCode = 1012
+	CloseTryAgainLater     CloseCode = 1013
+	CloseBadGateway        CloseCode = 1014
+	closeTLSHandshakeError CloseCode = 1015
+)
+
+// Returns close code name
+func (c CloseCode) String() string {
+	switch c {
+	case CloseNormal:
+		return "normal closure"
+	case CloseGoingAway:
+		return "going away"
+	case CloseProtocolError:
+		return "protocol error"
+	case CloseUnsupportedData:
+		return "unsupported data"
+	case CloseNoStatus:
+		return "no status"
+	case CloseAbnormal:
+		return "abnormal closure"
+	case CloseInvalidPayload:
+		return "invalid payload data"
+	case ClosePolicyViolation:
+		return "policy violation"
+	case CloseMessageTooBig:
+		return "message too big"
+	case CloseMandatoryExt:
+		return "mandatory extension"
+	case CloseInternalError:
+		return "internal error"
+	case CloseServiceRestart:
+		return "service restart"
+	case CloseTryAgainLater:
+		return "try again later"
+	case CloseBadGateway:
+		return "bad gateway"
+	case closeTLSHandshakeError:
+		return "TLS handshake error"
+	}
+	return strconv.Itoa(int(c))
+}
+
+// Returns whether the close code may be sent in a close frame
+func (c CloseCode) isValid() bool {
+	switch {
+	case c >= 1000 && c <= 1003, c >= 1007 && c <= 1014:
+		return true
+	case c >= 3000 && c <= 4999:
+		// registered (3000-3999) and private use (4000-4999)
+		return true
+	}
+	return false
+}
+
+// Returned by Conn.ReadMessage once the peer closed the connection
+type CloseError struct {
+	Code CloseCode
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	s := "websocket: closed by peer (" + e.Code.String() + ")"
+	if e.Text != "" {
+		s += ": " + e.Text
+	}
+	return s
+}
+
+// WebSocket config
+type Config struct {
+	// Supported subprotocols in order of preference; the first one offered by
+	// the client is selected
+	Subprotocols []string
+	// Checks the Origin header of the upgrade request (defaults to allowing
+	// requests without Origin or with an origin whose host equals Host)
+	CheckOrigin func(req *http.Request) bool
+	// Negotiate permessage-deflate if offered by the client
+	EnableCompression bool
+	// Compression level (defaults to flate.BestSpeed)
+	CompressionLevel int
+	// Messages smaller than this are sent uncompressed (defaults to 128 bytes)
+	CompressionThreshold int
+	// Maximum size of a received message after decompression (defaults to
+	// 4 MiB)
+	MaxMessageSize int
+	// Maximum size of the upgrade request header (defaults to 8 KiB)
+	MaxHeaderSize int
+	// Timeout for reading the upgrade request (defaults to 10s)
+	HandshakeTimeout time.Duration
+}
+
+// Upgrades connections with a fixed config
+type Upgrader struct {
+	config Config
+}
+
+// Returns a new upgrader
+func NewUpgrader(config *Config) *Upgrader {
+	u := &Upgrader{}
+	if config != nil {
+		u.config = *config
+	}
+	if u.config.CheckOrigin == nil {
+		u.config.CheckOrigin = checkSameOrigin
+	}
+	if u.config.CompressionLevel == 0 {
+		u.config.CompressionLevel = flate.BestSpeed
+	}
+	if u.config.CompressionLevel < flate.HuffmanOnly || u.config.CompressionLevel > flate.BestCompression {
+		u.config.CompressionLevel = flate.BestSpeed
+	}
+	if u.config.CompressionThreshold <= 0 {
+		u.config.CompressionThreshold = 128
+	}
+	if u.config.MaxMessageSize <= 0 {
+		u.config.MaxMessageSize = 4 * 1024 * 1024
+	}
+	if u.config.MaxHeaderSize <= 0 {
+		u.config.MaxHeaderSize = 8 * 1024
+	}
+	if u.config.HandshakeTimeout <= 0 {
+		u.config.HandshakeTimeout = 10 * time.Second
+	}
+	return u
+}
+
+// Returns a request handler upgrading connections and passing them to fn;
+// the connection is closed with CloseNormal (unless already closed) once fn
+// returns. Handshake errors and protocol violations of the peer are set on
+// the connection (see tcpserver.Connection.SetError).
+func NewHandler(fn func(c *Conn), config *Config) tcpserver.RequestHandlerFunc {
+	u := NewUpgrader(config)
+
+	return func(conn tcpserver.Connection) {
+		c, err := u.Upgrade(conn)
+		if err != nil {
+			if err != io.EOF {
+				conn.SetError(err)
+			}
+			return
+		}
+		fn(c)
+		c.releaseReadBuffers()
+		_ = c.Close()
+		if c.violation != nil {
+			conn.SetError(c.violation)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+// Copyright 2019-2022 Moritz Fain
+// Moritz Fain <moritz@fain.io>
+
+package websocket_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"github.com/maurice2k/tcpserver/websocket"
+)
+
+// Key and accept value from RFC 6455, 1.3
+const (
+	testKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	testAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// Starts a server passing connections to handler; returns its address
+func startServer(t *testing.T, handler tcpserver.RequestHandlerFunc) string {
+	t.Helper()
+	s, err := tcpserver.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetBallast(0)
+	s.SetRequestHandler(handler)
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = s.Shutdown(time.Second)
+		<-done
+	})
+	return s.GetListenAddr().String()
+}
+
+// Starts a server echoing messages; the error ReadMessage finally returned is
+// sent to the returned channel
+func startEcho(t *testing.T, config *websocket.Config) (string, chan error) {
+	t.Helper()
+	errs := make(chan error, 1)
+	addr := startServer(t, websocket.NewHandler(func(c *websocket.Conn) {
+		for {
+			typ, msg, err := c.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err = c.WriteMessage(typ, msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}, config))
+	return addr, errs
+}
+
+// Waits for the error returned by the server
+func waitError(t *testing.T, errs chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the server")
+		return nil
+	}
+}
+
+// Minimal WebSocket client
+type client struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// Sends an upgrade request (with additional header lines); returns the
+// client and the handshake response
+func dial(t *testing.T, addr string, header string) (*client, *http.Response) {
+	t.Helper()
+	return dialRequest(t, addr, "GET / HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: "+testKey+"\r\nSec-WebSocket-Version: 13\r\n"+header+"\r\n")
+}
+
+// Sends a raw upgrade request; returns the client and the handshake response
+func dialRequest(t *testing.T, addr string, req string) (*client, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	c := &client{conn: conn, rd: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+// Sends a frame; b0 is the first header byte (FIN, RSV and opcode)
+func (c *client) writeFrame(t *testing.T, b0 byte, payload []byte, masked bool) {
+	t.Helper()
+	frame := []byte{b0, 0}
+	switch l := len(payload); {
+	case l <= 125:
+		frame[1] = byte(l)
+	case l <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(l))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(l))
+	}
+	if masked {
+		frame[1] |= 0x80
+		key := [4]byte{0x12, 0x34, 0x56, 0x78}
+		frame = append(frame, key[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i&3])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads a frame; returns the first header byte and the payload
+func (c *client) readFrame(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var h [2]byte
+	if _, err := io.ReadFull(c.rd, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	if h[1]&0x80 != 0 {
+		t.Fatal("server frames must not be masked")
+	}
+	length := uint64(h[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		_, _ = io.ReadFull(c.rd, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		_, _ = io.ReadFull(c.rd, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.rd, payload); err != nil {
+		t.Fatal(err)
+	}
+	return h[0], payload
+}
+
+// Reads a frame and checks it
+func (c *client) expectFrame(t *testing.T, b0 byte, payload []byte) {
+	t.Helper()
+	h, p := c.readFrame(t)
+	if h != b0 || !bytes.Equal(p, payload) {
+		t.Fatalf("expected frame %#x %q, got %#x %q", b0, payload, h, p)
+	}
+}
+
+// Reads a close frame and checks its code
+func (c *client) expectClose(t *testing.T, code websocket.CloseCode) {
+	t.Helper()
+	h, p := c.readFrame(t)
+	if h != 0x88 {
+		t.Fatalf("expected close frame, got %#x %q", h, p)
+	}
+	if code == websocket.CloseNoStatus {
+		if len(p) != 0 {
+			t.Fatalf("expected close frame without code, got %q", p)
+		}
+		return
+	}
+	if len(p) < 2 || websocket.CloseCode(binary.BigEndian.Uint16(p)) != code {
+		t.Fatalf("expected close code %d, got %q", code, p)
+	}
+}
+
+// Returns a close frame payload
+func closePayload(code websocket.CloseCode, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// Compresses data like a permessage-deflate client
+func deflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+}
+
+// Decompresses a permessage-deflate message
+func inflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader([]byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff})))
+	b, err := io.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHandshake(t *testing.T) {
+	upgrader := websocket.NewUpgrader(&websocket.Config{
+		Subprotocols:  []string{"chat", "superchat"},
+		MaxHeaderSize: 1024,
+	})
+	errs := make(chan error, 1)
+	addr := startServer(t, func(conn tcpserver.Connection) {
+		c, err := upgrader.Upgrade(conn)
+		if err == nil {
+			_ = c.Close()
+		}
+		errs <- err
+	})
+
+	valid := "GET /chat HTTP/1.1\r\nHost: " + addr + "\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Key: " + testKey + "\r\nSec-WebSocket-Version: 13\r\n"
+	tests := []struct {
+		name   string
+		req    string
+		status int
+		err    error
+	}{
+		{"valid", valid, http.StatusSwitchingProtocols, nil},
+		{"same origin", valid + "Origin: http://" + addr + "\r\n", http.StatusSwitchingProtocols, nil},
+		{"other origin", valid + "Origin: http://example.com\r\n", http.StatusForbidden, websocket.ErrOriginNotAllowed},
+		{"missing key", strings.Replace(valid, "Sec-WebSocket-Key: "+testKey+"\r\n", "", 1), http.StatusBadRequest, websocket.ErrBadHandshake},
+		{"invalid key", strings.Replace(valid, testKey, "c2hvcnQ=", 1), http.StatusBadRequest, websocket.ErrBadHandshake},
+		{"missing upgrade", strings.Replace(valid, "Upgrade: websocket\r\n", "", 1), http.StatusBadRequest, websocket.ErrBadHandshake},
+		{"missing connection upgrade", strings.Replace(valid, "keep-alive, Upgrade", "keep-alive", 1), http.StatusBadRequest, websocket.ErrBadHandshake},
+		{"POST", strings.Replace(valid, "GET", "POST", 1), http.StatusBadRequest, websocket.ErrBadHandshake},
+		{"HTTP/1.0", strings.Replace(valid, "HTTP/1.1", "HTTP/1.0", 1), http.StatusBadRequest, websocket.ErrBadHandshake},
+		{"wrong version", strings.Replace(valid, "Version: 13", "Version: 8", 1), http.StatusUpgradeRequired, websocket.ErrBadHandshake},
+		{"missing version", strings.Replace(valid, "Sec-WebSocket-Version: 13\r\n", "", 1), http.StatusUpgradeRequired, websocket.ErrBadHandshake},
+		{"oversized header", valid + "X-Large: " + strings.Repeat("x", 2048) + "\r\n", http.StatusRequestHeaderFieldsTooLarge, websocket.ErrHeaderTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, resp := dialRequest(t, addr, tt.req+"\r\n")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if err := waitError(t, errs); err != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			switch tt.status {
+			case http.StatusSwitchingProtocols:
+				if v := resp.Header.Get("Sec-WebSocket-Accept"); v != testAccept {
+					t.Errorf("unexpected Sec-WebSocket-Accept %q", v)
+				}
+			case http.StatusUpgradeRequired:
+				if v := resp.Header.Get("Sec-WebSocket-Version"); v != "13" {
+					t.Errorf("unexpected Sec-WebSocket-Version %q", v)
+				}
+			}
+		})
+	}
+
+	// the first supported subprotocol offered is selected
+	c, resp := dial(t, addr, "Sec-WebSocket-Protocol: superchat, chat\r\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Protocol") != "chat" {
+		t.Fatalf("expected subprotocol chat, got %d %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Protocol"))
+	}
+	c.expectClose(t, websocket.CloseNormal)
+	if err := waitError(t, errs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	addr, errs := startEcho(t, nil)
+	c, _ := dial(t, addr, "")
+
+	c.writeFrame(t, 0x81, []byte("hello"), true)
+	c.expectFrame(t, 0x81, []byte("hello"))
+	large := bytes.Repeat([]byte{0xab}, 70000)
+	c.writeFrame(t, 0x82, large, true)
+	c.expectFrame(t, 0x82, large)
+	c.writeFrame(t, 0x81, nil, true)
+	c.expectFrame(t, 0x81, nil)
+
+	c.writeFrame(t, 0x88, closePayload(websocket.CloseNormal, "bye"), true)
+	c.expectClose(t, websocket.CloseNormal)
+	var ce *websocket.CloseError
+	if err := waitError(t, errs); !errors.As(err, &ce) || ce.Code != websocket.CloseNormal || ce.Text != "bye" {
+		t.Fatalf("expected close error, got %v", err)
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	addr, errs := startEcho(t, nil)
+	c, _ := dial(t, addr, "")
+
+	// control frames may be interleaved with fragments; a multi-byte UTF-8
+	// sequence may be split across fragments
+	c.writeFrame(t, 0x01, []byte("Hel"), true)
+	c.writeFrame(t, 0x89, []byte("ping"), true)
+	c.writeFrame(t, 0x00, []byte("lo \xc3"), true)
+	c.writeFrame(t, 0x8a, []byte("unsolicited"), true)
+	c.writeFrame(t, 0x80, []byte("\xa9"), true)
+	c.expectFrame(t, 0x8a, []byte("ping"))
+	c.expectFrame(t, 0x81, []byte("Hello é"))
+
+	c.writeFrame(t, 0x02, []byte{1}, true)
+	c.writeFrame(t, 0x00, nil, true)
+	c.writeFrame(t, 0x80, []byte{2, 3}, true)
+	c.expectFrame(t, 0x82, []byte{1, 2, 3})
+
+	c.writeFrame(t, 0x88, nil, true)
+	c.expectClose(t, websocket.CloseNoStatus)
+	var ce *websocket.CloseError
+	if err := waitError(t, errs); !errors.As(err, &ce) || ce.Code != websocket.CloseNoStatus {
+		t.Fatalf("expected close error, got %v", err)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	pongs := make(chan string, 1)
+	addr := startServer(t, websocket.NewHandler(func(c *websocket.Conn) {
+		c.SetPongHandler(func(data []byte) {
+			pongs <- string(data)
+		})
+		if err := c.WritePing([]byte("server")); err != nil {
+			return
+		}
+		if err := c.WritePing(make([]byte, 126)); err != websocket.ErrControlTooLong {
+			pongs <- "expected ErrControlTooLong"
+		}
+		_, _, _ = c.ReadMessage()
+	}, nil))
+	c, _ := dial(t, addr, "")
+
+	c.expectFrame(t, 0x89, []byte("server"))
+	c.writeFrame(t, 0x8a, []byte("server"), true)
+	c.writeFrame(t, 0x81, []byte("done"), true)
+	select {
+	case data := <-pongs:
+		if data != "server" {
+			t.Fatalf("unexpected pong %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for pong")
+	}
+	c.expectClose(t, websocket.CloseNormal)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames func(t *testing.T, c *client)
+		code   websocket.CloseCode
+		err    error
+	}{
+		{"unmasked frame", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x81, []byte("hello"), false)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"reserved bits", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0xc1, []byte("hello"), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"reserved opcode", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x83, []byte("hello"), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"continuation without message", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x80, []byte("hello"), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"new message before final fragment", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x01, []byte("hel"), true)
+			c.writeFrame(t, 0x81, []byte("lo"), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"fragmented control frame", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x09, []byte("ping"), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"control frame too long", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x89, make([]byte, 126), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"invalid UTF-8", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x81, []byte("hello \xff"), true)
+		}, websocket.CloseInvalidPayload, websocket.ErrInvalidUTF8},
+		{"invalid UTF-8 across fragments", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x01, []byte("\xc3"), true)
+			c.writeFrame(t, 0x80, []byte("x"), true)
+		}, websocket.CloseInvalidPayload, websocket.ErrInvalidUTF8},
+		{"message too big", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x82, make([]byte, 2048), true)
+		}, websocket.CloseMessageTooBig, websocket.ErrMessageTooBig},
+		{"fragmented message too big", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x02, make([]byte, 1000), true)
+			c.writeFrame(t, 0x80, make([]byte, 1000), true)
+		}, websocket.CloseMessageTooBig, websocket.ErrMessageTooBig},
+		{"close code too short", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x88, []byte{0x03}, true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"close code 1005", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x88, closePayload(websocket.CloseNoStatus, ""), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"close code 1006", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x88, closePayload(websocket.CloseAbnormal, ""), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"close code 999", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x88, closePayload(999, ""), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"close code 2000", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x88, closePayload(2000, ""), true)
+		}, websocket.CloseProtocolError, websocket.ErrProtocolError},
+		{"close reason invalid UTF-8", func(t *testing.T, c *client) {
+			c.writeFrame(t, 0x88, closePayload(websocket.CloseNormal, "\xff"), true)
+		}, websocket.CloseInvalidPayload, websocket.ErrInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, errs := startEcho(t, &websocket.Config{MaxMessageSize: 1500})
+			c, _ := dial(t, addr, "")
+			tt.frames(t, c)
+			c.expectClose(t, tt.code)
+			if err := waitError(t, errs); err != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// private close codes are echoed
+	addr, errs := startEcho(t, nil)
+	c, _ := dial(t, addr, "")
+	c.writeFrame(t, 0x88, closePayload(4000, ""), true)
+	c.expectClose(t, 4000)
+	var ce *websocket.CloseError
+	if err := waitError(t, errs); !errors.As(err, &ce) || ce.Code != 4000 {
+		t.Fatalf("expected close error, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	addr, errs := startEcho(t, &websocket.Config{EnableCompression: true, MaxMessageSize: 64 * 1024})
+
+	// not negotiated for unsupported parameters
+	_, resp := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10\r\n")
+	if v := resp.Header.Get("Sec-WebSocket-Extensions"); v != "" {
+		t.Fatalf("unexpected Sec-WebSocket-Extensions %q", v)
+	}
+
+	c, resp := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	if v := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.HasPrefix(v, "permessage-deflate") {
+		t.Fatalf("expected permessage-deflate, got %q", v)
+	}
+
+	// large messages are echoed compressed
+	msg := bytes.Repeat([]byte("compress me "), 1000)
+	c.writeFrame(t, 0xc1, deflate(t, msg), true)
+	h, p := c.readFrame(t)
+	if h != 0xc1 || !bytes.Equal(inflate(t, p), msg) {
+		t.Fatalf("expected compressed echo, got %#x", h)
+	}
+
+	// RSV1 is only set on the first fragment
+	compressed := deflate(t, msg)
+	c.writeFrame(t, 0x41, compressed[:10], true)
+	c.writeFrame(t, 0x89, []byte("ping"), true)
+	c.writeFrame(t, 0x80, compressed[10:], true)
+	c.expectFrame(t, 0x8a, []byte("ping"))
+	h, p = c.readFrame(t)
+	if h != 0xc1 || !bytes.Equal(inflate(t, p), msg) {
+		t.Fatalf("expected compressed echo, got %#x", h)
+	}
+
+	// small messages are sent uncompressed
+	c.writeFrame(t, 0xc1, deflate(t, []byte("small")), true)
+	c.expectFrame(t, 0x81, []byte("small"))
+
+	// the size limit applies to the decompressed message
+	c.writeFrame(t, 0xc2, deflate(t, make([]byte, 1024*1024)), true)
+	c.expectClose(t, websocket.CloseMessageTooBig)
+	if err := waitError(t, errs); err != websocket.ErrMessageTooBig {
+		t.Fatalf("expected %v, got %v", websocket.ErrMessageTooBig, err)
+	}
+
+	// invalid compressed data
+	c, _ = dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+	c.writeFrame(t, 0xc1, []byte{0xff, 0xff, 0xff, 0xff}, true)
+	c.expectClose(t, websocket.CloseInvalidPayload)
+	if err := waitError(t, errs); err != websocket.ErrInvalidCompressedData {
+		t.Fatalf("expected %v, got %v", websocket.ErrInvalidCompressedData, err)
+	}
+
+	// RSV1 without compression
+	c, _ = dial(t, addr, "")
+	c.writeFrame(t, 0xc1, deflate(t, msg), true)
+	c.expectClose(t, websocket.CloseProtocolError)
+	if err := waitError(t, errs); err != websocket.ErrProtocolError {
+		t.Fatalf("expected %v, got %v", websocket.ErrProtocolError, err)
+	}
+}
+
+func TestCompressedMessageWriter(t *testing.T) {
+	msg := bytes.Repeat([]byte("fragment "), 100)
+	addr := startServer(t, websocket.NewHandler(func(c *websocket.Conn) {
+		w, err := c.NewMessageWriter(websocket.TextMessage)
+		if err != nil {
+			return
+		}
+		_, _ = w.Write(msg[:400])
+		_, _ = w.Write(msg[400:])
+		_ = w.Close()
+	}, &websocket.Config{EnableCompression: true}))
+	c, _ := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+
+	var compressed []byte
+	for i, b0 := range []byte{0x41, 0x00, 0x80} {
+		h, p := c.readFrame(t)
+		if h != b0 {
+			t.Fatalf("frame %d: expected %#x, got %#x", i, b0, h)
+		}
+		compressed = append(compressed, p...)
+	}
+	if !bytes.Equal(inflate(t, compressed), msg) {
+		t.Fatal("unexpected message")
+	}
+	c.expectClose(t, websocket.CloseNormal)
+}